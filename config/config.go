@@ -22,6 +22,11 @@ const (
 	RepoTypeLocal          RepoType       = "local"
 	RepoTypeSFTP           RepoType       = "sftp"
 	RepoTypeS3             RepoType       = "s3"
+	RepoTypeAzure          RepoType       = "azure"
+	RepoTypeGCS            RepoType       = "gcs"
+	RepoTypeWebDAV         RepoType       = "webdav"
+	RepoTypeFTP            RepoType       = "ftp"
+	RepoTypeMemory         RepoType       = "memory"
 	RepoEncryptorAes256Gcm RepoEncryptor  = "aes-256-gcm"
 	RepoCompressorGzip     RepoCompressor = "gzip"
 	RepoCompressorZstd     RepoCompressor = "zstd"
@@ -30,7 +35,7 @@ const (
 type Config struct {
 	// Repo main config
 	RepoPath string   `json:"REPO_PATH"` // /mnt/backups
-	RepoType RepoType `json:"REPO_TYPE"` // "local", "sftp", "s3"
+	RepoType RepoType `json:"REPO_TYPE"` // "local", "sftp", "s3", "azure", "gcs", "webdav", "ftp", "memory"
 
 	// Compression
 	RepoCompressor RepoCompressor `json:"REPO_COMPRESSOR"` // gzip, zstd
@@ -39,6 +44,49 @@ type Config struct {
 	RepoEncryptor      RepoEncryptor `json:"REPO_ENCRYPTOR"` // aes-256-gcm
 	RepoEncryptionPass string        `json:"REPO_ENCRYPTION_PASS"`
 
+	// Seekable compressed objects are stored as independent frames with an index, so ranged reads do not decode
+	// from the start, at the cost of one more upload per object and a slightly worse compression
+	RepoSeekableEnabled bool `json:"REPO_SEEKABLE_ENABLED"`
+
+	// Deduplication splits objects into content-defined chunks, and stores each distinct chunk once
+	RepoDedupEnabled    bool `json:"REPO_DEDUP_ENABLED"`
+	RepoDedupAvgChunkKb int  `json:"REPO_DEDUP_AVG_CHUNK_KB"` // 1024 by default
+
+	// Replicas receive every write of the repo, along with the storage configured above, which stays the preferred
+	// one for reads. Each replica is a config of its own, only the repo path and the storage settings are used.
+	RepoReplicas      []*Config `json:"REPO_REPLICAS"`
+	RepoReplicaQuorum string    `json:"REPO_REPLICA_QUORUM"` // all (default), any, or a number of the replicas, including the main one
+
+	// Fallbacks are read-only copies of the repo, reads fail over to them in order while the storage above is failing
+	RepoFallbacks           []*Config `json:"REPO_FALLBACKS"`
+	RepoFailoverThreshold   int       `json:"REPO_FAILOVER_THRESHOLD"`     // consecutive failures that make a backend unhealthy, 3 by default
+	RepoFailoverCoolDownSec int       `json:"REPO_FAILOVER_COOL_DOWN_SEC"` // 30 by default
+
+	// Retries of storage operations, disabled unless max attempts (including the first one) is above 1
+	RepoRetryMaxAttempts      int     `json:"REPO_RETRY_MAX_ATTEMPTS"`
+	RepoRetryInitialBackoffMs int     `json:"REPO_RETRY_INITIAL_BACKOFF_MS"` // 200 by default, doubled after every attempt
+	RepoRetryMaxBackoffMs     int     `json:"REPO_RETRY_MAX_BACKOFF_MS"`     // 10000 by default
+	RepoRetryJitter           float64 `json:"REPO_RETRY_JITTER"`             // 0..1, a fraction of the backoff
+	RepoRetrySpoolDir         string  `json:"REPO_RETRY_SPOOL_DIR"`          // uploads of streams are retried only when set
+
+	// Bandwidth limits in KiB per second, shared by all concurrent transfers, unlimited when not set
+	RepoUploadLimitKbps   int64  `json:"REPO_UPLOAD_LIMIT_KBPS"`
+	RepoDownloadLimitKbps int64  `json:"REPO_DOWNLOAD_LIMIT_KBPS"`
+	RepoThrottleSchedule  string `json:"REPO_THROTTLE_SCHEDULE"` // i.e. "08:00-18:00", local time, limits apply all day when not set
+
+	// Local read-through cache of remote objects, disabled unless the dir is set
+	RepoCacheDir           string `json:"REPO_CACHE_DIR"`
+	RepoCacheMaxMb         int64  `json:"REPO_CACHE_MAX_MB"`         // least recently used objects are evicted above it
+	RepoCacheMode          string `json:"REPO_CACHE_MODE"`           // write-around (default), write-through
+	RepoCacheRevalidateSec int    `json:"REPO_CACHE_REVALIDATE_SEC"` // hits are trusted for it after a Stat of the object, every hit is checked when not set
+
+	// Prometheus metrics of repo and storage operations, registered with the default registry
+	RepoMetricsEnabled    bool   `json:"REPO_METRICS_ENABLED"`
+	RepoMetricsListenAddr string `json:"REPO_METRICS_LISTEN_ADDR"` // i.e. ":9090", serves /metrics, enables metrics when set
+
+	// OpenTelemetry spans of repo and storage operations, reported to the global tracer provider set up by the application
+	RepoTracingEnabled bool `json:"REPO_TRACING_ENABLED"`
+
 	// Local Storage config
 	RepoStorageLocalFsyncOnWrite bool `json:"REPO_STORAGE_LOCAL_FSYNC_ON_WRITE"`
 
@@ -50,6 +98,16 @@ type Config struct {
 	RepoStorageSFTPPrivateKeyPath       string `json:"REPO_STORAGE_SFTP_PRIVATE_KEY_PATH"`
 	RepoStorageSFTPPrivateKeyPassphrase string `json:"REPO_STORAGE_SFTP_PRIVATE_KEY_PASSPHRASE"`
 
+	// FTP Storage config (FTPS when TLS is set)
+	RepoStorageFTPHost               string `json:"REPO_STORAGE_FTP_HOST"`
+	RepoStorageFTPPort               int    `json:"REPO_STORAGE_FTP_PORT"` // 21 (990 for implicit TLS) by default
+	RepoStorageFTPUser               string `json:"REPO_STORAGE_FTP_USER"`
+	RepoStorageFTPPass               string `json:"REPO_STORAGE_FTP_PASS"`
+	RepoStorageFTPTLS                string `json:"REPO_STORAGE_FTP_TLS"` // explicit, implicit
+	RepoStorageFTPCACertPath         string `json:"REPO_STORAGE_FTP_CA_CERT_PATH"`
+	RepoStorageFTPInsecureSkipVerify bool   `json:"REPO_STORAGE_FTP_INSECURE_SKIP_VERIFY"`
+	RepoStorageFTPDisableEPSV        bool   `json:"REPO_STORAGE_FTP_DISABLE_EPSV"`
+
 	// S3 Storage config
 	RepoStorageS3URL             string `json:"REPO_STORAGE_S3_URL"`
 	RepoStorageS3AccessKeyID     string `json:"REPO_STORAGE_S3_ACCESS_KEY_ID"`
@@ -58,6 +116,26 @@ type Config struct {
 	RepoStorageS3Region          string `json:"REPO_STORAGE_S3_REGION"`
 	RepoStorageS3UsePathStyle    bool   `json:"REPO_STORAGE_S3_USE_PATH_STYLE"`
 	RepoStorageS3DisableSSL      bool   `json:"REPO_STORAGE_S3_DISABLE_SSL"`
+
+	// Azure Blob Storage config (either SAS token or account key is required)
+	RepoStorageAzureURL         string `json:"REPO_STORAGE_AZURE_URL"` // optional, i.e. Azurite endpoint
+	RepoStorageAzureAccountName string `json:"REPO_STORAGE_AZURE_ACCOUNT_NAME"`
+	RepoStorageAzureAccountKey  string `json:"REPO_STORAGE_AZURE_ACCOUNT_KEY"`
+	RepoStorageAzureSASToken    string `json:"REPO_STORAGE_AZURE_SAS_TOKEN"`
+	RepoStorageAzureContainer   string `json:"REPO_STORAGE_AZURE_CONTAINER"`
+
+	// GCS Storage config (application default credentials are used when the file is not set)
+	RepoStorageGCSURL             string `json:"REPO_STORAGE_GCS_URL"` // optional, i.e. fake-gcs-server endpoint
+	RepoStorageGCSCredentialsFile string `json:"REPO_STORAGE_GCS_CREDENTIALS_FILE"`
+	RepoStorageGCSBucket          string `json:"REPO_STORAGE_GCS_BUCKET"`
+
+	// WebDAV Storage config (requests are not authenticated when the user is not set)
+	RepoStorageWebDAVURL                string `json:"REPO_STORAGE_WEBDAV_URL"` // i.e. https://cloud.example.com/remote.php/dav/files/backup
+	RepoStorageWebDAVUser               string `json:"REPO_STORAGE_WEBDAV_USER"`
+	RepoStorageWebDAVPass               string `json:"REPO_STORAGE_WEBDAV_PASS"`
+	RepoStorageWebDAVAuth               string `json:"REPO_STORAGE_WEBDAV_AUTH"` // basic (default), digest
+	RepoStorageWebDAVCACertPath         string `json:"REPO_STORAGE_WEBDAV_CA_CERT_PATH"`
+	RepoStorageWebDAVInsecureSkipVerify bool   `json:"REPO_STORAGE_WEBDAV_INSECURE_SKIP_VERIFY"`
 }
 
 // LoadConfigFromFile unmarshal file into config struct
@@ -1,25 +1,219 @@
 package boot
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/hashmap-kz/streamcrypt/pkg/codec"
 	"github.com/hashmap-kz/streamcrypt/pkg/crypt"
 	"github.com/hashmap-kz/streamcrypt/pkg/crypt/aesgcm"
 	"github.com/hashmap-kz/xrepo/config"
+	"github.com/hashmap-kz/xrepo/pkg/clients/azblobx"
+	"github.com/hashmap-kz/xrepo/pkg/clients/ftpx"
+	"github.com/hashmap-kz/xrepo/pkg/clients/gcsx"
 	"github.com/hashmap-kz/xrepo/pkg/clients/s3x"
 	"github.com/hashmap-kz/xrepo/pkg/clients/sftpx"
+	"github.com/hashmap-kz/xrepo/pkg/clients/webdavx"
+	"github.com/hashmap-kz/xrepo/pkg/metrics"
 	"github.com/hashmap-kz/xrepo/pkg/repo"
 	"github.com/hashmap-kz/xrepo/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricsListenerMu sync.Mutex
+	metricsListening  bool
 )
 
 // DecideRepo inits repository with storage/compression/encryption assigned according to configs
 func DecideRepo(cfg *config.Config, dir string) (repo.WriteReader, error) {
-	baseDir := filepath.ToSlash(filepath.Join(cfg.RepoPath, dir))
 	compressor, crypter := decideCompressorEncryptor(cfg)
 
+	s, m, err := decideRepoStorage(cfg, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var r repo.WriteReader
+	if cfg.RepoDedupEnabled {
+		slog.Info("init deduplication",
+			slog.String("module", "boot"),
+			slog.Int("avg chunk KiB", cfg.RepoDedupAvgChunkKb),
+		)
+		r, err = repo.NewDedupWriteReader(s, compressor, crypter, &repo.DedupOpts{
+			AvgChunkSize: cfg.RepoDedupAvgChunkKb * 1024,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		r = repo.NewWriteReaderWithOpts(s, compressor, crypter, &repo.WriteReaderOpts{
+			Seekable: cfg.RepoSeekableEnabled,
+		})
+	}
+	if cfg.RepoTracingEnabled {
+		r = repo.NewTracingWriteReader(r, nil)
+	}
+	if m != nil {
+		r = repo.NewMetricsWriteReader(r, m)
+	}
+	return r, nil
+}
+
+// DecideStorage inits the storage of the repository with all the configured layers, but without
+// compression/encryption, i.e. to sync the stored objects as they are
+func DecideStorage(cfg *config.Config, dir string) (storage.Storage, error) {
+	s, _, err := decideRepoStorage(cfg, dir)
+	return s, err
+}
+
+func decideRepoStorage(cfg *config.Config, dir string) (storage.Storage, *metrics.Metrics, error) {
+	s, err := decideBackend(cfg, cfg, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(cfg.RepoReplicas) > 0 {
+		s, err = decideReplicas(cfg, dir, s)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(cfg.RepoFallbacks) > 0 {
+		s, err = decideFallbacks(cfg, dir, s)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	m, err := decideMetrics(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m != nil {
+		s = storage.NewMetricsStorage(s, m)
+	}
+	s, err = decorateStorage(cfg, dir, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, m, nil
+}
+
+// decideBackend inits the storage of a single destination, spans are the innermost layer,
+// so that every attempt of a retried operation is visible
+func decideBackend(cfg, dest *config.Config, dir string) (storage.Storage, error) {
+	s, err := decideStorage(dest, filepath.ToSlash(filepath.Join(dest.RepoPath, dir)))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RepoTracingEnabled {
+		s = storage.NewTracingStorage(s, string(dest.RepoType), nil)
+	}
+	return s, nil
+}
+
+// decideReplicas adds the configured replicas to the primary storage, which stays the preferred one for reads
+func decideReplicas(cfg *config.Config, dir string, primary storage.Storage) (storage.Storage, error) {
+	replicas := []storage.Storage{primary}
+	for _, replicaCfg := range cfg.RepoReplicas {
+		s, err := decideBackend(cfg, replicaCfg, dir)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, s)
+	}
+	quorum, err := storage.ParseQuorum(cfg.RepoReplicaQuorum, len(replicas))
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("init replicated storage",
+		slog.String("module", "boot"),
+		slog.Int("replicas", len(replicas)),
+		slog.Int("write quorum", quorum),
+	)
+	return storage.NewReplicatingStorage(replicas, &storage.ReplicateOpts{Quorum: quorum})
+}
+
+// decideFallbacks puts the read-only copies of the repo behind the main storage
+func decideFallbacks(cfg *config.Config, dir string, main storage.Storage) (storage.Storage, error) {
+	backends := []storage.FailoverBackend{{Name: backendName(cfg), Storage: main}}
+	for _, fallbackCfg := range cfg.RepoFallbacks {
+		s, err := decideBackend(cfg, fallbackCfg, dir)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, storage.FailoverBackend{Name: backendName(fallbackCfg), Storage: s})
+	}
+	slog.Info("init storage failover",
+		slog.String("module", "boot"),
+		slog.Int("fallbacks", len(cfg.RepoFallbacks)),
+	)
+	return storage.NewFailoverStorage(backends, &storage.FailoverOpts{
+		FailureThreshold: cfg.RepoFailoverThreshold,
+		CoolDown:         time.Duration(cfg.RepoFailoverCoolDownSec) * time.Second,
+	})
+}
+
+// backendName tells the backends apart in logs, i.e. "sftp:/backups"
+func backendName(cfg *config.Config) string {
+	return fmt.Sprintf("%s:%s", cfg.RepoType, filepath.ToSlash(cfg.RepoPath))
+}
+
+// storageIdentity tells the repo dirs of all the backends apart, i.e. "s3:https://s3.local/backups:pg/wal",
+// so that they may share a cache dir
+func storageIdentity(cfg *config.Config, dir string) string {
+	var location string
+	switch cfg.RepoType {
+	case config.RepoTypeSFTP:
+		location = fmt.Sprintf("%s@%s:%d", cfg.RepoStorageSFTPUser, cfg.RepoStorageSFTPHost, cfg.RepoStorageSFTPPort)
+	case config.RepoTypeFTP:
+		location = fmt.Sprintf("%s@%s:%d", cfg.RepoStorageFTPUser, cfg.RepoStorageFTPHost, cfg.RepoStorageFTPPort)
+	case config.RepoTypeS3:
+		location = cfg.RepoStorageS3URL + "/" + cfg.RepoStorageS3Bucket
+	case config.RepoTypeAzure:
+		location = cfg.RepoStorageAzureURL + "/" + cfg.RepoStorageAzureAccountName + "/" + cfg.RepoStorageAzureContainer
+	case config.RepoTypeGCS:
+		location = cfg.RepoStorageGCSURL + "/" + cfg.RepoStorageGCSBucket
+	case config.RepoTypeWebDAV:
+		location = cfg.RepoStorageWebDAVURL
+	}
+	return fmt.Sprintf("%s:%s:%s", cfg.RepoType, location, filepath.ToSlash(filepath.Join(cfg.RepoPath, dir)))
+}
+
+// decideMetrics registers the collectors with the default registry, and starts the /metrics listener once per process
+func decideMetrics(cfg *config.Config) (*metrics.Metrics, error) {
+	if !cfg.RepoMetricsEnabled && cfg.RepoMetricsListenAddr == "" {
+		return nil, nil
+	}
+	m, err := metrics.New(prometheus.DefaultRegisterer)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RepoMetricsListenAddr == "" {
+		return m, nil
+	}
+
+	metricsListenerMu.Lock()
+	defer metricsListenerMu.Unlock()
+	if !metricsListening {
+		srv, err := metrics.Listen(cfg.RepoMetricsListenAddr, prometheus.DefaultGatherer)
+		if err != nil {
+			return nil, fmt.Errorf("cannot listen for metrics: %w", err)
+		}
+		metricsListening = true
+		slog.Info("init metrics listener",
+			slog.String("module", "boot"),
+			slog.String("address", "http://"+srv.Addr+"/metrics"),
+		)
+	}
+	return m, nil
+}
+
+// decideStorage inits the backend of the configured repo type
+func decideStorage(cfg *config.Config, baseDir string) (storage.Storage, error) {
 	switch cfg.RepoType {
 	// local
 	case config.RepoTypeLocal:
@@ -27,14 +221,10 @@ func DecideRepo(cfg *config.Config, dir string) (repo.WriteReader, error) {
 			slog.String("module", "boot"),
 			slog.String("local storage ready with location", filepath.ToSlash(baseDir)),
 		)
-		s, err := storage.NewLocal(&storage.LocalStorageOpts{
+		return storage.NewLocal(&storage.LocalStorageOpts{
 			BaseDir:      baseDir,
 			FsyncOnWrite: cfg.RepoStorageLocalFsyncOnWrite,
 		})
-		if err != nil {
-			return nil, err
-		}
-		return repo.NewWriteReader(s, compressor, crypter), nil
 
 		// sftp
 	case config.RepoTypeSFTP:
@@ -52,8 +242,28 @@ func DecideRepo(cfg *config.Config, dir string) (repo.WriteReader, error) {
 		if err != nil {
 			return nil, err
 		}
-		sftpStorage := storage.NewSFTPStorage(c.SFTPClient(), baseDir)
-		return repo.NewWriteReader(sftpStorage, compressor, crypter), nil
+		return storage.NewSFTPStorageWithRedial(c.SFTPClient(), baseDir, c.Redial), nil
+
+		// ftp
+	case config.RepoTypeFTP:
+		slog.Info("init FTP storage",
+			slog.String("module", "boot"),
+			slog.String("FTP storage ready with location", filepath.ToSlash(baseDir)),
+		)
+		c, err := ftpx.NewFTPClient(&ftpx.FTPConfig{
+			Host:               cfg.RepoStorageFTPHost,
+			Port:               fmt.Sprintf("%d", cfg.RepoStorageFTPPort),
+			User:               cfg.RepoStorageFTPUser,
+			Pass:               cfg.RepoStorageFTPPass,
+			TLS:                cfg.RepoStorageFTPTLS,
+			CACertPath:         cfg.RepoStorageFTPCACertPath,
+			InsecureSkipVerify: cfg.RepoStorageFTPInsecureSkipVerify,
+			DisableEPSV:        cfg.RepoStorageFTPDisableEPSV,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewFTPStorage(c.Dial, baseDir), nil
 
 		// s3
 	case config.RepoTypeS3:
@@ -73,14 +283,130 @@ func DecideRepo(cfg *config.Config, dir string) (repo.WriteReader, error) {
 		if err != nil {
 			return nil, err
 		}
-		s3Storage := storage.NewS3Storage(c.Client(), cfg.RepoStorageS3Bucket, baseDir)
-		return repo.NewWriteReader(s3Storage, compressor, crypter), nil
+		return storage.NewS3Storage(c.Client(), cfg.RepoStorageS3Bucket, baseDir), nil
+
+		// azure
+	case config.RepoTypeAzure:
+		slog.Info("init azure storage",
+			slog.String("module", "boot"),
+			slog.String("azure storage ready with location", filepath.ToSlash(baseDir)),
+		)
+		c, err := azblobx.NewAzureBlobClient(&azblobx.AzureBlobConfig{
+			EndpointURL: cfg.RepoStorageAzureURL,
+			AccountName: cfg.RepoStorageAzureAccountName,
+			AccountKey:  cfg.RepoStorageAzureAccountKey,
+			SASToken:    cfg.RepoStorageAzureSASToken,
+			Container:   cfg.RepoStorageAzureContainer,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewAzureBlobStorage(c.Client(), baseDir), nil
+
+		// gcs
+	case config.RepoTypeGCS:
+		slog.Info("init gcs storage",
+			slog.String("module", "boot"),
+			slog.String("gcs storage ready with location", filepath.ToSlash(baseDir)),
+		)
+		c, err := gcsx.NewGCSClient(context.Background(), &gcsx.GCSConfig{
+			EndpointURL:     cfg.RepoStorageGCSURL,
+			CredentialsFile: cfg.RepoStorageGCSCredentialsFile,
+			Bucket:          cfg.RepoStorageGCSBucket,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewGCSStorage(c.Client(), cfg.RepoStorageGCSBucket, baseDir), nil
+
+		// webdav
+	case config.RepoTypeWebDAV:
+		slog.Info("init webdav storage",
+			slog.String("module", "boot"),
+			slog.String("webdav storage ready with location", filepath.ToSlash(baseDir)),
+		)
+		c, err := webdavx.NewWebDAVClient(&webdavx.WebDAVConfig{
+			URL:                cfg.RepoStorageWebDAVURL,
+			User:               cfg.RepoStorageWebDAVUser,
+			Pass:               cfg.RepoStorageWebDAVPass,
+			Auth:               cfg.RepoStorageWebDAVAuth,
+			CACertPath:         cfg.RepoStorageWebDAVCACertPath,
+			InsecureSkipVerify: cfg.RepoStorageWebDAVInsecureSkipVerify,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewWebDAVStorage(c.Client(), c.URL(), baseDir), nil
+
+		// memory
+	case config.RepoTypeMemory:
+		slog.Info("init memory storage",
+			slog.String("module", "boot"),
+			slog.String("memory storage is ephemeral, location is ignored", filepath.ToSlash(baseDir)),
+		)
+		return storage.NewMemoryStorage(), nil
 
 	default:
 		return nil, fmt.Errorf("unimplemented repo type: %s", cfg.RepoType)
 	}
 }
 
+// decorateStorage wraps the backend with the optional layers, retries are outer,
+// so that a retried upload is throttled again, and the cache is outermost, so that hits cost nothing
+func decorateStorage(cfg *config.Config, dir string, s storage.Storage) (storage.Storage, error) {
+	if cfg.RepoUploadLimitKbps > 0 || cfg.RepoDownloadLimitKbps > 0 {
+		schedule, err := storage.ParseTimeWindows(cfg.RepoThrottleSchedule)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("init bandwidth limits",
+			slog.String("module", "boot"),
+			slog.Int64("upload KiB/s", cfg.RepoUploadLimitKbps),
+			slog.Int64("download KiB/s", cfg.RepoDownloadLimitKbps),
+			slog.String("schedule", cfg.RepoThrottleSchedule),
+		)
+		s = storage.NewThrottleStorage(s, &storage.ThrottleOpts{
+			UploadBytesPerSec:   cfg.RepoUploadLimitKbps * 1024,
+			DownloadBytesPerSec: cfg.RepoDownloadLimitKbps * 1024,
+			Schedule:            schedule,
+		})
+	}
+	if cfg.RepoRetryMaxAttempts > 1 {
+		slog.Info("init storage retries",
+			slog.String("module", "boot"),
+			slog.Int("max attempts", cfg.RepoRetryMaxAttempts),
+		)
+		s = storage.NewRetryStorage(s, &storage.RetryOpts{
+			MaxAttempts:    cfg.RepoRetryMaxAttempts,
+			InitialBackoff: time.Duration(cfg.RepoRetryInitialBackoffMs) * time.Millisecond,
+			MaxBackoff:     time.Duration(cfg.RepoRetryMaxBackoffMs) * time.Millisecond,
+			Jitter:         cfg.RepoRetryJitter,
+			SpoolDir:       cfg.RepoRetrySpoolDir,
+		})
+	}
+	if cfg.RepoCacheDir != "" {
+		slog.Info("init storage cache",
+			slog.String("module", "boot"),
+			slog.String("dir", cfg.RepoCacheDir),
+			slog.Int64("max MiB", cfg.RepoCacheMaxMb),
+			slog.String("mode", cfg.RepoCacheMode),
+			slog.Int("revalidate sec", cfg.RepoCacheRevalidateSec),
+		)
+		var err error
+		s, err = storage.NewCacheStorage(s, &storage.CacheOpts{
+			Dir:             cfg.RepoCacheDir,
+			MaxBytes:        cfg.RepoCacheMaxMb * 1024 * 1024,
+			Mode:            storage.CacheMode(cfg.RepoCacheMode),
+			Namespace:       storageIdentity(cfg, dir),
+			RevalidateAfter: time.Duration(cfg.RepoCacheRevalidateSec) * time.Second,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
 func decideCompressorEncryptor(cfg *config.Config) (codec.Compressor, crypt.Crypter) {
 	var compressor codec.Compressor
 	var crypter crypt.Crypter
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/hashmap-kz/xrepo/config"
+	"github.com/hashmap-kz/xrepo/pkg/storage"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -73,3 +75,284 @@ func TestBoot_LocalRepoWriteWithPrefix(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(all))
 }
+
+func TestBoot_AzureRepoRequiresCredentials(t *testing.T) {
+	_, err := DecideRepo(&config.Config{
+		RepoType:                    config.RepoTypeAzure,
+		RepoStorageAzureAccountName: "devstoreaccount1",
+		RepoStorageAzureContainer:   "backups",
+	}, "azure-repo")
+	assert.Error(t, err)
+}
+
+func TestBoot_WebDAVRepoRequiresURL(t *testing.T) {
+	_, err := DecideRepo(&config.Config{
+		RepoType:              config.RepoTypeWebDAV,
+		RepoStorageWebDAVUser: "backup",
+	}, "webdav-repo")
+	assert.Error(t, err)
+}
+
+func TestBoot_FTPRepoRequiresHost(t *testing.T) {
+	_, err := DecideRepo(&config.Config{
+		RepoType:           config.RepoTypeFTP,
+		RepoStorageFTPUser: "backup",
+	}, "ftp-repo")
+	assert.Error(t, err)
+}
+
+func TestBoot_MemoryRepo(t *testing.T) {
+	repo, err := DecideRepo(&config.Config{
+		RepoType:       config.RepoTypeMemory,
+		RepoCompressor: config.RepoCompressorGzip,
+	}, "memory-repo")
+	assert.NoError(t, err)
+
+	_, err = repo.PutObject(context.TODO(), "a/b/my-file", strings.NewReader("content"))
+	assert.NoError(t, err)
+
+	all, err := repo.ListAll(context.TODO(), "a/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/b/my-file"}, all)
+}
+
+func TestBoot_MemoryRepoWithRetries(t *testing.T) {
+	repo, err := DecideRepo(&config.Config{
+		RepoType:             config.RepoTypeMemory,
+		RepoRetryMaxAttempts: 3,
+		RepoRetrySpoolDir:    t.TempDir(),
+	}, "memory-repo")
+	assert.NoError(t, err)
+
+	_, err = repo.PutObject(context.TODO(), "a/b/my-file", strings.NewReader("content"))
+	assert.NoError(t, err)
+
+	all, err := repo.ListAll(context.TODO(), "a/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/b/my-file"}, all)
+}
+
+func TestBoot_InvalidThrottleSchedule(t *testing.T) {
+	_, err := DecideRepo(&config.Config{
+		RepoType:             config.RepoTypeMemory,
+		RepoUploadLimitKbps:  1024,
+		RepoThrottleSchedule: "8-18",
+	}, "memory-repo")
+	assert.Error(t, err)
+}
+
+func TestBoot_MemoryRepoWithMetrics(t *testing.T) {
+	repo, err := DecideRepo(&config.Config{
+		RepoType:           config.RepoTypeMemory,
+		RepoMetricsEnabled: true,
+	}, "memory-repo")
+	assert.NoError(t, err)
+
+	_, err = repo.PutObject(context.TODO(), "a/b/my-file", strings.NewReader("content"))
+	assert.NoError(t, err)
+
+	// the collectors of the default registry are reused
+	_, err = DecideRepo(&config.Config{
+		RepoType:           config.RepoTypeMemory,
+		RepoMetricsEnabled: true,
+	}, "memory-repo")
+	assert.NoError(t, err)
+}
+
+func TestBoot_MemoryRepoWithTracing(t *testing.T) {
+	repo, err := DecideRepo(&config.Config{
+		RepoType:           config.RepoTypeMemory,
+		RepoCompressor:     config.RepoCompressorZstd,
+		RepoTracingEnabled: true,
+	}, "memory-repo")
+	assert.NoError(t, err)
+
+	_, err = repo.PutObject(context.TODO(), "a/b/my-file", strings.NewReader("content"))
+	assert.NoError(t, err)
+	assert.Equal(t, "zstd", repo.GetCompressorName())
+}
+
+func TestBoot_LocalRepoWithCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	repo, err := DecideRepo(&config.Config{
+		RepoPath:       t.TempDir(),
+		RepoType:       config.RepoTypeLocal,
+		RepoCompressor: config.RepoCompressorGzip,
+		RepoCacheDir:   cacheDir,
+		RepoCacheMaxMb: 1,
+		RepoCacheMode:  string(storage.CacheWriteThrough),
+	}, "local-repo")
+	assert.NoError(t, err)
+
+	_, err = repo.PutObject(context.TODO(), "a/b/my-file", strings.NewReader("content"))
+	assert.NoError(t, err)
+
+	rc, err := repo.ReadObject(context.TODO(), "a/b/my-file")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, "content", string(data))
+
+	cached, err := os.ReadDir(cacheDir)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cached)
+}
+
+func TestBoot_LocalReposShareCacheDir(t *testing.T) {
+	cfg := &config.Config{
+		RepoPath:       t.TempDir(),
+		RepoType:       config.RepoTypeLocal,
+		RepoCacheDir:   t.TempDir(),
+		RepoCacheMaxMb: 1,
+		RepoCacheMode:  string(storage.CacheWriteThrough),
+	}
+	for _, dir := range []string{"db1", "db2"} {
+		repo, err := DecideRepo(cfg, dir)
+		assert.NoError(t, err)
+		_, err = repo.PutObject(context.TODO(), "base/my-file", strings.NewReader(dir+"-content"))
+		assert.NoError(t, err)
+	}
+
+	// the same object name in both repos is cached apart
+	for _, dir := range []string{"db1", "db2"} {
+		repo, err := DecideRepo(cfg, dir)
+		assert.NoError(t, err)
+		rc, err := repo.ReadObject(context.TODO(), "base/my-file")
+		assert.NoError(t, err)
+		data, err := io.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		assert.Equal(t, dir+"-content", string(data))
+	}
+}
+
+func TestBoot_LocalRepoWithReplicas(t *testing.T) {
+	primaryDir, replicaDir := t.TempDir(), t.TempDir()
+	repo, err := DecideRepo(&config.Config{
+		RepoPath: primaryDir,
+		RepoType: config.RepoTypeLocal,
+		RepoReplicas: []*config.Config{
+			{RepoPath: replicaDir, RepoType: config.RepoTypeLocal},
+		},
+		RepoReplicaQuorum: "all",
+	}, "local-repo")
+	assert.NoError(t, err)
+
+	_, err = repo.PutObject(context.TODO(), "a/b/my-file", strings.NewReader("content"))
+	assert.NoError(t, err)
+
+	for _, dir := range []string{primaryDir, replicaDir} {
+		data, err := os.ReadFile(filepath.Join(dir, "local-repo", "a", "b", "my-file"))
+		assert.NoError(t, err)
+		assert.Equal(t, "content", string(data))
+	}
+
+	_, err = DecideRepo(&config.Config{
+		RepoPath:          primaryDir,
+		RepoType:          config.RepoTypeLocal,
+		RepoReplicas:      []*config.Config{{RepoPath: replicaDir, RepoType: config.RepoTypeLocal}},
+		RepoReplicaQuorum: "3",
+	}, "local-repo")
+	assert.Error(t, err)
+}
+
+func TestBoot_LocalRepoWithFallbacks(t *testing.T) {
+	primaryDir, fallbackDir := t.TempDir(), t.TempDir()
+
+	// only the fallback has a copy of the object
+	copyRepo, err := DecideRepo(&config.Config{RepoPath: fallbackDir, RepoType: config.RepoTypeLocal}, "local-repo")
+	assert.NoError(t, err)
+	_, err = copyRepo.PutObject(context.TODO(), "a/b/my-file", strings.NewReader("content"))
+	assert.NoError(t, err)
+
+	repo, err := DecideRepo(&config.Config{
+		RepoPath:      primaryDir,
+		RepoType:      config.RepoTypeLocal,
+		RepoFallbacks: []*config.Config{{RepoPath: fallbackDir, RepoType: config.RepoTypeLocal}},
+	}, "local-repo")
+	assert.NoError(t, err)
+
+	// missing objects don't fail over
+	_, err = repo.ReadObject(context.TODO(), "a/b/my-file")
+	assert.Error(t, err)
+
+	// writes go to the main storage
+	_, err = repo.PutObject(context.TODO(), "c/my-file", strings.NewReader("content"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(primaryDir, "local-repo", "c", "my-file"))
+	assert.NoError(t, err)
+}
+
+func TestBoot_LocalStorageKeepsStoredObjects(t *testing.T) {
+	cfg := &config.Config{
+		RepoPath:       t.TempDir(),
+		RepoType:       config.RepoTypeLocal,
+		RepoCompressor: config.RepoCompressorGzip,
+	}
+	repo, err := DecideRepo(cfg, "local-repo")
+	assert.NoError(t, err)
+	_, err = repo.PutObject(context.TODO(), "my-file", strings.NewReader("content"))
+	assert.NoError(t, err)
+
+	s, err := DecideStorage(cfg, "local-repo")
+	assert.NoError(t, err)
+	all, err := s.ListAll(context.TODO(), "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"my-file.gz"}, all)
+}
+
+func TestBoot_LocalRepoSeekable(t *testing.T) {
+	cfg := &config.Config{
+		RepoPath:            t.TempDir(),
+		RepoType:            config.RepoTypeLocal,
+		RepoCompressor:      config.RepoCompressorGzip,
+		RepoSeekableEnabled: true,
+	}
+	repo, err := DecideRepo(cfg, "local-repo")
+	assert.NoError(t, err)
+	_, err = repo.PutObject(context.TODO(), "my-file", strings.NewReader("content"))
+	assert.NoError(t, err)
+
+	s, err := DecideStorage(cfg, "local-repo")
+	assert.NoError(t, err)
+	all, err := s.ListAll(context.TODO(), "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"my-file.gz", "my-file.gz.idx"}, all)
+}
+
+func TestBoot_LocalRepoWithDedup(t *testing.T) {
+	cfg := &config.Config{
+		RepoPath:            t.TempDir(),
+		RepoType:            config.RepoTypeLocal,
+		RepoCompressor:      config.RepoCompressorZstd,
+		RepoDedupEnabled:    true,
+		RepoDedupAvgChunkKb: 4,
+	}
+	repo, err := DecideRepo(cfg, "local-repo")
+	assert.NoError(t, err)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	_, err = repo.PutObject(context.TODO(), "night1/base", bytes.NewReader(content))
+	assert.NoError(t, err)
+	_, err = repo.PutObject(context.TODO(), "night2/base", bytes.NewReader(content))
+	assert.NoError(t, err)
+
+	rc, err := repo.ReadObject(context.TODO(), "night2/base")
+	assert.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	all, err := repo.ListAll(context.TODO(), "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"night1/base", "night2/base"}, all)
+
+	_, err = DecideRepo(&config.Config{
+		RepoType:            config.RepoTypeMemory,
+		RepoDedupEnabled:    true,
+		RepoDedupAvgChunkKb: -1,
+	}, "memory-repo")
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package azblobx
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+type AzureBlobConfig struct {
+	// EndpointURL is the blob service URL, i.e. http://127.0.0.1:10000/devstoreaccount1 for Azurite,
+	// defaults to https://<account>.blob.core.windows.net
+	EndpointURL string
+	AccountName string
+	AccountKey  string
+	SASToken    string
+	Container   string
+}
+
+type AzureBlobClient struct {
+	client    *container.Client
+	container string
+}
+
+// NewAzureBlobClient initializes the container client, authenticating either with a SAS token, or with the shared account key
+func NewAzureBlobClient(cfg *AzureBlobConfig) (*AzureBlobClient, error) {
+	if cfg.Container == "" {
+		return nil, fmt.Errorf("azure container is not set")
+	}
+
+	endpoint := cfg.EndpointURL
+	if endpoint == "" {
+		if cfg.AccountName == "" {
+			return nil, fmt.Errorf("neither azure endpoint nor account name is set")
+		}
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", cfg.AccountName)
+	}
+	containerURL, err := url.JoinPath(endpoint, cfg.Container)
+	if err != nil {
+		return nil, err
+	}
+
+	var client *container.Client
+	switch {
+	case cfg.SASToken != "":
+		client, err = container.NewClientWithNoCredential(containerURL+"?"+strings.TrimPrefix(cfg.SASToken, "?"), nil)
+	case cfg.AccountKey != "":
+		var cred *container.SharedKeyCredential
+		cred, err = container.NewSharedKeyCredential(cfg.AccountName, cfg.AccountKey)
+		if err != nil {
+			return nil, err
+		}
+		client, err = container.NewClientWithSharedKeyCredential(containerURL, cred, nil)
+	default:
+		return nil, fmt.Errorf("neither azure SAS token nor account key is set")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &AzureBlobClient{
+		client:    client,
+		container: cfg.Container,
+	}, nil
+}
+
+func (c *AzureBlobClient) Client() *container.Client {
+	return c.client
+}
+
+func (c *AzureBlobClient) Container() string {
+	return c.container
+}
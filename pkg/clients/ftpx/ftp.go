@@ -0,0 +1,119 @@
+package ftpx
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+const (
+	TLSExplicit = "explicit"
+	TLSImplicit = "implicit"
+)
+
+type FTPConfig struct {
+	// Required
+	Host string
+	Port string
+	User string
+	Pass string
+
+	// Optional, "explicit" (AUTH TLS on the plain port) or "implicit" (TLS from the first byte), plain FTP if empty
+	TLS                string
+	CACertPath         string
+	InsecureSkipVerify bool
+
+	// Optional, some NAT-ed servers answer EPSV with an unreachable port, PASV is used then
+	DisableEPSV bool
+}
+
+// FTPClient dials logged-in connections, a connection serves a single transfer at a time,
+// so the storage keeps a pool of them.
+type FTPClient struct {
+	addr string
+	user string
+	pass string
+	opts []ftp.DialOption
+}
+
+// NewFTPClient prepares the dial options, and checks the settings with a test connection
+func NewFTPClient(cfg *FTPConfig) (*FTPClient, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("ftp host is not set")
+	}
+	port := cfg.Port
+	if port == "" || port == "0" {
+		port = "21"
+		if cfg.TLS == TLSImplicit {
+			port = "990"
+		}
+	}
+
+	opts := []ftp.DialOption{
+		ftp.DialWithTimeout(10 * time.Second),
+		ftp.DialWithDisabledEPSV(cfg.DisableEPSV),
+	}
+
+	if cfg.TLS != "" {
+		tlsConfig := &tls.Config{
+			// data connections are dialed by address, so the name to verify is set explicitly
+			ServerName: cfg.Host,
+			//nolint:gosec
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+			// servers commonly require data connections to resume the session of the control one
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		}
+		if cfg.CACertPath != "" {
+			pem, err := os.ReadFile(cfg.CACertPath)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read CA cert: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in: %s", cfg.CACertPath)
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		switch cfg.TLS {
+		case TLSExplicit:
+			opts = append(opts, ftp.DialWithExplicitTLS(tlsConfig))
+		case TLSImplicit:
+			opts = append(opts, ftp.DialWithTLS(tlsConfig))
+		default:
+			return nil, fmt.Errorf("unknown ftp tls mode: %s", cfg.TLS)
+		}
+	}
+
+	c := &FTPClient{
+		addr: net.JoinHostPort(cfg.Host, port),
+		user: cfg.User,
+		pass: cfg.Pass,
+		opts: opts,
+	}
+
+	conn, err := c.Dial()
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.Quit()
+	return c, nil
+}
+
+// Dial opens a new connection and logs in
+func (c *FTPClient) Dial() (*ftp.ServerConn, error) {
+	conn, err := ftp.Dial(c.addr, c.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to FTP server: %w", err)
+	}
+	if err := conn.Login(c.user, c.pass); err != nil {
+		_ = conn.Quit()
+		return nil, fmt.Errorf("unable to login to FTP server: %w", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,58 @@
+package gcsx
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+type GCSConfig struct {
+	// EndpointURL overrides the JSON API endpoint, i.e. http://localhost:4443/storage/v1/ for fake-gcs-server,
+	// requests to a custom endpoint are not authenticated
+	EndpointURL     string
+	CredentialsFile string
+	Bucket          string
+}
+
+type GCSClient struct {
+	client *storage.Client
+	bucket string
+}
+
+// NewGCSClient initializes the client, credentials are taken from the file if set, from the environment otherwise
+func NewGCSClient(ctx context.Context, cfg *GCSConfig) (*GCSClient, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("gcs bucket is not set")
+	}
+
+	opts := []option.ClientOption{storage.WithJSONReads()}
+	if cfg.EndpointURL != "" {
+		opts = append(opts, option.WithEndpoint(cfg.EndpointURL), option.WithoutAuthentication())
+	} else if cfg.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.CredentialsFile))
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GCSClient{
+		client: client,
+		bucket: cfg.Bucket,
+	}, nil
+}
+
+func (c *GCSClient) Client() *storage.Client {
+	return c.client
+}
+
+func (c *GCSClient) Bucket() string {
+	return c.bucket
+}
+
+func (c *GCSClient) Close() error {
+	return c.client.Close()
+}
@@ -24,7 +24,9 @@ type SFTPClient struct {
 	sshClient  *ssh.Client
 	sftpClient *sftp.Client
 
-	config *SFTPConfig
+	config    *SFTPConfig
+	addr      string
+	sshConfig *ssh.ClientConfig
 }
 
 // NewSFTPClient creates an SFTP client using passphrase-protected private key authentication
@@ -62,24 +64,43 @@ func NewSFTPClient(sftpConfig *SFTPConfig) (*SFTPClient, error) {
 		Timeout:         5 * time.Second,
 	}
 
+	c := &SFTPClient{
+		config:    sftpConfig,
+		addr:      fmt.Sprintf("%s:%s", sftpConfig.Host, sftpConfig.Port),
+		sshConfig: sshConfig,
+	}
+	if err := c.dial(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *SFTPClient) dial() error {
 	// Establish the SSH connection
-	addr := fmt.Sprintf("%s:%s", sftpConfig.Host, sftpConfig.Port)
-	conn, err := ssh.Dial("tcp", addr, sshConfig)
+	conn, err := ssh.Dial("tcp", s.addr, s.sshConfig)
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect to SFTP server: %w", err)
+		return fmt.Errorf("unable to connect to SFTP server: %w", err)
 	}
 
 	// Create an SFTP sftpClient over the SSH connection
 	client, err := sftp.NewClient(conn)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create SFTP sftpClient: %w", err)
+		_ = conn.Close()
+		return fmt.Errorf("unable to create SFTP sftpClient: %w", err)
 	}
 
-	return &SFTPClient{
-		sshClient:  conn,
-		sftpClient: client,
-		config:     sftpConfig,
-	}, nil
+	s.sshClient = conn
+	s.sftpClient = client
+	return nil
+}
+
+// Redial replaces a lost connection with a new one, it's not safe for concurrent use
+func (s *SFTPClient) Redial() (*sftp.Client, error) {
+	_ = s.Close()
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return s.sftpClient, nil
 }
 
 func (s *SFTPClient) SFTPClient() *sftp.Client {
@@ -0,0 +1,260 @@
+package webdavx
+
+import (
+	"crypto/md5" //nolint:gosec
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// digestAuthTransport implements RFC 7616 digest authentication (qop=auth, MD5 and SHA-256).
+//
+// The challenge of the server is remembered and reused for subsequent requests (with an increasing nonce count),
+// so a request normally takes a single round-trip. Streamed bodies cannot be replayed after a 401,
+// so the challenge is obtained with a bodyless probe before the first of them is sent. The challenge is
+// updated from every 401 reply, so a streamed request that met an expired nonce fails alone, and the next
+// requests answer the fresh one. Concurrent requests share the nonce count, the server may receive
+// their counts out of order, but never the same count twice for a nonce.
+type digestAuthTransport struct {
+	base       http.RoundTripper
+	user, pass string
+
+	mu        sync.Mutex
+	challenge *digestChallenge
+	nc        uint32
+}
+
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+}
+
+func (t *digestAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	if !replayable && t.currentChallenge() == nil {
+		if err := t.probe(req); err != nil {
+			if req.Body != nil {
+				_ = req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+
+	resp, err := t.send(req, req.Body)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// the nonce is expired (or was never known), remember the fresh challenge for the next requests,
+	// and answer it once when the body can be sent again
+	ch := parseDigestChallenge(resp.Header)
+	if ch == nil {
+		return resp, nil
+	}
+	t.setChallenge(ch)
+	if !replayable {
+		return resp, nil
+	}
+
+	var body io.ReadCloser
+	if req.GetBody != nil {
+		body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	return t.send(req, body)
+}
+
+// probe obtains the challenge with an OPTIONS request to the same URL
+func (t *digestAuthTransport) probe(req *http.Request) error {
+	probe, err := http.NewRequestWithContext(req.Context(), http.MethodOptions, req.URL.String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+	resp, err := t.base.RoundTrip(probe)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if ch := parseDigestChallenge(resp.Header); ch != nil {
+		t.setChallenge(ch)
+	}
+	return nil
+}
+
+func (t *digestAuthTransport) send(req *http.Request, body io.ReadCloser) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.Body = body
+
+	t.mu.Lock()
+	if t.challenge != nil {
+		t.nc++
+		auth, err := t.challenge.authorize(t.user, t.pass, r.Method, r.URL.RequestURI(), t.nc)
+		if err != nil {
+			t.mu.Unlock()
+			if body != nil {
+				_ = body.Close()
+			}
+			return nil, err
+		}
+		r.Header.Set("Authorization", auth)
+	}
+	t.mu.Unlock()
+
+	return t.base.RoundTrip(r)
+}
+
+func (t *digestAuthTransport) currentChallenge() *digestChallenge {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.challenge
+}
+
+// setChallenge replaces the challenge, the nonce count restarts only with a new nonce,
+// as concurrent requests may bring the same challenge back
+func (t *digestAuthTransport) setChallenge(ch *digestChallenge) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.challenge != nil && *t.challenge == *ch {
+		return
+	}
+	t.challenge = ch
+	t.nc = 0
+}
+
+// authorize builds the Authorization header value answering the challenge
+func (c *digestChallenge) authorize(user, pass, method, uri string, nc uint32) (string, error) {
+	var newHash func() hash.Hash
+	algorithm := strings.ToUpper(c.algorithm)
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm: %s", c.algorithm)
+	}
+	h := func(s string) string {
+		d := newHash()
+		_, _ = io.WriteString(d, s)
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	cnonce, err := newCnonce()
+	if err != nil {
+		return "", err
+	}
+	ncValue := fmt.Sprintf("%08x", nc)
+
+	ha1 := h(user + ":" + c.realm + ":" + pass)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	var response string
+	if c.qop != "" {
+		response = h(strings.Join([]string{ha1, c.nonce, ncValue, cnonce, c.qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `Digest username=%q, realm=%q, nonce=%q, uri=%q, response=%q`, user, c.realm, c.nonce, uri, response)
+	if c.algorithm != "" {
+		fmt.Fprintf(&sb, `, algorithm=%s`, c.algorithm)
+	}
+	if c.opaque != "" {
+		fmt.Fprintf(&sb, `, opaque=%q`, c.opaque)
+	}
+	if c.qop != "" {
+		fmt.Fprintf(&sb, `, qop=%s, nc=%s, cnonce=%q`, c.qop, ncValue, cnonce)
+	}
+	return sb.String(), nil
+}
+
+func newCnonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseDigestChallenge picks the digest challenge among WWW-Authenticate headers, nil if there is none
+func parseDigestChallenge(h http.Header) *digestChallenge {
+	for _, v := range h.Values("WWW-Authenticate") {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		params := parseAuthParams(rest)
+		ch := &digestChallenge{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: params["algorithm"],
+		}
+		// only qop=auth is supported, auth-int would require hashing the body
+		for _, qop := range strings.Split(params["qop"], ",") {
+			if strings.TrimSpace(qop) == "auth" {
+				ch.qop = "auth"
+			}
+		}
+		if params["qop"] != "" && ch.qop == "" {
+			continue
+		}
+		return ch
+	}
+	return nil
+}
+
+// parseAuthParams splits a comma separated list of key=value pairs, values may be quoted
+func parseAuthParams(s string) map[string]string {
+	result := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return result
+		}
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return result
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " ")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			v, tail, _ := strings.Cut(rest, ",")
+			value.WriteString(strings.TrimSpace(v))
+			s = tail
+		}
+		result[key] = value.String()
+	}
+}
@@ -0,0 +1,125 @@
+package webdavx
+
+import (
+	"crypto/md5" //nolint:gosec
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// digestTestServer accepts digest answers to its current nonce, every nonce count once
+type digestTestServer struct {
+	mu     sync.Mutex
+	nonce  string
+	seen   map[string]bool
+	probes int
+}
+
+func (s *digestTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := func(v string) string {
+		sum := md5.Sum([]byte(v)) //nolint:gosec
+		return hex.EncodeToString(sum[:])
+	}
+	_, _ = io.Copy(io.Discard, r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method == http.MethodOptions {
+		s.probes++
+	}
+
+	stale := false
+	if params, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Digest "); ok {
+		p := parseAuthParams(params)
+		ha1 := h("backup:dav:secret")
+		ha2 := h(r.Method + ":" + p["uri"])
+		want := h(strings.Join([]string{ha1, p["nonce"], p["nc"], p["cnonce"], p["qop"], ha2}, ":"))
+		counted := p["nonce"] + "/" + p["nc"]
+		switch {
+		case p["response"] != want || s.seen[counted]:
+		case p["nonce"] != s.nonce:
+			stale = true
+		default:
+			s.seen[counted] = true
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+	}
+	w.Header().Set("WWW-Authenticate",
+		fmt.Sprintf(`Digest realm="dav", nonce=%q, qop="auth", algorithm=MD5, stale=%t`, s.nonce, stale))
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (s *digestTestServer) rotateNonce(nonce string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonce = nonce
+}
+
+func TestDigestAuth_StaleNonceWithStreamedPut(t *testing.T) {
+	server := &digestTestServer{nonce: "nonce-1", seen: make(map[string]bool)}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	client := &http.Client{Transport: &digestAuthTransport{base: http.DefaultTransport, user: "backup", pass: "secret"}}
+	put := func() int {
+		// a streamed body, it cannot be replayed after a 401
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/obj", io.MultiReader(strings.NewReader("content")))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusCreated, put())
+
+	// the nonce expires while there is a challenge, the upload fails without being replayed
+	server.rotateNonce("nonce-2")
+	assert.Equal(t, http.StatusUnauthorized, put())
+
+	// the next uploads answer the challenge of the 401, without probing again
+	assert.Equal(t, http.StatusCreated, put())
+	assert.Equal(t, http.StatusCreated, put())
+	assert.Equal(t, 1, server.probes)
+}
+
+func TestDigestAuth_ConcurrentRequestsNeverRepeatNonceCounts(t *testing.T) {
+	server := &digestTestServer{nonce: "nonce-1", seen: make(map[string]bool)}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	client := &http.Client{Transport: &digestAuthTransport{base: http.DefaultTransport, user: "backup", pass: "secret"}}
+	var wg sync.WaitGroup
+	codes := make([]int, 16)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// bodyless requests are replayed once after a 401
+			req, err := http.NewRequest(http.MethodPut, ts.URL+"/obj", http.NoBody)
+			if err != nil {
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return
+			}
+			_ = resp.Body.Close()
+			codes[i] = resp.StatusCode
+		}()
+	}
+	wg.Wait()
+
+	for _, code := range codes {
+		assert.Equal(t, http.StatusCreated, code)
+	}
+}
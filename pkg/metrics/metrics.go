@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Layers of the instrumented operations, comparing the bytes of both shows the compression ratio
+const (
+	LayerRepo    = "repo"    // plain content, before compression/encryption
+	LayerStorage = "storage" // stored content, after compression/encryption
+)
+
+// Directions of the transferred bytes
+const (
+	DirectionIn  = "in"  // written
+	DirectionOut = "out" // read
+)
+
+// Metrics holds the collectors shared by the instrumented repo and storage
+type Metrics struct {
+	ops      *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	bytes    *prometheus.CounterVec
+}
+
+// New registers the collectors with reg. Collectors that are already registered are reused,
+// so several repos may report to the same registry.
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		ops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "xrepo",
+			Name:      "operations_total",
+			Help:      "Number of operations, by layer and operation.",
+		}, []string{"layer", "op"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "xrepo",
+			Name:      "errors_total",
+			Help:      "Number of failed operations, by layer, operation and error type.",
+		}, []string{"layer", "op", "type"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "xrepo",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of operations, streams are measured until they are opened.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"layer", "op"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "xrepo",
+			Name:      "bytes_total",
+			Help:      "Transferred bytes, by layer and direction.",
+		}, []string{"layer", "direction"}),
+	}
+
+	var err error
+	if m.ops, err = register(reg, m.ops); err != nil {
+		return nil, err
+	}
+	if m.errors, err = register(reg, m.errors); err != nil {
+		return nil, err
+	}
+	if m.duration, err = register(reg, m.duration); err != nil {
+		return nil, err
+	}
+	if m.bytes, err = register(reg, m.bytes); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func register[T prometheus.Collector](reg prometheus.Registerer, c T) (T, error) {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+		return c, err
+	}
+	return c, nil
+}
+
+// Observe records an operation started at start, along with its error, if any
+func (m *Metrics) Observe(layer, op string, start time.Time, err error) {
+	m.ops.WithLabelValues(layer, op).Inc()
+	m.duration.WithLabelValues(layer, op).Observe(time.Since(start).Seconds())
+	m.ObserveError(layer, op, err)
+}
+
+// ObserveError records an error that happened after the operation was counted, i.e. while streaming
+func (m *Metrics) ObserveError(layer, op string, err error) {
+	if err == nil {
+		return
+	}
+	m.errors.WithLabelValues(layer, op, ErrorType(err)).Inc()
+}
+
+// AddBytes records n transferred bytes
+func (m *Metrics) AddBytes(layer, direction string, n int) {
+	if n > 0 {
+		m.bytes.WithLabelValues(layer, direction).Add(float64(n))
+	}
+}
+
+// ErrorType reduces an error to a label of low cardinality
+func ErrorType(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return "not_found"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return "network"
+	default:
+		return "other"
+	}
+}
+
+// CountingReader reports the bytes read to the metrics
+type CountingReader struct {
+	m                *Metrics
+	layer, direction string
+	r                io.Reader
+}
+
+func NewCountingReader(m *Metrics, layer, direction string, r io.Reader) *CountingReader {
+	return &CountingReader{m: m, layer: layer, direction: direction, r: r}
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.m.AddBytes(c.layer, c.direction, n)
+	return n, err
+}
+
+// CountingReadCloser counts the bytes of a download, and its errors, as they are not returned by the operation itself
+type CountingReadCloser struct {
+	m         *Metrics
+	layer, op string
+	rc        io.ReadCloser
+}
+
+func NewCountingReadCloser(m *Metrics, layer, op string, rc io.ReadCloser) *CountingReadCloser {
+	return &CountingReadCloser{m: m, layer: layer, op: op, rc: rc}
+}
+
+func (c *CountingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.rc.Read(p)
+	c.m.AddBytes(c.layer, DirectionOut, n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		c.m.ObserveError(c.layer, c.op, err)
+	}
+	return n, err
+}
+
+func (c *CountingReadCloser) Close() error {
+	return c.rc.Close()
+}
+
+// Listen serves /metrics of the gatherer on addr in background, the returned server has to be shut down by the caller
+func Listen(addr string, g prometheus.Gatherer) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
+	srv := &http.Server{
+		Addr:              ln.Addr().String(),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	return srv, nil
+}
@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_Observe(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(reg)
+	require.NoError(t, err)
+
+	m.Observe(LayerStorage, "stat", time.Now(), nil)
+	m.Observe(LayerStorage, "stat", time.Now(), fmt.Errorf("stat: %w", fs.ErrNotExist))
+	m.AddBytes(LayerRepo, DirectionIn, 10)
+	m.AddBytes(LayerRepo, DirectionIn, 0)
+
+	assert.InDelta(t, 2, testutil.ToFloat64(m.ops.WithLabelValues(LayerStorage, "stat")), 0)
+	assert.InDelta(t, 1, testutil.ToFloat64(m.errors.WithLabelValues(LayerStorage, "stat", "not_found")), 0)
+	assert.InDelta(t, 10, testutil.ToFloat64(m.bytes.WithLabelValues(LayerRepo, DirectionIn)), 0)
+	assert.Equal(t, 1, testutil.CollectAndCount(m.duration))
+}
+
+func TestMetrics_ReusesRegisteredCollectors(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m1, err := New(reg)
+	require.NoError(t, err)
+	m2, err := New(reg)
+	require.NoError(t, err)
+
+	m1.AddBytes(LayerStorage, DirectionOut, 1)
+	m2.AddBytes(LayerStorage, DirectionOut, 2)
+	assert.InDelta(t, 3, testutil.ToFloat64(m1.bytes.WithLabelValues(LayerStorage, DirectionOut)), 0)
+}
+
+func TestCountingReadCloser_CountsStreamErrors(t *testing.T) {
+	m, err := New(prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	rc := NewCountingReadCloser(m, LayerStorage, "read_object",
+		io.NopCloser(io.MultiReader(strings.NewReader("content"), errReader{err: syscall.ECONNRESET})))
+	_, err = io.ReadAll(rc)
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+	require.NoError(t, rc.Close())
+
+	assert.InDelta(t, 7, testutil.ToFloat64(m.bytes.WithLabelValues(LayerStorage, DirectionOut)), 0)
+	assert.InDelta(t, 1, testutil.ToFloat64(m.errors.WithLabelValues(LayerStorage, "read_object", "network")), 0)
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(_ []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestErrorType(t *testing.T) {
+	assert.Equal(t, "not_found", ErrorType(fs.ErrNotExist))
+	assert.Equal(t, "permission", ErrorType(fmt.Errorf("open: %w", fs.ErrPermission)))
+	assert.Equal(t, "canceled", ErrorType(context.Canceled))
+	assert.Equal(t, "timeout", ErrorType(context.DeadlineExceeded))
+	assert.Equal(t, "network", ErrorType(io.ErrUnexpectedEOF))
+	assert.Equal(t, "network", ErrorType(syscall.ECONNRESET))
+	assert.Equal(t, "other", ErrorType(errors.New("boom")))
+}
+
+func TestListen(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(reg)
+	require.NoError(t, err)
+	m.Observe(LayerRepo, "put_object", time.Now(), nil)
+
+	srv, err := Listen("127.0.0.1:0", reg)
+	require.NoError(t, err)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + srv.Addr + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `xrepo_operations_total{layer="repo",op="put_object"} 1`)
+}
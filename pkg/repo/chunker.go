@@ -0,0 +1,103 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// gearTable maps bytes to the random values of the rolling gear hash, it's derived from SHA-256
+// so that it never changes: chunk boundaries (and so deduplication) depend on it.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{byte(i)})
+		table[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks with FastCDC: a boundary is placed where the gear
+// hash of the preceding bytes matches a mask, so an insert or a change moves only the boundaries around it,
+// and unchanged data is cut into the same chunks as before.
+//
+// The mask is harder to match below the average size and easier above it (normalized chunking),
+// which keeps chunk sizes close to the average.
+type chunker struct {
+	r            io.Reader
+	minSize      int
+	avgSize      int
+	maskS, maskL uint64
+	buf          []byte
+	n            int // buffered bytes
+	consumed     int // bytes of the chunk returned by the last call, dropped on the next one
+	eof          bool
+}
+
+func newChunker(r io.Reader, minSize, avgSize, maxSize int) (*chunker, error) {
+	if minSize <= 0 || minSize > avgSize || avgSize > maxSize {
+		return nil, fmt.Errorf("invalid chunk sizes: min %d, avg %d, max %d", minSize, avgSize, maxSize)
+	}
+	// masks use the high bits of the hash, which depend on the last 64 bytes
+	maskBits := bits.Len(uint(avgSize)) - 1
+	return &chunker{
+		r:       r,
+		minSize: minSize,
+		avgSize: avgSize,
+		maskS:   ^uint64(0) << (64 - min(maskBits+2, 64)),
+		maskL:   ^uint64(0) << (64 - max(maskBits-2, 1)),
+		buf:     make([]byte, maxSize),
+	}, nil
+}
+
+// Next returns the next chunk, it's valid until the following call. The end of the stream is io.EOF,
+// an empty stream has no chunks.
+func (c *chunker) Next() ([]byte, error) {
+	copy(c.buf, c.buf[c.consumed:c.n])
+	c.n -= c.consumed
+	c.consumed = 0
+
+	if !c.eof && c.n < len(c.buf) {
+		read, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += read
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	c.consumed = c.cut(c.buf[:c.n])
+	return c.buf[:c.consumed], nil
+}
+
+// cut returns the length of the chunk at the start of the data
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	normal := min(c.avgSize, n)
+
+	var hash uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
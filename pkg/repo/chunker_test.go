@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomBytes(seed uint64, n int) []byte {
+	rnd := rand.New(rand.NewPCG(seed, seed)) //nolint:gosec
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rnd.Uint32())
+	}
+	return data
+}
+
+func splitAll(t *testing.T, data []byte, minSize, avgSize, maxSize int) [][]byte {
+	t.Helper()
+	ch, err := newChunker(bytes.NewReader(data), minSize, avgSize, maxSize)
+	require.NoError(t, err)
+
+	var chunks [][]byte
+	for {
+		chunk, err := ch.Next()
+		if errors.Is(err, io.EOF) {
+			return chunks
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+func TestChunker_SplitsWithinBounds(t *testing.T) {
+	data := randomBytes(1, 1<<20)
+	chunks := splitAll(t, data, 2048, 8192, 32768)
+
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	assert.Greater(t, len(chunks), 1<<20/32768)
+	for i, chunk := range chunks {
+		assert.LessOrEqual(t, len(chunk), 32768)
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(t, len(chunk), 2048)
+		}
+	}
+	avg := (1 << 20) / len(chunks)
+	assert.InDelta(t, 8192, avg, 4096)
+}
+
+func TestChunker_BoundariesSurviveInserts(t *testing.T) {
+	data := randomBytes(2, 512*1024)
+	edited := append(bytes.Clone(data[:200_000]), append([]byte("inserted bytes"), data[200_000:]...)...)
+
+	before := splitAll(t, data, 1024, 4096, 16384)
+	after := splitAll(t, edited, 1024, 4096, 16384)
+
+	known := make(map[string]bool)
+	for _, chunk := range before {
+		known[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range after {
+		if !known[string(chunk)] {
+			changed++
+		}
+	}
+	assert.LessOrEqual(t, changed, 3)
+}
+
+func TestChunker_EmptyStream(t *testing.T) {
+	assert.Empty(t, splitAll(t, nil, 1024, 4096, 16384))
+}
+
+func TestChunker_InvalidSizes(t *testing.T) {
+	_, err := newChunker(bytes.NewReader(nil), 0, 4096, 16384)
+	assert.Error(t, err)
+	_, err = newChunker(bytes.NewReader(nil), 4096, 1024, 16384)
+	assert.Error(t, err)
+}
@@ -0,0 +1,490 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashmap-kz/streamcrypt/pkg/codec"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt"
+	"github.com/hashmap-kz/streamcrypt/pkg/ioutils"
+	"github.com/hashmap-kz/streamcrypt/pkg/pipe"
+	"github.com/hashmap-kz/xrepo/pkg/storage"
+)
+
+const (
+	// dedupChunkDir holds the chunks of all the objects, as <dir>/<first two hex digits>/<sha256>
+	dedupChunkDir = "_chunks"
+
+	// dedupListExt is appended to the plain name of an object to get the name of its chunk list
+	dedupListExt = ".chunks"
+
+	defaultAvgChunkSize = 1024 * 1024
+	minAvgChunkSize     = 1024
+
+	// dedupUploadWorkers is the number of chunks uploaded concurrently, each one holds a copy of its chunk
+	dedupUploadWorkers = 4
+)
+
+type DedupOpts struct {
+	// AvgChunkSize is the target size of chunks, 1MiB by default. Chunks are between a quarter and
+	// four times of it, smaller chunks find more duplicates, at the cost of more objects in the storage
+	// (and, with encryption, of a key derivation per chunk).
+	AvgChunkSize int
+}
+
+// chunkList is stored instead of the content of an object, the content is the chunks in order
+type chunkList struct {
+	Size   int64      `json:"size"`
+	Chunks []chunkRef `json:"chunks"`
+}
+
+type chunkRef struct {
+	Hash string `json:"sha256"`
+	Size int64  `json:"size"`
+}
+
+// DedupRepo splits objects into content-defined chunks, and stores each distinct chunk once, so a repo of
+// mostly unchanged full copies grows only with the changed data.
+//
+// Chunks go through the compress/encrypt pipeline of the repo, and are named by the SHA-256 of their plain
+// content (so with encryption the names still tell whether the repo holds a known piece of data).
+// Every object is stored as the list of its chunks, which ReadObject reassembles and verifies.
+// Listings report the sizes of the lists, as stored.
+//
+// Deletes remove the lists only, chunks that are no longer referenced are removed by Prune
+// (reachable through the tracing/metrics wrappers with the package level Prune).
+type DedupRepo struct {
+	repo    *repoImpl
+	minSize int
+	avgSize int
+	maxSize int
+}
+
+var (
+	_ WriteReader = &DedupRepo{}
+	_ Pruner      = &DedupRepo{}
+)
+
+// NewDedupWriteReader creates the dedup repo, nil opts mean the defaults
+func NewDedupWriteReader(s storage.Storage, compressor codec.Compressor, crypter crypt.Crypter, o *DedupOpts) (*DedupRepo, error) {
+	avg := 0
+	if o != nil {
+		avg = o.AvgChunkSize
+	}
+	if avg == 0 {
+		avg = defaultAvgChunkSize
+	}
+	if avg < minAvgChunkSize {
+		return nil, fmt.Errorf("average chunk size %d is below %d", avg, minAvgChunkSize)
+	}
+	return &DedupRepo{
+		repo:    &repoImpl{storage: s, compressor: compressor, crypter: crypter},
+		minSize: avg / 4,
+		avgSize: avg,
+		maxSize: avg * 4,
+	}, nil
+}
+
+// encodePath returns the stored name of the chunk list of the object
+func (d *DedupRepo) encodePath(logical string) string {
+	return d.repo.encodePath(logical + dedupListExt)
+}
+
+func (d *DedupRepo) chunkPath(hash string) string {
+	return d.repo.encodePath(path.Join(dedupChunkDir, hash[:2], hash))
+}
+
+func isChunkPath(p string) bool {
+	return strings.HasPrefix(filepath.ToSlash(p), dedupChunkDir+"/")
+}
+
+func (d *DedupRepo) PutObject(ctx context.Context, path string, r io.Reader) (string, error) {
+	return d.PutObjectWithOpts(ctx, path, r, nil)
+}
+
+// PutObjectWithOpts uploads the chunks the repo does not have yet, then the chunk list.
+// Metadata and tags go to the chunk list, as chunks are shared between objects.
+func (d *DedupRepo) PutObjectWithOpts(ctx context.Context, path string, r io.Reader, opts *storage.PutObjectOpts) (string, error) {
+	ch, err := newChunker(r, d.minSize, d.avgSize, d.maxSize)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// chunks are uploaded concurrently, the chunker is not waiting for the uploads
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, dedupUploadWorkers)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	list := &chunkList{Chunks: []chunkRef{}}
+	stored := make(map[string]bool)
+	for ctx.Err() == nil {
+		data, err := ch.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			fail(fmt.Errorf("copy: %w", err))
+			break
+		}
+
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		if !stored[hash] {
+			stored[hash] = true
+			chunk := bytes.Clone(data)
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := d.putChunk(ctx, hash, chunk); err != nil {
+					fail(err)
+				}
+			}()
+		}
+		list.Chunks = append(list.Chunks, chunkRef{Hash: hash, Size: int64(len(data))})
+		list.Size += int64(len(data))
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return "", firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return "", err
+	}
+	encReader, err := pipe.CompressAndEncryptOptional(bytes.NewReader(data), d.repo.compressor, d.repo.crypter)
+	if err != nil {
+		return "", err
+	}
+	fullPath := d.encodePath(path)
+	if err := d.repo.storage.PutObjectWithOpts(ctx, fullPath, encReader, opts); err != nil {
+		return "", err
+	}
+	return fullPath, nil
+}
+
+func (d *DedupRepo) putChunk(ctx context.Context, hash string, data []byte) error {
+	chunkPath := d.chunkPath(hash)
+	exists, err := d.repo.storage.Exists(ctx, chunkPath)
+	if err != nil || exists {
+		return err
+	}
+	encReader, err := pipe.CompressAndEncryptOptional(bytes.NewReader(data), d.repo.compressor, d.repo.crypter)
+	if err != nil {
+		return err
+	}
+	return d.repo.storage.PutObject(ctx, chunkPath, encReader)
+}
+
+// readChunk fetches the whole chunk, and checks it against its hash
+func (d *DedupRepo) readChunk(ctx context.Context, ref chunkRef) ([]byte, error) {
+	rc, err := d.decode(ctx, d.chunkPath(ref.Hash))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read chunk %s: %w", ref.Hash, err)
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != ref.Size || hex.EncodeToString(sum[:]) != ref.Hash {
+		return nil, fmt.Errorf("chunk %s is corrupted", ref.Hash)
+	}
+	return data, nil
+}
+
+func (d *DedupRepo) readList(ctx context.Context, fullPath string) (*chunkList, error) {
+	rc, err := d.decode(ctx, fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var list chunkList
+	if err := json.NewDecoder(rc).Decode(&list); err != nil {
+		return nil, fmt.Errorf("cannot decode chunk list of %s: %w", fullPath, err)
+	}
+	var size int64
+	for _, ref := range list.Chunks {
+		if len(ref.Hash) != sha256.Size*2 || ref.Size <= 0 {
+			return nil, fmt.Errorf("invalid chunk list of %s", fullPath)
+		}
+		size += ref.Size
+	}
+	if size != list.Size {
+		return nil, fmt.Errorf("invalid chunk list of %s", fullPath)
+	}
+	return &list, nil
+}
+
+// decode opens the stored object through the decrypt/decompress pipeline
+func (d *DedupRepo) decode(ctx context.Context, fullPath string) (io.ReadCloser, error) {
+	obj, err := d.repo.storage.ReadObject(ctx, fullPath)
+	if err != nil {
+		return nil, err
+	}
+	var dec codec.Decompressor
+	if d.repo.compressor != nil {
+		dec = d.repo.decompressor()
+		if dec == nil {
+			obj.Close()
+			return nil, fmt.Errorf("cannot decide decompressor for: %s", d.repo.compressor.FileExtension())
+		}
+	}
+	rc, err := d.repo.decode(ctx, obj, dec)
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return ioutils.NewMultiCloser(rc, obj, rc), nil
+}
+
+// chunkReader streams the content of the chunks, skipping the first bytes of the first one
+type chunkReader struct {
+	ctx    context.Context
+	d      *DedupRepo
+	chunks []chunkRef
+	skip   int64
+	buf    []byte
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if len(cr.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := cr.d.readChunk(cr.ctx, cr.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		cr.chunks = cr.chunks[1:]
+		cr.buf = data[cr.skip:]
+		cr.skip = 0
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+func (cr *chunkReader) Close() error {
+	cr.chunks = nil
+	cr.buf = nil
+	return nil
+}
+
+func (d *DedupRepo) PutObjectPlain(ctx context.Context, path string, r io.Reader) (string, error) {
+	return d.repo.PutObjectPlain(ctx, path, r)
+}
+
+func (d *DedupRepo) ReadObject(ctx context.Context, path string) (io.ReadCloser, error) {
+	list, err := d.readList(ctx, d.encodePath(path))
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{ctx: ctx, d: d, chunks: list.Chunks}, nil
+}
+
+func (d *DedupRepo) ReadObjectRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	obj, err := d.OpenSeekable(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := obj.Seek(offset, io.SeekStart); err != nil {
+		_ = obj.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return obj, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(obj, length), Closer: obj}, nil
+}
+
+// OpenSeekable opens the object for random access, a seek costs one chunk fetch
+func (d *DedupRepo) OpenSeekable(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	list, err := d.readList(ctx, d.encodePath(path))
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]int64, len(list.Chunks))
+	var pos int64
+	for i, ref := range list.Chunks {
+		offsets[i] = pos
+		pos += ref.Size
+	}
+
+	return newSeekableObject(list.Size, func(offset int64) (io.ReadCloser, error) {
+		if offset >= list.Size {
+			return io.NopCloser(bytes.NewReader(nil)), nil
+		}
+		// the last chunk that starts at or before the offset
+		i := sort.Search(len(offsets), func(i int) bool { return offsets[i] > offset }) - 1
+		return &chunkReader{ctx: ctx, d: d, chunks: list.Chunks[i:], skip: offset - offsets[i]}, nil
+	}), nil
+}
+
+func (d *DedupRepo) Exists(ctx context.Context, path string) (bool, error) {
+	return d.repo.storage.Exists(ctx, d.encodePath(path))
+}
+
+func (d *DedupRepo) Stat(ctx context.Context, path string) (storage.ObjectInfo, error) {
+	info, err := d.repo.storage.Stat(ctx, d.encodePath(path))
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	info.Path = filepath.ToSlash(path)
+	return info, nil
+}
+
+func (d *DedupRepo) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	var result []string
+	for info, err := range d.Walk(ctx, prefix) {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info.Path)
+	}
+	return result, nil
+}
+
+func (d *DedupRepo) ListAllInfo(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	var result []storage.ObjectInfo
+	for info, err := range d.Walk(ctx, prefix) {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+func (d *DedupRepo) Walk(ctx context.Context, prefix string) iter.Seq2[storage.ObjectInfo, error] {
+	return func(yield func(storage.ObjectInfo, error) bool) {
+		for info, err := range d.repo.storage.Walk(ctx, prefix) {
+			if err != nil {
+				yield(storage.ObjectInfo{}, err)
+				return
+			}
+			// chunks are internal to the repo
+			if isChunkPath(info.Path) {
+				continue
+			}
+			info.Path = filepath.ToSlash(d.repo.decodePath(info.Path))
+			if !yield(info, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (d *DedupRepo) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	dirs, err := d.repo.storage.ListTopLevelDirs(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	delete(dirs, dedupChunkDir)
+	return dirs, nil
+}
+
+// Delete removes the chunk list of the object, its chunks may be shared, and are left for Prune
+func (d *DedupRepo) Delete(ctx context.Context, path string) error {
+	return d.repo.storage.Delete(ctx, d.encodePath(path))
+}
+
+func (d *DedupRepo) DeletePrefix(ctx context.Context, prefix string) error {
+	return d.repo.storage.DeletePrefix(ctx, prefix)
+}
+
+// Copy duplicates the chunk list only, the copy shares the chunks
+func (d *DedupRepo) Copy(ctx context.Context, src, dst string) error {
+	return d.repo.storage.Copy(ctx, d.encodePath(src), d.encodePath(dst))
+}
+
+func (d *DedupRepo) Rename(ctx context.Context, src, dst string) error {
+	return d.repo.storage.Rename(ctx, d.encodePath(src), d.encodePath(dst))
+}
+
+func (d *DedupRepo) GetCompressorName() string {
+	return d.repo.GetCompressorName()
+}
+
+func (d *DedupRepo) GetEncryptorName() string {
+	return d.repo.GetEncryptorName()
+}
+
+// Prune removes the chunks that no object refers to, and returns their number.
+// It must not run along with writes to the repo: a put reuses the chunks it finds, and they could be
+// removed before its chunk list is stored.
+func (d *DedupRepo) Prune(ctx context.Context) (int, error) {
+	referenced := make(map[string]bool)
+	listExt := d.encodePath("")
+	for info, err := range d.repo.storage.Walk(ctx, "") {
+		if err != nil {
+			return 0, err
+		}
+		if isChunkPath(info.Path) || !strings.HasSuffix(info.Path, listExt) {
+			continue
+		}
+		list, err := d.readList(ctx, info.Path)
+		if err != nil {
+			return 0, err
+		}
+		for _, ref := range list.Chunks {
+			referenced[ref.Hash] = true
+		}
+	}
+
+	removed := 0
+	for info, err := range d.repo.storage.Walk(ctx, dedupChunkDir+"/") {
+		if err != nil {
+			return removed, err
+		}
+		hash := d.repo.decodePath(path.Base(info.Path))
+		if referenced[hash] {
+			continue
+		}
+		if err := d.repo.storage.Delete(ctx, info.Path); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,259 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hashmap-kz/streamcrypt/pkg/codec"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt/aesgcm"
+	"github.com/hashmap-kz/xrepo/pkg/metrics"
+	storage2 "github.com/hashmap-kz/xrepo/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAvgChunkSize = 4096
+
+func newTestDedupRepo(t *testing.T, s storage2.Storage, compressor codec.Compressor, crypter crypt.Crypter) *DedupRepo {
+	t.Helper()
+	r, err := NewDedupWriteReader(s, compressor, crypter, &DedupOpts{AvgChunkSize: testAvgChunkSize})
+	require.NoError(t, err)
+	return r
+}
+
+func readObject(t *testing.T, r WriteReader, path string) []byte {
+	t.Helper()
+	rc, err := r.ReadObject(context.Background(), path)
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return data
+}
+
+func countChunks(t *testing.T, s storage2.Storage) int {
+	t.Helper()
+	chunks, err := s.ListAll(context.Background(), dedupChunkDir+"/")
+	require.NoError(t, err)
+	return len(chunks)
+}
+
+func TestDedupRepo_RoundTrip(t *testing.T) {
+	cases := []struct {
+		name       string
+		compressor codec.Compressor
+		crypter    crypt.Crypter
+	}{
+		{"plain", nil, nil},
+		{"gzip", &codec.GzipCompressor{}, nil},
+		{"aes", nil, aesgcm.NewChunkedGCMCrypter("dedup-key")},
+		{"zstd+aes", &codec.ZstdCompressor{}, aesgcm.NewChunkedGCMCrypter("dedup-key")},
+	}
+	contents := map[string][]byte{
+		"empty":  {},
+		"small":  []byte("small object"),
+		"chunks": randomBytes(3, 30_000),
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestDedupRepo(t, storage2.NewMemoryStorage(), tc.compressor, tc.crypter)
+			for name, content := range contents {
+				_, err := r.PutObject(context.Background(), "base/"+name, bytes.NewReader(content))
+				require.NoError(t, err)
+				assert.Equal(t, content, readObject(t, r, "base/"+name), name)
+			}
+		})
+	}
+}
+
+func TestDedupRepo_StoresChangedChunksOnly(t *testing.T) {
+	s := storage2.NewMemoryStorage()
+	r := newTestDedupRepo(t, s, &codec.GzipCompressor{}, nil)
+	ctx := context.Background()
+
+	night1 := randomBytes(4, 400_000)
+	_, err := r.PutObject(ctx, "night1/base", bytes.NewReader(night1))
+	require.NoError(t, err)
+	initial := countChunks(t, s)
+
+	// the same copy stores nothing new
+	_, err = r.PutObject(ctx, "night2/base", bytes.NewReader(night1))
+	require.NoError(t, err)
+	assert.Equal(t, initial, countChunks(t, s))
+
+	// a page changed in place stores only the chunks around it
+	night3 := bytes.Clone(night1)
+	copy(night3[250_000:], bytes.Repeat([]byte{0xab}, 8192))
+	_, err = r.PutObject(ctx, "night3/base", bytes.NewReader(night3))
+	require.NoError(t, err)
+	assert.LessOrEqual(t, countChunks(t, s)-initial, 4)
+
+	assert.Equal(t, night1, readObject(t, r, "night2/base"))
+	assert.Equal(t, night3, readObject(t, r, "night3/base"))
+}
+
+func TestDedupRepo_ListingsHideChunks(t *testing.T) {
+	s := storage2.NewMemoryStorage()
+	r := newTestDedupRepo(t, s, &codec.GzipCompressor{}, nil)
+	ctx := context.Background()
+
+	_, err := r.PutObject(ctx, "base/a", bytes.NewReader(randomBytes(5, 20_000)))
+	require.NoError(t, err)
+	_, err = r.PutObject(ctx, "obj", strings.NewReader("root object"))
+	require.NoError(t, err)
+
+	all, err := r.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"base/a", "obj"}, all)
+
+	dirs, err := r.ListTopLevelDirs(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"base": true}, dirs)
+
+	info, err := r.Stat(ctx, "base/a")
+	require.NoError(t, err)
+	assert.Equal(t, "base/a", info.Path)
+
+	exists, err := r.Exists(ctx, "base/a")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestDedupRepo_RangeAndSeek(t *testing.T) {
+	r := newTestDedupRepo(t, storage2.NewMemoryStorage(), &codec.GzipCompressor{}, nil)
+	ctx := context.Background()
+	content := randomBytes(6, 100_000)
+	_, err := r.PutObject(ctx, "base/obj", bytes.NewReader(content))
+	require.NoError(t, err)
+
+	for _, rng := range [][2]int64{{0, 10}, {4095, 5000}, {50_000, -1}, {99_990, 100}, {100_000, 10}} {
+		rc, err := r.ReadObjectRange(ctx, "base/obj", rng[0], rng[1])
+		require.NoError(t, err)
+		data, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+
+		end := int64(len(content))
+		if rng[1] >= 0 {
+			end = min(end, rng[0]+rng[1])
+		}
+		assert.Equal(t, content[min(rng[0], end):end], data, "range %v", rng)
+	}
+
+	obj, err := r.OpenSeekable(ctx, "base/obj")
+	require.NoError(t, err)
+	defer obj.Close()
+	size, err := obj.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	_, err = obj.Seek(-100, io.SeekEnd)
+	require.NoError(t, err)
+	tail, err := io.ReadAll(obj)
+	require.NoError(t, err)
+	assert.Equal(t, content[len(content)-100:], tail)
+}
+
+func TestDedupRepo_DetectsCorruptedChunks(t *testing.T) {
+	store := storage2.NewFaultStorage(storage2.NewMemoryStorage(), 1)
+	r := newTestDedupRepo(t, store, nil, nil)
+	ctx := context.Background()
+	_, err := r.PutObject(ctx, "base/obj", bytes.NewReader(randomBytes(7, 50_000)))
+	require.NoError(t, err)
+
+	store.Inject(storage2.Fault{Kind: storage2.FaultCorrupt, Ops: []string{"read"}, Path: dedupChunkDir + "/*/*", Offset: 10, Times: 1})
+	rc, err := r.ReadObject(ctx, "base/obj")
+	require.NoError(t, err)
+	defer rc.Close()
+	_, err = io.ReadAll(rc)
+	assert.ErrorContains(t, err, "corrupted")
+}
+
+func TestDedupRepo_CopyRenameDeleteAndPrune(t *testing.T) {
+	s := storage2.NewMemoryStorage()
+	r := newTestDedupRepo(t, s, &codec.GzipCompressor{}, nil)
+	ctx := context.Background()
+
+	shared := randomBytes(8, 60_000)
+	_, err := r.PutObject(ctx, "night1/base", bytes.NewReader(shared))
+	require.NoError(t, err)
+	_, err = r.PutObject(ctx, "night2/base", bytes.NewReader(append(bytes.Clone(shared), randomBytes(9, 60_000)...)))
+	require.NoError(t, err)
+
+	require.NoError(t, r.Copy(ctx, "night1/base", "copy/base"))
+	require.NoError(t, r.Rename(ctx, "copy/base", "renamed/base"))
+	assert.Equal(t, shared, readObject(t, r, "renamed/base"))
+
+	// nothing is unreferenced yet
+	removed, err := r.Prune(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	// the chunks of night2 that night1 does not share go away
+	before := countChunks(t, s)
+	require.NoError(t, r.Delete(ctx, "night2/base"))
+	removed, err = r.Prune(ctx)
+	require.NoError(t, err)
+	assert.Positive(t, removed)
+	assert.Equal(t, before-removed, countChunks(t, s))
+	assert.Equal(t, shared, readObject(t, r, "night1/base"))
+
+	require.NoError(t, r.Delete(ctx, "night1/base"))
+	require.NoError(t, r.Delete(ctx, "renamed/base"))
+	_, err = r.Prune(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, countChunks(t, s))
+}
+
+func TestDedupRepo_InvalidChunkSize(t *testing.T) {
+	_, err := NewDedupWriteReader(storage2.NewMemoryStorage(), nil, nil, &DedupOpts{AvgChunkSize: 100})
+	assert.Error(t, err)
+}
+
+func TestDedupRepo_NilOptsAreDefaults(t *testing.T) {
+	r, err := NewDedupWriteReader(storage2.NewMemoryStorage(), nil, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, defaultAvgChunkSize, r.avgSize)
+}
+
+func TestDedupRepo_PruneThroughWrappers(t *testing.T) {
+	m, err := metrics.New(prometheus.NewRegistry())
+	require.NoError(t, err)
+	s := storage2.NewMemoryStorage()
+	r := NewMetricsWriteReader(NewTracingWriteReader(newTestDedupRepo(t, s, nil, nil), nil), m)
+	ctx := context.Background()
+
+	_, err = r.PutObject(ctx, "base/obj", bytes.NewReader(randomBytes(11, 50_000)))
+	require.NoError(t, err)
+	require.NoError(t, r.Delete(ctx, "base/obj"))
+	require.Positive(t, countChunks(t, s))
+
+	removed, err := Prune(ctx, r)
+	require.NoError(t, err)
+	assert.Positive(t, removed)
+	assert.Equal(t, 0, countChunks(t, s))
+
+	// repos without shared data have nothing to prune
+	removed, err = Prune(ctx, NewTracingWriteReader(NewWriteReader(s, nil, nil), nil))
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+func TestDedupRepo_FailedChunkUploadFailsPut(t *testing.T) {
+	store := storage2.NewFaultStorage(storage2.NewMemoryStorage(), 1,
+		storage2.Fault{Kind: storage2.FaultError, Ops: []string{"put"}, Path: dedupChunkDir + "/*/*", Times: 1})
+	r := newTestDedupRepo(t, store, nil, nil)
+	ctx := context.Background()
+
+	_, err := r.PutObject(ctx, "base/obj", bytes.NewReader(randomBytes(10, 50_000)))
+	require.ErrorIs(t, err, storage2.ErrInjectedFault)
+
+	exists, err := r.Exists(ctx, "base/obj")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
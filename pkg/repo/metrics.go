@@ -0,0 +1,192 @@
+package repo
+
+import (
+	"context"
+	"io"
+	"iter"
+	"time"
+
+	"github.com/hashmap-kz/xrepo/pkg/metrics"
+	"github.com/hashmap-kz/xrepo/pkg/storage"
+)
+
+type metricsRepo struct {
+	r WriteReader
+	m *metrics.Metrics
+}
+
+var (
+	_ WriteReader = &metricsRepo{}
+	_ Pruner      = &metricsRepo{}
+)
+
+// NewMetricsWriteReader records counts, errors, latencies and transferred bytes of the repo operations.
+// Bytes are the plain ones, before compression and encryption, so that together with the metrics
+// of the storage they show the compression ratio.
+func NewMetricsWriteReader(r WriteReader, m *metrics.Metrics) WriteReader {
+	return &metricsRepo{r: r, m: m}
+}
+
+func (mr *metricsRepo) observe(op string, start time.Time, err error) {
+	mr.m.Observe(metrics.LayerRepo, op, start, err)
+}
+
+func (mr *metricsRepo) PutObject(ctx context.Context, path string, r io.Reader) (string, error) {
+	return mr.PutObjectWithOpts(ctx, path, r, nil)
+}
+
+func (mr *metricsRepo) PutObjectWithOpts(ctx context.Context, path string, r io.Reader, opts *storage.PutObjectOpts) (string, error) {
+	start := time.Now()
+	cr := metrics.NewCountingReader(mr.m, metrics.LayerRepo, metrics.DirectionIn, r)
+	fullPath, err := mr.r.PutObjectWithOpts(ctx, path, cr, opts)
+	mr.observe("put_object", start, err)
+	return fullPath, err
+}
+
+func (mr *metricsRepo) PutObjectPlain(ctx context.Context, path string, r io.Reader) (string, error) {
+	start := time.Now()
+	cr := metrics.NewCountingReader(mr.m, metrics.LayerRepo, metrics.DirectionIn, r)
+	fullPath, err := mr.r.PutObjectPlain(ctx, path, cr)
+	mr.observe("put_object_plain", start, err)
+	return fullPath, err
+}
+
+func (mr *metricsRepo) ReadObject(ctx context.Context, path string) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := mr.r.ReadObject(ctx, path)
+	mr.observe("read_object", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return metrics.NewCountingReadCloser(mr.m, metrics.LayerRepo, "read_object", rc), nil
+}
+
+func (mr *metricsRepo) ReadObjectRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := mr.r.ReadObjectRange(ctx, path, offset, length)
+	mr.observe("read_object_range", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return metrics.NewCountingReadCloser(mr.m, metrics.LayerRepo, "read_object_range", rc), nil
+}
+
+// countingReadSeekCloser keeps the object seekable, while counting what is read from it
+type countingReadSeekCloser struct {
+	*metrics.CountingReadCloser
+	s io.Seeker
+}
+
+func (c *countingReadSeekCloser) Seek(offset int64, whence int) (int64, error) {
+	return c.s.Seek(offset, whence)
+}
+
+func (mr *metricsRepo) OpenSeekable(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	start := time.Now()
+	rsc, err := mr.r.OpenSeekable(ctx, path)
+	mr.observe("open_seekable", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReadSeekCloser{
+		CountingReadCloser: metrics.NewCountingReadCloser(mr.m, metrics.LayerRepo, "open_seekable", rsc),
+		s:                  rsc,
+	}, nil
+}
+
+func (mr *metricsRepo) Exists(ctx context.Context, path string) (bool, error) {
+	start := time.Now()
+	exists, err := mr.r.Exists(ctx, path)
+	mr.observe("exists", start, err)
+	return exists, err
+}
+
+func (mr *metricsRepo) Stat(ctx context.Context, path string) (storage.ObjectInfo, error) {
+	start := time.Now()
+	info, err := mr.r.Stat(ctx, path)
+	mr.observe("stat", start, err)
+	return info, err
+}
+
+func (mr *metricsRepo) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	start := time.Now()
+	files, err := mr.r.ListAll(ctx, prefix)
+	mr.observe("list_all", start, err)
+	return files, err
+}
+
+func (mr *metricsRepo) ListAllInfo(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	start := time.Now()
+	infos, err := mr.r.ListAllInfo(ctx, prefix)
+	mr.observe("list_all_info", start, err)
+	return infos, err
+}
+
+// Walk is measured until the listing is exhausted, or the consumer stops
+func (mr *metricsRepo) Walk(ctx context.Context, prefix string) iter.Seq2[storage.ObjectInfo, error] {
+	return func(yield func(storage.ObjectInfo, error) bool) {
+		start := time.Now()
+		var walkErr error
+		defer func() {
+			mr.observe("walk", start, walkErr)
+		}()
+		for info, err := range mr.r.Walk(ctx, prefix) {
+			if err != nil {
+				walkErr = err
+			}
+			if !yield(info, err) {
+				return
+			}
+		}
+	}
+}
+
+func (mr *metricsRepo) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	start := time.Now()
+	dirs, err := mr.r.ListTopLevelDirs(ctx, prefix)
+	mr.observe("list_top_level_dirs", start, err)
+	return dirs, err
+}
+
+func (mr *metricsRepo) Delete(ctx context.Context, path string) error {
+	start := time.Now()
+	err := mr.r.Delete(ctx, path)
+	mr.observe("delete", start, err)
+	return err
+}
+
+func (mr *metricsRepo) DeletePrefix(ctx context.Context, prefix string) error {
+	start := time.Now()
+	err := mr.r.DeletePrefix(ctx, prefix)
+	mr.observe("delete_prefix", start, err)
+	return err
+}
+
+func (mr *metricsRepo) Copy(ctx context.Context, src, dst string) error {
+	start := time.Now()
+	err := mr.r.Copy(ctx, src, dst)
+	mr.observe("copy", start, err)
+	return err
+}
+
+func (mr *metricsRepo) Rename(ctx context.Context, src, dst string) error {
+	start := time.Now()
+	err := mr.r.Rename(ctx, src, dst)
+	mr.observe("rename", start, err)
+	return err
+}
+
+func (mr *metricsRepo) Prune(ctx context.Context) (int, error) {
+	start := time.Now()
+	removed, err := Prune(ctx, mr.r)
+	mr.observe("prune", start, err)
+	return removed, err
+}
+
+func (mr *metricsRepo) GetCompressorName() string {
+	return mr.r.GetCompressorName()
+}
+
+func (mr *metricsRepo) GetEncryptorName() string {
+	return mr.r.GetEncryptorName()
+}
@@ -0,0 +1,74 @@
+package repo
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hashmap-kz/streamcrypt/pkg/codec"
+	"github.com/hashmap-kz/xrepo/pkg/metrics"
+	storage2 "github.com/hashmap-kz/xrepo/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bytesTotal finds xrepo_bytes_total of the layer and direction
+func bytesTotal(t *testing.T, reg *prometheus.Registry, layer, direction string) float64 {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != "xrepo_bytes_total" {
+			continue
+		}
+		for _, metric := range f.GetMetric() {
+			if hasLabels(metric, map[string]string{"layer": layer, "direction": direction}) {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func hasLabels(metric *dto.Metric, labels map[string]string) bool {
+	matched := 0
+	for _, l := range metric.GetLabel() {
+		if labels[l.GetName()] == l.GetValue() {
+			matched++
+		}
+	}
+	return matched == len(labels)
+}
+
+func TestMetricsWriteReader_CompressionRatio(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := metrics.New(reg)
+	require.NoError(t, err)
+
+	store := storage2.NewMetricsStorage(storage2.NewMemoryStorage(), m)
+	r := NewMetricsWriteReader(NewWriteReader(store, &codec.GzipCompressor{}, nil), m)
+	ctx := context.Background()
+
+	content := strings.Repeat("compressible ", 1000)
+	_, err = r.PutObject(ctx, "a/obj", strings.NewReader(content))
+	require.NoError(t, err)
+
+	rc, err := r.ReadObject(ctx, "a/obj")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(content), readAllAndClose(t, rc))
+
+	rs, err := r.OpenSeekable(ctx, "a/obj")
+	require.NoError(t, err)
+	_, err = rs.Seek(int64(len(content)-13), io.SeekStart)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("compressible "), readAllAndClose(t, rs))
+
+	assert.InDelta(t, len(content), bytesTotal(t, reg, metrics.LayerRepo, metrics.DirectionIn), 0)
+	assert.InDelta(t, len(content)+13, bytesTotal(t, reg, metrics.LayerRepo, metrics.DirectionOut), 0)
+
+	stored := bytesTotal(t, reg, metrics.LayerStorage, metrics.DirectionIn)
+	assert.Positive(t, stored)
+	assert.Less(t, stored, float64(len(content))/10)
+}
@@ -0,0 +1,257 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt/aesgcm"
+)
+
+// Layout of the stream written by aesgcm.ChunkedGCMCrypter:
+//
+//	"AEADv1" | salt | { nonce | sealed chunk of up to 64KiB plaintext + tag }...
+//
+// Every chunk is sealed independently, so a plaintext range maps onto a ciphertext range,
+// and only the chunks covering it have to be fetched and decrypted.
+// streamcrypt does not export the layout, it is checked against the crypter by checkGCMLayout before use.
+const (
+	gcmHeaderPrefix    = "AEADv1"
+	gcmSaltSize        = 16
+	gcmNonceSize       = 12
+	gcmTagSize         = 16
+	gcmChunkSize       = 64 * 1024
+	gcmHeaderSize      = int64(len(gcmHeaderPrefix) + gcmSaltSize)
+	gcmSealedChunkSize = int64(gcmNonceSize + gcmChunkSize + gcmTagSize)
+)
+
+var (
+	errGCMTampered = errors.New("decryption failed: tampering or corruption detected")
+
+	gcmLayoutOnce sync.Once
+	gcmLayoutErr  error
+)
+
+// checkGCMLayout encrypts a sample with the crypter once per process, and fails when the stream
+// does not have the layout above, i.e. after an incompatible upgrade of streamcrypt
+func checkGCMLayout(crypter *aesgcm.ChunkedGCMCrypter) error {
+	gcmLayoutOnce.Do(func() {
+		gcmLayoutErr = verifyGCMLayout(crypter, crypter.Password)
+	})
+	return gcmLayoutErr
+}
+
+func verifyGCMLayout(crypter crypt.Crypter, password string) error {
+	// two chunks, the second one is partial
+	plain := bytes.Repeat([]byte("layout"), (gcmChunkSize+100)/len("layout"))
+
+	var stored bytes.Buffer
+	w, err := crypter.Encrypt(&stored)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(plain); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	fail := func(reason string) error {
+		return fmt.Errorf("unsupported %s stream layout, ranged reads are not possible: %s", crypter.Name(), reason)
+	}
+	data := stored.Bytes()
+	if !bytes.HasPrefix(data, []byte(gcmHeaderPrefix)) {
+		return fail("unexpected header")
+	}
+	if int64(len(data)) != gcmHeaderSize+int64(len(plain))+2*(gcmNonceSize+gcmTagSize) {
+		return fail("unexpected chunk overhead")
+	}
+
+	aead, err := newGCMAEAD(password, data[len(gcmHeaderPrefix):gcmHeaderSize])
+	if err != nil {
+		return err
+	}
+	g := &gcmRangeReader{
+		aead:      aead,
+		body:      io.NopCloser(bytes.NewReader(data[gcmHeaderSize+gcmSealedChunkSize:])),
+		chunkNum:  1,
+		remaining: -1,
+	}
+	tail, err := io.ReadAll(g)
+	if err != nil || !bytes.Equal(tail, plain[gcmChunkSize:]) {
+		return fail("chunks cannot be decrypted independently")
+	}
+	return nil
+}
+
+// gcmObject gives random access to the plaintext of a chunked AES-GCM object,
+// the header is read and the key derived once, on the first range
+type gcmObject struct {
+	repo     *repoImpl
+	crypter  *aesgcm.ChunkedGCMCrypter
+	fullPath string
+	aead     cipher.AEAD
+}
+
+func (repo *repoImpl) openGCMObject(crypter *aesgcm.ChunkedGCMCrypter, fullPath string) (*gcmObject, error) {
+	if err := checkGCMLayout(crypter); err != nil {
+		return nil, err
+	}
+	return &gcmObject{repo: repo, crypter: crypter, fullPath: fullPath}, nil
+}
+
+// readRange decrypts only the chunks that cover the requested plaintext range
+func (o *gcmObject) readRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if o.aead == nil {
+		aead, err := o.openHeader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		o.aead = aead
+	}
+
+	first := offset / gcmChunkSize
+	cipherLength := int64(-1)
+	if length >= 0 {
+		last := (offset + length - 1) / gcmChunkSize
+		cipherLength = (last - first + 1) * gcmSealedChunkSize
+	}
+
+	body, err := o.repo.storage.ReadObjectRange(ctx, o.fullPath, gcmHeaderSize+first*gcmSealedChunkSize, cipherLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcmRangeReader{
+		aead:      o.aead,
+		body:      body,
+		chunkNum:  uint64(first), //nolint:gosec
+		skip:      offset % gcmChunkSize,
+		remaining: length,
+	}, nil
+}
+
+// openHeader reads the salt and derives the key of the object
+func (o *gcmObject) openHeader(ctx context.Context) (cipher.AEAD, error) {
+	rc, err := o.repo.storage.ReadObjectRange(ctx, o.fullPath, 0, gcmHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	header := make([]byte, gcmHeaderSize)
+	if _, err := io.ReadFull(rc, header); err != nil {
+		return nil, fmt.Errorf("cannot read header: %w", err)
+	}
+	if string(header[:len(gcmHeaderPrefix)]) != gcmHeaderPrefix {
+		return nil, errors.New("invalid file header")
+	}
+	return newGCMAEAD(o.crypter.Password, header[len(gcmHeaderPrefix):])
+}
+
+func newGCMAEAD(password string, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(aesgcm.GeneratePBEKey(password, salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type gcmRangeReader struct {
+	aead      cipher.AEAD
+	body      io.ReadCloser
+	chunkNum  uint64
+	skip      int64 // bytes to drop from the first decrypted chunk
+	remaining int64 // negative when reading up to the end
+	buf       []byte
+}
+
+func (g *gcmRangeReader) Read(p []byte) (int, error) {
+	if g.remaining == 0 {
+		return 0, io.EOF
+	}
+	for len(g.buf) == 0 {
+		if err := g.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	if g.remaining > 0 && int64(len(p)) > g.remaining {
+		p = p[:g.remaining]
+	}
+	n := copy(p, g.buf)
+	g.buf = g.buf[n:]
+	if g.remaining > 0 {
+		g.remaining -= int64(n)
+	}
+	return n, nil
+}
+
+func (g *gcmRangeReader) nextChunk() error {
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := io.ReadFull(g.body, nonce); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.EOF
+		}
+		return errGCMTampered
+	}
+	// chunks are numbered by the writer, a mismatch means chunks were reordered or cut
+	if binary.BigEndian.Uint64(nonce[4:]) != g.chunkNum {
+		return errGCMTampered
+	}
+
+	ciphertext := make([]byte, gcmChunkSize+gcmTagSize)
+	n, err := io.ReadFull(g.body, ciphertext)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			return errGCMTampered
+		}
+		return err
+	}
+
+	plaintext, err := g.aead.Open(nil, nonce, ciphertext[:n], nil)
+	if err != nil {
+		return errGCMTampered
+	}
+	g.chunkNum++
+
+	if g.skip > 0 {
+		if g.skip >= int64(len(plaintext)) {
+			// the range starts past the end of the object
+			return io.EOF
+		}
+		plaintext = plaintext[g.skip:]
+		g.skip = 0
+	}
+	g.buf = plaintext
+	return nil
+}
+
+func (g *gcmRangeReader) Close() error {
+	return g.body.Close()
+}
+
+// discardRange skips to the offset of a stream that can only be read sequentially
+func discardRange(rc io.ReadCloser, offset, length int64) (io.ReadCloser, error) {
+	if _, err := io.CopyN(io.Discard, rc, offset); err != nil && !errors.Is(err, io.EOF) {
+		_ = rc.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return rc, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(rc, length), Closer: rc}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,166 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	storage2 "github.com/hashmap-kz/xrepo/pkg/storage"
+
+	"github.com/hashmap-kz/streamcrypt/pkg/codec"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt/aesgcm"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepo_ReadObjectRange(t *testing.T) {
+	content := make([]byte, 3*gcmChunkSize+1234)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	size := int64(len(content))
+	ranges := []struct {
+		name           string
+		offset, length int64
+	}{
+		{"head", 0, 100},
+		{"within first chunk", 10, 1000},
+		{"crossing chunk boundary", gcmChunkSize - 10, 20},
+		{"several chunks", 100, 2*gcmChunkSize + 500},
+		{"tail to the end", size - 300, -1},
+		{"whole object", 0, -1},
+		{"past the end", size + 10, 100},
+		{"longer than object", size - 5, 100},
+		{"empty", 42, 0},
+	}
+
+	repos := []struct {
+		name       string
+		compressor codec.Compressor
+		crypter    crypt.Crypter
+	}{
+		{"plain", nil, nil},
+		{"aes", nil, aesgcm.NewChunkedGCMCrypter("range-key")},
+		{"gzip", &codec.GzipCompressor{}, nil},
+		{"gzip+aes", &codec.GzipCompressor{}, aesgcm.NewChunkedGCMCrypter("range-key")},
+	}
+
+	for _, rr := range repos {
+		t.Run(rr.name, func(t *testing.T) {
+			store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: t.TempDir()})
+			require.NoError(t, err)
+
+			r := NewWriteReader(store, rr.compressor, rr.crypter)
+			_, err = r.PutObject(context.Background(), "rel/16384", bytes.NewReader(content))
+			require.NoError(t, err)
+
+			for _, tt := range ranges {
+				t.Run(tt.name, func(t *testing.T) {
+					end := size
+					if tt.length >= 0 {
+						end = min(tt.offset+tt.length, size)
+					}
+					start := min(tt.offset, size)
+
+					rc, err := r.ReadObjectRange(context.Background(), "rel/16384", tt.offset, tt.length)
+					require.NoError(t, err)
+					assert.Equal(t, content[start:end], readAllAndClose(t, rc))
+				})
+			}
+		})
+	}
+}
+
+func TestRepo_ReadObjectRange_DetectsTampering(t *testing.T) {
+	tmp := t.TempDir()
+	store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: tmp})
+	require.NoError(t, err)
+
+	r := NewWriteReader(store, nil, aesgcm.NewChunkedGCMCrypter("tamper-key"))
+
+	content := bytes.Repeat([]byte("x"), 3*gcmChunkSize)
+	finalPath, err := r.PutObject(context.Background(), "obj", bytes.NewReader(content))
+	require.NoError(t, err)
+
+	// flip a byte inside of the second chunk
+	stored, err := os.ReadFile(filepath.Join(tmp, finalPath))
+	require.NoError(t, err)
+	stored[gcmHeaderSize+gcmSealedChunkSize+gcmNonceSize+10] ^= 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(tmp, finalPath), stored, 0o600))
+
+	// untouched chunks are still readable
+	rc, err := r.ReadObjectRange(context.Background(), "obj", 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, content[:100], readAllAndClose(t, rc))
+
+	rc, err = r.ReadObjectRange(context.Background(), "obj", gcmChunkSize+5, 10)
+	require.NoError(t, err)
+	_, err = io.ReadAll(rc)
+	assert.ErrorContains(t, err, "tampering")
+	assert.NoError(t, rc.Close())
+}
+
+// headerCountingStorage counts the reads of the AES-GCM header
+type headerCountingStorage struct {
+	storage2.Storage
+	headerReads int
+}
+
+func (s *headerCountingStorage) ReadObjectRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	if offset == 0 && length == gcmHeaderSize {
+		s.headerReads++
+	}
+	return s.Storage.ReadObjectRange(ctx, path, offset, length)
+}
+
+func TestRepo_OpenSeekable_DerivesKeyOnce(t *testing.T) {
+	store := &headerCountingStorage{Storage: storage2.NewMemoryStorage()}
+	r := NewWriteReader(store, nil, aesgcm.NewChunkedGCMCrypter("once-key"))
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("0123456789"), gcmChunkSize)
+	_, err := r.PutObject(ctx, "obj", bytes.NewReader(content))
+	require.NoError(t, err)
+
+	obj, err := r.OpenSeekable(ctx, "obj")
+	require.NoError(t, err)
+	defer obj.Close()
+
+	for _, pos := range []int64{5 * gcmChunkSize, 10, 8*gcmChunkSize + 3, 0} {
+		_, err := obj.Seek(pos, io.SeekStart)
+		require.NoError(t, err)
+		buf := make([]byte, 16)
+		_, err = io.ReadFull(obj, buf)
+		require.NoError(t, err)
+		assert.Equal(t, content[pos:pos+16], buf)
+	}
+	assert.Equal(t, 1, store.headerReads)
+}
+
+// plainCrypter writes the stream as is
+type plainCrypter struct{}
+
+func (plainCrypter) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	return &nopWriteCloser{Writer: w}, nil
+}
+
+func (plainCrypter) Decrypt(r io.Reader) (io.Reader, error) { return r, nil }
+func (plainCrypter) FileExtension() string                  { return ".plain" }
+func (plainCrypter) Name() string                           { return "plain" }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (*nopWriteCloser) Close() error { return nil }
+
+func TestVerifyGCMLayout(t *testing.T) {
+	assert.NoError(t, verifyGCMLayout(aesgcm.NewChunkedGCMCrypter("layout-key"), "layout-key"))
+	assert.ErrorContains(t, verifyGCMLayout(plainCrypter{}, "layout-key"), "unsupported plain stream layout")
+}
@@ -2,8 +2,11 @@ package repo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"iter"
 	"path/filepath"
 	"strings"
 
@@ -13,48 +16,124 @@ import (
 
 	"github.com/hashmap-kz/streamcrypt/pkg/codec"
 	"github.com/hashmap-kz/streamcrypt/pkg/crypt"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt/aesgcm"
 )
 
 type WriteReader interface {
 	// PutObject writes file to storage (through compress/encrypt pipes), returns final name (with optional extensions: *.gz, *.gz.aes)
 	PutObject(ctx context.Context, path string, r io.Reader) (string, error)
 
+	// PutObjectWithOpts works like PutObject, and attaches metadata and tags to the stored object
+	PutObjectWithOpts(ctx context.Context, path string, r io.Reader, opts *storage.PutObjectOpts) (string, error)
+
 	// PutObjectPlain saves object without applying compression/encryption (i.e: manifest writing for debug, etc...)
 	PutObjectPlain(ctx context.Context, path string, r io.Reader) (string, error)
 
 	ReadObject(ctx context.Context, path string) (io.ReadCloser, error)
 
+	// ReadObjectRange streams length bytes of the plain content starting at offset, a negative length reads up to the end.
+	// Plain objects are read with a storage range, encrypted-only objects fetch and decrypt only the covering chunks.
+	ReadObjectRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error)
+
+	// OpenSeekable opens an object for random access, compressed objects are addressed through the frame index
+	OpenSeekable(ctx context.Context, path string) (io.ReadSeekCloser, error)
+
 	Exists(ctx context.Context, path string) (bool, error)
 
+	// Stat returns metadata of the stored object, Path is reported with the plain (decoded) name
+	Stat(ctx context.Context, path string) (storage.ObjectInfo, error)
+
 	ListAll(ctx context.Context, prefix string) ([]string, error)
 
+	// ListAllInfo works like ListAll, but returns object metadata with plain (decoded) names
+	ListAllInfo(ctx context.Context, prefix string) ([]storage.ObjectInfo, error)
+
+	// Walk streams object metadata with plain (decoded) names, stops early when the consumer breaks
+	Walk(ctx context.Context, prefix string) iter.Seq2[storage.ObjectInfo, error]
+
 	ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error)
 
+	// Delete removes an object by its plain name (the stored name is resolved with optional extensions: *.gz, *.gz.aes)
+	Delete(ctx context.Context, path string) error
+
+	// DeletePrefix removes all objects under the given prefix
+	DeletePrefix(ctx context.Context, prefix string) error
+
+	// Copy duplicates an object by its plain name, using server-side copy where the storage allows it
+	Copy(ctx context.Context, src, dst string) error
+
+	// Rename moves an object by its plain name, i.e. from incoming/ to base/ without reading it back
+	Rename(ctx context.Context, src, dst string) error
+
 	GetCompressorName() string
 
 	GetEncryptorName() string
 }
 
+// Pruner is implemented by repos that share stored data between objects (i.e. chunks of DedupRepo),
+// such data outlives the objects that are deleted, until it's pruned
+type Pruner interface {
+	// Prune removes the stored data no object refers to, and returns the number of removed objects
+	Prune(ctx context.Context) (int, error)
+}
+
+// Prune removes the data no object of the repo refers to anymore, through the tracing/metrics wrappers too.
+// Repos that share no data between objects have nothing to prune.
+func Prune(ctx context.Context, r WriteReader) (int, error) {
+	if p, ok := r.(Pruner); ok {
+		return p.Prune(ctx)
+	}
+	return 0, nil
+}
+
 type repoImpl struct {
 	storage    storage.Storage  // required: e.g. LocalImpl()
 	compressor codec.Compressor // optional
 	crypter    crypt.Crypter    // optional
+	seekable   bool
 }
 
 var _ WriteReader = &repoImpl{}
 
+type WriteReaderOpts struct {
+	// Seekable makes compressed objects addressable by ReadObjectRange/OpenSeekable without decoding from the start:
+	// each MiB of content is compressed as an independent frame, and a frame index is stored next to the object.
+	// It costs one more upload per object, and compresses slightly worse. Disabled by default.
+	Seekable bool
+}
+
 func NewWriteReader(s storage.Storage, compressor codec.Compressor, crypter crypt.Crypter) WriteReader {
+	return NewWriteReaderWithOpts(s, compressor, crypter, nil)
+}
+
+func NewWriteReaderWithOpts(s storage.Storage, compressor codec.Compressor, crypter crypt.Crypter, opts *WriteReaderOpts) WriteReader {
+	if opts == nil {
+		opts = &WriteReaderOpts{}
+	}
 	return &repoImpl{
 		storage:    s,
 		compressor: compressor,
 		crypter:    crypter,
+		seekable:   opts.Seekable,
 	}
 }
 
 func (repo *repoImpl) PutObject(ctx context.Context, path string, r io.Reader) (string, error) {
+	return repo.PutObjectWithOpts(ctx, path, r, nil)
+}
+
+func (repo *repoImpl) PutObjectWithOpts(ctx context.Context, path string, r io.Reader, opts *storage.PutObjectOpts) (string, error) {
 	var err error
 	fullPath := repo.encodePath(path)
 
+	// Compressed objects of seekable repos are written as independent frames with an index
+	if repo.seekable && repo.compressor != nil {
+		if err := repo.putFramed(ctx, fullPath, r, opts); err != nil {
+			return "", err
+		}
+		return fullPath, nil
+	}
+
 	// Compress and encrypt
 	encReader, err := pipe.CompressAndEncryptOptional(r, repo.compressor, repo.crypter)
 	if err != nil {
@@ -62,7 +141,7 @@ func (repo *repoImpl) PutObject(ctx context.Context, path string, r io.Reader) (
 	}
 
 	// Store in repo
-	err = repo.storage.PutObject(ctx, fullPath, encReader)
+	err = repo.storage.PutObjectWithOpts(ctx, fullPath, encReader, opts)
 	if err != nil {
 		return "", err
 	}
@@ -95,14 +174,14 @@ func (repo *repoImpl) ReadObject(ctx context.Context, path string) (io.ReadClose
 
 	var dec codec.Decompressor
 	if repo.compressor != nil {
-		dec = codec.GetDecompressor(repo.compressor)
+		dec = repo.decompressor()
 		if dec == nil {
 			obj.Close()
 			return nil, fmt.Errorf("cannot decide decompressor for: %s", repo.compressor.FileExtension())
 		}
 	}
 
-	readCloser, err := pipe.DecryptAndDecompressOptional(obj, repo.crypter, dec)
+	readCloser, err := repo.decode(ctx, obj, dec)
 	if err != nil {
 		obj.Close()
 		return nil, err
@@ -111,38 +190,183 @@ func (repo *repoImpl) ReadObject(ctx context.Context, path string) (io.ReadClose
 	return ioutils.NewMultiCloser(readCloser, obj, readCloser), nil
 }
 
+func (repo *repoImpl) ReadObjectRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	fullPath := repo.encodePath(path)
+
+	if repo.compressor == nil {
+		if repo.crypter == nil {
+			return repo.storage.ReadObjectRange(ctx, fullPath, offset, length)
+		}
+		if gcm, ok := repo.crypter.(*aesgcm.ChunkedGCMCrypter); ok {
+			obj, err := repo.openGCMObject(gcm, fullPath)
+			if err != nil {
+				return nil, err
+			}
+			return obj.readRange(ctx, offset, length)
+		}
+	}
+
+	// compressed objects are addressed through the frame index
+	obj, err := repo.OpenSeekable(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := obj.Seek(offset, io.SeekStart); err != nil {
+		_ = obj.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return obj, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(obj, length), Closer: obj}, nil
+}
+
 func (repo *repoImpl) Exists(ctx context.Context, path string) (bool, error) {
 	fullPath := repo.encodePath(path)
 	return repo.storage.Exists(ctx, fullPath)
 }
 
 func (repo *repoImpl) ListAll(ctx context.Context, prefix string) ([]string, error) {
-	// objects in storage are saved with optional extensions: *.gz, *.gz.aes, etc...
-	// but repo is working ONLY with plain names, and handles compression/encryption
-	// so: we need to trim extensions and return a clean list of names
-	storageObjects, err := repo.storage.ListAll(ctx, prefix)
+	var result []string
+	for info, err := range repo.Walk(ctx, prefix) {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info.Path)
+	}
+	return result, nil
+}
+
+func (repo *repoImpl) Stat(ctx context.Context, path string) (storage.ObjectInfo, error) {
+	fullPath := repo.encodePath(path)
+	info, err := repo.storage.Stat(ctx, fullPath)
 	if err != nil {
-		return nil, err
+		return storage.ObjectInfo{}, err
 	}
+	info.Path = filepath.ToSlash(path)
+	return info, nil
+}
 
-	// no compression, no encryption, return as is
-	if repo.compressor == nil && repo.crypter == nil {
-		return storageObjects, nil
+func (repo *repoImpl) ListAllInfo(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	var result []storage.ObjectInfo
+	for info, err := range repo.Walk(ctx, prefix) {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
 	}
+	return result, nil
+}
 
-	// trim all possible extensions
-	filtered := make([]string, 0, len(storageObjects))
-	for _, elem := range storageObjects {
-		cleaned := repo.decodePath(elem)
-		filtered = append(filtered, filepath.ToSlash(cleaned))
+func (repo *repoImpl) Walk(ctx context.Context, prefix string) iter.Seq2[storage.ObjectInfo, error] {
+	return func(yield func(storage.ObjectInfo, error) bool) {
+		for info, err := range repo.storage.Walk(ctx, prefix) {
+			if err != nil {
+				yield(storage.ObjectInfo{}, err)
+				return
+			}
+
+			// frame indexes are internal to the repo
+			if repo.compressor != nil && strings.HasSuffix(info.Path, repo.encodePath("")+seekIndexExt) {
+				continue
+			}
+
+			// objects in storage are saved with optional extensions: *.gz, *.gz.aes, etc...
+			// but repo is working ONLY with plain names, and handles compression/encryption
+			// so: we need to trim extensions, sizes are reported as stored (i.e. compressed/encrypted)
+			if repo.compressor != nil || repo.crypter != nil {
+				info.Path = filepath.ToSlash(repo.decodePath(info.Path))
+			}
+			if !yield(info, nil) {
+				return
+			}
+		}
 	}
-	return filtered, nil
 }
 
 func (repo *repoImpl) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
 	return repo.storage.ListTopLevelDirs(ctx, prefix)
 }
 
+func (repo *repoImpl) Delete(ctx context.Context, path string) error {
+	fullPath := repo.encodePath(path)
+	if err := repo.storage.Delete(ctx, fullPath); err != nil {
+		return err
+	}
+	if repo.compressor != nil {
+		return repo.storage.Delete(ctx, fullPath+seekIndexExt)
+	}
+	return nil
+}
+
+func (repo *repoImpl) DeletePrefix(ctx context.Context, prefix string) error {
+	// prefixes address directories, extensions are applied to object names only
+	return repo.storage.DeletePrefix(ctx, prefix)
+}
+
+func (repo *repoImpl) Copy(ctx context.Context, src, dst string) error {
+	return repo.moveWithIndex(ctx, repo.storage.Copy, repo.encodePath(src), repo.encodePath(dst), false)
+}
+
+func (repo *repoImpl) Rename(ctx context.Context, src, dst string) error {
+	return repo.moveWithIndex(ctx, repo.storage.Rename, repo.encodePath(src), repo.encodePath(dst), true)
+}
+
+// moveWithIndex applies the copy/rename to the object, and carries over the frame index of a compressed object,
+// if there is one. The index is rewritten for the destination object, as copies do not keep ETags on every backend.
+// Objects are checked for an index regardless of the seekable option, they may be written by a seekable repo.
+func (repo *repoImpl) moveWithIndex(
+	ctx context.Context,
+	op func(context.Context, string, string) error,
+	srcPath, dstPath string,
+	removeSrc bool,
+) error {
+	var idx *seekIndex
+	if repo.compressor != nil {
+		var err error
+		idx, err = repo.loadIndex(ctx, srcPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	staleIdx := false
+	if idx != nil {
+		info, err := repo.storage.Stat(ctx, srcPath)
+		if err != nil {
+			return err
+		}
+		staleIdx = !idx.describes(info)
+	}
+
+	if err := op(ctx, srcPath, dstPath); err != nil {
+		return err
+	}
+	if idx == nil {
+		return nil
+	}
+
+	if !staleIdx {
+		info, err := repo.storage.Stat(ctx, dstPath)
+		if err != nil {
+			return err
+		}
+		idx.stamp(info)
+		if err := repo.writeIndex(ctx, dstPath, idx); err != nil {
+			return err
+		}
+	}
+	if removeSrc {
+		return repo.storage.Delete(ctx, srcPath+seekIndexExt)
+	}
+	return nil
+}
+
 // path-utils
 
 // encodePath adds extensions based on active compressor/crypter
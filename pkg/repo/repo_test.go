@@ -5,6 +5,8 @@ import (
 	"context"
 	"errors"
 	"io"
+	"io/fs"
+	"iter"
 	"os"
 	"path/filepath"
 	"strings"
@@ -225,6 +227,150 @@ func TestRepo_BadReaderWrite(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestRepo_Delete_ResolvesEncodedName(t *testing.T) {
+	tmp := t.TempDir()
+	store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: tmp})
+	require.NoError(t, err)
+
+	r := NewWriteReader(store, &codec.GzipCompressor{}, aesgcm.NewChunkedGCMCrypter("del-key"))
+
+	finalPath, err := r.PutObject(context.Background(), "wal/000000010000000000000001", bytes.NewReader([]byte("wal")))
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(tmp, finalPath))
+
+	require.NoError(t, r.Delete(context.Background(), "wal/000000010000000000000001"))
+	assert.NoFileExists(t, filepath.Join(tmp, finalPath))
+
+	exists, err := r.Exists(context.Background(), "wal/000000010000000000000001")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestRepo_DeletePrefix(t *testing.T) {
+	tmp := t.TempDir()
+	store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: tmp})
+	require.NoError(t, err)
+
+	r := NewWriteReader(store, &codec.GzipCompressor{}, nil)
+
+	for _, p := range []string{"old/a", "old/b", "new/c"} {
+		_, err = r.PutObject(context.Background(), p, bytes.NewReader([]byte(p)))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, r.DeletePrefix(context.Background(), "old"))
+
+	all, err := r.ListAll(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new/c"}, all)
+}
+
+func TestRepo_StatAndListAllInfo_DecodedNames(t *testing.T) {
+	tmp := t.TempDir()
+	store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: tmp})
+	require.NoError(t, err)
+
+	r := NewWriteReader(store, &codec.GzipCompressor{}, aesgcm.NewChunkedGCMCrypter("stat-key"))
+
+	finalPath, err := r.PutObject(context.Background(), "base/1234", bytes.NewReader([]byte("relation")))
+	require.NoError(t, err)
+
+	stored, err := os.Stat(filepath.Join(tmp, finalPath))
+	require.NoError(t, err)
+
+	info, err := r.Stat(context.Background(), "base/1234")
+	require.NoError(t, err)
+	assert.Equal(t, "base/1234", info.Path)
+	assert.Equal(t, stored.Size(), info.Size)
+
+	infos, err := r.ListAllInfo(context.Background(), "")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "base/1234", infos[0].Path)
+	assert.Equal(t, stored.Size(), infos[0].Size)
+
+	_, err = r.Stat(context.Background(), "base/missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestRepo_PutObjectWithOpts(t *testing.T) {
+	tmp := t.TempDir()
+	store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: tmp})
+	require.NoError(t, err)
+
+	r := NewWriteReaderWithOpts(store, &codec.GzipCompressor{}, aesgcm.NewChunkedGCMCrypter("meta-key"), &WriteReaderOpts{Seekable: true})
+
+	opts := &storage2.PutObjectOpts{
+		Metadata: map[string]string{"lsn": "0/3000028", "mode": "0600"},
+		Tags:     map[string]string{"kind": "base"},
+	}
+	finalPath, err := r.PutObjectWithOpts(context.Background(), "base/1234", bytes.NewReader([]byte("relation")), opts)
+	require.NoError(t, err)
+
+	info, err := r.Stat(context.Background(), "base/1234")
+	require.NoError(t, err)
+	assert.Equal(t, opts.Metadata, info.Metadata)
+	assert.Equal(t, opts.Tags, info.Tags)
+
+	// the frame index is internal and carries no metadata
+	idxInfo, err := store.Stat(context.Background(), finalPath+seekIndexExt)
+	require.NoError(t, err)
+	assert.Nil(t, idxInfo.Metadata)
+}
+
+func TestRepo_Walk_DecodedNamesAndEarlyStop(t *testing.T) {
+	tmp := t.TempDir()
+	store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: tmp})
+	require.NoError(t, err)
+
+	r := NewWriteReader(store, &codec.GzipCompressor{}, nil)
+
+	for _, p := range []string{"wal/1", "wal/2", "wal/3"} {
+		_, err = r.PutObject(context.Background(), p, bytes.NewReader([]byte(p)))
+		require.NoError(t, err)
+	}
+
+	var seen []string
+	for info, err := range r.Walk(context.Background(), "wal") {
+		require.NoError(t, err)
+		assert.False(t, strings.HasSuffix(info.Path, ".gz"))
+		seen = append(seen, info.Path)
+		if len(seen) == 2 {
+			break
+		}
+	}
+	assert.Len(t, seen, 2)
+}
+
+func TestRepo_RenameAndCopy_EncodedNames(t *testing.T) {
+	tmp := t.TempDir()
+	store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: tmp})
+	require.NoError(t, err)
+
+	r := NewWriteReader(store, &codec.GzipCompressor{}, aesgcm.NewChunkedGCMCrypter("mv-key"))
+	ctx := context.Background()
+
+	content := []byte("finished backup")
+	_, err = r.PutObject(ctx, "incoming/20250101/base_tar", bytes.NewReader(content))
+	require.NoError(t, err)
+
+	require.NoError(t, r.Rename(ctx, "incoming/20250101/base_tar", "base/20250101/base_tar"))
+	require.NoError(t, r.Copy(ctx, "base/20250101/base_tar", "copy/20250101/base_tar"))
+
+	all, err := r.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"base/20250101/base_tar", "copy/20250101/base_tar"}, all)
+
+	for _, p := range all {
+		rc, err := r.ReadObject(ctx, p)
+		require.NoError(t, err)
+		assert.Equal(t, content, readAllAndClose(t, rc))
+	}
+
+	err = r.Rename(ctx, "incoming/20250101/base_tar", "base/other")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
 func TestEncodePath(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -325,6 +471,16 @@ func (m *mockStorage) ListAll(_ context.Context, _ string) ([]string, error) {
 	panic("implement me")
 }
 
+func (m *mockStorage) ListAllInfo(_ context.Context, _ string) ([]storage2.ObjectInfo, error) {
+	// TODO implement me
+	panic("implement me")
+}
+
+func (m *mockStorage) Walk(_ context.Context, _ string) iter.Seq2[storage2.ObjectInfo, error] {
+	// TODO implement me
+	panic("implement me")
+}
+
 func (m *mockStorage) ListTopLevelDirs(_ context.Context, _ string) (map[string]bool, error) {
 	// TODO implement me
 	panic("implement me")
@@ -336,6 +492,10 @@ func (m *mockStorage) PutObject(_ context.Context, _ string, _ io.Reader) error
 	return nil
 }
 
+func (m *mockStorage) PutObjectWithOpts(_ context.Context, _ string, _ io.Reader, _ *storage2.PutObjectOpts) error {
+	return nil
+}
+
 func (m *mockStorage) ReadObject(_ context.Context, path string) (io.ReadCloser, error) {
 	if m.closed == nil {
 		m.closed = make(map[string]bool)
@@ -352,8 +512,28 @@ func (m *mockStorage) ReadObject(_ context.Context, path string) (io.ReadCloser,
 	}, nil
 }
 
+func (m *mockStorage) ReadObjectRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	rc, err := m.ReadObject(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.CopyN(io.Discard, rc, offset)
+	if length < 0 {
+		return rc, nil
+	}
+	return &mockCloserReader{Reader: io.LimitReader(rc, length), onClose: func() { _ = rc.Close() }}, nil
+}
+
 func (m *mockStorage) Exists(_ context.Context, _ string) (bool, error)   { return true, nil }
 func (m *mockStorage) SHA256(_ context.Context, _ string) (string, error) { return "", nil }
+func (m *mockStorage) Delete(_ context.Context, _ string) error           { return nil }
+func (m *mockStorage) DeletePrefix(_ context.Context, _ string) error     { return nil }
+func (m *mockStorage) Copy(_ context.Context, _, _ string) error          { return nil }
+func (m *mockStorage) Rename(_ context.Context, _, _ string) error        { return nil }
+
+func (m *mockStorage) Stat(_ context.Context, path string) (storage2.ObjectInfo, error) {
+	return storage2.ObjectInfo{Path: path, Size: int64(len(m.files[path]))}, nil
+}
 
 // compressor
 
@@ -405,3 +585,30 @@ func (m *mockCrypter) Encrypt(_ io.Writer) (io.WriteCloser, error) { return nil,
 func (m *mockCrypter) Decrypt(_ io.Reader) (io.Reader, error)      { return nil, nil }
 func (m *mockCrypter) FileExtension() string                       { return m.ext }
 func (m *mockCrypter) Name() string                                { return "" }
+
+func TestRepo_ReadObject_DetectsTampering(t *testing.T) {
+	content := bytes.Repeat([]byte("backup payload "), 10_000)
+
+	faults := map[string]storage2.Fault{
+		"corrupted": {Kind: storage2.FaultCorrupt, Ops: []string{"read"}, Offset: 100},
+		"truncated": {Kind: storage2.FaultTruncate, Ops: []string{"read"}, Offset: 1000},
+	}
+	for name, fault := range faults {
+		t.Run(name, func(t *testing.T) {
+			store := storage2.NewFaultStorage(storage2.NewMemoryStorage(), 1)
+			r := NewWriteReader(store, nil, aesgcm.NewChunkedGCMCrypter("tamper-key"))
+			ctx := context.Background()
+
+			_, err := r.PutObject(ctx, "base/obj", bytes.NewReader(content))
+			require.NoError(t, err)
+
+			store.Inject(fault)
+			rc, err := r.ReadObject(ctx, "base/obj")
+			if err == nil {
+				_, err = io.ReadAll(rc)
+				_ = rc.Close()
+			}
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,388 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/hashmap-kz/xrepo/pkg/storage"
+
+	"github.com/hashmap-kz/streamcrypt/pkg/codec"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt/aesgcm"
+	"github.com/hashmap-kz/streamcrypt/pkg/ioutils"
+	"github.com/hashmap-kz/streamcrypt/pkg/pipe"
+)
+
+const (
+	// seekFrameSize is the amount of plain content compressed as an independent frame,
+	// seeking into a compressed object costs at most one frame decode.
+	seekFrameSize = 1024 * 1024
+
+	// seekIndexExt is appended to the stored name of a compressed object to get its index name
+	seekIndexExt = ".idx"
+)
+
+// seekIndex is written alongside compressed objects of seekable repos.
+// Frame i holds plain bytes [i*FrameSize, (i+1)*FrameSize) and starts at Offsets[i] of the compressed stream,
+// the last element of Offsets is the total compressed size.
+// StoredSize and ETag identify the version of the object the index was written for.
+type seekIndex struct {
+	FrameSize  int64   `json:"frame_size"`
+	Size       int64   `json:"size"`
+	Offsets    []int64 `json:"offsets"`
+	StoredSize int64   `json:"stored_size"`
+	ETag       string  `json:"etag,omitempty"`
+}
+
+func (idx *seekIndex) frames() int64 {
+	return int64(len(idx.Offsets) - 1)
+}
+
+// describes reports whether the index was written for the given version of the object,
+// ETags are compared when both sides have them
+func (idx *seekIndex) describes(info storage.ObjectInfo) bool {
+	if idx.StoredSize != info.Size {
+		return false
+	}
+	if idx.ETag != "" && info.ETag != "" {
+		return idx.ETag == info.ETag
+	}
+	return true
+}
+
+// stamp binds the index to the given version of the object
+func (idx *seekIndex) stamp(info storage.ObjectInfo) {
+	idx.StoredSize = info.Size
+	idx.ETag = info.ETag
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// putFramed stores a compressed object as a sequence of independent frames (concatenated gzip members
+// or zstd frames are valid streams, so plain ReadObject is not affected), and writes the frame index next to it.
+// Metadata and tags go to the object only, the index is internal.
+//
+// The index is written after the object, readers ignore an index that is missing or describes another version.
+func (repo *repoImpl) putFramed(ctx context.Context, fullPath string, r io.Reader, opts *storage.PutObjectOpts) error {
+	pr, pw := io.Pipe()
+	idx := &seekIndex{FrameSize: seekFrameSize}
+	stored := &countingWriter{w: pw}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = pw.CloseWithError(repo.writeFrames(stored, r, idx))
+	}()
+
+	err := repo.storage.PutObjectWithOpts(ctx, fullPath, pr, opts)
+	// unblock the writer if the storage stopped reading early
+	_ = pr.Close()
+	<-done
+	if err != nil {
+		return err
+	}
+
+	info := storage.ObjectInfo{Size: stored.n}
+	if stat, err := repo.storage.Stat(ctx, fullPath); err == nil {
+		info = stat
+	}
+	idx.stamp(info)
+	return repo.writeIndex(ctx, fullPath, idx)
+}
+
+func (repo *repoImpl) writeIndex(ctx context.Context, fullPath string, idx *seekIndex) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	encReader, err := pipe.CompressAndEncryptOptional(bytes.NewReader(data), nil, repo.crypter)
+	if err != nil {
+		return err
+	}
+	return repo.storage.PutObject(ctx, fullPath+seekIndexExt, encReader)
+}
+
+func (repo *repoImpl) writeFrames(w io.Writer, src io.Reader, idx *seekIndex) error {
+	var dst io.Writer = w
+	var encWriter io.WriteCloser
+	if repo.crypter != nil {
+		var err error
+		encWriter, err = repo.crypter.Encrypt(w)
+		if err != nil {
+			return err
+		}
+		dst = encWriter
+	}
+	cw := &countingWriter{w: dst}
+
+	buf := make([]byte, seekFrameSize)
+	for {
+		n, readErr := io.ReadFull(src, buf)
+		if readErr != nil && !errors.Is(readErr, io.EOF) && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("copy: %w", readErr)
+		}
+
+		// an empty input still gets one (empty) frame, so the stream stays decodable
+		if n > 0 || len(idx.Offsets) == 0 {
+			idx.Offsets = append(idx.Offsets, cw.n)
+			if err := repo.writeFrame(cw, buf[:n]); err != nil {
+				return err
+			}
+			idx.Size += int64(n)
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	idx.Offsets = append(idx.Offsets, cw.n)
+
+	if encWriter != nil {
+		return encWriter.Close()
+	}
+	return nil
+}
+
+func (repo *repoImpl) writeFrame(w io.Writer, p []byte) error {
+	zw, err := repo.compressor.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(p); err != nil {
+		_ = zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// readIndex loads the frame index, and checks that it describes the current version of the object
+func (repo *repoImpl) readIndex(ctx context.Context, fullPath string, info storage.ObjectInfo) (*seekIndex, error) {
+	idx, err := repo.loadIndex(ctx, fullPath)
+	if err != nil {
+		return nil, err
+	}
+	// an index left over from a previous version of the object is useless
+	if !idx.describes(info) {
+		return nil, fmt.Errorf("stale index of %s: %w", fullPath, fs.ErrNotExist)
+	}
+	return idx, nil
+}
+
+func (repo *repoImpl) loadIndex(ctx context.Context, fullPath string) (*seekIndex, error) {
+	obj, err := repo.storage.ReadObject(ctx, fullPath+seekIndexExt)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	rc, err := pipe.DecryptAndDecompressOptional(obj, repo.crypter, nil)
+	if err != nil {
+		return nil, err
+	}
+	var idx seekIndex
+	if err := json.NewDecoder(rc).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("cannot decode index of %s: %w", fullPath, err)
+	}
+	if idx.FrameSize <= 0 || len(idx.Offsets) < 2 {
+		return nil, fmt.Errorf("invalid index of %s", fullPath)
+	}
+	return &idx, nil
+}
+
+// gcmPlainSize is the size of the plain content of the chunked AES-GCM stream
+func gcmPlainSize(storedSize int64) int64 {
+	body := storedSize - gcmHeaderSize
+	if body <= 0 {
+		return 0
+	}
+	chunks := (body + gcmSealedChunkSize - 1) / gcmSealedChunkSize
+	return body - chunks*(gcmNonceSize+gcmTagSize)
+}
+
+// decompressor resolves the decompressor for the configured compressor, nil if there is no such
+func (repo *repoImpl) decompressor() codec.Decompressor {
+	if repo.compressor == nil {
+		return nil
+	}
+	if repo.compressor.FileExtension() == codec.ZstdFileExt {
+		return &codec.ZstdDecompressor{}
+	}
+	return codec.GetDecompressor(repo.compressor)
+}
+
+// OpenSeekable opens the object for random access.
+//
+// Plain and encrypted-only objects are addressed directly, compressed objects use the frame index
+// written by PutObject of seekable repos, so a seek costs one frame decode.
+// Objects without an index (or with a stale one) are decoded from the start.
+func (repo *repoImpl) OpenSeekable(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	fullPath := repo.encodePath(path)
+
+	info, err := repo.storage.Stat(ctx, fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// random access to the stream as it's stored (i.e. compressed, but decrypted)
+	var readRange func(offset int64) (io.ReadCloser, error)
+	size := info.Size
+	if repo.crypter == nil {
+		readRange = func(offset int64) (io.ReadCloser, error) {
+			return repo.storage.ReadObjectRange(ctx, fullPath, offset, -1)
+		}
+	} else if gcm, ok := repo.crypter.(*aesgcm.ChunkedGCMCrypter); ok {
+		obj, err := repo.openGCMObject(gcm, fullPath)
+		if err != nil {
+			return nil, err
+		}
+		size = gcmPlainSize(info.Size)
+		readRange = func(offset int64) (io.ReadCloser, error) {
+			return obj.readRange(ctx, offset, -1)
+		}
+	}
+
+	sequential := func(offset int64) (io.ReadCloser, error) {
+		rc, err := repo.ReadObject(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		return discardRange(rc, offset, -1)
+	}
+
+	if readRange == nil {
+		return newSeekableObject(-1, sequential), nil
+	}
+	if repo.compressor == nil {
+		return newSeekableObject(size, readRange), nil
+	}
+
+	idx, err := repo.readIndex(ctx, fullPath, info)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return newSeekableObject(-1, sequential), nil
+		}
+		return nil, err
+	}
+	dec := repo.decompressor()
+	if dec == nil {
+		return nil, fmt.Errorf("cannot decide decompressor for: %s", repo.compressor.FileExtension())
+	}
+
+	return newSeekableObject(idx.Size, func(offset int64) (io.ReadCloser, error) {
+		frame := offset / idx.FrameSize
+		if frame >= idx.frames() {
+			return io.NopCloser(bytes.NewReader(nil)), nil
+		}
+		raw, err := readRange(idx.Offsets[frame])
+		if err != nil {
+			return nil, err
+		}
+		zr, err := dec.Decompress(raw)
+		if err != nil {
+			_ = raw.Close()
+			return nil, err
+		}
+		return discardRange(ioutils.NewMultiCloser(zr, zr, raw), offset-frame*idx.FrameSize, -1)
+	}), nil
+}
+
+// seekableObject reopens the underlying stream at the new position when a read follows a seek
+type seekableObject struct {
+	size   int64 // negative when unknown until the stream is read through
+	open   func(offset int64) (io.ReadCloser, error)
+	pos    int64
+	cur    io.ReadCloser
+	curPos int64
+}
+
+var _ io.ReadSeekCloser = &seekableObject{}
+
+func newSeekableObject(size int64, open func(offset int64) (io.ReadCloser, error)) *seekableObject {
+	return &seekableObject{size: size, open: open}
+}
+
+func (s *seekableObject) Read(p []byte) (int, error) {
+	if s.size >= 0 && s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if s.cur == nil || s.curPos != s.pos {
+		if err := s.closeCurrent(); err != nil {
+			return 0, err
+		}
+		rc, err := s.open(s.pos)
+		if err != nil {
+			return 0, err
+		}
+		s.cur = rc
+		s.curPos = s.pos
+	}
+
+	n, err := s.cur.Read(p)
+	s.pos += int64(n)
+	s.curPos += int64(n)
+	return n, err
+}
+
+func (s *seekableObject) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = s.pos + offset
+	case io.SeekEnd:
+		if s.size < 0 {
+			if err := s.measure(); err != nil {
+				return 0, err
+			}
+		}
+		abs = s.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if abs < 0 {
+		return 0, fmt.Errorf("negative position: %d", abs)
+	}
+	s.pos = abs
+	return abs, nil
+}
+
+// measure reads the stream through, when the size cannot be known in advance
+func (s *seekableObject) measure() error {
+	rc, err := s.open(0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	n, err := io.Copy(io.Discard, rc)
+	if err != nil {
+		return err
+	}
+	s.size = n
+	return nil
+}
+
+func (s *seekableObject) closeCurrent() error {
+	if s.cur == nil {
+		return nil
+	}
+	err := s.cur.Close()
+	s.cur = nil
+	return err
+}
+
+func (s *seekableObject) Close() error {
+	return s.closeCurrent()
+}
@@ -0,0 +1,221 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	storage2 "github.com/hashmap-kz/xrepo/pkg/storage"
+
+	"github.com/hashmap-kz/streamcrypt/pkg/codec"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt/aesgcm"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func seekableTestContent(t *testing.T) []byte {
+	t.Helper()
+	// half random, half compressible, spanning several frames
+	content := make([]byte, 3*seekFrameSize+seekFrameSize/2)
+	_, err := rand.Read(content[:len(content)/2])
+	require.NoError(t, err)
+	return content
+}
+
+func TestRepo_OpenSeekable(t *testing.T) {
+	content := seekableTestContent(t)
+	size := int64(len(content))
+
+	repos := []struct {
+		name       string
+		compressor codec.Compressor
+		crypter    crypt.Crypter
+	}{
+		{"plain", nil, nil},
+		{"aes", nil, aesgcm.NewChunkedGCMCrypter("seek-key")},
+		{"gzip", &codec.GzipCompressor{}, nil},
+		{"zstd+aes", &codec.ZstdCompressor{}, aesgcm.NewChunkedGCMCrypter("seek-key")},
+	}
+
+	for _, rr := range repos {
+		t.Run(rr.name, func(t *testing.T) {
+			store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: t.TempDir()})
+			require.NoError(t, err)
+
+			r := NewWriteReaderWithOpts(store, rr.compressor, rr.crypter, &WriteReaderOpts{Seekable: true})
+			ctx := context.Background()
+			_, err = r.PutObject(ctx, "base/archive", bytes.NewReader(content))
+			require.NoError(t, err)
+
+			// the frame index is not a repo object
+			all, err := r.ListAll(ctx, "")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"base/archive"}, all)
+
+			obj, err := r.OpenSeekable(ctx, "base/archive")
+			require.NoError(t, err)
+			defer obj.Close()
+
+			end, err := obj.Seek(0, io.SeekEnd)
+			require.NoError(t, err)
+			assert.Equal(t, size, end)
+
+			positions := []int64{size - 100, 10, seekFrameSize - 5, 2*seekFrameSize + 7, 0, size}
+			for _, pos := range positions {
+				_, err := obj.Seek(pos, io.SeekStart)
+				require.NoError(t, err)
+
+				buf := make([]byte, 64)
+				n, err := io.ReadFull(obj, buf)
+				expected := content[pos:min(pos+64, size)]
+				if len(expected) < len(buf) {
+					assert.Error(t, err)
+				} else {
+					require.NoError(t, err)
+				}
+				assert.Equal(t, expected, buf[:n], "at %d", pos)
+			}
+
+			// relative seek continues from the current position
+			_, err = obj.Seek(100, io.SeekStart)
+			require.NoError(t, err)
+			_, err = obj.Seek(50, io.SeekCurrent)
+			require.NoError(t, err)
+			buf := make([]byte, 10)
+			_, err = io.ReadFull(obj, buf)
+			require.NoError(t, err)
+			assert.Equal(t, content[150:160], buf)
+
+			// ranged reads of compressed objects go through the index as well
+			rc, err := r.ReadObjectRange(ctx, "base/archive", seekFrameSize+3, 2*seekFrameSize)
+			require.NoError(t, err)
+			assert.Equal(t, content[seekFrameSize+3:3*seekFrameSize+3], readAllAndClose(t, rc))
+
+			// and sequential reads are not affected by framing
+			rc, err = r.ReadObject(ctx, "base/archive")
+			require.NoError(t, err)
+			assert.Equal(t, content, readAllAndClose(t, rc))
+		})
+	}
+}
+
+func TestRepo_OpenSeekable_NotSeekableByDefault(t *testing.T) {
+	tmp := t.TempDir()
+	store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: tmp})
+	require.NoError(t, err)
+
+	r := NewWriteReader(store, &codec.GzipCompressor{}, nil)
+	ctx := context.Background()
+	content := seekableTestContent(t)
+
+	_, err = r.PutObject(ctx, "obj", bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(tmp, "obj.gz.idx"))
+
+	// decoded from the start
+	rc, err := r.ReadObjectRange(ctx, "obj", seekFrameSize+3, 10)
+	require.NoError(t, err)
+	assert.Equal(t, content[seekFrameSize+3:seekFrameSize+13], readAllAndClose(t, rc))
+}
+
+func TestRepo_OpenSeekable_StaleIndexIsIgnored(t *testing.T) {
+	crypters := []struct {
+		name    string
+		crypter crypt.Crypter
+	}{
+		{"plain", nil},
+		{"aes", aesgcm.NewChunkedGCMCrypter("stale-key")},
+	}
+
+	for _, cc := range crypters {
+		t.Run(cc.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: tmp})
+			require.NoError(t, err)
+
+			r := NewWriteReaderWithOpts(store, &codec.GzipCompressor{}, cc.crypter, &WriteReaderOpts{Seekable: true})
+			ctx := context.Background()
+
+			finalPath, err := r.PutObject(ctx, "obj", bytes.NewReader(seekableTestContent(t)))
+			require.NoError(t, err)
+			staleIndex, err := os.ReadFile(filepath.Join(tmp, finalPath+seekIndexExt))
+			require.NoError(t, err)
+
+			// the object is replaced, but the index of the previous version is put back
+			content := []byte("a newer and much smaller version")
+			_, err = r.PutObject(ctx, "obj", bytes.NewReader(content))
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(filepath.Join(tmp, finalPath+seekIndexExt), staleIndex, 0o600))
+
+			obj, err := r.OpenSeekable(ctx, "obj")
+			require.NoError(t, err)
+			defer obj.Close()
+
+			_, err = obj.Seek(8, io.SeekStart)
+			require.NoError(t, err)
+			rest, err := io.ReadAll(obj)
+			require.NoError(t, err)
+			assert.Equal(t, content[8:], rest)
+		})
+	}
+}
+
+func TestRepo_OpenSeekable_IndexOfSameSizeVersionIsIgnored(t *testing.T) {
+	store := storage2.NewMemoryStorage()
+	r := NewWriteReaderWithOpts(store, &codec.GzipCompressor{}, nil, &WriteReaderOpts{Seekable: true})
+	ctx := context.Background()
+
+	// the index of the first version is put back over the one of the second version
+	first := bytes.Repeat([]byte("a"), 2*seekFrameSize)
+	_, err := r.PutObject(ctx, "obj", bytes.NewReader(first))
+	require.NoError(t, err)
+	idxData, err := store.ReadObject(ctx, "obj.gz"+seekIndexExt)
+	require.NoError(t, err)
+	staleIndex := readAllAndClose(t, idxData)
+
+	second := bytes.Repeat([]byte("b"), 2*seekFrameSize)
+	_, err = r.PutObject(ctx, "obj", bytes.NewReader(second))
+	require.NoError(t, err)
+	require.NoError(t, store.PutObject(ctx, "obj.gz"+seekIndexExt, bytes.NewReader(staleIndex)))
+
+	info, err := store.Stat(ctx, "obj.gz")
+	require.NoError(t, err)
+	var idx seekIndex
+	require.NoError(t, json.Unmarshal(staleIndex, &idx))
+	require.Equal(t, idx.StoredSize, info.Size, "same stored size, only the ETag differs")
+
+	_, err = r.(*repoImpl).readIndex(ctx, "obj.gz", info)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	rc, err := r.ReadObjectRange(ctx, "obj", seekFrameSize, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bbbb"), readAllAndClose(t, rc))
+}
+
+func TestRepo_SeekIndex_FollowsObject(t *testing.T) {
+	tmp := t.TempDir()
+	store, err := storage2.NewLocal(&storage2.LocalStorageOpts{BaseDir: tmp})
+	require.NoError(t, err)
+
+	r := NewWriteReaderWithOpts(store, &codec.GzipCompressor{}, nil, &WriteReaderOpts{Seekable: true})
+	ctx := context.Background()
+
+	_, err = r.PutObject(ctx, "incoming/obj", bytes.NewReader([]byte("content")))
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(tmp, "incoming/obj.gz.idx"))
+
+	require.NoError(t, r.Rename(ctx, "incoming/obj", "base/obj"))
+	assert.NoFileExists(t, filepath.Join(tmp, "incoming/obj.gz.idx"))
+	assert.FileExists(t, filepath.Join(tmp, "base/obj.gz.idx"))
+
+	require.NoError(t, r.Delete(ctx, "base/obj"))
+	assert.NoFileExists(t, filepath.Join(tmp, "base/obj.gz.idx"))
+}
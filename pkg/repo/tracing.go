@@ -0,0 +1,278 @@
+package repo
+
+import (
+	"context"
+	"io"
+	"iter"
+
+	"github.com/hashmap-kz/streamcrypt/pkg/codec"
+	"github.com/hashmap-kz/streamcrypt/pkg/ioutils"
+	"github.com/hashmap-kz/streamcrypt/pkg/pipe"
+	"github.com/hashmap-kz/xrepo/pkg/storage"
+	"github.com/hashmap-kz/xrepo/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// pathEncoder resolves the stored name of an object, implemented by the repo itself
+type pathEncoder interface {
+	encodePath(logical string) string
+}
+
+type tracingRepo struct {
+	r      WriteReader
+	tracer trace.Tracer
+}
+
+var (
+	_ WriteReader = &tracingRepo{}
+	_ Pruner      = &tracingRepo{}
+)
+
+// NewTracingWriteReader wraps every repo operation into a span, the global provider is used when tp is nil.
+// Spans carry the logical and the stored names, the compressor and the encryptor, the storage operations
+// become their children when the storage is traced as well. Downloads are traced until the stream is closed,
+// decryption and decompression of ReadObject are reported as child spans of their own.
+func NewTracingWriteReader(r WriteReader, tp trace.TracerProvider) WriteReader {
+	return &tracingRepo{r: r, tracer: tracing.Tracer(tp)}
+}
+
+func (tr *tracingRepo) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		tracing.CompressorKey.String(tr.r.GetCompressorName()),
+		tracing.EncryptorKey.String(tr.r.GetEncryptorName()),
+	)
+	return tracing.Start(ctx, tr.tracer, "repo."+op, attrs...)
+}
+
+// pathAttrs describes the object by its logical name and, when it's known, by the stored one
+func (tr *tracingRepo) pathAttrs(path string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{tracing.PathKey.String(path)}
+	if e, ok := tr.r.(pathEncoder); ok {
+		attrs = append(attrs, tracing.EncodedPathKey.String(e.encodePath(path)))
+	}
+	return attrs
+}
+
+func (tr *tracingRepo) PutObject(ctx context.Context, path string, r io.Reader) (string, error) {
+	return tr.PutObjectWithOpts(ctx, path, r, nil)
+}
+
+func (tr *tracingRepo) PutObjectWithOpts(ctx context.Context, path string, r io.Reader, opts *storage.PutObjectOpts) (string, error) {
+	ctx, span := tr.start(ctx, "PutObject", tracing.PathKey.String(path))
+	cr := tracing.NewCountingReader(r)
+	fullPath, err := tr.r.PutObjectWithOpts(ctx, path, cr, opts)
+	span.SetAttributes(tracing.EncodedPathKey.String(fullPath), tracing.BytesKey.Int64(cr.Count()))
+	tracing.End(span, err)
+	return fullPath, err
+}
+
+func (tr *tracingRepo) PutObjectPlain(ctx context.Context, path string, r io.Reader) (string, error) {
+	ctx, span := tr.start(ctx, "PutObjectPlain", tracing.PathKey.String(path))
+	cr := tracing.NewCountingReader(r)
+	fullPath, err := tr.r.PutObjectPlain(ctx, path, cr)
+	span.SetAttributes(tracing.EncodedPathKey.String(fullPath), tracing.BytesKey.Int64(cr.Count()))
+	tracing.End(span, err)
+	return fullPath, err
+}
+
+func (tr *tracingRepo) ReadObject(ctx context.Context, path string) (io.ReadCloser, error) {
+	ctx, span := tr.start(ctx, "ReadObject", tr.pathAttrs(path)...)
+	rc, err := tr.r.ReadObject(ctx, path)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	return tracing.NewSpanReadCloser(span, rc), nil
+}
+
+func (tr *tracingRepo) ReadObjectRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	attrs := append(tr.pathAttrs(path), tracing.OffsetKey.Int64(offset), tracing.LengthKey.Int64(length))
+	ctx, span := tr.start(ctx, "ReadObjectRange", attrs...)
+	rc, err := tr.r.ReadObjectRange(ctx, path, offset, length)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	return tracing.NewSpanReadCloser(span, rc), nil
+}
+
+// spanReadSeekCloser keeps the object seekable, while the span covers the reads
+type spanReadSeekCloser struct {
+	*tracing.SpanReadCloser
+	s io.Seeker
+}
+
+func (s *spanReadSeekCloser) Seek(offset int64, whence int) (int64, error) {
+	return s.s.Seek(offset, whence)
+}
+
+func (tr *tracingRepo) OpenSeekable(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	ctx, span := tr.start(ctx, "OpenSeekable", tr.pathAttrs(path)...)
+	rsc, err := tr.r.OpenSeekable(ctx, path)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	return &spanReadSeekCloser{SpanReadCloser: tracing.NewSpanReadCloser(span, rsc), s: rsc}, nil
+}
+
+func (tr *tracingRepo) Exists(ctx context.Context, path string) (bool, error) {
+	ctx, span := tr.start(ctx, "Exists", tr.pathAttrs(path)...)
+	exists, err := tr.r.Exists(ctx, path)
+	tracing.End(span, err)
+	return exists, err
+}
+
+func (tr *tracingRepo) Stat(ctx context.Context, path string) (storage.ObjectInfo, error) {
+	ctx, span := tr.start(ctx, "Stat", tr.pathAttrs(path)...)
+	info, err := tr.r.Stat(ctx, path)
+	tracing.End(span, err)
+	return info, err
+}
+
+func (tr *tracingRepo) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	ctx, span := tr.start(ctx, "ListAll", tracing.PrefixKey.String(prefix))
+	files, err := tr.r.ListAll(ctx, prefix)
+	tracing.End(span, err)
+	return files, err
+}
+
+func (tr *tracingRepo) ListAllInfo(ctx context.Context, prefix string) ([]storage.ObjectInfo, error) {
+	ctx, span := tr.start(ctx, "ListAllInfo", tracing.PrefixKey.String(prefix))
+	infos, err := tr.r.ListAllInfo(ctx, prefix)
+	tracing.End(span, err)
+	return infos, err
+}
+
+// Walk is traced until the listing is exhausted, or the consumer stops
+func (tr *tracingRepo) Walk(ctx context.Context, prefix string) iter.Seq2[storage.ObjectInfo, error] {
+	return func(yield func(storage.ObjectInfo, error) bool) {
+		ctx, span := tr.start(ctx, "Walk", tracing.PrefixKey.String(prefix))
+		var walkErr error
+		defer func() {
+			tracing.End(span, walkErr)
+		}()
+		for info, err := range tr.r.Walk(ctx, prefix) {
+			if err != nil {
+				walkErr = err
+			}
+			if !yield(info, err) {
+				return
+			}
+		}
+	}
+}
+
+func (tr *tracingRepo) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	ctx, span := tr.start(ctx, "ListTopLevelDirs", tracing.PrefixKey.String(prefix))
+	dirs, err := tr.r.ListTopLevelDirs(ctx, prefix)
+	tracing.End(span, err)
+	return dirs, err
+}
+
+func (tr *tracingRepo) Delete(ctx context.Context, path string) error {
+	ctx, span := tr.start(ctx, "Delete", tr.pathAttrs(path)...)
+	err := tr.r.Delete(ctx, path)
+	tracing.End(span, err)
+	return err
+}
+
+func (tr *tracingRepo) DeletePrefix(ctx context.Context, prefix string) error {
+	ctx, span := tr.start(ctx, "DeletePrefix", tracing.PrefixKey.String(prefix))
+	err := tr.r.DeletePrefix(ctx, prefix)
+	tracing.End(span, err)
+	return err
+}
+
+// moveAttrs describes both ends of a copy/rename
+func (tr *tracingRepo) moveAttrs(src, dst string) []attribute.KeyValue {
+	attrs := append(tr.pathAttrs(src), tracing.DestinationKey.String(dst))
+	if e, ok := tr.r.(pathEncoder); ok {
+		attrs = append(attrs, tracing.EncodedDestinationKey.String(e.encodePath(dst)))
+	}
+	return attrs
+}
+
+func (tr *tracingRepo) Copy(ctx context.Context, src, dst string) error {
+	ctx, span := tr.start(ctx, "Copy", tr.moveAttrs(src, dst)...)
+	err := tr.r.Copy(ctx, src, dst)
+	tracing.End(span, err)
+	return err
+}
+
+func (tr *tracingRepo) Rename(ctx context.Context, src, dst string) error {
+	ctx, span := tr.start(ctx, "Rename", tr.moveAttrs(src, dst)...)
+	err := tr.r.Rename(ctx, src, dst)
+	tracing.End(span, err)
+	return err
+}
+
+func (tr *tracingRepo) Prune(ctx context.Context) (int, error) {
+	ctx, span := tr.start(ctx, "Prune")
+	removed, err := Prune(ctx, tr.r)
+	span.SetAttributes(tracing.ObjectsKey.Int(removed))
+	tracing.End(span, err)
+	return removed, err
+}
+
+func (tr *tracingRepo) GetCompressorName() string {
+	return tr.r.GetCompressorName()
+}
+
+func (tr *tracingRepo) GetEncryptorName() string {
+	return tr.r.GetEncryptorName()
+}
+
+// decode decrypts and decompresses a stored stream. When the read is traced (i.e. by the tracing repo),
+// decryption and decompression become child spans of it, with the time spent in each of them.
+func (repo *repoImpl) decode(ctx context.Context, stored io.Reader, dec codec.Decompressor) (io.ReadCloser, error) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() || (repo.crypter == nil && dec == nil) {
+		return pipe.DecryptAndDecompressOptional(stored, repo.crypter, dec)
+	}
+	tracer := tracing.Tracer(parent.TracerProvider())
+
+	stages := &readStages{}
+	reader := stored
+	if repo.crypter != nil {
+		stage := tracing.StartStage(ctx, tracer, "repo.Decrypt", tracing.EncryptorKey.String(repo.GetEncryptorName()))
+		stages.list = append(stages.list, stage)
+		r, err := stage.Open(reader, repo.crypter.Decrypt)
+		if err != nil {
+			_ = stages.Close()
+			return nil, err
+		}
+		reader = r
+	}
+	if dec == nil {
+		return ioutils.NewMultiCloser(reader, stages), nil
+	}
+
+	stage := tracing.StartStage(ctx, tracer, "repo.Decompress", tracing.CompressorKey.String(repo.GetCompressorName()))
+	stages.list = append(stages.list, stage)
+	var zr io.ReadCloser
+	r, err := stage.Open(reader, func(src io.Reader) (io.Reader, error) {
+		var err error
+		zr, err = dec.Decompress(src)
+		return zr, err
+	})
+	if err != nil {
+		_ = stages.Close()
+		return nil, err
+	}
+	return ioutils.NewMultiCloser(r, zr, stages), nil
+}
+
+// readStages ends the spans of the stages when the stream is closed
+type readStages struct {
+	list []*tracing.Stage
+}
+
+func (s *readStages) Close() error {
+	for _, stage := range s.list {
+		stage.End()
+	}
+	s.list = nil
+	return nil
+}
@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashmap-kz/streamcrypt/pkg/codec"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt/aesgcm"
+	storage2 "github.com/hashmap-kz/xrepo/pkg/storage"
+	"github.com/hashmap-kz/xrepo/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]string {
+	result := make(map[attribute.Key]string)
+	for _, kv := range span.Attributes() {
+		result[kv.Key] = kv.Value.Emit()
+	}
+	return result
+}
+
+func TestTracingWriteReader_SpansAcrossLayers(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	store := storage2.NewTracingStorage(storage2.NewMemoryStorage(), "memory", tp)
+	r := NewTracingWriteReader(NewWriteReader(store, &codec.GzipCompressor{}, aesgcm.NewChunkedGCMCrypter("pass")), tp)
+	ctx := context.Background()
+
+	content := strings.Repeat("content ", 100)
+	_, err := r.PutObject(ctx, "a/obj", strings.NewReader(content))
+	require.NoError(t, err)
+
+	rc, err := r.ReadObject(ctx, "a/obj")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(content), readAllAndClose(t, rc))
+
+	byName := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range sr.Ended() {
+		byName[span.Name()] = append(byName[span.Name()], span)
+	}
+
+	require.Len(t, byName["repo.PutObject"], 1)
+	put := byName["repo.PutObject"][0]
+	attrs := spanAttrs(put)
+	assert.Equal(t, "a/obj", attrs[tracing.PathKey])
+	assert.Equal(t, "a/obj.gz.aes", attrs[tracing.EncodedPathKey])
+	assert.Equal(t, "gzip", attrs[tracing.CompressorKey])
+	assert.Equal(t, "aes-256-gcm", attrs[tracing.EncryptorKey])
+	assert.Equal(t, "800", attrs[tracing.BytesKey])
+
+	// the object is stored within the repo span
+	require.NotEmpty(t, byName["storage.PutObject"])
+	for _, span := range byName["storage.PutObject"] {
+		assert.Equal(t, put.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+
+	require.Len(t, byName["repo.ReadObject"], 1)
+	read := byName["repo.ReadObject"][0]
+	assert.Equal(t, "a/obj.gz.aes", spanAttrs(read)[tracing.EncodedPathKey])
+	assert.Equal(t, "800", spanAttrs(read)[tracing.BytesKey])
+
+	require.Len(t, byName["storage.ReadObject"], 1)
+	stored := byName["storage.ReadObject"][0]
+	assert.Equal(t, read.SpanContext().SpanID(), stored.Parent().SpanID())
+	assert.Equal(t, "memory", spanAttrs(stored)[tracing.BackendKey])
+	assert.Equal(t, "a/obj.gz.aes", spanAttrs(stored)[tracing.EncodedPathKey])
+
+	// decryption and decompression are stages of the read
+	require.Len(t, byName["repo.Decrypt"], 1)
+	decrypt := byName["repo.Decrypt"][0]
+	assert.Equal(t, read.SpanContext().SpanID(), decrypt.Parent().SpanID())
+	assert.Equal(t, spanAttrs(stored)[tracing.BytesKey], spanAttrs(decrypt)[tracing.InputBytesKey])
+	assert.Contains(t, spanAttrs(decrypt), tracing.ReadTimeKey)
+
+	require.Len(t, byName["repo.Decompress"], 1)
+	decompress := byName["repo.Decompress"][0]
+	assert.Equal(t, read.SpanContext().SpanID(), decompress.Parent().SpanID())
+	assert.Equal(t, spanAttrs(decrypt)[tracing.BytesKey], spanAttrs(decompress)[tracing.InputBytesKey])
+	assert.Equal(t, "800", spanAttrs(decompress)[tracing.BytesKey])
+}
+
+func TestTracingWriteReader_DedupReadStages(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	d, err := NewDedupWriteReader(storage2.NewMemoryStorage(), &codec.GzipCompressor{}, aesgcm.NewChunkedGCMCrypter("pass"), nil)
+	require.NoError(t, err)
+	r := NewTracingWriteReader(d, tp)
+	ctx := context.Background()
+
+	content := strings.Repeat("content ", 100)
+	_, err = r.PutObject(ctx, "a/obj", strings.NewReader(content))
+	require.NoError(t, err)
+	rc, err := r.ReadObject(ctx, "a/obj")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(content), readAllAndClose(t, rc))
+
+	var read sdktrace.ReadOnlySpan
+	stages := make(map[string]int)
+	for _, span := range sr.Ended() {
+		if span.Name() == "repo.ReadObject" {
+			read = span
+		}
+	}
+	require.NotNil(t, read)
+	for _, span := range sr.Ended() {
+		if span.Parent().SpanID() == read.SpanContext().SpanID() {
+			stages[span.Name()]++
+		}
+	}
+	// the chunk list and the chunk are decoded within the read
+	assert.Equal(t, 2, stages["repo.Decrypt"])
+	assert.Equal(t, 2, stages["repo.Decompress"])
+}
@@ -0,0 +1,363 @@
+package reposync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/hashmap-kz/xrepo/pkg/concur"
+	"github.com/hashmap-kz/xrepo/pkg/storage"
+)
+
+type Action string
+
+const (
+	ActionCopy   Action = "copy"   // the object is missing in the destination
+	ActionUpdate Action = "update" // the destination has a different content
+	ActionDelete Action = "delete" // the object exists in the destination only
+)
+
+// Change is a difference between the repos, and what is done about it
+type Change struct {
+	Action Action
+	Path   string
+	Size   int64 // size of the source object, of the deleted one for deletes
+}
+
+type Opts struct {
+	Prefix  string // only objects under the prefix are synced, the whole repo when it's empty
+	Workers int    // objects compared and transferred concurrently, 4 by default
+	Delete  bool   // delete objects that exist in the destination only
+	DryRun  bool   // compute the changes without applying them
+
+	// SpoolDir keeps the content of objects without a known checksum while it's hashed for the transfer,
+	// the default temp dir is used when it's empty
+	SpoolDir string
+}
+
+const defaultWorkers = 4
+
+// sha256MetaKey keeps the SHA256 of the content in the metadata of the transferred objects,
+// so that next syncs compare them without reading the content back
+const sha256MetaKey = "xrepo-sha256"
+
+// Summary reports the outcome of a sync, in dry-run it reports the planned changes
+type Summary struct {
+	Copied    int
+	Updated   int
+	Deleted   int
+	Unchanged int
+	Failed    int
+	Bytes     int64 // transferred bytes
+
+	// Changes are sorted by path, failed ones are not included
+	Changes []Change
+}
+
+func (s *Summary) add(c Change) {
+	switch c.Action {
+	case ActionCopy:
+		s.Copied++
+		s.Bytes += c.Size
+	case ActionUpdate:
+		s.Updated++
+		s.Bytes += c.Size
+	case ActionDelete:
+		s.Deleted++
+	}
+	s.Changes = append(s.Changes, c)
+}
+
+// Sync makes the destination storage a mirror of the source one, the way "rclone sync" does.
+//
+// Objects are compared and copied as they are stored, so compressed and encrypted objects (with their
+// frame indexes) are transferred without being decoded, and no keys are needed. Both repos have to use
+// the same compression/encryption settings to be read with the same config. Metadata and tags are copied
+// along with the content, and the SHA256 of the content is recorded in the metadata of the destination.
+//
+// Objects of the same size are compared by their storage-side checksums first, by the recorded SHA256
+// then, and are hashed only when a side has no recorded checksum (hashing downloads the object from remote storages).
+//
+// Failed objects don't stop the sync, they are counted in the summary and returned joined as the error.
+func Sync(ctx context.Context, src, dst storage.Storage, o *Opts) (*Summary, error) {
+	workers := o.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	changes, srcSums, unchanged, errs := diff(ctx, src, dst, o.Prefix, o.Delete, workers)
+	summary := &Summary{Unchanged: unchanged, Failed: len(errs)}
+
+	if o.DryRun {
+		for _, c := range changes {
+			summary.add(c)
+		}
+		logSummary(summary, o)
+		return summary, errors.Join(errs...)
+	}
+
+	// deletes go last, so that a failed transfer never leaves the destination with less than it had
+	var transfers, deletes []Change
+	for _, c := range changes {
+		if c.Action == ActionDelete {
+			deletes = append(deletes, c)
+		} else {
+			transfers = append(transfers, c)
+		}
+	}
+
+	done, transferErrs := concur.ProcessConcurrentlyWithResultAndLimit(ctx, workers, transfers,
+		func(ctx context.Context, c Change) (Change, error) {
+			return c, transfer(ctx, src, dst, c.Path, srcSums[c.Path], o.SpoolDir)
+		}, nil)
+	errs = append(errs, transferErrs...)
+
+	if len(transferErrs) == 0 {
+		deleted, deleteErrs := concur.ProcessConcurrentlyWithResultAndLimit(ctx, workers, deletes,
+			func(ctx context.Context, c Change) (Change, error) {
+				if err := dst.Delete(ctx, c.Path); err != nil {
+					return c, fmt.Errorf("delete %s: %w", c.Path, err)
+				}
+				return c, nil
+			}, nil)
+		done = append(done, deleted...)
+		errs = append(errs, deleteErrs...)
+	} else if len(deletes) > 0 {
+		slog.Warn("extraneous objects are not deleted, as some transfers failed",
+			slog.String("module", "reposync"),
+			slog.Int("objects", len(deletes)),
+		)
+	}
+
+	slices.SortFunc(done, func(a, b Change) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	for _, c := range done {
+		summary.add(c)
+	}
+	summary.Failed = len(errs)
+	logSummary(summary, o)
+	return summary, errors.Join(errs...)
+}
+
+// diff lists both sides and compares the objects they have in common,
+// the SHA256 of the source objects computed by the comparison are returned by path
+func diff(
+	ctx context.Context,
+	src, dst storage.Storage,
+	prefix string,
+	withDeletes bool,
+	workers int,
+) ([]Change, map[string]string, int, []error) {
+	srcInfos, err := src.ListAllInfo(ctx, prefix)
+	if err != nil {
+		return nil, nil, 0, []error{fmt.Errorf("list source: %w", err)}
+	}
+	dstInfos, err := dst.ListAllInfo(ctx, prefix)
+	if err != nil {
+		return nil, nil, 0, []error{fmt.Errorf("list destination: %w", err)}
+	}
+
+	dstByPath := make(map[string]storage.ObjectInfo, len(dstInfos))
+	for _, info := range dstInfos {
+		dstByPath[info.Path] = info
+	}
+
+	var changes []Change
+	var candidates []storage.ObjectInfo
+	for _, info := range srcInfos {
+		dstInfo, ok := dstByPath[info.Path]
+		delete(dstByPath, info.Path)
+		switch {
+		case !ok:
+			changes = append(changes, Change{Action: ActionCopy, Path: info.Path, Size: info.Size})
+		case dstInfo.Size != info.Size:
+			changes = append(changes, Change{Action: ActionUpdate, Path: info.Path, Size: info.Size})
+		default:
+			candidates = append(candidates, info)
+		}
+	}
+
+	type update struct {
+		change Change
+		srcSum string
+	}
+	differ, errs := concur.ProcessConcurrentlyWithResultAndLimit(ctx, workers, candidates,
+		func(ctx context.Context, info storage.ObjectInfo) (*update, error) {
+			same, srcSum, err := sameContent(ctx, src, dst, info.Path)
+			if err != nil || same {
+				return nil, err
+			}
+			return &update{Change{Action: ActionUpdate, Path: info.Path, Size: info.Size}, srcSum}, nil
+		},
+		func(u *update) bool { return u != nil },
+	)
+	srcSums := make(map[string]string, len(differ))
+	for _, u := range differ {
+		changes = append(changes, u.change)
+		srcSums[u.change.Path] = u.srcSum
+	}
+	unchanged := len(candidates) - len(differ) - len(errs)
+
+	if withDeletes {
+		for _, info := range dstByPath {
+			changes = append(changes, Change{Action: ActionDelete, Path: info.Path, Size: info.Size})
+		}
+	}
+
+	slices.SortFunc(changes, func(a, b Change) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return changes, srcSums, unchanged, errs
+}
+
+// sameContent compares objects of the same size, the SHA256 of the source is returned when it's known
+func sameContent(ctx context.Context, src, dst storage.Storage, p string) (bool, string, error) {
+	srcInfo, err := src.Stat(ctx, p)
+	if err != nil {
+		return false, "", fmt.Errorf("stat source %s: %w", p, err)
+	}
+	dstInfo, err := dst.Stat(ctx, p)
+	if err != nil {
+		return false, "", fmt.Errorf("stat destination %s: %w", p, err)
+	}
+
+	// equal checksums mean the same content, different ones are not conclusive (i.e. multipart uploads
+	// of the same content with different part sizes). ETags are not compared, as most backends derive
+	// them from versions, not from the content.
+	if srcInfo.Checksum != "" && srcInfo.Checksum == dstInfo.Checksum {
+		return true, "", nil
+	}
+
+	srcSum := srcInfo.Metadata[sha256MetaKey]
+	if srcSum == "" {
+		srcSum, err = src.SHA256(ctx, p)
+		if err != nil {
+			return false, "", fmt.Errorf("checksum source %s: %w", p, err)
+		}
+	}
+	dstSum := dstInfo.Metadata[sha256MetaKey]
+	if dstSum == "" {
+		dstSum, err = dst.SHA256(ctx, p)
+		if err != nil {
+			return false, "", fmt.Errorf("checksum destination %s: %w", p, err)
+		}
+	}
+	return srcSum == dstSum, srcSum, nil
+}
+
+// transfer copies the stored object with its metadata and tags, and records the SHA256 of the content.
+//
+// The recorded checksum is always the one of the uploaded bytes: a known checksum (recorded in the source,
+// or computed by the comparison) is checked against the streamed content, an unknown one is computed while
+// the content is spooled, and the spooled bytes are uploaded then. The source is read once, unless it
+// changed after it was hashed.
+func transfer(ctx context.Context, src, dst storage.Storage, p, srcSum, spoolDir string) error {
+	info, err := src.Stat(ctx, p)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", p, err)
+	}
+	if srcSum == "" {
+		srcSum = info.Metadata[sha256MetaKey]
+	}
+	if srcSum == "" {
+		return transferSpooled(ctx, src, dst, info, spoolDir)
+	}
+
+	rc, err := src.ReadObject(ctx, p)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", p, err)
+	}
+	defer rc.Close()
+
+	h := sha256.New()
+	if err := upload(ctx, dst, info, io.TeeReader(rc, h), srcSum); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) == srcSum {
+		return nil
+	}
+
+	// the source changed after it was hashed, the recorded checksum must not outlive the uploaded content
+	if err := transferSpooled(ctx, src, dst, info, spoolDir); err != nil {
+		if delErr := dst.Delete(ctx, p); delErr != nil {
+			return errors.Join(err, fmt.Errorf("delete %s with a wrong checksum: %w", p, delErr))
+		}
+		return err
+	}
+	return nil
+}
+
+// transferSpooled hashes the content while it's spooled, and uploads the spooled bytes with their checksum
+func transferSpooled(ctx context.Context, src, dst storage.Storage, info storage.ObjectInfo, spoolDir string) error {
+	rc, err := src.ReadObject(ctx, info.Path)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", info.Path, err)
+	}
+	defer rc.Close()
+
+	f, sum, err := spool(rc, spoolDir)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", info.Path, err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	return upload(ctx, dst, info, f, sum)
+}
+
+func upload(ctx context.Context, dst storage.Storage, info storage.ObjectInfo, r io.Reader, sum string) error {
+	metadata := maps.Clone(info.Metadata)
+	if metadata == nil {
+		metadata = make(map[string]string, 1)
+	}
+	metadata[sha256MetaKey] = sum
+
+	err := dst.PutObjectWithOpts(ctx, info.Path, r, &storage.PutObjectOpts{Metadata: metadata, Tags: info.Tags})
+	if err != nil {
+		return fmt.Errorf("write %s: %w", info.Path, err)
+	}
+	return nil
+}
+
+// spool copies the content into a temp file positioned at its start, and returns its SHA256
+func spool(r io.Reader, dir string) (*os.File, string, error) {
+	f, err := os.CreateTemp(dir, "xrepo-sync-*")
+	if err != nil {
+		return nil, "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, "", err
+	}
+	return f, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func logSummary(s *Summary, o *Opts) {
+	slog.Info("sync finished",
+		slog.String("module", "reposync"),
+		slog.Bool("dry-run", o.DryRun),
+		slog.Int("copied", s.Copied),
+		slog.Int("updated", s.Updated),
+		slog.Int("deleted", s.Deleted),
+		slog.Int("unchanged", s.Unchanged),
+		slog.Int("failed", s.Failed),
+		slog.Int64("bytes", s.Bytes),
+	)
+}
@@ -0,0 +1,296 @@
+package reposync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hashmap-kz/streamcrypt/pkg/codec"
+	"github.com/hashmap-kz/streamcrypt/pkg/crypt/aesgcm"
+	"github.com/hashmap-kz/xrepo/pkg/repo"
+	"github.com/hashmap-kz/xrepo/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func put(t *testing.T, s storage.Storage, p, content string) {
+	t.Helper()
+	require.NoError(t, s.PutObject(context.Background(), p, strings.NewReader(content)))
+}
+
+func get(t *testing.T, s storage.Storage, p string) string {
+	t.Helper()
+	rc, err := s.ReadObject(context.Background(), p)
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// fixture returns a source and a destination that differ in every possible way
+func fixture(t *testing.T) (storage.Storage, storage.Storage) {
+	t.Helper()
+	src := storage.NewMemoryStorage()
+	dst := storage.NewMemoryStorage()
+
+	put(t, src, "base/missing", "new object")
+	put(t, src, "base/resized", "longer content")
+	put(t, src, "base/modified", "content-a")
+	put(t, src, "base/same", "unchanged")
+
+	put(t, dst, "base/resized", "short")
+	put(t, dst, "base/modified", "content-b")
+	put(t, dst, "base/same", "unchanged")
+	put(t, dst, "base/extra", "extraneous")
+	return src, dst
+}
+
+func TestSync_CopiesChangesAndKeepsExtraneous(t *testing.T) {
+	src, dst := fixture(t)
+
+	summary, err := Sync(context.Background(), src, dst, &Opts{})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, summary.Copied)
+	assert.Equal(t, 2, summary.Updated)
+	assert.Equal(t, 0, summary.Deleted)
+	assert.Equal(t, 1, summary.Unchanged)
+	assert.Equal(t, 0, summary.Failed)
+	assert.Equal(t, int64(len("new object")+len("longer content")+len("content-a")), summary.Bytes)
+	assert.Equal(t, []Change{
+		{Action: ActionCopy, Path: "base/missing", Size: 10},
+		{Action: ActionUpdate, Path: "base/modified", Size: 9},
+		{Action: ActionUpdate, Path: "base/resized", Size: 14},
+	}, summary.Changes)
+
+	assert.Equal(t, "new object", get(t, dst, "base/missing"))
+	assert.Equal(t, "longer content", get(t, dst, "base/resized"))
+	assert.Equal(t, "content-a", get(t, dst, "base/modified"))
+	assert.Equal(t, "extraneous", get(t, dst, "base/extra"))
+}
+
+func TestSync_DeletesExtraneous(t *testing.T) {
+	src, dst := fixture(t)
+
+	summary, err := Sync(context.Background(), src, dst, &Opts{Delete: true, Workers: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Deleted)
+
+	srcAll, err := src.ListAll(context.Background(), "")
+	require.NoError(t, err)
+	dstAll, err := dst.ListAll(context.Background(), "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, srcAll, dstAll)
+
+	// nothing is left to do
+	summary, err = Sync(context.Background(), src, dst, &Opts{Delete: true})
+	require.NoError(t, err)
+	assert.Empty(t, summary.Changes)
+	assert.Equal(t, 4, summary.Unchanged)
+}
+
+func TestSync_DryRunChangesNothing(t *testing.T) {
+	src, dst := fixture(t)
+	before, err := dst.ListAll(context.Background(), "")
+	require.NoError(t, err)
+
+	summary, err := Sync(context.Background(), src, dst, &Opts{Delete: true, DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Copied)
+	assert.Equal(t, 2, summary.Updated)
+	assert.Equal(t, 1, summary.Deleted)
+	assert.Len(t, summary.Changes, 4)
+
+	after, err := dst.ListAll(context.Background(), "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, before, after)
+	assert.Equal(t, "content-b", get(t, dst, "base/modified"))
+}
+
+func TestSync_Prefix(t *testing.T) {
+	src := storage.NewMemoryStorage()
+	dst := storage.NewMemoryStorage()
+	put(t, src, "a/obj", "a")
+	put(t, src, "b/obj", "b")
+	put(t, dst, "b/extra", "b")
+
+	summary, err := Sync(context.Background(), src, dst, &Opts{Prefix: "a/", Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, []Change{{Action: ActionCopy, Path: "a/obj", Size: 1}}, summary.Changes)
+
+	all, err := dst.ListAll(context.Background(), "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a/obj", "b/extra"}, all)
+}
+
+func TestSync_CarriesMetadataAndTags(t *testing.T) {
+	src := storage.NewMemoryStorage()
+	dst := storage.NewMemoryStorage()
+	ctx := context.Background()
+	require.NoError(t, src.PutObjectWithOpts(ctx, "obj", strings.NewReader("data"), &storage.PutObjectOpts{
+		Metadata: map[string]string{"origin": "primary"},
+		Tags:     map[string]string{"retention": "30d"},
+	}))
+
+	_, err := Sync(ctx, src, dst, &Opts{})
+	require.NoError(t, err)
+
+	info, err := dst.Stat(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, "primary", info.Metadata["origin"])
+	assert.Equal(t, "30d", info.Tags["retention"])
+}
+
+// hashCountingStorage counts the objects hashed by reading them through
+type hashCountingStorage struct {
+	storage.Storage
+	hashed int
+}
+
+func (s *hashCountingStorage) SHA256(ctx context.Context, p string) (string, error) {
+	s.hashed++
+	return s.Storage.SHA256(ctx, p)
+}
+
+func TestSync_RecordsChecksums(t *testing.T) {
+	ctx := context.Background()
+	local, err := storage.NewLocal(&storage.LocalStorageOpts{BaseDir: t.TempDir()})
+	require.NoError(t, err)
+	remote, err := storage.NewLocal(&storage.LocalStorageOpts{BaseDir: t.TempDir()})
+	require.NoError(t, err)
+	src := &hashCountingStorage{Storage: local}
+	dst := &hashCountingStorage{Storage: remote}
+	put(t, src, "obj", "content-a")
+
+	_, err = Sync(ctx, src, dst, &Opts{SpoolDir: t.TempDir()})
+	require.NoError(t, err)
+	assert.Equal(t, 0, src.hashed, "the checksum is computed from the transferred content")
+	info, err := dst.Stat(ctx, "obj")
+	require.NoError(t, err)
+	expected, err := src.SHA256(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, expected, info.Metadata[sha256MetaKey])
+
+	// the destination is compared by the recorded checksum, without reading it back
+	put(t, src, "obj", "content-b")
+	src.hashed = 0
+	summary, err := Sync(ctx, src, dst, &Opts{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Updated)
+	assert.Equal(t, "content-b", get(t, dst, "obj"))
+	assert.Equal(t, 0, dst.hashed)
+	assert.Equal(t, 1, src.hashed, "the checksum of the comparison is reused by the transfer")
+
+	summary, err = Sync(ctx, src, dst, &Opts{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Unchanged)
+	assert.Equal(t, 0, dst.hashed)
+}
+
+func TestSync_WrongRecordedChecksumIsNotCopied(t *testing.T) {
+	src := storage.NewMemoryStorage()
+	dst := storage.NewMemoryStorage()
+	ctx := context.Background()
+	// i.e. the object was overwritten after it was hashed
+	require.NoError(t, src.PutObjectWithOpts(ctx, "obj", strings.NewReader("content"), &storage.PutObjectOpts{
+		Metadata: map[string]string{sha256MetaKey: "stale"},
+	}))
+	expected, err := src.SHA256(ctx, "obj")
+	require.NoError(t, err)
+
+	_, err = Sync(ctx, src, dst, &Opts{})
+	require.NoError(t, err)
+	info, err := dst.Stat(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, expected, info.Metadata[sha256MetaKey])
+	assert.Equal(t, "content", get(t, dst, "obj"))
+}
+
+// sameETagStorage reports the same ETag for every object, the way version based ETags may collide
+type sameETagStorage struct {
+	storage.Storage
+}
+
+func (s *sameETagStorage) Stat(ctx context.Context, p string) (storage.ObjectInfo, error) {
+	info, err := s.Storage.Stat(ctx, p)
+	info.ETag = "1"
+	return info, err
+}
+
+func TestSync_ETagsAreNotCompared(t *testing.T) {
+	src := &sameETagStorage{Storage: storage.NewMemoryStorage()}
+	dst := &sameETagStorage{Storage: storage.NewMemoryStorage()}
+	put(t, src, "obj", "content-a")
+	put(t, dst, "obj", "content-b")
+
+	summary, err := Sync(context.Background(), src, dst, &Opts{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Updated)
+	assert.Equal(t, "content-a", get(t, dst, "obj"))
+}
+
+func TestSync_FailuresAreReportedAndSkipDeletes(t *testing.T) {
+	src, dst := fixture(t)
+	faulty := storage.NewFaultStorage(dst, 1, storage.Fault{
+		Kind: storage.FaultError,
+		Ops:  []string{"put"},
+		Path: "base/missing",
+	})
+
+	summary, err := Sync(context.Background(), src, faulty, &Opts{Delete: true})
+	require.ErrorIs(t, err, storage.ErrInjectedFault)
+	assert.Contains(t, err.Error(), "base/missing")
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, 0, summary.Copied)
+	assert.Equal(t, 2, summary.Updated)
+	assert.Equal(t, 0, summary.Deleted)
+	assert.Equal(t, "extraneous", get(t, dst, "base/extra"))
+}
+
+func TestSync_ListingFailure(t *testing.T) {
+	src, dst := fixture(t)
+	faulty := storage.NewFaultStorage(src, 1, storage.Fault{Kind: storage.FaultError, Ops: []string{"list"}})
+
+	summary, err := Sync(context.Background(), faulty, dst, &Opts{Delete: true})
+	require.ErrorIs(t, err, storage.ErrInjectedFault)
+	assert.Empty(t, summary.Changes)
+	assert.Equal(t, "extraneous", get(t, dst, "base/extra"))
+}
+
+func TestSync_EncryptedRepoRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("encrypted backup "), 50_000)
+
+	local := storage.NewMemoryStorage()
+	remote := storage.NewMemoryStorage()
+	newRepo := func(s storage.Storage) repo.WriteReader {
+		return repo.NewWriteReader(s, &codec.GzipCompressor{}, aesgcm.NewChunkedGCMCrypter("sync-key"))
+	}
+
+	_, err := newRepo(local).PutObject(ctx, "base/obj", bytes.NewReader(content))
+	require.NoError(t, err)
+	_, err = Sync(ctx, local, remote, &Opts{})
+	require.NoError(t, err)
+
+	// objects are mirrored as they are stored, not decoded
+	stored, err := local.ListAll(ctx, "")
+	require.NoError(t, err)
+	for _, p := range stored {
+		assert.Equal(t, get(t, local, p), get(t, remote, p))
+	}
+
+	// a restore syncs them back into an empty repo
+	restored := storage.NewMemoryStorage()
+	_, err = Sync(ctx, remote, restored, &Opts{})
+	require.NoError(t, err)
+
+	rc, err := newRepo(restored).ReadObject(ctx, "base/obj")
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+}
@@ -0,0 +1,524 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+const (
+	azureBlockSize   = 5 * 1024 * 1024
+	azureConcurrency = 2
+
+	// azureCopyPollInterval is how often the status of a pending server-side copy is checked
+	azureCopyPollInterval = 500 * time.Millisecond
+)
+
+type azureBlobStorage struct {
+	client *container.Client
+	prefix string
+}
+
+var _ Storage = &azureBlobStorage{}
+
+// NewAzureBlobStorage stores objects as block blobs of the container, under the given prefix
+func NewAzureBlobStorage(client *container.Client, prefix string) Storage {
+	return &azureBlobStorage{
+		client: client,
+		prefix: strings.Trim(filepath.ToSlash(prefix), "/"),
+	}
+}
+
+// fullPath resolves the path to a blob name under the prefix, paths that escape it are rejected
+func (s *azureBlobStorage) fullPath(p string) (string, error) {
+	name, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	name = path.Join(s.prefix, name)
+	if name == "." {
+		return "", nil
+	}
+	return strings.TrimPrefix(name, "/"), nil
+}
+
+// keyPrefix resolves a listing prefix to a blob name prefix, keeping the trailing slash
+// so that "a/" (or the storage root) does not match sibling blobs like "ab/...".
+// A prefix without it still lists sibling blobs, they are dropped with matchesKeyPrefix.
+func (s *azureBlobStorage) keyPrefix(prefix string) (string, error) {
+	fullPath, err := s.fullPath(prefix)
+	if err != nil || fullPath == "" {
+		return "", err
+	}
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return fullPath + "/", nil
+	}
+	return fullPath, nil
+}
+
+// azureValue dereferences optional fields of SDK responses
+func azureValue[T any](p *T) T {
+	var zero T
+	if p == nil {
+		return zero
+	}
+	return *p
+}
+
+func (s *azureBlobStorage) relPath(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return strings.TrimPrefix(name, s.prefix+"/")
+}
+
+// notFound maps the missing blob error to fs.ErrNotExist
+func (s *azureBlobStorage) notFound(op, p string, err error) error {
+	if bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound) {
+		return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+// isRetryable treats throttling and server-side failures as transient
+func (s *azureBlobStorage) isRetryable(err error) bool {
+	var re *azcore.ResponseError
+	if errors.As(err, &re) {
+		return isRetryableStatus(re.StatusCode)
+	}
+	return isTransientError(err)
+}
+
+func (s *azureBlobStorage) PutObject(ctx context.Context, p string, r io.Reader) error {
+	return s.PutObjectWithOpts(ctx, p, r, nil)
+}
+
+// PutObjectWithOpts uploads the content as staged blocks, which become visible at once when the block list is committed.
+// Metadata is sent as blob metadata, tags as blob index tags.
+func (s *azureBlobStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	name, err := s.fullPath(p)
+	if err != nil {
+		return err
+	}
+	uploadOpts := &blockblob.UploadStreamOptions{
+		BlockSize:   azureBlockSize,
+		Concurrency: azureConcurrency,
+	}
+	if meta := newObjectMeta(opts); meta != nil {
+		metadata, err := encodeAzureMetadata(meta.Metadata)
+		if err != nil {
+			return err
+		}
+		uploadOpts.Metadata = metadata
+		uploadOpts.Tags = meta.Tags
+	}
+
+	_, err = s.client.NewBlockBlobClient(name).UploadStream(ctx, r, uploadOpts)
+	if err != nil {
+		return fmt.Errorf("failed to upload blob: %w", err)
+	}
+	return nil
+}
+
+// encodeAzureMetadata maps metadata keys onto C# identifiers, as Azure requires:
+// '-' and '_' are escaped by their hex codes, as "_x2d_" and "_x5f_"
+func encodeAzureMetadata(m map[string]string) (map[string]*string, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	result := make(map[string]*string, len(m))
+	for k, v := range m {
+		var sb strings.Builder
+		for i, c := range k {
+			switch {
+			case c == '_', c == '-':
+				fmt.Fprintf(&sb, "_x%02x_", c)
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9' && i > 0:
+				sb.WriteRune(c)
+			default:
+				return nil, fmt.Errorf("metadata key is not supported by azure: %q", k)
+			}
+		}
+		result[sb.String()] = to.Ptr(v)
+	}
+	return result, nil
+}
+
+// decodeAzureMetadata reverses encodeAzureMetadata, Azure keys are case-insensitive and are reported
+// in lower case. Underscores that don't start an escape are kept as they are.
+func decodeAzureMetadata(m map[string]*string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		k = strings.ToLower(k)
+		var sb strings.Builder
+		for i := 0; i < len(k); i++ {
+			if k[i] == '_' && i+5 <= len(k) && k[i+1] == 'x' && k[i+4] == '_' {
+				if b, err := hex.DecodeString(k[i+2 : i+4]); err == nil {
+					sb.WriteByte(b[0])
+					i += 4
+					continue
+				}
+			}
+			sb.WriteByte(k[i])
+		}
+		result[sb.String()] = azureValue(v)
+	}
+	return result
+}
+
+func (s *azureBlobStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	name, err := s.fullPath(p)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.NewBlobClient(name).DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", s.notFound("read", p, err))
+	}
+	return resp.Body, nil
+}
+
+func (s *azureBlobStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	name, err := s.fullPath(p)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	// a zero count means up to the end
+	byteRange := blob.HTTPRange{Offset: offset}
+	if length > 0 {
+		byteRange.Count = length
+	}
+
+	resp, err := s.client.NewBlobClient(name).DownloadStream(ctx, &blob.DownloadStreamOptions{
+		Range: byteRange,
+	})
+	if err != nil {
+		// the range starts past the end of the blob
+		if bloberror.HasCode(err, bloberror.InvalidRange) {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		return nil, fmt.Errorf("failed to read blob range: %w", s.notFound("read", p, err))
+	}
+	return resp.Body, nil
+}
+
+func (s *azureBlobStorage) Exists(ctx context.Context, p string) (bool, error) {
+	name, err := s.fullPath(p)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.client.NewBlobClient(name).GetProperties(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *azureBlobStorage) SHA256(ctx context.Context, p string) (string, error) {
+	obj, err := s.ReadObject(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, obj); err != nil {
+		return "", fmt.Errorf("failed to hash blob: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *azureBlobStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	name, err := s.fullPath(p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	blobClient := s.client.NewBlobClient(name)
+
+	props, err := blobClient.GetProperties(ctx, nil)
+	if err != nil {
+		return ObjectInfo{}, s.notFound("stat", p, err)
+	}
+
+	tags, err := s.getTags(ctx, blobClient, props.TagCount)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info := ObjectInfo{
+		Path:      s.relPath(name),
+		Size:      azureValue(props.ContentLength),
+		ModTime:   azureValue(props.LastModified),
+		VersionID: azureValue(props.VersionID),
+		Metadata:  decodeAzureMetadata(props.Metadata),
+		Tags:      tags,
+	}
+	if props.ETag != nil {
+		info.ETag = strings.Trim(string(*props.ETag), `"`)
+	}
+	// MD5 is kept only for blobs uploaded in a single request
+	if len(props.ContentMD5) > 0 {
+		info.Checksum = "md5:" + base64.StdEncoding.EncodeToString(props.ContentMD5)
+	}
+	return info, nil
+}
+
+// getTags reads blob index tags, only when the properties report some. Tags that cannot be read
+// (i.e. a SAS token without the tag permission, or an account with hierarchical namespace) are reported as none.
+func (s *azureBlobStorage) getTags(ctx context.Context, blobClient *blob.Client, tagCount *int64) (map[string]string, error) {
+	if azureValue(tagCount) == 0 {
+		return nil, nil
+	}
+	resp, err := blobClient.GetTags(ctx, nil)
+	if err != nil {
+		if isAzureTagReadUnsupported(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get blob tags: %w", err)
+	}
+	if len(resp.BlobTagSet) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string, len(resp.BlobTagSet))
+	for _, tag := range resp.BlobTagSet {
+		tags[azureValue(tag.Key)] = azureValue(tag.Value)
+	}
+	return tags, nil
+}
+
+// isAzureTagReadUnsupported tells denied or unsupported tag reads from failures of the request
+func isAzureTagReadUnsupported(err error) bool {
+	var re *azcore.ResponseError
+	if !errors.As(err, &re) {
+		return false
+	}
+	switch re.StatusCode {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusConflict, http.StatusNotImplemented:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *azureBlobStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	return collectPaths(s.Walk(ctx, prefix))
+}
+
+func (s *azureBlobStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return collectInfos(s.Walk(ctx, prefix))
+}
+
+func (s *azureBlobStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		keyPrefix, err := s.keyPrefix(prefix)
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+		pager := s.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+			Prefix: to.Ptr(keyPrefix),
+		})
+
+		// the next page is requested only when the current one is consumed
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				yield(ObjectInfo{}, fmt.Errorf("failed to get page: %w", err))
+				return
+			}
+
+			for _, item := range page.Segment.BlobItems {
+				if item.Name == nil || !matchesKeyPrefix(*item.Name, keyPrefix) {
+					continue
+				}
+				info := ObjectInfo{
+					Path:      s.relPath(*item.Name),
+					VersionID: azureValue(item.VersionID),
+				}
+				if props := item.Properties; props != nil {
+					info.Size = azureValue(props.ContentLength)
+					info.ModTime = azureValue(props.LastModified)
+					if props.ETag != nil {
+						info.ETag = strings.Trim(string(*props.ETag), `"`)
+					}
+				}
+				if !yield(info, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ListTopLevelDirs returns the "directories" directly under the prefix (relative to the storage root),
+// using a delimiter listing, so the blobs inside of them are not enumerated.
+func (s *azureBlobStorage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	dirPrefix, err := s.fullPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if dirPrefix != "" {
+		dirPrefix += "/"
+	}
+
+	pager := s.client.NewListBlobsHierarchyPager("/", &container.ListBlobsHierarchyOptions{
+		Prefix: to.Ptr(dirPrefix),
+	})
+
+	result := make(map[string]bool)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list blobs in container: %w", err)
+		}
+		for _, blobPrefix := range page.Segment.BlobPrefixes {
+			if blobPrefix.Name == nil {
+				continue
+			}
+			result[s.relPath(strings.TrimSuffix(*blobPrefix.Name, "/"))] = true
+		}
+	}
+	return result, nil
+}
+
+func (s *azureBlobStorage) Delete(ctx context.Context, p string) error {
+	name, err := s.fullPath(p)
+	if err != nil {
+		return err
+	}
+	return s.deleteBlob(ctx, name)
+}
+
+func (s *azureBlobStorage) deleteBlob(ctx context.Context, name string) error {
+	_, err := s.client.NewBlobClient(name).Delete(ctx, &blob.DeleteOptions{
+		DeleteSnapshots: to.Ptr(blob.DeleteSnapshotsOptionTypeInclude),
+	})
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
+
+func (s *azureBlobStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	keyPrefix, err := s.keyPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	pager := s.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix: to.Ptr(keyPrefix),
+	})
+
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get page: %w", err)
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil || !matchesKeyPrefix(*item.Name, keyPrefix) {
+				continue
+			}
+			if err := s.deleteBlob(ctx, *item.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Copy starts a server-side copy and waits for it to complete.
+// Metadata is carried over by the service, index tags are not, so they are passed explicitly.
+func (s *azureBlobStorage) Copy(ctx context.Context, src, dst string) error {
+	srcName, err := s.fullPath(src)
+	if err != nil {
+		return err
+	}
+	dstName, err := s.fullPath(dst)
+	if err != nil {
+		return err
+	}
+	srcClient := s.client.NewBlobClient(srcName)
+	props, err := srcClient.GetProperties(ctx, nil)
+	if err != nil {
+		return s.notFound("copy", src, err)
+	}
+	if srcName == dstName {
+		return nil
+	}
+	tags, err := s.getTags(ctx, srcClient, props.TagCount)
+	if err != nil {
+		return err
+	}
+
+	dstClient := s.client.NewBlobClient(dstName)
+	resp, err := dstClient.StartCopyFromURL(ctx, srcClient.URL(), &blob.StartCopyFromURLOptions{
+		BlobTags: tags,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy blob: %w", err)
+	}
+
+	status := azureValue(resp.CopyStatus)
+	for status == blob.CopyStatusTypePending {
+		select {
+		case <-ctx.Done():
+			_, _ = dstClient.AbortCopyFromURL(context.WithoutCancel(ctx), azureValue(resp.CopyID), nil)
+			return ctx.Err()
+		case <-time.After(azureCopyPollInterval):
+		}
+
+		props, err := dstClient.GetProperties(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to get copy status: %w", err)
+		}
+		status = azureValue(props.CopyStatus)
+		if status != blob.CopyStatusTypePending && status != blob.CopyStatusTypeSuccess {
+			return fmt.Errorf("failed to copy blob, status %s: %s", status, azureValue(props.CopyStatusDescription))
+		}
+	}
+	if status != blob.CopyStatusTypeSuccess {
+		return fmt.Errorf("failed to copy blob, status %s", status)
+	}
+	return nil
+}
+
+// Rename is copy+delete, Azure Blob has no move operation
+func (s *azureBlobStorage) Rename(ctx context.Context, src, dst string) error {
+	if err := s.Copy(ctx, src, dst); err != nil {
+		return err
+	}
+	if same, err := samePath(src, dst); err != nil || same {
+		return err
+	}
+	return s.Delete(ctx, src)
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAzureMetadata_RoundTrip(t *testing.T) {
+	meta := map[string]string{
+		"source-host":   "pg-01",
+		"pg_timeline":   "3",
+		"lsn":           "0/3000028",
+		"original-mode": "0600",
+	}
+
+	encoded, err := encodeAzureMetadata(meta)
+	require.NoError(t, err)
+	for k := range encoded {
+		assert.NotContains(t, k, "-")
+	}
+	assert.Contains(t, encoded, "source_x2d_host")
+	assert.Contains(t, encoded, "pg_x5f_timeline")
+
+	assert.Equal(t, meta, decodeAzureMetadata(encoded))
+}
+
+func TestAzureMetadata_DistinctKeysStayDistinct(t *testing.T) {
+	meta := map[string]string{"a-_b": "1", "a_-b": "2", "a__b": "3", "a--b": "4", "a_x2d_b": "5"}
+
+	encoded, err := encodeAzureMetadata(meta)
+	require.NoError(t, err)
+	assert.Len(t, encoded, len(meta))
+	assert.Equal(t, meta, decodeAzureMetadata(encoded))
+
+	// Azure may report the keys in another case
+	upper := make(map[string]*string, len(encoded))
+	for k, v := range encoded {
+		upper[strings.ToUpper(k)] = v
+	}
+	assert.Equal(t, meta, decodeAzureMetadata(upper))
+}
+
+func TestAzureMetadata_InvalidKeys(t *testing.T) {
+	for _, k := range []string{"1st", "with space", "dotted.key"} {
+		_, err := encodeAzureMetadata(map[string]string{k: "v"})
+		assert.Error(t, err, k)
+	}
+}
+
+func TestIsAzureTagReadUnsupported(t *testing.T) {
+	for _, code := range []int{http.StatusBadRequest, http.StatusForbidden, http.StatusConflict, http.StatusNotImplemented} {
+		err := fmt.Errorf("failed: %w", &azcore.ResponseError{StatusCode: code})
+		assert.True(t, isAzureTagReadUnsupported(err), code)
+	}
+	assert.False(t, isAzureTagReadUnsupported(&azcore.ResponseError{StatusCode: http.StatusServiceUnavailable}))
+	assert.False(t, isAzureTagReadUnsupported(errors.New("connection reset")))
+}
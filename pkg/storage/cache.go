@@ -0,0 +1,633 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type CacheMode string
+
+const (
+	// CacheWriteAround sends uploads to the backend only, the object is cached when it's read
+	CacheWriteAround CacheMode = "write-around"
+
+	// CacheWriteThrough keeps a copy of every upload in the cache
+	CacheWriteThrough CacheMode = "write-through"
+)
+
+type CacheOpts struct {
+	Dir      string    // required, the cache survives restarts
+	MaxBytes int64     // required, least recently used objects are evicted above it
+	Mode     CacheMode // write-around by default
+
+	// Namespace identifies the backend (i.e. "s3:bucket/prefix"), caches of different storages
+	// may share the dir as long as their namespaces differ
+	Namespace string
+
+	// RevalidateAfter is how long a cached copy is served without asking the backend after it was validated,
+	// changes made by other writers in the meantime are not noticed. Every read is validated when it's not set.
+	RevalidateAfter time.Duration
+}
+
+const cacheMetaExt = ".json"
+
+// cacheEntry describes a cached object, the validators are the ones of the backend object it was taken from
+type cacheEntry struct {
+	Namespace string    `json:"namespace,omitempty"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	ETag      string    `json:"etag,omitempty"`
+
+	file        string
+	validatedAt time.Time // of the last Stat that matched, entries of a previous run are validated first
+}
+
+// id is the key of the entry in the index of the dir
+func (e *cacheEntry) id() string {
+	return cacheEntryID(e.Namespace, e.Path)
+}
+
+func cacheEntryID(namespace, key string) string {
+	return namespace + "\x00" + key
+}
+
+// matches reports whether the cached copy is still the current version of the backend object.
+// ETags are compared when both sides have them, size and modification time otherwise.
+func (e *cacheEntry) matches(info ObjectInfo) bool {
+	if e.Size != info.Size {
+		return false
+	}
+	if e.ETag != "" && info.ETag != "" {
+		return e.ETag == info.ETag
+	}
+	return e.ModTime.Equal(info.ModTime)
+}
+
+// sameAs reports whether both describe the same copy of the same object
+func (e *cacheEntry) sameAs(other *cacheEntry) bool {
+	return e.Namespace == other.Namespace && e.Path == other.Path && e.Size == other.Size &&
+		e.ETag == other.ETag && e.ModTime.Equal(other.ModTime)
+}
+
+// cacheIndex keeps the order of use of the objects in a cache dir. It's shared by all the caches
+// over the dir in the process (one per storage), so that MaxBytes bounds the dir as a whole.
+type cacheIndex struct {
+	dir string
+
+	mu       sync.Mutex
+	maxBytes int64
+	lru      *list.List // *cacheEntry, most recently used first
+	entries  map[string]*list.Element
+	size     int64
+}
+
+var (
+	cacheIndexesMu sync.Mutex
+	cacheIndexes   = make(map[string]*cacheIndex)
+)
+
+// openCacheIndex returns the index of the dir, it's loaded from the disk when the dir is opened for the first time.
+// The smallest size requested for the dir is the one enforced.
+func openCacheIndex(dir string, maxBytes int64) (*cacheIndex, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheIndexesMu.Lock()
+	defer cacheIndexesMu.Unlock()
+	if idx, ok := cacheIndexes[abs]; ok {
+		idx.mu.Lock()
+		defer idx.mu.Unlock()
+		if maxBytes < idx.maxBytes {
+			idx.maxBytes = maxBytes
+			idx.evictLocked()
+		}
+		return idx, nil
+	}
+
+	if err := os.MkdirAll(abs, 0o750); err != nil {
+		return nil, err
+	}
+	idx := &cacheIndex{
+		dir:      abs,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	if err := idx.load(); err != nil {
+		return nil, err
+	}
+	cacheIndexes[abs] = idx
+	return idx, nil
+}
+
+type cacheStorage struct {
+	s               Storage
+	idx             *cacheIndex
+	namespace       string
+	mode            CacheMode
+	revalidateAfter time.Duration
+}
+
+var _ Storage = &cacheStorage{}
+
+// NewCacheStorage serves reads of hot objects from a bounded local directory.
+//
+// Reads validate the cached copy with a Stat of the backend object, so changes made by other writers
+// are noticed, unless it was validated within RevalidateAfter. Objects are cached after they were read to the end,
+// ranges are served from the cache when the object is there, and passed to the backend otherwise.
+// Objects that are bigger than the cache are never cached.
+func NewCacheStorage(s Storage, o *CacheOpts) (Storage, error) {
+	if o.Dir == "" {
+		return nil, errors.New("cache dir is required")
+	}
+	if o.MaxBytes <= 0 {
+		return nil, errors.New("cache size is required")
+	}
+	mode := o.Mode
+	switch mode {
+	case "":
+		mode = CacheWriteAround
+	case CacheWriteAround, CacheWriteThrough:
+	default:
+		return nil, fmt.Errorf("unknown cache mode: %s", mode)
+	}
+
+	idx, err := openCacheIndex(o.Dir, o.MaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheStorage{
+		s:               s,
+		idx:             idx,
+		namespace:       o.Namespace,
+		mode:            mode,
+		revalidateAfter: o.RevalidateAfter,
+	}, nil
+}
+
+// load restores the index of a previous run, the order of use is kept in the modification times of the files
+func (idx *cacheIndex) load() error {
+	dirEntries, err := os.ReadDir(idx.dir)
+	if err != nil {
+		return err
+	}
+
+	type loaded struct {
+		e      *cacheEntry
+		usedAt time.Time
+	}
+	var all []loaded
+	for _, d := range dirEntries {
+		name := d.Name()
+		if d.IsDir() || !strings.HasSuffix(name, cacheMetaExt) {
+			// data files are picked up with their metadata, leftovers of interrupted downloads are removed
+			if isTempName(name) {
+				_ = os.Remove(filepath.Join(idx.dir, name))
+			}
+			continue
+		}
+		file := filepath.Join(idx.dir, strings.TrimSuffix(name, cacheMetaExt))
+		e, err := readCacheMeta(filepath.Join(idx.dir, name))
+		// the name is derived from the identity of the object, a file of another object is never served
+		if err != nil || file != idx.fileOf(e) {
+			removeCacheFiles(file)
+			continue
+		}
+		st, err := os.Stat(file)
+		if err != nil || st.Size() != e.Size {
+			removeCacheFiles(file)
+			continue
+		}
+		e.file = file
+		all = append(all, loaded{e: e, usedAt: st.ModTime()})
+	}
+
+	slices.SortFunc(all, func(a, b loaded) int {
+		return b.usedAt.Compare(a.usedAt)
+	})
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, l := range all {
+		idx.entries[l.e.id()] = idx.lru.PushBack(l.e)
+		idx.size += l.e.Size
+	}
+	idx.evictLocked()
+	return nil
+}
+
+func readCacheMeta(name string) (*cacheEntry, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (c *cacheStorage) key(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+}
+
+func (idx *cacheIndex) fileOf(e *cacheEntry) string {
+	sum := sha256.Sum256([]byte(e.id()))
+	return filepath.Join(idx.dir, hex.EncodeToString(sum[:]))
+}
+
+func removeCacheFiles(file string) {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		slog.Warn("cannot remove cached object", slog.String("module", "storage"), slog.Any("err", err))
+	}
+	_ = os.Remove(file + cacheMetaExt)
+}
+
+// lookup returns the cached copy of the object, if it matches the backend one, and marks it as used.
+// Without the info of the backend object, only a copy validated within RevalidateAfter is returned.
+// The metadata on the disk is checked as well, so that a file replaced behind the index is never served.
+func (c *cacheStorage) lookup(key string, info *ObjectInfo) (*cacheEntry, bool) {
+	idx := c.idx
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	el, ok := idx.entries[cacheEntryID(c.namespace, key)]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if info == nil {
+		if c.revalidateAfter <= 0 || time.Since(e.validatedAt) >= c.revalidateAfter {
+			return nil, false
+		}
+	} else if !e.matches(*info) {
+		idx.removeLocked(el)
+		return nil, false
+	}
+	if onDisk, err := readCacheMeta(e.file + cacheMetaExt); err != nil || !onDisk.sameAs(e) {
+		idx.removeLocked(el)
+		return nil, false
+	}
+	if info != nil {
+		e.validatedAt = time.Now()
+	}
+	idx.lru.MoveToFront(el)
+	now := time.Now()
+	_ = os.Chtimes(e.file, now, now)
+	return e, true
+}
+
+func (idx *cacheIndex) removeLocked(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	idx.lru.Remove(el)
+	delete(idx.entries, e.id())
+	idx.size -= e.Size
+	removeCacheFiles(e.file)
+}
+
+func (idx *cacheIndex) evictLocked() {
+	for idx.size > idx.maxBytes && idx.lru.Len() > 0 {
+		idx.removeLocked(idx.lru.Back())
+	}
+}
+
+func (idx *cacheIndex) maxBytesOf() int64 {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.maxBytes
+}
+
+// fits reports whether an object of the size may be cached at all
+func (idx *cacheIndex) fits(size int64) bool {
+	return size <= idx.maxBytesOf()
+}
+
+// invalidate drops the cached copy of the object
+func (c *cacheStorage) invalidate(p string) {
+	id := cacheEntryID(c.namespace, c.key(p))
+	c.idx.mu.Lock()
+	defer c.idx.mu.Unlock()
+	if el, ok := c.idx.entries[id]; ok {
+		c.idx.removeLocked(el)
+	}
+}
+
+// invalidatePrefix drops the cached copies of all objects under the dir prefix
+func (c *cacheStorage) invalidatePrefix(prefix string) {
+	dir := c.key(prefix)
+	c.idx.mu.Lock()
+	defer c.idx.mu.Unlock()
+	for _, el := range c.idx.entries {
+		e := el.Value.(*cacheEntry)
+		if e.Namespace != c.namespace {
+			continue
+		}
+		if dir == "" || e.Path == dir || strings.HasPrefix(e.Path, dir+"/") {
+			c.idx.removeLocked(el)
+		}
+	}
+}
+
+// commit moves a complete download (or upload) into the cache
+func (idx *cacheIndex) commit(tmp string, e *cacheEntry) error {
+	e.file = idx.fileOf(e)
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if el, ok := idx.entries[e.id()]; ok {
+		idx.removeLocked(el)
+	}
+	if err := os.WriteFile(e.file+cacheMetaExt, meta, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, e.file); err != nil {
+		_ = os.Remove(e.file + cacheMetaExt)
+		return err
+	}
+	idx.entries[e.id()] = idx.lru.PushFront(e)
+	idx.size += e.Size
+	idx.evictLocked()
+	return nil
+}
+
+func (idx *cacheIndex) createTemp() (*os.File, error) {
+	return os.CreateTemp(idx.dir, tmpFilePrefix+"*")
+}
+
+// newEntry describes the cached copy of the backend object, the info is the one of a Stat just made
+func (c *cacheStorage) newEntry(key string, info ObjectInfo) *cacheEntry {
+	return &cacheEntry{
+		Namespace:   c.namespace,
+		Path:        key,
+		Size:        info.Size,
+		ModTime:     info.ModTime,
+		ETag:        info.ETag,
+		validatedAt: time.Now(),
+	}
+}
+
+func (c *cacheStorage) isRetryable(err error) bool {
+	return isRetryableBy(c.s, err)
+}
+
+func (c *cacheStorage) PutObject(ctx context.Context, p string, r io.Reader) error {
+	return c.PutObjectWithOpts(ctx, p, r, nil)
+}
+
+func (c *cacheStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	c.invalidate(p)
+	if c.mode != CacheWriteThrough {
+		return c.s.PutObjectWithOpts(ctx, p, r, opts)
+	}
+
+	tmp, err := c.idx.createTemp()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	// the cache copy is best-effort, a failed write drops it without failing the upload
+	tw := &cacheTeeWriter{w: tmp, limit: c.idx.maxBytesOf()}
+	if err := c.s.PutObjectWithOpts(ctx, p, io.TeeReader(r, tw), opts); err != nil {
+		return err
+	}
+	if tw.failed || tmp.Close() != nil {
+		return nil
+	}
+	info, err := c.s.Stat(ctx, p)
+	if err != nil || info.Size != tw.n {
+		return nil
+	}
+	if err := c.idx.commit(tmp.Name(), c.newEntry(c.key(p), info)); err != nil {
+		slog.Warn("cannot cache uploaded object", slog.String("module", "storage"), slog.String("path", p), slog.Any("err", err))
+	}
+	return nil
+}
+
+// cacheTeeWriter never fails the stream it copies, it gives up on the copy instead
+type cacheTeeWriter struct {
+	w      io.Writer
+	n      int64
+	limit  int64
+	failed bool
+}
+
+func (t *cacheTeeWriter) Write(p []byte) (int, error) {
+	if t.failed {
+		return len(p), nil
+	}
+	if t.n+int64(len(p)) > t.limit {
+		t.failed = true
+		return len(p), nil
+	}
+	n, err := t.w.Write(p)
+	t.n += int64(n)
+	if err != nil {
+		t.failed = true
+	}
+	return len(p), nil
+}
+
+func (c *cacheStorage) openCached(e *cacheEntry) (*os.File, error) {
+	f, err := os.Open(e.file)
+	if err != nil {
+		// evicted in the meantime
+		c.invalidate(e.Path)
+		return nil, err
+	}
+	return f, nil
+}
+
+func (c *cacheStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	key := c.key(p)
+	if e, ok := c.lookup(key, nil); ok {
+		if f, err := c.openCached(e); err == nil {
+			return f, nil
+		}
+	}
+
+	info, err := c.s.Stat(ctx, p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			c.invalidate(p)
+		}
+		return nil, err
+	}
+	if e, ok := c.lookup(key, &info); ok {
+		if f, err := c.openCached(e); err == nil {
+			return f, nil
+		}
+	}
+
+	rc, err := c.s.ReadObject(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if !c.idx.fits(info.Size) {
+		return rc, nil
+	}
+	tmp, err := c.idx.createTemp()
+	if err != nil {
+		return rc, nil
+	}
+	return &cachingReader{
+		c:     c,
+		rc:    rc,
+		tmp:   tmp,
+		tw:    &cacheTeeWriter{w: tmp, limit: info.Size},
+		entry: c.newEntry(key, info),
+	}, nil
+}
+
+// cachingReader copies a download into a temp file, which becomes the cached copy
+// when the object was read to the end
+type cachingReader struct {
+	c     *cacheStorage
+	rc    io.ReadCloser
+	tmp   *os.File
+	tw    *cacheTeeWriter
+	entry *cacheEntry
+	eof   bool
+	done  bool
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if n > 0 {
+		_, _ = r.tw.Write(p[:n])
+	}
+	if errors.Is(err, io.EOF) {
+		r.eof = true
+	} else if err != nil {
+		r.tw.failed = true
+	}
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	err := r.rc.Close()
+	if r.done {
+		return err
+	}
+	r.done = true
+
+	complete := r.eof && !r.tw.failed && r.tw.n == r.entry.Size
+	if cerr := r.tmp.Close(); cerr != nil {
+		complete = false
+	}
+	if complete {
+		if cerr := r.c.idx.commit(r.tmp.Name(), r.entry); cerr == nil {
+			return err
+		}
+	}
+	_ = os.Remove(r.tmp.Name())
+	return err
+}
+
+func (c *cacheStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	key := c.key(p)
+	e, ok := c.lookup(key, nil)
+	if !ok {
+		info, err := c.s.Stat(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		if e, ok = c.lookup(key, &info); !ok {
+			return c.s.ReadObjectRange(ctx, p, offset, length)
+		}
+	}
+	f, err := c.openCached(e)
+	if err != nil {
+		return c.s.ReadObjectRange(ctx, p, offset, length)
+	}
+	if offset > e.Size {
+		offset = e.Size
+	}
+	if length < 0 || offset+length > e.Size {
+		length = e.Size - offset
+	}
+	return &limitedFile{Reader: io.NewSectionReader(f, offset, length), f: f}, nil
+}
+
+type limitedFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (l *limitedFile) Close() error {
+	return l.f.Close()
+}
+
+func (c *cacheStorage) Exists(ctx context.Context, p string) (bool, error) {
+	return c.s.Exists(ctx, p)
+}
+
+func (c *cacheStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	return c.s.Stat(ctx, p)
+}
+
+func (c *cacheStorage) SHA256(ctx context.Context, p string) (string, error) {
+	return c.s.SHA256(ctx, p)
+}
+
+func (c *cacheStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	return c.s.ListAll(ctx, prefix)
+}
+
+func (c *cacheStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return c.s.ListAllInfo(ctx, prefix)
+}
+
+func (c *cacheStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return c.s.Walk(ctx, prefix)
+}
+
+func (c *cacheStorage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	return c.s.ListTopLevelDirs(ctx, prefix)
+}
+
+func (c *cacheStorage) Delete(ctx context.Context, p string) error {
+	c.invalidate(p)
+	return c.s.Delete(ctx, p)
+}
+
+func (c *cacheStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	c.invalidatePrefix(prefix)
+	return c.s.DeletePrefix(ctx, prefix)
+}
+
+func (c *cacheStorage) Copy(ctx context.Context, src, dst string) error {
+	c.invalidate(dst)
+	return c.s.Copy(ctx, src, dst)
+}
+
+func (c *cacheStorage) Rename(ctx context.Context, src, dst string) error {
+	c.invalidate(src)
+	c.invalidate(dst)
+	return c.s.Rename(ctx, src, dst)
+}
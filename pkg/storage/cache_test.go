@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCacheStorage(t *testing.T, s Storage, dir string, maxBytes int64, mode CacheMode) Storage {
+	c, err := NewCacheStorage(s, &CacheOpts{Dir: dir, MaxBytes: maxBytes, Mode: mode})
+	require.NoError(t, err)
+	return c
+}
+
+// forgetCacheIndexes drops the indexes of the cache dirs opened in the process, as a restart does
+func forgetCacheIndexes() {
+	cacheIndexesMu.Lock()
+	defer cacheIndexesMu.Unlock()
+	clear(cacheIndexes)
+}
+
+func readString(t *testing.T, s Storage, p string) string {
+	rc, err := s.ReadObject(context.Background(), p)
+	require.NoError(t, err)
+	return string(readAll(t, rc))
+}
+
+func TestCacheStorage_ServesHotObjects(t *testing.T) {
+	f := newFlakyStorage()
+	c := newTestCacheStorage(t, f, t.TempDir(), 1024, "")
+	ctx := context.Background()
+	require.NoError(t, f.Storage.PutObject(ctx, "base/obj", strings.NewReader("content")))
+
+	assert.Equal(t, "content", readString(t, c, "base/obj"))
+	assert.Equal(t, "content", readString(t, c, "base/obj"))
+	assert.Equal(t, 1, f.callCount("read"))
+
+	rc, err := c.ReadObjectRange(ctx, "base/obj", 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("nte"), readAll(t, rc))
+	assert.Equal(t, 1, f.callCount("read"))
+
+	// changed by another writer
+	require.NoError(t, f.Storage.PutObject(ctx, "base/obj", strings.NewReader("changed")))
+	assert.Equal(t, "changed", readString(t, c, "base/obj"))
+	assert.Equal(t, 2, f.callCount("read"))
+
+	require.NoError(t, c.Delete(ctx, "base/obj"))
+	_, err = c.ReadObject(ctx, "base/obj")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestCacheStorage_PartialReadsAreNotCached(t *testing.T) {
+	f := newFlakyStorage()
+	c := newTestCacheStorage(t, f, t.TempDir(), 1024, "")
+	ctx := context.Background()
+	require.NoError(t, f.Storage.PutObject(ctx, "obj", strings.NewReader("content")))
+
+	rc, err := c.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	_, err = io.ReadFull(rc, make([]byte, 3))
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+
+	assert.Equal(t, "content", readString(t, c, "obj"))
+	assert.Equal(t, 2, f.callCount("read"))
+}
+
+func TestCacheStorage_EvictsLeastRecentlyUsed(t *testing.T) {
+	f := newFlakyStorage()
+	dir := t.TempDir()
+	c := newTestCacheStorage(t, f, dir, 20, "")
+	ctx := context.Background()
+	for _, p := range []string{"a", "b", "c"} {
+		require.NoError(t, f.Storage.PutObject(ctx, p, strings.NewReader(strings.Repeat(p, 8))))
+	}
+
+	readString(t, c, "a")
+	readString(t, c, "b")
+	readString(t, c, "a") // b is the least recently used now
+	readString(t, c, "c")
+	assert.Equal(t, 3, f.callCount("read"))
+
+	readString(t, c, "a")
+	readString(t, c, "c")
+	assert.Equal(t, 3, f.callCount("read"))
+	readString(t, c, "b")
+	assert.Equal(t, 4, f.callCount("read"))
+
+	// objects bigger than the cache pass through
+	require.NoError(t, f.Storage.PutObject(ctx, "big", strings.NewReader(strings.Repeat("x", 21))))
+	readString(t, c, "big")
+	readString(t, c, "big")
+	assert.Equal(t, 6, f.callCount("read"))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 4) // two objects with their metadata
+}
+
+func TestCacheStorage_WriteModes(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("write-through", func(t *testing.T) {
+		f := newFlakyStorage()
+		c := newTestCacheStorage(t, f, t.TempDir(), 1024, CacheWriteThrough)
+
+		require.NoError(t, c.PutObject(ctx, "obj", strings.NewReader("content")))
+		assert.Equal(t, "content", readString(t, c, "obj"))
+		assert.Equal(t, 0, f.callCount("read"))
+	})
+
+	t.Run("write-around", func(t *testing.T) {
+		f := newFlakyStorage()
+		c := newTestCacheStorage(t, f, t.TempDir(), 1024, CacheWriteAround)
+
+		require.NoError(t, c.PutObject(ctx, "obj", strings.NewReader("content")))
+		assert.Equal(t, "content", readString(t, c, "obj"))
+		assert.Equal(t, 1, f.callCount("read"))
+
+		require.NoError(t, c.PutObject(ctx, "obj", strings.NewReader("changed")))
+		assert.Equal(t, "changed", readString(t, c, "obj"))
+		assert.Equal(t, 2, f.callCount("read"))
+	})
+}
+
+func TestCacheStorage_SurvivesRestarts(t *testing.T) {
+	f := newFlakyStorage()
+	dir := t.TempDir()
+	ctx := context.Background()
+	require.NoError(t, f.Storage.PutObject(ctx, "obj", strings.NewReader("content")))
+
+	readString(t, newTestCacheStorage(t, f, dir, 1024, ""), "obj")
+
+	// an interrupted download is cleaned up
+	tmp, err := os.CreateTemp(dir, tmpFilePrefix+"*")
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+
+	forgetCacheIndexes()
+	c := newTestCacheStorage(t, f, dir, 1024, "")
+	assert.Equal(t, "content", readString(t, c, "obj"))
+	assert.Equal(t, 1, f.callCount("read"))
+	_, err = os.Stat(tmp.Name())
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestCacheStorage_SharedDir(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	f1, f2 := newFlakyStorage(), newFlakyStorage()
+	c1, err := NewCacheStorage(f1, &CacheOpts{Dir: dir, MaxBytes: 20, Namespace: "local:/backups/db1"})
+	require.NoError(t, err)
+	c2, err := NewCacheStorage(f2, &CacheOpts{Dir: dir, MaxBytes: 20, Namespace: "local:/backups/db2"})
+	require.NoError(t, err)
+
+	// the same path in two repos
+	require.NoError(t, f1.Storage.PutObject(ctx, "obj", strings.NewReader("db1-data")))
+	require.NoError(t, f2.Storage.PutObject(ctx, "obj", strings.NewReader("db2-data")))
+	for range 2 {
+		assert.Equal(t, "db1-data", readString(t, c1, "obj"))
+		assert.Equal(t, "db2-data", readString(t, c2, "obj"))
+	}
+	assert.Equal(t, 1, f1.callCount("read"))
+	assert.Equal(t, 1, f2.callCount("read"))
+
+	// the size bounds the dir, not each of the caches
+	require.NoError(t, f2.Storage.PutObject(ctx, "other", strings.NewReader("db2-next")))
+	readString(t, c2, "other")
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 4) // two objects with their metadata
+	assert.Equal(t, "db1-data", readString(t, c1, "obj"))
+	assert.Equal(t, 2, f1.callCount("read"))
+}
+
+func TestCacheStorage_ChecksMetadataOnDisk(t *testing.T) {
+	f := newFlakyStorage()
+	dir := t.TempDir()
+	c := newTestCacheStorage(t, f, dir, 1024, "")
+	ctx := context.Background()
+	require.NoError(t, f.Storage.PutObject(ctx, "obj", strings.NewReader("content")))
+	readString(t, c, "obj")
+
+	// the files were replaced behind the index, i.e. by another process
+	metas, err := filepath.Glob(filepath.Join(dir, "*"+cacheMetaExt))
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	require.NoError(t, os.WriteFile(metas[0], []byte(`{"path":"other","size":7}`), 0o600))
+
+	assert.Equal(t, "content", readString(t, c, "obj"))
+	assert.Equal(t, 2, f.callCount("read"))
+}
+
+func TestCacheStorage_RevalidateAfter(t *testing.T) {
+	f := newFlakyStorage()
+	c, err := NewCacheStorage(f, &CacheOpts{Dir: t.TempDir(), MaxBytes: 1024, RevalidateAfter: 50 * time.Millisecond})
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, f.Storage.PutObject(ctx, "obj", strings.NewReader("content")))
+
+	// hits within the interval do not ask the backend
+	assert.Equal(t, "content", readString(t, c, "obj"))
+	assert.Equal(t, "content", readString(t, c, "obj"))
+	rc, err := c.ReadObjectRange(ctx, "obj", 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("nte"), readAll(t, rc))
+	assert.Equal(t, 1, f.callCount("stat"))
+	assert.Equal(t, 1, f.callCount("read"))
+
+	// changed by another writer, noticed once the interval is over
+	require.NoError(t, f.Storage.PutObject(ctx, "obj", strings.NewReader("changed")))
+	assert.Equal(t, "content", readString(t, c, "obj"))
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, "changed", readString(t, c, "obj"))
+	assert.Equal(t, 2, f.callCount("stat"))
+	assert.Equal(t, 2, f.callCount("read"))
+}
+
+func TestCacheStorage_InvalidOpts(t *testing.T) {
+	s := NewMemoryStorage()
+	_, err := NewCacheStorage(s, &CacheOpts{MaxBytes: 1})
+	assert.Error(t, err)
+	_, err = NewCacheStorage(s, &CacheOpts{Dir: t.TempDir()})
+	assert.Error(t, err)
+	_, err = NewCacheStorage(s, &CacheOpts{Dir: t.TempDir(), MaxBytes: 1, Mode: "write-back"})
+	assert.Error(t, err)
+}
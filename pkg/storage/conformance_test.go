@@ -0,0 +1,108 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/hashmap-kz/xrepo/pkg/clients/webdavx"
+	"github.com/hashmap-kz/xrepo/pkg/metrics"
+	"github.com/hashmap-kz/xrepo/pkg/storage"
+	"github.com/hashmap-kz/xrepo/pkg/storage/storagetest"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConformance_Local(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := storage.NewLocal(&storage.LocalStorageOpts{BaseDir: t.TempDir()})
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestConformance_Memory(t *testing.T) {
+	storagetest.Run(t, func(_ *testing.T) storage.Storage {
+		return storage.NewMemoryStorage()
+	})
+}
+
+func TestConformance_WebDAV(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewWebDAVTestStorage(t, &webdavx.WebDAVConfig{}, nil)
+	})
+}
+
+func TestConformance_FTP(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewFTPTestStorage(t, "")
+	})
+}
+
+func TestConformance_Retry(t *testing.T) {
+	storagetest.Run(t, func(_ *testing.T) storage.Storage {
+		return storage.NewRetryStorage(storage.NewMemoryStorage(), &storage.RetryOpts{})
+	})
+}
+
+func TestConformance_Throttle(t *testing.T) {
+	storagetest.Run(t, func(_ *testing.T) storage.Storage {
+		return storage.NewThrottleStorage(storage.NewMemoryStorage(), &storage.ThrottleOpts{
+			UploadBytesPerSec:   1 << 30,
+			DownloadBytesPerSec: 1 << 30,
+		})
+	})
+}
+
+func TestConformance_Metrics(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		m, err := metrics.New(prometheus.NewRegistry())
+		require.NoError(t, err)
+		return storage.NewMetricsStorage(storage.NewMemoryStorage(), m)
+	})
+}
+
+func TestConformance_Tracing(t *testing.T) {
+	storagetest.Run(t, func(_ *testing.T) storage.Storage {
+		return storage.NewTracingStorage(storage.NewMemoryStorage(), "memory", nil)
+	})
+}
+
+func TestConformance_Cache(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := storage.NewCacheStorage(storage.NewMemoryStorage(), &storage.CacheOpts{
+			Dir:      t.TempDir(),
+			MaxBytes: 32 << 20,
+			Mode:     storage.CacheWriteThrough,
+		})
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestConformance_Replicating(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := storage.NewReplicatingStorage(
+			[]storage.Storage{storage.NewMemoryStorage(), storage.NewMemoryStorage()},
+			&storage.ReplicateOpts{},
+		)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestConformance_Failover(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := storage.NewFailoverStorage([]storage.FailoverBackend{
+			{Name: "primary", Storage: storage.NewMemoryStorage()},
+			{Name: "fallback", Storage: storage.NewMemoryStorage()},
+		}, &storage.FailoverOpts{})
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestConformance_Faults(t *testing.T) {
+	storagetest.Run(t, func(_ *testing.T) storage.Storage {
+		return storage.NewFaultStorage(storage.NewMemoryStorage(), 1)
+	})
+}
@@ -0,0 +1,7 @@
+package storage
+
+// Test servers of the backends, exported for the conformance tests of package storage_test
+var (
+	NewWebDAVTestStorage = newWebDAVTestStorage
+	NewFTPTestStorage    = newFTPTestStorage
+)
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"iter"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// FailoverBackend is a named backend of the failover storage, the name is used in logs
+type FailoverBackend struct {
+	Name    string
+	Storage Storage
+}
+
+type FailoverOpts struct {
+	FailureThreshold int           // consecutive failures that make a backend unhealthy, 3 by default
+	CoolDown         time.Duration // time an unhealthy backend is skipped for, 30s by default
+}
+
+const (
+	defaultFailureThreshold = 3
+	defaultFailoverCoolDown = 30 * time.Second
+)
+
+type failoverBackend struct {
+	FailoverBackend
+
+	failures       int
+	unhealthyUntil time.Time
+}
+
+type failoverStorage struct {
+	backends  []*failoverBackend
+	threshold int
+	coolDown  time.Duration
+	now       func() time.Time
+
+	mu sync.Mutex
+}
+
+var _ Storage = &failoverStorage{}
+
+// NewFailoverStorage reads from the first healthy backend in priority order, i.e. from an SFTP copy
+// of the repo while S3 is down. Writes go to the first backend only, the others are read-only copies.
+//
+// A backend becomes unhealthy after repeated failures and is skipped until the cool-down passes,
+// then it's tried again. Missing objects are an answer and not a failure, so they don't fail over.
+// Streams are not switched over once they are opened.
+func NewFailoverStorage(backends []FailoverBackend, o *FailoverOpts) (Storage, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("no backends")
+	}
+	f := &failoverStorage{
+		threshold: o.FailureThreshold,
+		coolDown:  o.CoolDown,
+		now:       time.Now,
+	}
+	if f.threshold <= 0 {
+		f.threshold = defaultFailureThreshold
+	}
+	if f.coolDown <= 0 {
+		f.coolDown = defaultFailoverCoolDown
+	}
+	for _, b := range backends {
+		f.backends = append(f.backends, &failoverBackend{FailoverBackend: b})
+	}
+	return f, nil
+}
+
+// candidates orders the backends by priority, healthy ones first
+func (f *failoverStorage) candidates() []*failoverBackend {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	var healthy, unhealthy []*failoverBackend
+	for _, b := range f.backends {
+		if now.Before(b.unhealthyUntil) {
+			unhealthy = append(unhealthy, b)
+		} else {
+			healthy = append(healthy, b)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// isFailure reports whether the error says something about the backend, rather than about the request
+func isFailure(err error) bool {
+	return err != nil &&
+		!errors.Is(err, fs.ErrNotExist) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+func (f *failoverStorage) report(b *failoverBackend, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !isFailure(err) {
+		if b.failures >= f.threshold {
+			slog.Info("storage backend recovered",
+				slog.String("module", "storage"),
+				slog.String("backend", b.Name),
+			)
+		}
+		b.failures = 0
+		b.unhealthyUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= f.threshold {
+		b.unhealthyUntil = f.now().Add(f.coolDown)
+		slog.Warn("storage backend is unhealthy",
+			slog.String("module", "storage"),
+			slog.String("backend", b.Name),
+			slog.Int("failures", b.failures),
+			slog.Duration("cool-down", f.coolDown),
+			slog.Any("err", err),
+		)
+	}
+}
+
+func (f *failoverStorage) served(op, p string, b *failoverBackend, failedOver bool) {
+	if failedOver {
+		slog.Warn("storage request served by fallback",
+			slog.String("module", "storage"),
+			slog.String("op", op),
+			slog.String("path", p),
+			slog.String("backend", b.Name),
+		)
+		return
+	}
+	slog.Debug("storage request served",
+		slog.String("module", "storage"),
+		slog.String("op", op),
+		slog.String("path", p),
+		slog.String("backend", b.Name),
+	)
+}
+
+// failover runs the operation on the backends in order, until one of them answers
+func failover[T any](f *failoverStorage, op, p string, fn func(s Storage) (T, error)) (T, error) {
+	var firstErr error
+	for i, b := range f.candidates() {
+		result, err := fn(b.Storage)
+		f.report(b, err)
+		if !isFailure(err) {
+			f.served(op, p, b, i > 0)
+			return result, err
+		}
+		slog.Warn("storage request failed",
+			slog.String("module", "storage"),
+			slog.String("op", op),
+			slog.String("path", p),
+			slog.String("backend", b.Name),
+			slog.Any("err", err),
+		)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	var zero T
+	return zero, firstErr
+}
+
+func (f *failoverStorage) primary() Storage {
+	return f.backends[0].Storage
+}
+
+func (f *failoverStorage) isRetryable(err error) bool {
+	for _, b := range f.backends {
+		if isRetryableBy(b.Storage, err) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *failoverStorage) PutObject(ctx context.Context, p string, r io.Reader) error {
+	return f.primary().PutObject(ctx, p, r)
+}
+
+func (f *failoverStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	return f.primary().PutObjectWithOpts(ctx, p, r, opts)
+}
+
+func (f *failoverStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	return failover(f, "read", p, func(s Storage) (io.ReadCloser, error) {
+		return s.ReadObject(ctx, p)
+	})
+}
+
+func (f *failoverStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	return failover(f, "read range", p, func(s Storage) (io.ReadCloser, error) {
+		return s.ReadObjectRange(ctx, p, offset, length)
+	})
+}
+
+func (f *failoverStorage) Exists(ctx context.Context, p string) (bool, error) {
+	return failover(f, "exists", p, func(s Storage) (bool, error) {
+		return s.Exists(ctx, p)
+	})
+}
+
+func (f *failoverStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	return failover(f, "stat", p, func(s Storage) (ObjectInfo, error) {
+		return s.Stat(ctx, p)
+	})
+}
+
+func (f *failoverStorage) SHA256(ctx context.Context, p string) (string, error) {
+	return failover(f, "sha256", p, func(s Storage) (string, error) {
+		return s.SHA256(ctx, p)
+	})
+}
+
+func (f *failoverStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	return failover(f, "list", prefix, func(s Storage) ([]string, error) {
+		return s.ListAll(ctx, prefix)
+	})
+}
+
+func (f *failoverStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return failover(f, "list", prefix, func(s Storage) ([]ObjectInfo, error) {
+		return s.ListAllInfo(ctx, prefix)
+	})
+}
+
+// Walk fails over only when the failed backend had not yielded anything
+func (f *failoverStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		var firstErr error
+		for i, b := range f.candidates() {
+			yielded := false
+			var walkErr error
+			for info, err := range b.Storage.Walk(ctx, prefix) {
+				if err != nil {
+					walkErr = err
+					break
+				}
+				if !yielded {
+					yielded = true
+					f.served("walk", prefix, b, i > 0)
+				}
+				if !yield(info, nil) {
+					f.report(b, nil)
+					return
+				}
+			}
+			f.report(b, walkErr)
+			if walkErr == nil {
+				return
+			}
+			if yielded || !isFailure(walkErr) {
+				yield(ObjectInfo{}, walkErr)
+				return
+			}
+			if firstErr == nil {
+				firstErr = walkErr
+			}
+		}
+		yield(ObjectInfo{}, firstErr)
+	}
+}
+
+func (f *failoverStorage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	return failover(f, "list dirs", prefix, func(s Storage) (map[string]bool, error) {
+		return s.ListTopLevelDirs(ctx, prefix)
+	})
+}
+
+func (f *failoverStorage) Delete(ctx context.Context, p string) error {
+	return f.primary().Delete(ctx, p)
+}
+
+func (f *failoverStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	return f.primary().DeletePrefix(ctx, prefix)
+}
+
+func (f *failoverStorage) Copy(ctx context.Context, src, dst string) error {
+	return f.primary().Copy(ctx, src, dst)
+}
+
+func (f *failoverStorage) Rename(ctx context.Context, src, dst string) error {
+	return f.primary().Rename(ctx, src, dst)
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"log/slog"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFailoverStorage(t *testing.T, primary, fallback Storage) *failoverStorage {
+	s, err := NewFailoverStorage([]FailoverBackend{
+		{Name: "s3", Storage: primary},
+		{Name: "sftp", Storage: fallback},
+	}, &FailoverOpts{FailureThreshold: 2, CoolDown: time.Minute})
+	require.NoError(t, err)
+	return s.(*failoverStorage)
+}
+
+func TestFailoverStorage_ReadsFromFallback(t *testing.T) {
+	primary, fallback := newFlakyStorage(), NewMemoryStorage()
+	s := newTestFailoverStorage(t, primary, fallback)
+	ctx := context.Background()
+	require.NoError(t, fallback.PutObject(ctx, "obj", strings.NewReader("content")))
+
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	primary.failNext("read", syscall.ECONNREFUSED)
+	rc, err := s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("content"), readAll(t, rc))
+	assert.Contains(t, logs.String(), `msg="storage request served by fallback" module=storage op=read path=obj backend=sftp`)
+}
+
+func TestFailoverStorage_CoolDown(t *testing.T) {
+	primary, fallback := newFlakyStorage(), NewMemoryStorage()
+	s := newTestFailoverStorage(t, primary, fallback)
+	clock := time.Now()
+	s.now = func() time.Time { return clock }
+	ctx := context.Background()
+	require.NoError(t, fallback.PutObject(ctx, "obj", strings.NewReader("content")))
+
+	primary.failNext("stat", syscall.ECONNREFUSED, syscall.ECONNREFUSED)
+	for range 2 {
+		info, err := s.Stat(ctx, "obj")
+		require.NoError(t, err)
+		assert.Equal(t, int64(7), info.Size)
+	}
+	assert.Equal(t, 2, primary.callCount("stat"))
+
+	// the primary is skipped while it cools down
+	_, err := s.Stat(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, 2, primary.callCount("stat"))
+
+	// and tried again after that, it has no such object
+	clock = clock.Add(time.Minute)
+	_, err = s.Stat(ctx, "obj")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Equal(t, 3, primary.callCount("stat"))
+}
+
+func TestFailoverStorage_AllBackendsFail(t *testing.T) {
+	primary, fallback := newFlakyStorage(), newFlakyStorage()
+	s := newTestFailoverStorage(t, primary, fallback)
+
+	primary.failNext("exists", syscall.ECONNREFUSED)
+	fallback.failNext("exists", syscall.ETIMEDOUT)
+	_, err := s.Exists(context.Background(), "obj")
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
+
+func TestFailoverStorage_WritesGoToPrimary(t *testing.T) {
+	primary, fallback := NewMemoryStorage(), NewMemoryStorage()
+	s := newTestFailoverStorage(t, primary, fallback)
+	ctx := context.Background()
+
+	require.NoError(t, s.PutObject(ctx, "obj", strings.NewReader("content")))
+	exists, err := primary.Exists(ctx, "obj")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	files, err := fallback.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,383 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"math/rand/v2"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+type FaultKind string
+
+const (
+	FaultError      FaultKind = "error"       // the operation fails with Fault.Err, without reaching the backend
+	FaultLatency    FaultKind = "latency"     // the operation is delayed by Fault.Latency
+	FaultTruncate   FaultKind = "truncate"    // read streams end cleanly after Fault.Offset bytes
+	FaultShortWrite FaultKind = "short-write" // uploads store only the first Fault.Offset bytes, and succeed
+	FaultCorrupt    FaultKind = "corrupt"     // the byte at Fault.Offset of read streams is flipped
+	FaultCancel     FaultKind = "cancel"      // the context is canceled, streams are cut after Fault.Offset bytes
+)
+
+// ErrInjectedFault is the error of FaultError faults that have no error of their own
+var ErrInjectedFault = errors.New("injected storage fault")
+
+// Fault describes a misbehavior of the storage, and the operations it applies to
+type Fault struct {
+	Kind FaultKind
+
+	// Ops limits the fault to the given operations: put, read, exists, stat, sha256, list, list-dirs,
+	// delete, delete-prefix, copy, rename. All operations are affected when it's empty, except that
+	// truncate and corrupt only affect reads, and short-write only affects puts.
+	Ops []string
+
+	// Path is a path.Match pattern of the affected objects (or listing prefixes), all of them when it's empty
+	Path string
+
+	// Probability of the fault, it fires every time when it's zero
+	Probability float64
+
+	// Times limits the number of times the fault fires, unlimited when it's zero
+	Times int
+
+	Err     error
+	Latency time.Duration
+	Offset  int64
+}
+
+type faultState struct {
+	Fault
+	fired int
+}
+
+// FaultStorage injects scripted faults into the operations of the storage, for resilience tests
+type FaultStorage struct {
+	s Storage
+
+	mu     sync.Mutex
+	faults []*faultState
+	rnd    *rand.Rand
+}
+
+var _ Storage = &FaultStorage{}
+
+// NewFaultStorage injects the faults into the storage, the seed makes probabilistic faults reproducible
+func NewFaultStorage(s Storage, seed uint64, faults ...Fault) *FaultStorage {
+	f := &FaultStorage{
+		s:   s,
+		rnd: rand.New(rand.NewPCG(seed, seed)), //nolint:gosec
+	}
+	f.Inject(faults...)
+	return f
+}
+
+// Inject adds faults, they are checked in the order they were added
+func (f *FaultStorage) Inject(faults ...Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, fault := range faults {
+		f.faults = append(f.faults, &faultState{Fault: fault})
+	}
+}
+
+// Clear removes all the faults
+func (f *FaultStorage) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
+
+// appliesTo reports whether the fault affects the operation, data faults only affect the streams
+// they are documented for
+func (f *Fault) appliesTo(op string) bool {
+	switch f.Kind {
+	case FaultTruncate, FaultCorrupt:
+		if op != "read" {
+			return false
+		}
+	case FaultShortWrite:
+		if op != "put" {
+			return false
+		}
+	}
+	return len(f.Ops) == 0 || slices.Contains(f.Ops, op)
+}
+
+// next picks the faults that fire for the operation, latency is applied on top of any other fault
+func (f *FaultStorage) next(op, p string) []Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var result []Fault
+	for _, st := range f.faults {
+		if st.Times > 0 && st.fired >= st.Times {
+			continue
+		}
+		if !st.appliesTo(op) {
+			continue
+		}
+		if st.Path != "" {
+			if ok, _ := path.Match(st.Path, p); !ok {
+				continue
+			}
+		}
+		if st.Probability > 0 && f.rnd.Float64() >= st.Probability {
+			continue
+		}
+		st.fired++
+		result = append(result, st.Fault)
+	}
+	return result
+}
+
+// before applies the faults that happen ahead of the operation, and returns the ones that affect its data
+func (f *FaultStorage) before(ctx context.Context, op, p string) (context.Context, []Fault, error) {
+	var data []Fault
+	for _, fault := range f.next(op, p) {
+		switch fault.Kind {
+		case FaultLatency:
+			t := time.NewTimer(fault.Latency)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx, nil, ctx.Err()
+			case <-t.C:
+			}
+		case FaultError:
+			if fault.Err != nil {
+				return ctx, nil, fault.Err
+			}
+			return ctx, nil, ErrInjectedFault
+		case FaultCancel:
+			// operations without a stream are canceled upfront
+			if fault.Offset == 0 || (op != "read" && op != "put") {
+				cctx, cancel := context.WithCancel(ctx)
+				cancel()
+				ctx = cctx
+				continue
+			}
+			data = append(data, fault)
+		default:
+			data = append(data, fault)
+		}
+	}
+	return ctx, data, nil
+}
+
+// cancelable derives the context of a stream when a fault cancels it midway
+func cancelable(ctx context.Context, faults []Fault) (context.Context, context.CancelFunc) {
+	if !slices.ContainsFunc(faults, func(fault Fault) bool { return fault.Kind == FaultCancel }) {
+		return ctx, func() {}
+	}
+	return context.WithCancel(ctx)
+}
+
+// faultyReader applies the data faults to a stream, offsets are counted from the start of the stream.
+// The context of the stream is canceled when it's cut by a cancel fault.
+type faultyReader struct {
+	r      io.Reader
+	faults []Fault
+	cancel context.CancelFunc
+	n      int64
+}
+
+func (fr *faultyReader) Read(p []byte) (int, error) {
+	// streams are cut at the nearest offset
+	limit := int64(-1)
+	var cut *Fault
+	for i, fault := range fr.faults {
+		if fault.Kind != FaultTruncate && fault.Kind != FaultShortWrite && fault.Kind != FaultCancel {
+			continue
+		}
+		if limit < 0 || fault.Offset < limit {
+			limit = fault.Offset
+			cut = &fr.faults[i]
+		}
+	}
+	if cut != nil {
+		if fr.n >= limit {
+			if cut.Kind == FaultCancel {
+				fr.cancel()
+				return 0, context.Canceled
+			}
+			return 0, io.EOF
+		}
+		if int64(len(p)) > limit-fr.n {
+			p = p[:limit-fr.n]
+		}
+	}
+
+	n, err := fr.r.Read(p)
+	for _, fault := range fr.faults {
+		if fault.Kind == FaultCorrupt && fault.Offset >= fr.n && fault.Offset < fr.n+int64(n) {
+			p[fault.Offset-fr.n] ^= 0xff
+		}
+	}
+	fr.n += int64(n)
+	return n, err
+}
+
+type faultyReadCloser struct {
+	faultyReader
+	c io.Closer
+}
+
+func (frc *faultyReadCloser) Close() error {
+	err := frc.c.Close()
+	frc.cancel()
+	return err
+}
+
+func (f *FaultStorage) wrapRead(rc io.ReadCloser, faults []Fault, cancel context.CancelFunc) io.ReadCloser {
+	if len(faults) == 0 {
+		return rc
+	}
+	return &faultyReadCloser{faultyReader: faultyReader{r: rc, faults: faults, cancel: cancel}, c: rc}
+}
+
+func (f *FaultStorage) isRetryable(err error) bool {
+	return isRetryableBy(f.s, err)
+}
+
+func (f *FaultStorage) PutObject(ctx context.Context, p string, r io.Reader) error {
+	return f.PutObjectWithOpts(ctx, p, r, nil)
+}
+
+func (f *FaultStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	ctx, faults, err := f.before(ctx, "put", p)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := cancelable(ctx, faults)
+	defer cancel()
+	if len(faults) > 0 {
+		r = &faultyReader{r: r, faults: faults, cancel: cancel}
+	}
+	return f.s.PutObjectWithOpts(ctx, p, r, opts)
+}
+
+func (f *FaultStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	ctx, faults, err := f.before(ctx, "read", p)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := cancelable(ctx, faults)
+	rc, err := f.s.ReadObject(ctx, p)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return f.wrapRead(rc, faults, cancel), nil
+}
+
+func (f *FaultStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	ctx, faults, err := f.before(ctx, "read", p)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := cancelable(ctx, faults)
+	rc, err := f.s.ReadObjectRange(ctx, p, offset, length)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return f.wrapRead(rc, faults, cancel), nil
+}
+
+func (f *FaultStorage) Exists(ctx context.Context, p string) (bool, error) {
+	ctx, _, err := f.before(ctx, "exists", p)
+	if err != nil {
+		return false, err
+	}
+	return f.s.Exists(ctx, p)
+}
+
+func (f *FaultStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	ctx, _, err := f.before(ctx, "stat", p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return f.s.Stat(ctx, p)
+}
+
+func (f *FaultStorage) SHA256(ctx context.Context, p string) (string, error) {
+	ctx, _, err := f.before(ctx, "sha256", p)
+	if err != nil {
+		return "", err
+	}
+	return f.s.SHA256(ctx, p)
+}
+
+func (f *FaultStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	ctx, _, err := f.before(ctx, "list", prefix)
+	if err != nil {
+		return nil, err
+	}
+	return f.s.ListAll(ctx, prefix)
+}
+
+func (f *FaultStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	ctx, _, err := f.before(ctx, "list", prefix)
+	if err != nil {
+		return nil, err
+	}
+	return f.s.ListAllInfo(ctx, prefix)
+}
+
+func (f *FaultStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		ctx, _, err := f.before(ctx, "list", prefix)
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+		for info, err := range f.s.Walk(ctx, prefix) {
+			if !yield(info, err) {
+				return
+			}
+		}
+	}
+}
+
+func (f *FaultStorage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	ctx, _, err := f.before(ctx, "list-dirs", prefix)
+	if err != nil {
+		return nil, err
+	}
+	return f.s.ListTopLevelDirs(ctx, prefix)
+}
+
+func (f *FaultStorage) Delete(ctx context.Context, p string) error {
+	ctx, _, err := f.before(ctx, "delete", p)
+	if err != nil {
+		return err
+	}
+	return f.s.Delete(ctx, p)
+}
+
+func (f *FaultStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	ctx, _, err := f.before(ctx, "delete-prefix", prefix)
+	if err != nil {
+		return err
+	}
+	return f.s.DeletePrefix(ctx, prefix)
+}
+
+func (f *FaultStorage) Copy(ctx context.Context, src, dst string) error {
+	ctx, _, err := f.before(ctx, "copy", src)
+	if err != nil {
+		return err
+	}
+	return f.s.Copy(ctx, src, dst)
+}
+
+func (f *FaultStorage) Rename(ctx context.Context, src, dst string) error {
+	ctx, _, err := f.before(ctx, "rename", src)
+	if err != nil {
+		return err
+	}
+	return f.s.Rename(ctx, src, dst)
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashmap-kz/xrepo/pkg/concur"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFaultStorage(t *testing.T, faults ...Fault) *FaultStorage {
+	s := NewFaultStorage(NewMemoryStorage(), 1, faults...)
+	for _, p := range []string{"base/a", "base/b", "wal/c"} {
+		require.NoError(t, s.s.PutObject(context.Background(), p, strings.NewReader("0123456789")))
+	}
+	return s
+}
+
+func TestFaultStorage_Errors(t *testing.T) {
+	errBoom := errors.New("boom")
+	s := newTestFaultStorage(t, Fault{Kind: FaultError, Ops: []string{"read"}, Path: "base/*", Times: 1, Err: errBoom})
+	ctx := context.Background()
+
+	_, err := s.ReadObject(ctx, "wal/c")
+	require.NoError(t, err)
+	_, err = s.Stat(ctx, "base/a")
+	require.NoError(t, err)
+
+	_, err = s.ReadObject(ctx, "base/a")
+	assert.ErrorIs(t, err, errBoom)
+
+	// fired once
+	_, err = s.ReadObject(ctx, "base/a")
+	require.NoError(t, err)
+
+	s.Inject(Fault{Kind: FaultError})
+	_, err = s.ListAll(ctx, "")
+	assert.ErrorIs(t, err, ErrInjectedFault)
+	for _, err := range s.Walk(ctx, "") {
+		assert.ErrorIs(t, err, ErrInjectedFault)
+	}
+
+	s.Clear()
+	_, err = s.ListAll(ctx, "")
+	require.NoError(t, err)
+}
+
+func TestFaultStorage_Latency(t *testing.T) {
+	s := newTestFaultStorage(t, Fault{Kind: FaultLatency, Latency: 50 * time.Millisecond})
+
+	start := time.Now()
+	_, err := s.Exists(context.Background(), "base/a")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = s.Exists(ctx, "base/a")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestFaultStorage_Streams(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("truncated read", func(t *testing.T) {
+		s := newTestFaultStorage(t, Fault{Kind: FaultTruncate, Offset: 4})
+		rc, err := s.ReadObject(ctx, "base/a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("0123"), readAll(t, rc))
+	})
+
+	t.Run("corrupted read", func(t *testing.T) {
+		s := newTestFaultStorage(t, Fault{Kind: FaultCorrupt, Offset: 3})
+		rc, err := s.ReadObjectRange(ctx, "base/a", 0, -1)
+		require.NoError(t, err)
+		data := readAll(t, rc)
+		assert.Equal(t, []byte("012\xcc456789"), data)
+	})
+
+	t.Run("short write", func(t *testing.T) {
+		s := newTestFaultStorage(t, Fault{Kind: FaultShortWrite, Ops: []string{"put"}, Offset: 2})
+		require.NoError(t, s.PutObject(ctx, "obj", strings.NewReader("content")))
+		rc, err := s.ReadObject(ctx, "obj")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("co"), readAll(t, rc))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		s := newTestFaultStorage(t, Fault{Kind: FaultCancel, Ops: []string{"read"}, Offset: 5})
+		rc, err := s.ReadObject(ctx, "base/a")
+		require.NoError(t, err)
+		data, err := io.ReadAll(rc)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, []byte("01234"), data)
+		require.NoError(t, rc.Close())
+
+		s.Clear()
+		s.Inject(Fault{Kind: FaultCancel, Ops: []string{"put"}})
+		err = s.PutObject(ctx, "obj", strings.NewReader("content"))
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestFaultStorage_DataFaultsKeepTheirDirection(t *testing.T) {
+	ctx := context.Background()
+	s := newTestFaultStorage(t,
+		Fault{Kind: FaultTruncate, Offset: 4, Times: 1},
+		Fault{Kind: FaultCorrupt, Offset: 1, Times: 1},
+		Fault{Kind: FaultShortWrite, Offset: 2, Times: 1})
+
+	// the read faults neither cut nor corrupt uploads, and are not used up by them
+	require.NoError(t, s.PutObject(ctx, "obj", strings.NewReader("content")))
+	rc, err := s.s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("co"), readAll(t, rc))
+
+	// the short write does not cut reads
+	require.NoError(t, s.PutObject(ctx, "obj", strings.NewReader("content")))
+	rc, err = s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("c\x90nt"), readAll(t, rc))
+}
+
+// ctxStorage remembers the context of the last read
+type ctxStorage struct {
+	Storage
+	ctx context.Context
+}
+
+func (c *ctxStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	c.ctx = ctx
+	return c.Storage.ReadObject(ctx, p)
+}
+
+func (c *ctxStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	err := c.Storage.PutObjectWithOpts(ctx, p, r, opts)
+	c.ctx = ctx
+	return err
+}
+
+func TestFaultStorage_CancelMidStreamCancelsBackend(t *testing.T) {
+	ctx := context.Background()
+	backend := &ctxStorage{Storage: NewMemoryStorage()}
+	require.NoError(t, backend.PutObject(ctx, "obj", strings.NewReader("content")))
+	s := NewFaultStorage(backend, 1, Fault{Kind: FaultCancel, Offset: 3})
+
+	rc, err := s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	require.NoError(t, backend.ctx.Err())
+	_, err = io.ReadAll(rc)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, backend.ctx.Err(), context.Canceled)
+	require.NoError(t, rc.Close())
+
+	err = s.PutObject(ctx, "other", strings.NewReader("content"))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, backend.ctx.Err(), context.Canceled)
+}
+
+func TestFaultStorage_Probability(t *testing.T) {
+	s := newTestFaultStorage(t, Fault{Kind: FaultError, Ops: []string{"exists"}, Probability: 0.3})
+
+	failed := 0
+	for range 1000 {
+		if _, err := s.Exists(context.Background(), "base/a"); err != nil {
+			failed++
+		}
+	}
+	assert.InDelta(t, 300, failed, 60)
+}
+
+func TestFaultStorage_ConcurrentPipelineSurfacesErrors(t *testing.T) {
+	s := newTestFaultStorage(t, Fault{Kind: FaultError, Ops: []string{"read"}, Path: "base/b"})
+
+	files, err := s.ListAll(context.Background(), "")
+	require.NoError(t, err)
+
+	results, errs := concur.ProcessConcurrentlyWithResultAndLimit(context.Background(), 2, files,
+		func(ctx context.Context, p string) (string, error) {
+			rc, err := s.ReadObject(ctx, p)
+			if err != nil {
+				return "", fmt.Errorf("read %s: %w", p, err)
+			}
+			defer rc.Close()
+			data, err := io.ReadAll(rc)
+			return string(data), err
+		}, nil)
+
+	assert.Len(t, results, 2)
+	require.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[0], ErrInjectedFault)
+	assert.ErrorContains(t, errs[0], "base/b")
+}
@@ -0,0 +1,798 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"log/slog"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+const (
+	// ftpMaxIdleConns limits the connections kept open between operations
+	ftpMaxIdleConns = 4
+
+	// ftpIdleCheckAfter is the idle time after which a pooled connection is checked with NOOP before reuse,
+	// servers drop idle control connections
+	ftpIdleCheckAfter = 30 * time.Second
+)
+
+type ftpStorage struct {
+	dial func() (*ftp.ServerConn, error)
+	root string
+
+	mu   sync.Mutex
+	idle []*ftpIdleConn
+}
+
+type ftpIdleConn struct {
+	conn     *ftp.ServerConn
+	lastUsed time.Time
+}
+
+var (
+	_ Storage      = &ftpStorage{}
+	_ clientCopier = &ftpStorage{}
+)
+
+// NewFTPStorage keeps objects as files under remoteDir, connections are opened with dial when needed,
+// since a control connection serves a single transfer at a time.
+func NewFTPStorage(dial func() (*ftp.ServerConn, error), remoteDir string) Storage {
+	return &ftpStorage{
+		dial: dial,
+		root: strings.TrimSuffix(remoteDir, "/"),
+	}
+}
+
+// resolvePath resolves the path under the root dir, paths that escape it are rejected
+func (s *ftpStorage) resolvePath(p string) (string, error) {
+	name, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.root, name), nil
+}
+
+func (s *ftpStorage) relPath(fullPath string) (string, error) {
+	rel, err := filepath.Rel(s.root, fullPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// acquire takes an idle connection from the pool, or dials a new one
+func (s *ftpStorage) acquire() (*ftp.ServerConn, error) {
+	for {
+		s.mu.Lock()
+		if len(s.idle) == 0 {
+			s.mu.Unlock()
+			return s.dial()
+		}
+		ic := s.idle[len(s.idle)-1]
+		s.idle = s.idle[:len(s.idle)-1]
+		s.mu.Unlock()
+
+		if time.Since(ic.lastUsed) < ftpIdleCheckAfter {
+			return ic.conn, nil
+		}
+		if err := ic.conn.NoOp(); err == nil {
+			return ic.conn, nil
+		}
+		_ = ic.conn.Quit()
+	}
+}
+
+// release returns the connection to the pool, unless the error may have left it broken
+func (s *ftpStorage) release(c *ftp.ServerConn, err error) {
+	if err != nil && !isFTPReply(err) && !errors.Is(err, fs.ErrNotExist) {
+		_ = c.Quit()
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) >= ftpMaxIdleConns {
+		_ = c.Quit()
+		return
+	}
+	s.idle = append(s.idle, &ftpIdleConn{conn: c, lastUsed: time.Now()})
+}
+
+func (s *ftpStorage) withConn(fn func(c *ftp.ServerConn) error) error {
+	c, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	err = fn(c)
+	s.release(c, err)
+	return err
+}
+
+// isFTPReply reports whether the error is a negative reply of the server, the connection is still usable then
+func isFTPReply(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr)
+}
+
+// isRetryable treats 4xx replies as transient, that's what they are for (RFC 959, "transient negative completion"),
+// a broken connection is dropped from the pool, so the next attempt dials a new one
+func (s *ftpStorage) isRetryable(err error) bool {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code >= 400 && tpErr.Code < 500
+	}
+	return isTransientError(err) || errors.Is(err, io.EOF)
+}
+
+func isFTPReplyCode(err error, codes ...int) bool {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return false
+	}
+	for _, code := range codes {
+		if tpErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// isFTPNotExist reports the "file unavailable" reply, which servers send for missing paths
+func isFTPNotExist(err error) bool {
+	return isFTPReplyCode(err, ftp.StatusFileUnavailable)
+}
+
+func (s *ftpStorage) PutObject(ctx context.Context, relPath string, r io.Reader) error {
+	return s.PutObjectWithOpts(ctx, relPath, r, nil)
+}
+
+// PutObjectWithOpts uploads the object, metadata and tags are kept in a sidecar file next to it.
+func (s *ftpStorage) PutObjectWithOpts(_ context.Context, relPath string, r io.Reader, opts *PutObjectOpts) error {
+	fullPath, err := s.resolvePath(relPath)
+	if err != nil {
+		return err
+	}
+	if err := s.putAtomic(fullPath, r); err != nil {
+		return err
+	}
+	return s.writeMeta(fullPath, newObjectMeta(opts))
+}
+
+// putAtomic uploads into a hidden temp file next to the target, and renames it into place when the transfer
+// is complete, so readers never observe a partially uploaded object.
+func (s *ftpStorage) putAtomic(fullPath string, r io.Reader) error {
+	return s.withConn(func(c *ftp.ServerConn) error {
+		dir := path.Dir(fullPath)
+		if err := s.mkdirAll(c, dir); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+
+		suffix, err := randomSuffix()
+		if err != nil {
+			return err
+		}
+		tmpPath := path.Join(dir, tmpFilePrefix+path.Base(fullPath)+"-"+suffix)
+
+		if err := c.Stor(tmpPath, r); err != nil {
+			_ = c.Delete(tmpPath)
+			return fmt.Errorf("ftp stor: %w", err)
+		}
+		if err := s.rename(c, tmpPath, fullPath); err != nil {
+			_ = c.Delete(tmpPath)
+			return err
+		}
+		return nil
+	})
+}
+
+// rename replaces dst. Servers that refuse to overwrite on RNTO (e.g. IIS, with 550 "file exists") get dst
+// moved aside first, and moved back when the source can't be renamed still, so dst is never lost.
+func (s *ftpStorage) rename(c *ftp.ServerConn, src, dst string) error {
+	err := c.Rename(src, dst)
+	if err == nil || !isFTPReplyCode(err, ftp.StatusFileUnavailable, ftp.StatusBadFileName) {
+		return wrapFTPErr("ftp rename", err)
+	}
+	// only an existing dst explains the refusal, a missing source or a denied rename do not
+	if _, statErr := s.stat(c, src); statErr != nil {
+		return wrapFTPErr("ftp rename", err)
+	}
+	if _, statErr := s.stat(c, dst); statErr != nil {
+		return wrapFTPErr("ftp rename", err)
+	}
+
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	aside := path.Join(path.Dir(dst), tmpFilePrefix+path.Base(dst)+"-"+suffix)
+	if err := c.Rename(dst, aside); err != nil {
+		return wrapFTPErr("ftp rename", err)
+	}
+	if err := c.Rename(src, dst); err != nil {
+		if restoreErr := c.Rename(aside, dst); restoreErr != nil {
+			return fmt.Errorf("ftp rename: %w (the replaced object is kept as %s: %w)", err, aside, restoreErr)
+		}
+		return wrapFTPErr("ftp rename", err)
+	}
+	if err := c.Delete(aside); err != nil {
+		slog.Warn("cannot remove the replaced object",
+			slog.String("module", "storage"),
+			slog.String("path", aside),
+			slog.Any("err", err),
+		)
+	}
+	return nil
+}
+
+func wrapFTPErr(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// mkdirAll creates the dir with its parents, starting from the deepest one,
+// so only a single MKD is sent when the parents already exist.
+func (s *ftpStorage) mkdirAll(c *ftp.ServerConn, dir string) error {
+	if dir == "" || dir == "." || dir == "/" {
+		return nil
+	}
+	err := c.MakeDir(dir)
+	if err == nil || !isFTPReply(err) {
+		return err
+	}
+
+	// the dir exists, or the parent is missing
+	if ok, statErr := s.isDir(c, dir); statErr == nil && ok {
+		return nil
+	}
+	if err := s.mkdirAll(c, path.Dir(dir)); err != nil {
+		return err
+	}
+	if err := c.MakeDir(dir); err != nil {
+		// created by a concurrent writer in the meantime
+		if ok, statErr := s.isDir(c, dir); statErr == nil && ok {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *ftpStorage) isDir(c *ftp.ServerConn, p string) (bool, error) {
+	e, err := s.stat(c, p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return e.Type == ftp.EntryTypeFolder, nil
+}
+
+// stat describes the path with MLST, servers without it are asked for a listing of the parent dir
+func (s *ftpStorage) stat(c *ftp.ServerConn, p string) (*ftp.Entry, error) {
+	e, err := c.GetEntry(p)
+	if err == nil {
+		return e, nil
+	}
+	if isFTPNotExist(err) {
+		return nil, &fs.PathError{Op: "stat", Path: p, Err: fs.ErrNotExist}
+	}
+	if !isFTPReplyCode(err, ftp.StatusNotImplemented, ftp.StatusBadCommand) {
+		return nil, err
+	}
+
+	entries, err := c.List(path.Dir(p))
+	if err != nil {
+		if isFTPNotExist(err) {
+			return nil, &fs.PathError{Op: "stat", Path: p, Err: fs.ErrNotExist}
+		}
+		return nil, err
+	}
+	for _, e := range entries {
+		if path.Base(e.Name) == path.Base(p) {
+			return e, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: p, Err: fs.ErrNotExist}
+}
+
+// statObject fails with fs.ErrNotExist unless the path is a regular file
+func (s *ftpStorage) statObject(op, p, fullPath string) (*ftp.Entry, error) {
+	var e *ftp.Entry
+	err := s.withConn(func(c *ftp.ServerConn) error {
+		var err error
+		e, err = s.stat(c, fullPath)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+		}
+		return nil, err
+	}
+	if e.Type != ftp.EntryTypeFile {
+		return nil, &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+// writeMeta replaces the metadata sidecar of the object, nil removes a stale one
+func (s *ftpStorage) writeMeta(fullPath string, meta *objectMeta) error {
+	sidecar := metaSidecarPath(fullPath)
+	if meta == nil {
+		return s.withConn(func(c *ftp.ServerConn) error {
+			if err := c.Delete(sidecar); err != nil && !isFTPNotExist(err) {
+				return fmt.Errorf("ftp delete: %w", err)
+			}
+			return nil
+		})
+	}
+	r, err := meta.marshal()
+	if err != nil {
+		return err
+	}
+	return s.putAtomic(sidecar, r)
+}
+
+// readMeta loads the metadata sidecar of the object, nil if there is none
+func (s *ftpStorage) readMeta(fullPath string) (*objectMeta, error) {
+	rc, err := s.retr(metaSidecarPath(fullPath), 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rc.Close()
+	return readObjectMeta(rc)
+}
+
+// copyMeta makes the metadata of dst match src
+func (s *ftpStorage) copyMeta(srcPath, dstPath string) error {
+	meta, err := s.readMeta(srcPath)
+	if err != nil {
+		return err
+	}
+	return s.writeMeta(dstPath, meta)
+}
+
+// ftpReadCloser keeps the connection busy until the transfer is closed
+type ftpReadCloser struct {
+	s      *ftpStorage
+	c      *ftp.ServerConn
+	resp   *ftp.Response
+	eof    bool
+	closed bool
+}
+
+func (r *ftpReadCloser) Read(p []byte) (int, error) {
+	n, err := r.resp.Read(p)
+	if errors.Is(err, io.EOF) {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *ftpReadCloser) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	err := r.resp.Close()
+	r.s.release(r.c, err)
+
+	// the server reports the transfer as aborted when the reader stops early, that's expected
+	if err != nil && !r.eof && isFTPReply(err) {
+		return nil
+	}
+	return wrapFTPErr("ftp retr", err)
+}
+
+func (s *ftpStorage) retr(fullPath string, offset int64) (io.ReadCloser, error) {
+	c, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.RetrFrom(fullPath, uint64(offset))
+	if err != nil {
+		s.release(c, err)
+		if isFTPNotExist(err) {
+			return nil, &fs.PathError{Op: "retr", Path: fullPath, Err: fs.ErrNotExist}
+		}
+		return nil, fmt.Errorf("ftp retr: %w", err)
+	}
+	return &ftpReadCloser{s: s, c: c, resp: resp}, nil
+}
+
+func (s *ftpStorage) ReadObject(_ context.Context, relPath string) (io.ReadCloser, error) {
+	fullPath, err := s.resolvePath(relPath)
+	if err != nil {
+		return nil, err
+	}
+	return s.retr(fullPath, 0)
+}
+
+// ReadObjectRange restarts the transfer at the offset (REST), and limits it to the length
+func (s *ftpStorage) ReadObjectRange(_ context.Context, relPath string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	fullPath, err := s.resolvePath(relPath)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := s.retr(fullPath, offset)
+	if err != nil {
+		if offset == 0 || errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		// some servers refuse to restart past the end of the file
+		e, statErr := s.statObject("read", relPath, fullPath)
+		if statErr != nil {
+			return nil, statErr
+		}
+		if offset >= int64(e.Size) {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		return nil, err
+	}
+	return newRangeReadCloser(rc, length), nil
+}
+
+func (s *ftpStorage) Exists(_ context.Context, relPath string) (bool, error) {
+	fullPath, err := s.resolvePath(relPath)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.statObject("stat", relPath, fullPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *ftpStorage) SHA256(ctx context.Context, relPath string) (string, error) {
+	rc, err := s.ReadObject(ctx, relPath)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (s *ftpStorage) Stat(_ context.Context, relPath string) (ObjectInfo, error) {
+	fullPath, err := s.resolvePath(relPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	e, err := s.statObject("stat", relPath, fullPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	result := ObjectInfo{
+		Path:    filepath.ToSlash(filepath.Clean(relPath)),
+		Size:    int64(e.Size),
+		ModTime: e.Time,
+	}
+
+	meta, err := s.readMeta(fullPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if meta != nil {
+		meta.applyTo(&result)
+	}
+	return result, nil
+}
+
+func (s *ftpStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	return collectPaths(s.Walk(ctx, prefix))
+}
+
+func (s *ftpStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return collectInfos(s.Walk(ctx, prefix))
+}
+
+// list reads the dir (MLSD, or LIST on servers without it), without the "." and ".." entries
+func (s *ftpStorage) list(dir string) ([]*ftp.Entry, error) {
+	var entries []*ftp.Entry
+	err := s.withConn(func(c *ftp.ServerConn) error {
+		var err error
+		entries, err = c.List(dir)
+		return err
+	})
+	if err != nil {
+		if isFTPNotExist(err) {
+			return nil, &fs.PathError{Op: "list", Path: dir, Err: fs.ErrNotExist}
+		}
+		return nil, fmt.Errorf("ftp list: %w", err)
+	}
+
+	result := entries[:0]
+	for _, e := range entries {
+		e.Name = path.Base(e.Name)
+		if e.Name == "." || e.Name == ".." || e.Name == "/" {
+			continue
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// Walk lists the dirs one at a time, a missing prefix yields nothing
+func (s *ftpStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		fullPath, err := s.resolvePath(prefix)
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+
+		// the prefix may name a single object
+		if e, err := s.statObject("stat", prefix, fullPath); err == nil {
+			rel, err := s.relPath(fullPath)
+			if err != nil {
+				yield(ObjectInfo{}, err)
+				return
+			}
+			if !isInternalName(fullPath) {
+				yield(ObjectInfo{Path: rel, Size: int64(e.Size), ModTime: e.Time}, nil)
+			}
+			return
+		}
+
+		pending := []string{fullPath}
+		first := true
+		for len(pending) > 0 {
+			if err := ctx.Err(); err != nil {
+				yield(ObjectInfo{}, err)
+				return
+			}
+			dir := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+
+			entries, err := s.list(dir)
+			if err != nil {
+				if first && errors.Is(err, fs.ErrNotExist) {
+					return
+				}
+				yield(ObjectInfo{}, err)
+				return
+			}
+			first = false
+
+			for _, e := range entries {
+				p := path.Join(dir, e.Name)
+				if e.Type == ftp.EntryTypeFolder {
+					pending = append(pending, p)
+					continue
+				}
+				if e.Type != ftp.EntryTypeFile || isInternalName(p) {
+					continue
+				}
+				rel, err := s.relPath(p)
+				if err != nil {
+					yield(ObjectInfo{}, err)
+					return
+				}
+				if !yield(ObjectInfo{
+					Path:    rel,
+					Size:    int64(e.Size),
+					ModTime: e.Time,
+				}, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ListTopLevelDirs returns the dirs directly under the prefix (relative to the storage root)
+func (s *ftpStorage) ListTopLevelDirs(_ context.Context, prefix string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	dir, err := s.resolvePath(prefix)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.list(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return result, nil
+		}
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e.Type != ftp.EntryTypeFolder {
+			continue
+		}
+		rel, err := s.relPath(path.Join(dir, e.Name))
+		if err != nil {
+			return nil, err
+		}
+		result[rel] = true
+	}
+	return result, nil
+}
+
+func (s *ftpStorage) Delete(_ context.Context, relPath string) error {
+	fullPath, err := s.resolvePath(relPath)
+	if err != nil {
+		return err
+	}
+	err = s.withConn(func(c *ftp.ServerConn) error {
+		if err := c.Delete(fullPath); err != nil && !isFTPNotExist(err) {
+			return fmt.Errorf("ftp delete: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.writeMeta(fullPath, nil)
+}
+
+func (s *ftpStorage) DeletePrefix(_ context.Context, prefix string) error {
+	fullPath, err := s.resolvePath(prefix)
+	if err != nil {
+		return err
+	}
+
+	// never remove the root dir itself, only its contents
+	if fullPath != path.Join(s.root, "") {
+		return s.removeAll(fullPath)
+	}
+
+	entries, err := s.list(fullPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if err := s.removeAll(path.Join(fullPath, e.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAll deletes the file, or the dir with its contents, a missing path is not an error
+func (s *ftpStorage) removeAll(p string) error {
+	return s.withConn(func(c *ftp.ServerConn) error {
+		e, err := s.stat(c, p)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		return s.removeEntry(c, p, e.Type == ftp.EntryTypeFolder)
+	})
+}
+
+func (s *ftpStorage) removeEntry(c *ftp.ServerConn, p string, isDir bool) error {
+	if !isDir {
+		if err := c.Delete(p); err != nil && !isFTPNotExist(err) {
+			return fmt.Errorf("ftp delete: %w", err)
+		}
+		return nil
+	}
+
+	entries, err := c.List(p)
+	if err != nil {
+		return fmt.Errorf("ftp list: %w", err)
+	}
+	for _, e := range entries {
+		name := path.Base(e.Name)
+		if name == "." || name == ".." || name == "/" {
+			continue
+		}
+		if err := s.removeEntry(c, path.Join(p, name), e.Type == ftp.EntryTypeFolder); err != nil {
+			return err
+		}
+	}
+	if err := c.RemoveDir(p); err != nil && !isFTPNotExist(err) {
+		return fmt.Errorf("ftp rmd: %w", err)
+	}
+	return nil
+}
+
+// Copy streams the content through the client, since FTP has no server-side copy
+func (s *ftpStorage) Copy(ctx context.Context, src, dst string) error {
+	return s.copyThrough(ctx, src, dst, nil)
+}
+
+func (s *ftpStorage) copyThrough(ctx context.Context, src, dst string, wrap func(io.Reader) io.Reader) error {
+	srcPath, err := s.resolvePath(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := s.resolvePath(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.statObject("copy", src, srcPath); err != nil {
+		return err
+	}
+	if srcPath == dstPath {
+		return nil
+	}
+
+	rc, err := s.ReadObject(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if wrap != nil {
+		r = wrap(r)
+	}
+	if err := s.putAtomic(dstPath, r); err != nil {
+		return err
+	}
+	return s.copyMeta(srcPath, dstPath)
+}
+
+func (s *ftpStorage) Rename(_ context.Context, src, dst string) error {
+	srcPath, err := s.resolvePath(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := s.resolvePath(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.statObject("rename", src, srcPath); err != nil {
+		return err
+	}
+	if srcPath == dstPath {
+		return nil
+	}
+
+	err = s.withConn(func(c *ftp.ServerConn) error {
+		if err := s.mkdirAll(c, path.Dir(dstPath)); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+		return s.rename(c, srcPath, dstPath)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.copyMeta(srcPath, dstPath); err != nil {
+		return err
+	}
+	return s.writeMeta(srcPath, nil)
+}
@@ -0,0 +1,617 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashmap-kz/xrepo/pkg/clients/ftpx"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ftpTestServer is a minimal in-process FTP(S) server over a local dir, it implements
+// the commands the client sends (passive mode, MLSD/MLST, REST, AUTH TLS) and nothing more.
+type ftpTestServer struct {
+	dir       string
+	tlsConfig *tls.Config
+
+	// noOverwrite refuses RNTO onto an existing file the way IIS does,
+	// deniedRenames refuses the given number of RNTO onto the paths
+	noOverwrite   bool
+	deniedRenames map[string]int
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// newFTPTestStorage serves a temp dir, tlsMode is passed to the client as is
+func newFTPTestStorage(t *testing.T, tlsMode string) Storage {
+	t.Helper()
+	_, s := newFTPTestServerStorage(t, tlsMode)
+	return s
+}
+
+func newFTPTestServerStorage(t *testing.T, tlsMode string) (*ftpTestServer, Storage) {
+	t.Helper()
+
+	srv := &ftpTestServer{dir: t.TempDir(), conns: make(map[net.Conn]struct{}), deniedRenames: make(map[string]int)}
+	cfg := &ftpx.FTPConfig{Host: "127.0.0.1", User: "backup", Pass: "secret", TLS: tlsMode}
+	if tlsMode != "" {
+		srv.tlsConfig, cfg.CACertPath = newFTPTestCert(t)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if tlsMode == ftpx.TLSImplicit {
+		ln = tls.NewListener(ln, srv.tlsConfig)
+	}
+	t.Cleanup(srv.close)
+	t.Cleanup(func() { _ = ln.Close() })
+	go srv.serve(ln)
+
+	cfg.Port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	c, err := ftpx.NewFTPClient(cfg)
+	require.NoError(t, err)
+	return srv, NewFTPStorage(c.Dial, "/backups/main")
+}
+
+// refuseRenames sets up the RNTO replies of the server
+func (srv *ftpTestServer) refuseRenames(noOverwrite bool, denied map[string]int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.noOverwrite = noOverwrite
+	maps.Copy(srv.deniedRenames, denied)
+}
+
+func newFTPTestCert(t *testing.T) (*tls.Config, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "xrepo-test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}, caPath
+}
+
+func (srv *ftpTestServer) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.conns[conn] = struct{}{}
+		srv.mu.Unlock()
+		go srv.session(conn)
+	}
+}
+
+func (srv *ftpTestServer) close() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for conn := range srv.conns {
+		_ = conn.Close()
+	}
+}
+
+func (srv *ftpTestServer) localPath(arg string) string {
+	return filepath.Join(srv.dir, filepath.FromSlash(path.Clean("/"+arg)))
+}
+
+type ftpTestSession struct {
+	srv      *ftpTestServer
+	conn     net.Conn
+	r        *bufio.Reader
+	loggedIn bool
+	prot     bool
+	pasv     net.Listener
+	rest     int64
+	rnfr     string
+}
+
+func (srv *ftpTestServer) session(conn net.Conn) {
+	s := &ftpTestSession{srv: srv, conn: conn, r: bufio.NewReader(conn)}
+	defer func() {
+		_ = s.conn.Close()
+		if s.pasv != nil {
+			_ = s.pasv.Close()
+		}
+	}()
+
+	s.reply(220, "ready")
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		if !s.handle(strings.ToUpper(cmd), arg) {
+			return
+		}
+	}
+}
+
+func (s *ftpTestSession) reply(code int, msg string) {
+	_, _ = fmt.Fprintf(s.conn, "%d %s\r\n", code, msg)
+}
+
+// handle executes the command, false ends the session
+func (s *ftpTestSession) handle(cmd, arg string) bool {
+	switch cmd {
+	case "QUIT":
+		s.reply(221, "bye")
+		return false
+	case "AUTH":
+		s.reply(234, "AUTH TLS ok")
+		tlsConn := tls.Server(s.conn, s.srv.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return false
+		}
+		s.conn = tlsConn
+		s.r = bufio.NewReader(tlsConn)
+		return true
+	case "USER":
+		s.reply(331, "password required")
+		return true
+	case "PASS":
+		if arg != "secret" {
+			s.reply(530, "login incorrect")
+			return true
+		}
+		s.loggedIn = true
+		s.reply(230, "logged in")
+		return true
+	case "FEAT":
+		_, _ = fmt.Fprint(s.conn, "211-Features:\r\n MLST type*;size*;modify*;\r\n UTF8\r\n EPSV\r\n REST STREAM\r\n211 End\r\n")
+		return true
+	}
+	if !s.loggedIn {
+		s.reply(530, "not logged in")
+		return true
+	}
+
+	switch cmd {
+	case "TYPE", "OPTS", "NOOP", "PBSZ":
+		s.reply(200, "ok")
+	case "PROT":
+		s.prot = arg == "P"
+		s.reply(200, "ok")
+	case "EPSV", "PASV":
+		if s.pasv != nil {
+			_ = s.pasv.Close()
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			s.reply(425, err.Error())
+			return true
+		}
+		s.pasv = ln
+		port := ln.Addr().(*net.TCPAddr).Port
+		if cmd == "EPSV" {
+			s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		} else {
+			s.reply(227, fmt.Sprintf("Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256))
+		}
+	case "REST":
+		s.rest, _ = strconv.ParseInt(arg, 10, 64)
+		s.reply(350, "restarting")
+	case "RETR":
+		s.retr(arg)
+	case "STOR":
+		s.stor(arg)
+	case "MLSD":
+		s.mlsd(arg)
+	case "MLST":
+		info, err := os.Stat(s.srv.localPath(arg))
+		if err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		_, _ = fmt.Fprintf(s.conn, "250-Listing %s\r\n %s %s\r\n250 End\r\n", arg, mlsxFacts(info), arg)
+	case "DELE":
+		info, err := os.Stat(s.srv.localPath(arg))
+		if err != nil || info.IsDir() {
+			s.reply(550, "not a file")
+			return true
+		}
+		s.result(os.Remove(s.srv.localPath(arg)), 250)
+	case "MKD":
+		s.result(os.Mkdir(s.srv.localPath(arg), 0o750), 257)
+	case "RMD":
+		s.result(rmdirOnly(s.srv.localPath(arg)), 250)
+	case "RNFR":
+		if _, err := os.Stat(s.srv.localPath(arg)); err != nil {
+			s.reply(550, err.Error())
+			return true
+		}
+		s.rnfr = arg
+		s.reply(350, "ready for RNTO")
+	case "RNTO":
+		s.srv.mu.Lock()
+		noOverwrite, denied := s.srv.noOverwrite, s.srv.deniedRenames[arg] > 0
+		if denied {
+			s.srv.deniedRenames[arg]--
+		}
+		s.srv.mu.Unlock()
+		if denied {
+			s.reply(550, "permission denied")
+			return true
+		}
+		if _, err := os.Stat(s.srv.localPath(arg)); err == nil && noOverwrite {
+			s.reply(550, "cannot create a file when that file already exists")
+			return true
+		}
+		s.result(os.Rename(s.srv.localPath(s.rnfr), s.srv.localPath(arg)), 250)
+	default:
+		s.reply(502, "not implemented")
+	}
+	return true
+}
+
+func rmdirOnly(p string) error {
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a dir: %s", p)
+	}
+	return os.Remove(p)
+}
+
+func (s *ftpTestSession) result(err error, code int) {
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+	s.reply(code, "ok")
+}
+
+func mlsxFacts(info fs.FileInfo) string {
+	kind := "file"
+	if info.IsDir() {
+		kind = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s;", kind, info.Size(), info.ModTime().UTC().Format("20060102150405"))
+}
+
+// openData accepts the connection the client has dialed after EPSV/PASV, the 150 reply is sent first,
+// since the TLS handshake of the data connection waits for the client to start reading/writing
+func (s *ftpTestSession) openData() (net.Conn, error) {
+	if s.pasv == nil {
+		return nil, fmt.Errorf("no passive listener")
+	}
+	s.reply(150, "opening data connection")
+	conn, err := s.pasv.Accept()
+	_ = s.pasv.Close()
+	s.pasv = nil
+	if err != nil {
+		return nil, err
+	}
+	if s.prot {
+		tlsConn := tls.Server(conn, s.srv.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return conn, nil
+}
+
+func (s *ftpTestSession) retr(arg string) {
+	offset := s.rest
+	s.rest = 0
+
+	f, err := os.Open(s.srv.localPath(arg))
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		s.reply(550, "not a file")
+		return
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+
+	data, err := s.openData()
+	if err != nil {
+		s.reply(425, err.Error())
+		return
+	}
+	_, err = io.Copy(data, f)
+	_ = data.Close()
+	if err != nil {
+		s.reply(426, "transfer aborted")
+		return
+	}
+	s.reply(226, "transfer complete")
+}
+
+func (s *ftpTestSession) stor(arg string) {
+	f, err := os.Create(s.srv.localPath(arg))
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+	defer f.Close()
+
+	data, err := s.openData()
+	if err != nil {
+		s.reply(425, err.Error())
+		return
+	}
+	_, err = io.Copy(f, data)
+	_ = data.Close()
+	if err != nil {
+		s.reply(426, "transfer aborted")
+		return
+	}
+	s.reply(226, "transfer complete")
+}
+
+func (s *ftpTestSession) mlsd(arg string) {
+	dir := s.srv.localPath(arg)
+	info, err := os.Stat(dir)
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+	if !info.IsDir() {
+		s.reply(501, "not a dir")
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		s.reply(550, err.Error())
+		return
+	}
+
+	data, err := s.openData()
+	if err != nil {
+		s.reply(425, err.Error())
+		return
+	}
+	w := bufio.NewWriter(data)
+	_, _ = fmt.Fprintf(w, "type=cdir;modify=%s; .\r\n", info.ModTime().UTC().Format("20060102150405"))
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			_, _ = fmt.Fprintf(w, "%s %s\r\n", mlsxFacts(info), e.Name())
+		}
+	}
+	_ = w.Flush()
+	_ = data.Close()
+	s.reply(226, "transfer complete")
+}
+
+func TestFTPStorage_PutListAndRead(t *testing.T) {
+	s := newFTPTestStorage(t, "")
+	ctx := context.Background()
+
+	require.NoError(t, s.PutObject(ctx, "listall/a b.txt", strings.NewReader("A")))
+	require.NoError(t, s.PutObject(ctx, "listall/sub/b.txt", strings.NewReader("BB")))
+	require.NoError(t, s.PutObject(ctx, "listall-sibling/c.txt", strings.NewReader("C")))
+	require.NoError(t, s.PutObject(ctx, "listall/empty.txt", strings.NewReader("")))
+
+	files, err := s.ListAll(ctx, "listall/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"listall/a b.txt", "listall/sub/b.txt", "listall/empty.txt"}, files)
+
+	files, err = s.ListAll(ctx, "listall/sub/b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"listall/sub/b.txt"}, files)
+
+	files, err = s.ListAll(ctx, "missing/")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	rc, err := s.ReadObject(ctx, "listall/sub/b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("BB"), readAll(t, rc))
+
+	_, err = s.ReadObject(ctx, "listall/missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	exists, err := s.Exists(ctx, "listall/a b.txt")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = s.Exists(ctx, "listall/sub")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestFTPStorage_ReadObjectRange(t *testing.T) {
+	s := newFTPTestStorage(t, "")
+	ctx := context.Background()
+
+	// large enough that the server is still sending when the reader is closed
+	content := bytes.Repeat([]byte("0123456789"), 256*1024)
+	require.NoError(t, s.PutObject(ctx, "range/obj", bytes.NewReader(content)))
+
+	rc, err := s.ReadObjectRange(ctx, "range/obj", 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("234"), readAll(t, rc))
+
+	rc, err = s.ReadObjectRange(ctx, "range/obj", int64(len(content))-3, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("789"), readAll(t, rc))
+
+	rc, err = s.ReadObjectRange(ctx, "range/obj", int64(len(content))+10, 5)
+	require.NoError(t, err)
+	assert.Empty(t, readAll(t, rc))
+
+	// the connections are still usable after the aborted transfers
+	sum, err := s.SHA256(ctx, "range/obj")
+	require.NoError(t, err)
+	assert.Len(t, sum, 64)
+}
+
+func TestFTPStorage_ListTopLevelDirs(t *testing.T) {
+	s := newFTPTestStorage(t, "")
+	ctx := context.Background()
+
+	for _, p := range []string{"dir1/file1.txt", "dir2/file2.txt", "dir3/subdir/file.txt", "root.txt"} {
+		require.NoError(t, s.PutObject(ctx, p, strings.NewReader("hello")))
+	}
+
+	dirs, err := s.ListTopLevelDirs(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"dir1": true, "dir2": true, "dir3": true}, dirs)
+
+	dirs, err = s.ListTopLevelDirs(ctx, "dir3")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"dir3/subdir": true}, dirs)
+}
+
+func TestFTPStorage_StatDeleteAndDeletePrefix(t *testing.T) {
+	s := newFTPTestStorage(t, "")
+	ctx := context.Background()
+
+	require.NoError(t, s.PutObject(ctx, "delete/a.txt", strings.NewReader("AAA")))
+	require.NoError(t, s.PutObject(ctx, "delete/sub/b.txt", strings.NewReader("B")))
+	require.NoError(t, s.PutObject(ctx, "delete-sibling/c.txt", strings.NewReader("C")))
+
+	info, err := s.Stat(ctx, "delete/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "delete/a.txt", info.Path)
+	assert.Equal(t, int64(3), info.Size)
+	assert.False(t, info.ModTime.IsZero())
+
+	_, err = s.Stat(ctx, "delete/missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, s.Delete(ctx, "delete/a.txt"))
+	require.NoError(t, s.Delete(ctx, "delete/a.txt"))
+
+	require.NoError(t, s.DeletePrefix(ctx, "delete/"))
+	files, err := s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"delete-sibling/c.txt"}, files)
+
+	require.NoError(t, s.DeletePrefix(ctx, ""))
+	files, err = s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestFTPStorage_CopyAndRenameWithOpts(t *testing.T) {
+	s := newFTPTestStorage(t, "")
+	ctx := context.Background()
+
+	opts := &PutObjectOpts{
+		Metadata: map[string]string{"Source-Host": "pg-01"},
+		Tags:     map[string]string{"kind": "wal"},
+	}
+	require.NoError(t, s.PutObjectWithOpts(ctx, "mv/incoming/a.txt", strings.NewReader("A"), opts))
+	require.NoError(t, s.PutObject(ctx, "mv/base/a.txt", strings.NewReader("stale")))
+
+	require.NoError(t, s.Rename(ctx, "mv/incoming/a.txt", "mv/base/a.txt"))
+	require.NoError(t, s.Copy(ctx, "mv/base/a.txt", "mv/copy/a.txt"))
+
+	files, err := s.ListAll(ctx, "mv/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"mv/base/a.txt", "mv/copy/a.txt"}, files)
+
+	rc, err := s.ReadObject(ctx, "mv/copy/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("A"), readAll(t, rc))
+
+	info, err := s.Stat(ctx, "mv/copy/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"source-host": "pg-01"}, info.Metadata)
+	assert.Equal(t, map[string]string{"kind": "wal"}, info.Tags)
+
+	assert.ErrorIs(t, s.Copy(ctx, "mv/missing", "mv/x"), fs.ErrNotExist)
+	assert.ErrorIs(t, s.Rename(ctx, "mv/missing", "mv/x"), fs.ErrNotExist)
+}
+
+func TestFTPStorage_RenameOntoExistingObject(t *testing.T) {
+	srv, s := newFTPTestServerStorage(t, "")
+	ctx := context.Background()
+	srv.refuseRenames(true, nil)
+
+	// the server refuses to overwrite, dst is replaced through a rename aside
+	require.NoError(t, s.PutObject(ctx, "obj", strings.NewReader("old")))
+	require.NoError(t, s.PutObject(ctx, "obj", strings.NewReader("new")))
+	rc, err := s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), readAll(t, rc))
+
+	// a denied rename keeps the existing object, it's moved aside and back
+	srv.refuseRenames(true, map[string]int{"/backups/main/obj": 2})
+	require.Error(t, s.PutObject(ctx, "obj", strings.NewReader("newer")))
+	rc, err = s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), readAll(t, rc))
+
+	entries, err := os.ReadDir(filepath.Join(srv.dir, "backups", "main"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "obj", entries[0].Name())
+}
+
+func TestFTPStorage_TLS(t *testing.T) {
+	for _, mode := range []string{ftpx.TLSExplicit, ftpx.TLSImplicit} {
+		t.Run(mode, func(t *testing.T) {
+			s := newFTPTestStorage(t, mode)
+			ctx := context.Background()
+
+			require.NoError(t, s.PutObject(ctx, "tls/a.txt", strings.NewReader("A")))
+			require.NoError(t, s.PutObject(ctx, "tls/empty.txt", strings.NewReader("")))
+
+			files, err := s.ListAll(ctx, "tls/")
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"tls/a.txt", "tls/empty.txt"}, files)
+
+			rc, err := s.ReadObject(ctx, "tls/a.txt")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("A"), readAll(t, rc))
+		})
+	}
+}
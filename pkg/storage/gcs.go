@@ -0,0 +1,426 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"iter"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// gcsChunkSize is the size of a resumable upload request, a failed chunk is retried without restarting the upload
+	gcsChunkSize = 8 * 1024 * 1024
+
+	// gcsTagPrefix marks tags among the object metadata, GCS has no separate object tags
+	gcsTagPrefix = "xrepo-tag-"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type gcsStorage struct {
+	bucket *gcs.BucketHandle
+	prefix string
+}
+
+var _ Storage = &gcsStorage{}
+
+func NewGCSStorage(client *gcs.Client, bucket, prefix string) Storage {
+	return &gcsStorage{
+		bucket: client.Bucket(bucket),
+		prefix: strings.Trim(filepath.ToSlash(prefix), "/"),
+	}
+}
+
+// fullPath resolves the path to an object name under the prefix, paths that escape it are rejected
+func (s *gcsStorage) fullPath(p string) (string, error) {
+	name, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	name = path.Join(s.prefix, name)
+	if name == "." {
+		return "", nil
+	}
+	return strings.TrimPrefix(name, "/"), nil
+}
+
+// keyPrefix resolves a listing prefix to an object name prefix, keeping the trailing slash
+// so that "a/" (or the storage root) does not match sibling objects like "ab/...".
+// A prefix without it still lists sibling objects, they are dropped with matchesKeyPrefix.
+func (s *gcsStorage) keyPrefix(prefix string) (string, error) {
+	fullPath, err := s.fullPath(prefix)
+	if err != nil || fullPath == "" {
+		return "", err
+	}
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return fullPath + "/", nil
+	}
+	return fullPath, nil
+}
+
+func (s *gcsStorage) relPath(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return strings.TrimPrefix(name, s.prefix+"/")
+}
+
+// notFound maps the missing object error to fs.ErrNotExist,
+// some calls (i.e. rewrite) return the plain API error instead of gcs.ErrObjectNotExist
+func (s *gcsStorage) notFound(op, p string, err error) error {
+	var gerr *googleapi.Error
+	if errors.Is(err, gcs.ErrObjectNotExist) || (errors.As(err, &gerr) && gerr.Code == http.StatusNotFound) {
+		return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+// isRetryable treats throttling and server-side failures as transient
+func (s *gcsStorage) isRetryable(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return isRetryableStatus(gerr.Code)
+	}
+	return isTransientError(err)
+}
+
+func (s *gcsStorage) PutObject(ctx context.Context, p string, r io.Reader) error {
+	return s.PutObjectWithOpts(ctx, p, r, nil)
+}
+
+// PutObjectWithOpts streams the content as a resumable upload, and verifies the CRC32C computed by GCS
+// against the one of the data sent, an object that does not match is removed.
+// Metadata is stored as custom object metadata, tags too (prefixed), since GCS has no object tags.
+func (s *gcsStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	name, err := s.fullPath(p)
+	if err != nil {
+		return err
+	}
+	obj := s.bucket.Object(name)
+
+	// canceling the context is the only way to abort an upload
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := obj.NewWriter(ctx)
+	w.ChunkSize = gcsChunkSize
+	if meta := newObjectMeta(opts); meta != nil {
+		w.Metadata = encodeGCSMetadata(meta)
+	}
+
+	crc := crc32.New(crc32cTable)
+	if _, err := io.Copy(io.MultiWriter(w, crc), r); err != nil {
+		cancel()
+		_ = w.Close()
+		return fmt.Errorf("failed to upload object to GCS: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to upload object to GCS: %w", err)
+	}
+
+	if w.Attrs().CRC32C != crc.Sum32() {
+		_ = obj.Delete(context.WithoutCancel(ctx))
+		return fmt.Errorf("CRC32C mismatch after upload of %s", p)
+	}
+	return nil
+}
+
+func encodeGCSMetadata(meta *objectMeta) map[string]string {
+	result := make(map[string]string, len(meta.Metadata)+len(meta.Tags))
+	for k, v := range meta.Metadata {
+		result[k] = v
+	}
+	for k, v := range meta.Tags {
+		result[gcsTagPrefix+k] = v
+	}
+	return result
+}
+
+func decodeGCSMetadata(m map[string]string, info *ObjectInfo) {
+	for k, v := range m {
+		k = strings.ToLower(k)
+		if tag, ok := strings.CutPrefix(k, gcsTagPrefix); ok {
+			if info.Tags == nil {
+				info.Tags = make(map[string]string)
+			}
+			info.Tags[tag] = v
+			continue
+		}
+		if info.Metadata == nil {
+			info.Metadata = make(map[string]string)
+		}
+		info.Metadata[k] = v
+	}
+}
+
+// ReadObject streams the object, the client verifies the CRC32C of the content when it's read through
+func (s *gcsStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	name, err := s.fullPath(p)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := s.bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object from GCS: %w", s.notFound("read", p, err))
+	}
+	return rc, nil
+}
+
+func (s *gcsStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	name, err := s.fullPath(p)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if length < 0 {
+		length = -1
+	}
+
+	rc, err := s.bucket.Object(name).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		// the range starts past the end of the object
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusRequestedRangeNotSatisfiable {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		return nil, fmt.Errorf("failed to read object range from GCS: %w", s.notFound("read", p, err))
+	}
+	return rc, nil
+}
+
+func (s *gcsStorage) Exists(ctx context.Context, p string) (bool, error) {
+	name, err := s.fullPath(p)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.bucket.Object(name).Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, gcs.ErrObjectNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *gcsStorage) SHA256(ctx context.Context, p string) (string, error) {
+	obj, err := s.ReadObject(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, obj); err != nil {
+		return "", fmt.Errorf("failed to hash object: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *gcsStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	name, err := s.fullPath(p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	attrs, err := s.bucket.Object(name).Attrs(ctx)
+	if err != nil {
+		return ObjectInfo{}, s.notFound("stat", p, err)
+	}
+	info := s.objectInfo(attrs)
+	decodeGCSMetadata(attrs.Metadata, &info)
+	return info, nil
+}
+
+func (s *gcsStorage) objectInfo(attrs *gcs.ObjectAttrs) ObjectInfo {
+	return ObjectInfo{
+		Path:      s.relPath(attrs.Name),
+		Size:      attrs.Size,
+		ModTime:   attrs.Updated,
+		ETag:      attrs.Etag,
+		VersionID: strconv.FormatInt(attrs.Generation, 10),
+		Checksum:  "crc32c:" + encodeCRC32C(attrs.CRC32C),
+	}
+}
+
+// encodeCRC32C formats the checksum the way GCS (and S3) report it: base64 of the big-endian value
+func encodeCRC32C(sum uint32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, sum)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func (s *gcsStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	return collectPaths(s.Walk(ctx, prefix))
+}
+
+func (s *gcsStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return collectInfos(s.Walk(ctx, prefix))
+}
+
+func (s *gcsStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		keyPrefix, err := s.keyPrefix(prefix)
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+		query := &gcs.Query{Prefix: keyPrefix}
+		if err := query.SetAttrSelection([]string{"Name", "Size", "Updated", "Etag", "Generation", "CRC32C"}); err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+
+		// the iterator fetches the next page only when the current one is consumed
+		it := s.bucket.Objects(ctx, query)
+		for {
+			attrs, err := it.Next()
+			if errors.Is(err, iterator.Done) {
+				return
+			}
+			if err != nil {
+				yield(ObjectInfo{}, fmt.Errorf("failed to get page: %w", err))
+				return
+			}
+			if !matchesKeyPrefix(attrs.Name, keyPrefix) {
+				continue
+			}
+			if !yield(s.objectInfo(attrs), nil) {
+				return
+			}
+		}
+	}
+}
+
+// ListTopLevelDirs returns the "directories" directly under the prefix (relative to the storage root),
+// using a delimiter listing, so the objects inside of them are not enumerated.
+func (s *gcsStorage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	dirPrefix, err := s.fullPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if dirPrefix != "" {
+		dirPrefix += "/"
+	}
+
+	query := &gcs.Query{Prefix: dirPrefix, Delimiter: "/"}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]bool)
+	it := s.bucket.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects in bucket: %w", err)
+		}
+		// synthetic entries with only Prefix set are the "directories"
+		if attrs.Prefix != "" {
+			result[s.relPath(strings.TrimSuffix(attrs.Prefix, "/"))] = true
+		}
+	}
+	return result, nil
+}
+
+func (s *gcsStorage) Delete(ctx context.Context, p string) error {
+	name, err := s.fullPath(p)
+	if err != nil {
+		return err
+	}
+	return s.deleteObject(ctx, name)
+}
+
+func (s *gcsStorage) deleteObject(ctx context.Context, name string) error {
+	err := s.bucket.Object(name).Delete(ctx)
+	if err != nil && !errors.Is(err, gcs.ErrObjectNotExist) {
+		return fmt.Errorf("failed to delete object from GCS: %w", err)
+	}
+	return nil
+}
+
+func (s *gcsStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	keyPrefix, err := s.keyPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	query := &gcs.Query{Prefix: keyPrefix}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return err
+	}
+
+	it := s.bucket.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get page: %w", err)
+		}
+		if !matchesKeyPrefix(attrs.Name, keyPrefix) {
+			continue
+		}
+		if err := s.deleteObject(ctx, attrs.Name); err != nil {
+			return err
+		}
+	}
+}
+
+// Copy rewrites the object server-side, the copier repeats the rewrite call until large objects are done.
+// Metadata (and so tags) are carried over.
+func (s *gcsStorage) Copy(ctx context.Context, src, dst string) error {
+	srcName, err := s.fullPath(src)
+	if err != nil {
+		return err
+	}
+	dstName, err := s.fullPath(dst)
+	if err != nil {
+		return err
+	}
+	if srcName == dstName {
+		_, err := s.Stat(ctx, src)
+		return err
+	}
+	srcObj := s.bucket.Object(srcName)
+	dstObj := s.bucket.Object(dstName)
+
+	if _, err := dstObj.CopierFrom(srcObj).Run(ctx); err != nil {
+		return fmt.Errorf("failed to copy object in GCS: %w", s.notFound("copy", src, err))
+	}
+	return nil
+}
+
+// Rename is copy+delete, GCS has no move operation for flat buckets
+func (s *gcsStorage) Rename(ctx context.Context, src, dst string) error {
+	if err := s.Copy(ctx, src, dst); err != nil {
+		return err
+	}
+	if same, err := samePath(src, dst); err != nil || same {
+		return err
+	}
+	return s.Delete(ctx, src)
+}
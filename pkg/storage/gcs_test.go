@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCSMetadata_TagsAreSplit(t *testing.T) {
+	meta := newObjectMeta(&PutObjectOpts{
+		Metadata: map[string]string{"Source-Host": "pg-01"},
+		Tags:     map[string]string{"kind": "wal"},
+	})
+
+	encoded := encodeGCSMetadata(meta)
+	assert.Equal(t, map[string]string{"source-host": "pg-01", "xrepo-tag-kind": "wal"}, encoded)
+
+	var info ObjectInfo
+	decodeGCSMetadata(encoded, &info)
+	assert.Equal(t, meta.Metadata, info.Metadata)
+	assert.Equal(t, meta.Tags, info.Tags)
+}
+
+func TestEncodeCRC32C(t *testing.T) {
+	// CRC32C of "hello world", as reported by GCS
+	assert.Equal(t, "yZRlqg==", encodeCRC32C(crc32.Checksum([]byte("hello world"), crc32cTable)))
+}
@@ -2,11 +2,16 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"iter"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/hashmap-kz/xrepo/pkg/fsync"
 
@@ -23,28 +28,141 @@ type LocalStorageOpts struct {
 	FsyncOnWrite bool
 }
 
-var _ Storage = &localStorage{}
+var (
+	_ Storage     = &localStorage{}
+	_ localHasher = &localStorage{}
+)
+
+// staleTempFileAge is the age of a temp file that makes it an interrupted upload rather than an in-flight one,
+// uploads of other processes writing to the same dir are left alone
+const staleTempFileAge = 24 * time.Hour
+
+// cleanedDirs holds the base dirs checked for stale temp files in the process,
+// with channels that are closed when the checks are over
+var cleanedDirs sync.Map
 
 func NewLocal(o *LocalStorageOpts) (Storage, error) {
 	if err := os.MkdirAll(o.BaseDir, 0o750); err != nil {
 		return nil, err
 	}
+	removeStaleTempFilesOnce(o.BaseDir)
 	return &localStorage{baseDir: o.BaseDir, fsyncOnWrite: o.FsyncOnWrite}, nil
 }
 
-func (l *localStorage) fullPath(path string) string {
-	return filepath.ToSlash(filepath.Join(l.baseDir, filepath.Clean(path)))
+// removeStaleTempFilesOnce walks the base dir in the background, on the first storage opened for it
+// in the process only. The returned channel is closed when the walk is over.
+func removeStaleTempFilesOnce(baseDir string) <-chan struct{} {
+	key, err := filepath.Abs(baseDir)
+	if err != nil {
+		key = filepath.Clean(baseDir)
+	}
+	done := make(chan struct{})
+	if prev, loaded := cleanedDirs.LoadOrStore(key, done); loaded {
+		return prev.(chan struct{})
+	}
+	go func() {
+		defer close(done)
+		removeStaleTempFiles(baseDir, time.Now().Add(-staleTempFileAge))
+	}()
+	return done
+}
+
+// removeStaleTempFiles cleans up uploads that were interrupted by a crash, i.e. temp files not modified since the cutoff.
+// It's best-effort: entries that can't be read or removed are logged and skipped, ones that vanish are ignored.
+func removeStaleTempFiles(baseDir string, cutoff time.Time) {
+	logFailure := func(path string, err error) {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("cannot clean up stale temp files",
+				slog.String("module", "storage"),
+				slog.String("path", path),
+				slog.Any("err", err),
+			)
+		}
+	}
+	_ = filepath.WalkDir(baseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// the dir (or what's left of it) is skipped, the walk goes on
+			logFailure(path, err)
+			return nil
+		}
+		if d.IsDir() || !isTempName(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			logFailure(path, err)
+			return nil
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			logFailure(path, err)
+		}
+		return nil
+	})
+}
+
+// fullPath resolves the path under the base dir, paths that escape it are rejected
+func (l *localStorage) fullPath(path string) (string, error) {
+	name, err := cleanPath(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(filepath.Join(l.baseDir, filepath.FromSlash(name))), nil
+}
+
+func (l *localStorage) PutObject(ctx context.Context, path string, r io.Reader) error {
+	return l.PutObjectWithOpts(ctx, path, r, nil)
+}
+
+// PutObjectWithOpts writes the object, metadata and tags are kept in a sidecar file next to it.
+func (l *localStorage) PutObjectWithOpts(_ context.Context, path string, r io.Reader, opts *PutObjectOpts) error {
+	fullPath, err := l.fullPath(path)
+	if err != nil {
+		return err
+	}
+	if err := l.writeAtomic(fullPath, r); err != nil {
+		return err
+	}
+	return l.writeMeta(fullPath, newObjectMeta(opts))
 }
 
-func (l *localStorage) PutObject(_ context.Context, path string, r io.Reader) error {
-	fullPath := l.fullPath(path)
-	if err := os.MkdirAll(filepath.Dir(fullPath), 0o750); err != nil {
+// writeAtomic writes into a temp file in the target dir, and renames it into place when the content is complete,
+// so readers never observe a partially written object.
+func (l *localStorage) writeAtomic(fullPath string, r io.Reader) error {
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
 		return err
 	}
-	f, err := os.Create(fullPath)
+	f, err := os.CreateTemp(dir, tmpFilePrefix+filepath.Base(fullPath)+"-*")
 	if err != nil {
 		return err
 	}
+	tmpPath := f.Name()
+
+	if err := l.writeTemp(f, r); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	// Persist the rename
+	if l.fsyncOnWrite {
+		return fsync.FsyncDir(dir)
+	}
+	return nil
+}
+
+func (l *localStorage) writeTemp(f *os.File, r io.Reader) error {
+	if err := f.Chmod(0o640); err != nil {
+		_ = f.Close()
+		return err
+	}
 
 	// Copy contents
 	if _, err := io.Copy(f, r); err != nil {
@@ -64,12 +182,60 @@ func (l *localStorage) PutObject(_ context.Context, path string, r io.Reader) er
 	return f.Close()
 }
 
+// writeMeta replaces the metadata sidecar of the object, nil removes a stale one
+func (l *localStorage) writeMeta(fullPath string, meta *objectMeta) error {
+	sidecar := metaSidecarPath(fullPath)
+	if meta == nil {
+		if err := os.Remove(sidecar); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	r, err := meta.marshal()
+	if err != nil {
+		return err
+	}
+	return l.writeAtomic(sidecar, r)
+}
+
+// readMeta loads the metadata sidecar of the object, nil if there is none
+func (l *localStorage) readMeta(fullPath string) (*objectMeta, error) {
+	f, err := os.Open(metaSidecarPath(fullPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return readObjectMeta(f)
+}
+
 func (l *localStorage) ReadObject(_ context.Context, path string) (io.ReadCloser, error) {
-	return os.Open(l.fullPath(path))
+	fullPath, err := l.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fullPath)
+}
+
+func (l *localStorage) ReadObjectRange(_ context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	fullPath, err := l.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return seekRange(f, offset, length)
 }
 
 func (l *localStorage) Exists(_ context.Context, path string) (bool, error) {
-	fullPath := l.fullPath(path)
+	fullPath, err := l.fullPath(path)
+	if err != nil {
+		return false, err
+	}
 
 	info, err := os.Stat(fullPath)
 	if err != nil {
@@ -85,43 +251,122 @@ func (l *localStorage) Exists(_ context.Context, path string) (bool, error) {
 	return false, nil
 }
 
+// hashesLocally marks that SHA256 reads local files only
+func (l *localStorage) hashesLocally() {}
+
 func (l *localStorage) SHA256(_ context.Context, path string) (string, error) {
-	fullPath := l.fullPath(path)
+	fullPath, err := l.fullPath(path)
+	if err != nil {
+		return "", err
+	}
 	return common.Sha256FromFile(fullPath)
 }
 
-func (l *localStorage) ListAll(_ context.Context, prefix string) ([]string, error) {
-	fullPath := l.fullPath(prefix)
-	var result []string
+func (l *localStorage) Stat(_ context.Context, path string) (ObjectInfo, error) {
+	name, err := cleanPath(path)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fullPath, err := l.fullPath(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return ObjectInfo{}, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+	result := ObjectInfo{
+		Path:    name,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
 
-	err := filepath.WalkDir(fullPath, func(path string, d fs.DirEntry, err error) error {
+	meta, err := l.readMeta(fullPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if meta != nil {
+		meta.applyTo(&result)
+	}
+	return result, nil
+}
+
+func (l *localStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	return collectPaths(l.Walk(ctx, prefix))
+}
+
+func (l *localStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return collectInfos(l.Walk(ctx, prefix))
+}
+
+func (l *localStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		fullPath, err := l.fullPath(prefix)
 		if err != nil {
-			return fmt.Errorf("error accessing path %q: %w", path, err)
+			yield(ObjectInfo{}, err)
+			return
 		}
-		if d.IsDir() {
+		stopped := false
+
+		err = filepath.WalkDir(fullPath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// a missing prefix is an empty listing, as it is on object stores
+				if path == fullPath && os.IsNotExist(err) {
+					return nil
+				}
+				return fmt.Errorf("error accessing path %q: %w", path, err)
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if d.IsDir() || isInternalName(d.Name()) {
+				return nil
+			}
+			rel, err := filepath.Rel(l.baseDir, path)
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if !yield(ObjectInfo{
+				Path:    filepath.ToSlash(rel),
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			}, nil) {
+				stopped = true
+				return fs.SkipAll
+			}
 			return nil
+		})
+		if err != nil && !stopped {
+			yield(ObjectInfo{}, err)
 		}
-		rel, err := filepath.Rel(l.baseDir, path)
-		if err != nil {
-			return err
-		}
-		result = append(result, filepath.ToSlash(rel))
-		return nil
-	})
-	return result, err
+	}
 }
 
 func (l *localStorage) ListTopLevelDirs(_ context.Context, prefix string) (map[string]bool, error) {
 	result := make(map[string]bool)
+	dir, err := l.fullPath(prefix)
+	if err != nil {
+		return nil, err
+	}
 
-	entries, err := os.ReadDir(prefix)
+	entries, err := os.ReadDir(dir)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
 		return nil, err
 	}
 
 	for _, entry := range entries {
 		if entry.IsDir() {
-			fullPath := filepath.ToSlash(filepath.Join(prefix, entry.Name()))
+			fullPath := filepath.ToSlash(filepath.Join(dir, entry.Name()))
 			rel, err := filepath.Rel(l.baseDir, fullPath)
 			if err != nil {
 				return nil, err
@@ -131,3 +376,155 @@ func (l *localStorage) ListTopLevelDirs(_ context.Context, prefix string) (map[s
 	}
 	return result, nil
 }
+
+func (l *localStorage) Delete(_ context.Context, path string) error {
+	fullPath, err := l.fullPath(path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.writeMeta(fullPath, nil)
+}
+
+func (l *localStorage) DeletePrefix(_ context.Context, prefix string) error {
+	fullPath, err := l.fullPath(prefix)
+	if err != nil {
+		return err
+	}
+
+	// never remove the base dir itself, only its contents
+	if fullPath != filepath.ToSlash(filepath.Clean(l.baseDir)) {
+		return os.RemoveAll(fullPath)
+	}
+
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(fullPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy hardlinks the object under a temp name and renames it into place, falling back to a plain copy
+// when links are not supported. It's safe to share the inode, since objects are only ever replaced by rename.
+func (l *localStorage) Copy(_ context.Context, src, dst string) error {
+	srcPath, err := l.fullPath(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := l.fullPath(dst)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return &fs.PathError{Op: "copy", Path: src, Err: fs.ErrNotExist}
+	}
+	if srcPath == dstPath {
+		return nil
+	}
+
+	dir := filepath.Dir(dstPath)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, tmpFilePrefix+filepath.Base(dstPath)+"-"+suffix)
+
+	if err := os.Link(srcPath, tmpPath); err != nil {
+		if err := l.copyContent(srcPath, dstPath); err != nil {
+			return err
+		}
+	} else {
+		if err := os.Rename(tmpPath, dstPath); err != nil {
+			_ = os.Remove(tmpPath)
+			return err
+		}
+		if l.fsyncOnWrite {
+			if err := fsync.FsyncDir(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return l.copyMeta(srcPath, dstPath)
+}
+
+// copyMeta makes the metadata of dst match src
+func (l *localStorage) copyMeta(srcPath, dstPath string) error {
+	meta, err := l.readMeta(srcPath)
+	if err != nil {
+		return err
+	}
+	return l.writeMeta(dstPath, meta)
+}
+
+func (l *localStorage) copyContent(srcPath, dstPath string) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return l.writeAtomic(dstPath, f)
+}
+
+func (l *localStorage) Rename(_ context.Context, src, dst string) error {
+	srcPath, err := l.fullPath(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := l.fullPath(dst)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return &fs.PathError{Op: "rename", Path: src, Err: fs.ErrNotExist}
+	}
+	if srcPath == dstPath {
+		return nil
+	}
+
+	dir := filepath.Dir(dstPath)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		return err
+	}
+
+	// Persist both directory entries
+	if l.fsyncOnWrite {
+		if err := fsync.FsyncDir(dir); err != nil {
+			return err
+		}
+		if err := fsync.FsyncDir(filepath.Dir(srcPath)); err != nil {
+			return err
+		}
+	}
+
+	if err := l.copyMeta(srcPath, dstPath); err != nil {
+		return err
+	}
+	return l.writeMeta(srcPath, nil)
+}
@@ -3,10 +3,13 @@ package storage
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/hashmap-kz/xrepo/pkg/common"
 
@@ -124,11 +127,363 @@ func TestLocalStorage_ListTopLevelDirs(t *testing.T) {
 	err = os.WriteFile(filepath.Join(dir, "file.txt"), []byte("ignore"), 0o600)
 	assert.NoError(t, err)
 
-	dirs, err := s.ListTopLevelDirs(context.Background(), dir)
+	dirs, err := s.ListTopLevelDirs(context.Background(), "")
 	assert.NoError(t, err)
 
 	assert.Equal(t, map[string]bool{
 		"x": true,
 		"y": true,
 	}, dirs)
+
+	dirs, err = s.ListTopLevelDirs(context.Background(), "x")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"x/sub": true}, dirs)
+}
+
+func TestLocalStorage_Delete(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, s.PutObject(ctx, "del/a.txt", bytes.NewReader([]byte("a"))))
+
+	require.NoError(t, s.Delete(ctx, "del/a.txt"))
+
+	exists, err := s.Exists(ctx, "del/a.txt")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// deleting a missing object is a no-op
+	assert.NoError(t, s.Delete(ctx, "del/a.txt"))
+}
+
+func TestLocalStorage_DeletePrefix(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, s.PutObject(ctx, "20250101/base/1", bytes.NewReader([]byte("1"))))
+	require.NoError(t, s.PutObject(ctx, "20250101/base/2", bytes.NewReader([]byte("2"))))
+	require.NoError(t, s.PutObject(ctx, "20250102/base/3", bytes.NewReader([]byte("3"))))
+
+	require.NoError(t, s.DeletePrefix(ctx, "20250101"))
+
+	files, err := s.ListAll(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"20250102/base/3"}, files)
+
+	// the whole storage, the base dir must survive
+	require.NoError(t, s.DeletePrefix(ctx, ""))
+
+	files, err = s.ListAll(ctx, "")
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+	assert.DirExists(t, dir)
+
+	// missing prefix is a no-op
+	assert.NoError(t, s.DeletePrefix(ctx, "missing"))
+}
+
+func TestLocalStorage_DeletePrefix_EscapingRoot(t *testing.T) {
+	parent := t.TempDir()
+	sibling := filepath.Join(parent, "other")
+	require.NoError(t, os.MkdirAll(sibling, 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(sibling, "keep"), []byte("keep"), 0o600))
+
+	s, err := NewLocal(&LocalStorageOpts{BaseDir: filepath.Join(parent, "repo")})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for _, prefix := range []string{"..", "../other", "a/../../other"} {
+		assert.ErrorIs(t, s.DeletePrefix(ctx, prefix), ErrPathEscapesRoot, prefix)
+	}
+	assert.FileExists(t, filepath.Join(sibling, "keep"))
+	assert.DirExists(t, filepath.Join(parent, "repo"))
+}
+
+func TestLocalStorage_Stat(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, s.PutObject(ctx, "stat/obj.bin", bytes.NewReader([]byte("12345"))))
+
+	info, err := s.Stat(ctx, "stat/obj.bin")
+	require.NoError(t, err)
+	assert.Equal(t, "stat/obj.bin", info.Path)
+	assert.Equal(t, int64(5), info.Size)
+	assert.False(t, info.ModTime.IsZero())
+
+	// the path is reported as the listings have it
+	for _, p := range []string{"/stat/obj.bin", "./stat/obj.bin", "stat//obj.bin"} {
+		info, err = s.Stat(ctx, p)
+		require.NoError(t, err)
+		assert.Equal(t, "stat/obj.bin", info.Path, p)
+	}
+
+	_, err = s.Stat(ctx, "stat/missing.bin")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// directories are not objects
+	_, err = s.Stat(ctx, "stat")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestLocalStorage_ListAllInfo(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, s.PutObject(ctx, "a/one", bytes.NewReader([]byte("1"))))
+	require.NoError(t, s.PutObject(ctx, "a/three", bytes.NewReader([]byte("333"))))
+
+	infos, err := s.ListAllInfo(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+
+	sizes := map[string]int64{}
+	for _, info := range infos {
+		sizes[info.Path] = info.Size
+	}
+	assert.Equal(t, map[string]int64{"a/one": 1, "a/three": 3}, sizes)
+}
+
+func TestLocalStorage_Walk_StopsEarly(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for _, p := range []string{"wal/1", "wal/2", "wal/3", "wal/4"} {
+		require.NoError(t, s.PutObject(ctx, p, bytes.NewReader([]byte(p))))
+	}
+
+	var seen []string
+	for info, err := range s.Walk(ctx, "wal") {
+		require.NoError(t, err)
+		seen = append(seen, info.Path)
+		if len(seen) == 2 {
+			break
+		}
+	}
+	assert.Len(t, seen, 2)
+}
+
+func TestLocalStorage_Walk_ContextCanceled(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+
+	require.NoError(t, s.PutObject(context.Background(), "a/1", bytes.NewReader([]byte("1"))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var lastErr error
+	for _, err := range s.Walk(ctx, "") {
+		lastErr = err
+	}
+	assert.ErrorIs(t, lastErr, context.Canceled)
+}
+
+type failingReader struct {
+	data []byte
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestLocalStorage_PutObject_FailedCopyLeavesNothing(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocal(&LocalStorageOpts{BaseDir: dir, FsyncOnWrite: true})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, s.PutObject(ctx, "obj", bytes.NewReader([]byte("previous"))))
+
+	err = s.PutObject(ctx, "obj", &failingReader{data: []byte("partial")})
+	assert.Error(t, err)
+
+	// the previous version is untouched, and no temp files are left
+	rc, err := s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("previous"), content)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestLocalStorage_StaleTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a"), 0o750))
+	stale := filepath.Join(dir, "a", tmpFilePrefix+"obj-123")
+	require.NoError(t, os.WriteFile(stale, []byte("partial"), 0o600))
+	old := time.Now().Add(-2 * staleTempFileAge)
+	require.NoError(t, os.Chtimes(stale, old, old))
+	inFlight := filepath.Join(dir, "a", tmpFilePrefix+"obj-456")
+	require.NoError(t, os.WriteFile(inFlight, []byte("partial"), 0o600))
+
+	// temp files are never listed
+	storage := &localStorage{baseDir: dir}
+	files, err := storage.ListAll(context.Background(), "")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	// stale ones are removed in the background on init, uploads that may be still in progress are kept
+	_, err = NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+	<-removeStaleTempFilesOnce(dir)
+	assert.NoFileExists(t, stale)
+	assert.FileExists(t, inFlight)
+
+	// the dir is checked once per process
+	require.NoError(t, os.Chtimes(inFlight, old, old))
+	_, err = NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+	<-removeStaleTempFilesOnce(dir)
+	assert.FileExists(t, inFlight)
+}
+
+func TestLocalStorage_StaleTempFilesCleanupIsBestEffort(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "b", tmpFilePrefix+"obj-123")
+	require.NoError(t, os.MkdirAll(filepath.Dir(stale), 0o750))
+	require.NoError(t, os.WriteFile(stale, []byte("partial"), 0o600))
+	old := time.Now().Add(-2 * staleTempFileAge)
+	require.NoError(t, os.Chtimes(stale, old, old))
+
+	// a dir that can't be read does not stop the walk, nor the storage from opening
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a-dir"), 0o750))
+	require.NoError(t, os.Chmod(filepath.Join(dir, "a-dir"), 0))
+	t.Cleanup(func() { _ = os.Chmod(filepath.Join(dir, "a-dir"), 0o750) })
+
+	_, err := NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+	<-removeStaleTempFilesOnce(dir)
+	assert.NoFileExists(t, stale)
+
+	// a missing base dir is nothing to clean up
+	removeStaleTempFiles(filepath.Join(dir, "missing"), time.Now())
+}
+
+func TestLocalStorage_CopyAndRename(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, s.PutObject(ctx, "incoming/obj", bytes.NewReader([]byte("v1"))))
+	require.NoError(t, s.PutObject(ctx, "base/obj", bytes.NewReader([]byte("old"))))
+
+	// rename replaces the existing target
+	require.NoError(t, s.Rename(ctx, "incoming/obj", "base/obj"))
+	exists, err := s.Exists(ctx, "incoming/obj")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, s.Copy(ctx, "base/obj", "copy/obj"))
+
+	// overwriting the source must not affect the copy, even if it shares the inode
+	require.NoError(t, s.PutObject(ctx, "base/obj", bytes.NewReader([]byte("v2"))))
+
+	rc, err := s.ReadObject(ctx, "copy/obj")
+	require.NoError(t, err)
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v1"), content)
+
+	files, err := s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"base/obj", "copy/obj"}, files)
+
+	assert.ErrorIs(t, s.Copy(ctx, "missing", "x"), fs.ErrNotExist)
+	assert.ErrorIs(t, s.Rename(ctx, "missing", "x"), fs.ErrNotExist)
+}
+
+func TestLocalStorage_ReadObjectRange(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, s.PutObject(ctx, "wal/seg", bytes.NewReader([]byte("0123456789"))))
+
+	tests := []struct {
+		offset, length int64
+		expected       string
+	}{
+		{0, 3, "012"},
+		{4, 2, "45"},
+		{7, -1, "789"},
+		{8, 100, "89"},
+		{20, 5, ""},
+	}
+	for _, tt := range tests {
+		rc, err := s.ReadObjectRange(ctx, "wal/seg", tt.offset, tt.length)
+		require.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+		assert.Equal(t, tt.expected, string(content))
+	}
+
+	_, err = s.ReadObjectRange(ctx, "wal/missing", 0, 1)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestLocalStorage_PutObjectWithOpts(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLocal(&LocalStorageOpts{BaseDir: dir})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	opts := &PutObjectOpts{
+		Metadata: map[string]string{"Source-Host": "pg-01", "timeline": "3"},
+		Tags:     map[string]string{"kind": "wal"},
+	}
+	require.NoError(t, s.PutObjectWithOpts(ctx, "wal/000000030000000000000001", bytes.NewReader([]byte("wal")), opts))
+
+	info, err := s.Stat(ctx, "wal/000000030000000000000001")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"source-host": "pg-01", "timeline": "3"}, info.Metadata)
+	assert.Equal(t, map[string]string{"kind": "wal"}, info.Tags)
+
+	// sidecars are not objects
+	files, err := s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"wal/000000030000000000000001"}, files)
+
+	// metadata follows the object
+	require.NoError(t, s.Copy(ctx, "wal/000000030000000000000001", "copy/obj"))
+	require.NoError(t, s.Rename(ctx, "copy/obj", "moved/obj"))
+	info, err = s.Stat(ctx, "moved/obj")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"kind": "wal"}, info.Tags)
+
+	// a plain overwrite drops the metadata of the previous version
+	require.NoError(t, s.PutObject(ctx, "moved/obj", bytes.NewReader([]byte("v2"))))
+	info, err = s.Stat(ctx, "moved/obj")
+	require.NoError(t, err)
+	assert.Nil(t, info.Metadata)
+	assert.Nil(t, info.Tags)
+
+	require.NoError(t, s.Delete(ctx, "wal/000000030000000000000001"))
+	entries, err := os.ReadDir(filepath.Join(dir, "wal"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
 }
@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" //nolint:gosec
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryObject is never modified after it's stored, a put replaces it as a whole,
+// so readers may keep the content while writers proceed.
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+	etag    string
+	meta    *objectMeta
+}
+
+type memoryStorage struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+}
+
+var (
+	_ Storage     = &memoryStorage{}
+	_ localHasher = &memoryStorage{}
+)
+
+// NewMemoryStorage keeps objects in memory, it's safe for concurrent use.
+// Names are flat keys, and listings follow S3 semantics, so there are no empty dirs.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{objects: make(map[string]*memoryObject)}
+}
+
+func (s *memoryStorage) key(p string) (string, error) {
+	return cleanPath(p)
+}
+
+// keyPrefix resolves a listing prefix the way the object store backends do, it's matched
+// by whole path segments (see matchesKeyPrefix), so "a" does not match sibling keys like "ab/..."
+func (s *memoryStorage) keyPrefix(prefix string) (string, error) {
+	k, err := s.key(prefix)
+	if err != nil || k == "" {
+		return "", err
+	}
+	if strings.HasSuffix(prefix, "/") {
+		return k + "/", nil
+	}
+	return k, nil
+}
+
+func (s *memoryStorage) get(op, p string) (*memoryObject, error) {
+	k, err := s.key(p)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[k]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	return obj, nil
+}
+
+func (s *memoryStorage) PutObject(ctx context.Context, p string, r io.Reader) error {
+	return s.PutObjectWithOpts(ctx, p, r, nil)
+}
+
+// PutObjectWithOpts reads the content fully before storing it, so a failed read leaves nothing behind
+func (s *memoryStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	k, err := s.key(p)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sum := md5.Sum(data) //nolint:gosec
+	obj := &memoryObject{
+		data:    data,
+		modTime: time.Now(),
+		etag:    hex.EncodeToString(sum[:]),
+		meta:    newObjectMeta(opts),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[k] = obj
+	return nil
+}
+
+func (s *memoryStorage) ReadObject(_ context.Context, p string) (io.ReadCloser, error) {
+	obj, err := s.get("open", p)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (s *memoryStorage) ReadObjectRange(_ context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	obj, err := s.get("open", p)
+	if err != nil {
+		return nil, err
+	}
+
+	data := obj.data[min(offset, int64(len(obj.data))):]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memoryStorage) Exists(_ context.Context, p string) (bool, error) {
+	k, err := s.key(p)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.objects[k]
+	return ok, nil
+}
+
+func (s *memoryStorage) Stat(_ context.Context, p string) (ObjectInfo, error) {
+	k, err := s.key(p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	obj, err := s.get("stat", p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info := obj.info(k)
+	if obj.meta != nil {
+		obj.meta.applyTo(&info)
+	}
+	return info, nil
+}
+
+func (o *memoryObject) info(key string) ObjectInfo {
+	return ObjectInfo{
+		Path:    key,
+		Size:    int64(len(o.data)),
+		ModTime: o.modTime,
+		ETag:    o.etag,
+	}
+}
+
+// hashesLocally marks that SHA256 reads the memory only
+func (s *memoryStorage) hashesLocally() {}
+
+func (s *memoryStorage) SHA256(_ context.Context, p string) (string, error) {
+	obj, err := s.get("open", p)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(obj.data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s *memoryStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	return collectPaths(s.Walk(ctx, prefix))
+}
+
+func (s *memoryStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return collectInfos(s.Walk(ctx, prefix))
+}
+
+// Walk yields a snapshot of the matching objects in lexicographic order (as S3 lists them),
+// objects stored while iterating are not seen.
+func (s *memoryStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		keyPrefix, err := s.keyPrefix(prefix)
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+		infos := s.snapshot(keyPrefix)
+		for _, info := range infos {
+			if err := ctx.Err(); err != nil {
+				yield(ObjectInfo{}, err)
+				return
+			}
+			if !yield(info, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (s *memoryStorage) snapshot(keyPrefix string) []ObjectInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []ObjectInfo
+	for k, obj := range s.objects {
+		if matchesKeyPrefix(k, keyPrefix) {
+			result = append(result, obj.info(k))
+		}
+	}
+	slices.SortFunc(result, func(a, b ObjectInfo) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return result
+}
+
+// ListTopLevelDirs returns the "directories" directly under the prefix (relative to the storage root),
+// the way a delimiter listing reports common prefixes.
+func (s *memoryStorage) ListTopLevelDirs(_ context.Context, prefix string) (map[string]bool, error) {
+	dirPrefix, err := s.key(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if dirPrefix != "" {
+		dirPrefix += "/"
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]bool)
+	for k := range s.objects {
+		rest, ok := strings.CutPrefix(k, dirPrefix)
+		if !ok {
+			continue
+		}
+		if dir, _, found := strings.Cut(rest, "/"); found {
+			result[dirPrefix+dir] = true
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStorage) Delete(_ context.Context, p string) error {
+	k, err := s.key(p)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, k)
+	return nil
+}
+
+func (s *memoryStorage) DeletePrefix(_ context.Context, prefix string) error {
+	keyPrefix, err := s.keyPrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range s.objects {
+		if matchesKeyPrefix(k, keyPrefix) {
+			delete(s.objects, k)
+		}
+	}
+	return nil
+}
+
+// Copy shares the content with the source, metadata is carried over
+func (s *memoryStorage) Copy(_ context.Context, src, dst string) error {
+	srcKey, err := s.key(src)
+	if err != nil {
+		return err
+	}
+	dstKey, err := s.key(dst)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[srcKey]
+	if !ok {
+		return &fs.PathError{Op: "copy", Path: src, Err: fs.ErrNotExist}
+	}
+	if srcKey == dstKey {
+		return nil
+	}
+	s.objects[dstKey] = &memoryObject{
+		data:    obj.data,
+		modTime: time.Now(),
+		etag:    obj.etag,
+		meta:    obj.meta,
+	}
+	return nil
+}
+
+func (s *memoryStorage) Rename(_ context.Context, src, dst string) error {
+	srcKey, err := s.key(src)
+	if err != nil {
+		return err
+	}
+	dstKey, err := s.key(dst)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[srcKey]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: src, Err: fs.ErrNotExist}
+	}
+	if srcKey == dstKey {
+		return nil
+	}
+	delete(s.objects, srcKey)
+	s.objects[dstKey] = obj
+	return nil
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorage_PutAndReadObject(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+
+	require.NoError(t, s.PutObject(ctx, "test/pg/put.txt", strings.NewReader("hello, pgwal!")))
+
+	rc, err := s.ReadObject(ctx, "/test/pg/./put.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello, pgwal!"), readAll(t, rc))
+
+	_, err = s.ReadObject(ctx, "test/pg/missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	rc, err = s.ReadObjectRange(ctx, "test/pg/put.txt", 7, 5)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("pgwal"), readAll(t, rc))
+
+	rc, err = s.ReadObjectRange(ctx, "test/pg/put.txt", 100, -1)
+	require.NoError(t, err)
+	assert.Empty(t, readAll(t, rc))
+
+	exists, err := s.Exists(ctx, "test/pg")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestMemoryStorage_PutObject_FailedReadLeavesNothing(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+
+	err := s.PutObject(ctx, "a.txt", &failingReader{})
+	require.Error(t, err)
+
+	exists, err := s.Exists(ctx, "a.txt")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestMemoryStorage_ListingMatchesPathSegments(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+
+	for _, p := range []string{"a/file1.txt", "a/sub/file2.txt", "ab/file3.txt", "b/c/file4.txt", "root.txt"} {
+		require.NoError(t, s.PutObject(ctx, p, strings.NewReader(p)))
+	}
+
+	files, err := s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/file1.txt", "a/sub/file2.txt", "ab/file3.txt", "b/c/file4.txt", "root.txt"}, files)
+
+	files, err = s.ListAll(ctx, "a/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/file1.txt", "a/sub/file2.txt"}, files)
+
+	// a prefix without the trailing slash matches whole path segments, not sibling keys
+	files, err = s.ListAll(ctx, "a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/file1.txt", "a/sub/file2.txt"}, files)
+
+	dirs, err := s.ListTopLevelDirs(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"a": true, "ab": true, "b": true}, dirs)
+
+	dirs, err = s.ListTopLevelDirs(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"b/c": true}, dirs)
+
+	require.NoError(t, s.DeletePrefix(ctx, "a"))
+	files, err = s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ab/file3.txt", "b/c/file4.txt", "root.txt"}, files)
+}
+
+func TestMemoryStorage_StatCopyAndRename(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+
+	opts := &PutObjectOpts{
+		Metadata: map[string]string{"Source-Host": "pg-01"},
+		Tags:     map[string]string{"kind": "wal"},
+	}
+	require.NoError(t, s.PutObjectWithOpts(ctx, "incoming/a.txt", strings.NewReader("AAA"), opts))
+
+	require.NoError(t, s.Rename(ctx, "incoming/a.txt", "base/a.txt"))
+	require.NoError(t, s.Copy(ctx, "base/a.txt", "copy/a.txt"))
+
+	info, err := s.Stat(ctx, "copy/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "copy/a.txt", info.Path)
+	assert.Equal(t, int64(3), info.Size)
+	assert.NotEmpty(t, info.ETag)
+	assert.Equal(t, map[string]string{"source-host": "pg-01"}, info.Metadata)
+	assert.Equal(t, map[string]string{"kind": "wal"}, info.Tags)
+
+	_, err = s.Stat(ctx, "incoming/a.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.ErrorIs(t, s.Copy(ctx, "missing", "x"), fs.ErrNotExist)
+	assert.ErrorIs(t, s.Rename(ctx, "missing", "x"), fs.ErrNotExist)
+
+	require.NoError(t, s.Delete(ctx, "copy/a.txt"))
+	require.NoError(t, s.Delete(ctx, "copy/a.txt"))
+}
+
+func TestMemoryStorage_ConcurrentUse(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := fmt.Sprintf("dir%d/obj", i%4)
+			for j := 0; j < 50; j++ {
+				if err := s.PutObject(ctx, p, strings.NewReader(p)); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := s.ListAll(ctx, ""); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := s.SHA256(ctx, p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					errs <- err
+					return
+				}
+				if err := s.Delete(ctx, p); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"iter"
+	"time"
+
+	"github.com/hashmap-kz/xrepo/pkg/metrics"
+)
+
+type metricsStorage struct {
+	s Storage
+	m *metrics.Metrics
+}
+
+var _ Storage = &metricsStorage{}
+
+// NewMetricsStorage records counts, errors, latencies and transferred bytes of the storage operations.
+// Bytes are the stored ones, after compression and encryption.
+func NewMetricsStorage(s Storage, m *metrics.Metrics) Storage {
+	return &metricsStorage{s: s, m: m}
+}
+
+func (ms *metricsStorage) observe(op string, start time.Time, err error) {
+	ms.m.Observe(metrics.LayerStorage, op, start, err)
+}
+
+func (ms *metricsStorage) isRetryable(err error) bool {
+	return isRetryableBy(ms.s, err)
+}
+
+func (ms *metricsStorage) PutObject(ctx context.Context, p string, r io.Reader) error {
+	return ms.PutObjectWithOpts(ctx, p, r, nil)
+}
+
+func (ms *metricsStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	start := time.Now()
+	cr := metrics.NewCountingReader(ms.m, metrics.LayerStorage, metrics.DirectionIn, r)
+	err := ms.s.PutObjectWithOpts(ctx, p, cr, opts)
+	ms.observe("put_object", start, err)
+	return err
+}
+
+func (ms *metricsStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := ms.s.ReadObject(ctx, p)
+	ms.observe("read_object", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return metrics.NewCountingReadCloser(ms.m, metrics.LayerStorage, "read_object", rc), nil
+}
+
+func (ms *metricsStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := ms.s.ReadObjectRange(ctx, p, offset, length)
+	ms.observe("read_object_range", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return metrics.NewCountingReadCloser(ms.m, metrics.LayerStorage, "read_object_range", rc), nil
+}
+
+func (ms *metricsStorage) Exists(ctx context.Context, p string) (bool, error) {
+	start := time.Now()
+	exists, err := ms.s.Exists(ctx, p)
+	ms.observe("exists", start, err)
+	return exists, err
+}
+
+func (ms *metricsStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	start := time.Now()
+	info, err := ms.s.Stat(ctx, p)
+	ms.observe("stat", start, err)
+	return info, err
+}
+
+func (ms *metricsStorage) SHA256(ctx context.Context, p string) (string, error) {
+	start := time.Now()
+	sum, err := ms.s.SHA256(ctx, p)
+	ms.observe("sha256", start, err)
+	return sum, err
+}
+
+func (ms *metricsStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	start := time.Now()
+	files, err := ms.s.ListAll(ctx, prefix)
+	ms.observe("list_all", start, err)
+	return files, err
+}
+
+func (ms *metricsStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	start := time.Now()
+	infos, err := ms.s.ListAllInfo(ctx, prefix)
+	ms.observe("list_all_info", start, err)
+	return infos, err
+}
+
+// Walk is measured until the listing is exhausted, or the consumer stops
+func (ms *metricsStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		start := time.Now()
+		var walkErr error
+		defer func() {
+			ms.observe("walk", start, walkErr)
+		}()
+		for info, err := range ms.s.Walk(ctx, prefix) {
+			if err != nil {
+				walkErr = err
+			}
+			if !yield(info, err) {
+				return
+			}
+		}
+	}
+}
+
+func (ms *metricsStorage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	start := time.Now()
+	dirs, err := ms.s.ListTopLevelDirs(ctx, prefix)
+	ms.observe("list_top_level_dirs", start, err)
+	return dirs, err
+}
+
+func (ms *metricsStorage) Delete(ctx context.Context, p string) error {
+	start := time.Now()
+	err := ms.s.Delete(ctx, p)
+	ms.observe("delete", start, err)
+	return err
+}
+
+func (ms *metricsStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	start := time.Now()
+	err := ms.s.DeletePrefix(ctx, prefix)
+	ms.observe("delete_prefix", start, err)
+	return err
+}
+
+func (ms *metricsStorage) Copy(ctx context.Context, src, dst string) error {
+	start := time.Now()
+	err := ms.s.Copy(ctx, src, dst)
+	ms.observe("copy", start, err)
+	return err
+}
+
+func (ms *metricsStorage) Rename(ctx context.Context, src, dst string) error {
+	start := time.Now()
+	err := ms.s.Rename(ctx, src, dst)
+	ms.observe("rename", start, err)
+	return err
+}
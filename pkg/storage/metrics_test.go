@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/hashmap-kz/xrepo/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsStorage(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := metrics.New(reg)
+	require.NoError(t, err)
+	s := NewMetricsStorage(NewMemoryStorage(), m)
+	ctx := context.Background()
+
+	require.NoError(t, s.PutObject(ctx, "a/obj", strings.NewReader("content")))
+	rc, err := s.ReadObjectRange(ctx, "a/obj", 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ont"), readAll(t, rc))
+	_, err = s.Stat(ctx, "missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	for _, err := range s.Walk(ctx, "a") {
+		require.NoError(t, err)
+	}
+
+	expected := `
+# HELP xrepo_bytes_total Transferred bytes, by layer and direction.
+# TYPE xrepo_bytes_total counter
+xrepo_bytes_total{direction="in",layer="storage"} 7
+xrepo_bytes_total{direction="out",layer="storage"} 3
+# HELP xrepo_errors_total Number of failed operations, by layer, operation and error type.
+# TYPE xrepo_errors_total counter
+xrepo_errors_total{layer="storage",op="stat",type="not_found"} 1
+# HELP xrepo_operations_total Number of operations, by layer and operation.
+# TYPE xrepo_operations_total counter
+xrepo_operations_total{layer="storage",op="put_object"} 1
+xrepo_operations_total{layer="storage",op="read_object_range"} 1
+xrepo_operations_total{layer="storage",op="stat"} 1
+xrepo_operations_total{layer="storage",op="walk"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"xrepo_bytes_total", "xrepo_errors_total", "xrepo_operations_total"))
+}
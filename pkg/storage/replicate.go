@@ -0,0 +1,491 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ReplicateOpts configures the replica set, the first replica is the preferred one for reads
+type ReplicateOpts struct {
+	// Quorum is the number of replicas a write has to succeed on, all of them when it's zero.
+	//
+	// A partial quorum gives no read-your-writes guarantee. Reads go by a vote of the replicas (an object exists
+	// when at least Quorum replicas have it), so a delete or overwrite that met the quorum is seen only when
+	// the quorum is a majority of the replicas, with a smaller one the replicas that missed it may bring
+	// the old state back. The version served is the most recently modified one.
+	Quorum int
+}
+
+// ParseQuorum parses "all", "any" or a number of replicas, an empty spec means all
+func ParseQuorum(spec string, replicas int) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(spec)) {
+	case "", "all":
+		return replicas, nil
+	case "any":
+		return 1, nil
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < 1 || n > replicas {
+		return 0, fmt.Errorf("invalid write quorum %q, expected all, any or 1..%d", spec, replicas)
+	}
+	return n, nil
+}
+
+type replicatingStorage struct {
+	replicas []Storage
+	quorum   int
+}
+
+var _ Storage = &replicatingStorage{}
+
+// NewReplicatingStorage writes every object to all the replicas concurrently.
+//
+// An upload is streamed to all the replicas at once, at the pace of the slowest one, without buffering
+// the object. Writes succeed when the quorum of replicas succeeded, the others are logged and left behind
+// as they are (a failed upload leaves no object on the backends that clean up, an old version otherwise).
+// Reads and listings are served by the first replica that answers them when the quorum is all of
+// the replicas. Otherwise the replicas vote (see ReplicateOpts.Quorum): an object is read from the replica
+// with the most recent version, and listed when enough replicas have it, as an object written with
+// the quorum may be missing from any of the others, and a deleted one may be left on them.
+func NewReplicatingStorage(replicas []Storage, o *ReplicateOpts) (Storage, error) {
+	if len(replicas) == 0 {
+		return nil, errors.New("no replicas")
+	}
+	quorum := o.Quorum
+	if quorum == 0 {
+		quorum = len(replicas)
+	}
+	if quorum < 1 || quorum > len(replicas) {
+		return nil, fmt.Errorf("invalid write quorum %d of %d replicas", quorum, len(replicas))
+	}
+	return &replicatingStorage{replicas: replicas, quorum: quorum}, nil
+}
+
+func (r *replicatingStorage) isRetryable(err error) bool {
+	for _, s := range r.replicas {
+		if isRetryableBy(s, err) {
+			return true
+		}
+	}
+	return false
+}
+
+// write runs the operation on all the replicas concurrently, and checks the quorum
+func (r *replicatingStorage) write(op, p string, fn func(s Storage) error) error {
+	errs := make([]error, len(r.replicas))
+	var wg sync.WaitGroup
+	for i, s := range r.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(s)
+		}()
+	}
+	wg.Wait()
+	return r.checkQuorum(op, p, errs)
+}
+
+func (r *replicatingStorage) checkQuorum(op, p string, errs []error) error {
+	succeeded := 0
+	for i, err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		slog.Warn("replica write failed",
+			slog.String("module", "storage"),
+			slog.String("op", op),
+			slog.String("path", p),
+			slog.Int("replica", i),
+			slog.Any("err", err),
+		)
+	}
+	if succeeded >= r.quorum {
+		return nil
+	}
+	return fmt.Errorf("%s %s: written to %d of %d replicas, quorum is %d: %w",
+		op, p, succeeded, len(r.replicas), r.quorum, errors.Join(errs...))
+}
+
+// readFirst returns the result of the first replica that succeeds, or the error of the first one
+func readFirst[T any](r *replicatingStorage, fn func(s Storage) (T, error)) (T, error) {
+	var firstErr error
+	for _, s := range r.replicas {
+		result, err := fn(s)
+		if err == nil {
+			return result, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	var zero T
+	return zero, firstErr
+}
+
+// partial reports whether a successful write may have left some of the replicas behind
+func (r *replicatingStorage) partial() bool {
+	return r.quorum < len(r.replicas)
+}
+
+// vote decides whether an object exists from the number of replicas that have it and that failed to answer:
+// a write that met the quorum left the object on at least quorum replicas, and a delete removed it from
+// at least as many. ok is false when the replicas that failed could change the outcome.
+func (r *replicatingStorage) vote(present, failed int) (exists, ok bool) {
+	switch {
+	case present >= r.quorum:
+		return true, true
+	case present+failed < r.quorum:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// readReplicas returns the results of the replicas that succeed, with the errors of the others
+func readReplicas[T any](r *replicatingStorage, fn func(s Storage) (T, error)) ([]T, []error) {
+	var results []T
+	var errs []error
+	for _, s := range r.replicas {
+		result, err := fn(s)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		results = append(results, result)
+	}
+	return results, errs
+}
+
+// votedKeys keeps the keys that enough of the replicas have, the replicas that failed to answer must not
+// be able to change the outcome for any of them (including keys that only they have)
+func votedKeys[T any](r *replicatingStorage, lists [][]T, errs []error, key func(T) string) ([]T, error) {
+	if len(errs) >= r.quorum {
+		return nil, errors.Join(errs...)
+	}
+	counts := make(map[string]int)
+	first := make(map[string]T)
+	var keys []string
+	for _, list := range lists {
+		for _, item := range list {
+			k := key(item)
+			if counts[k] == 0 {
+				first[k] = item
+				keys = append(keys, k)
+			}
+			counts[k]++
+		}
+	}
+	slices.Sort(keys)
+	result := make([]T, 0, len(keys))
+	for _, k := range keys {
+		exists, ok := r.vote(counts[k], len(errs))
+		if !ok {
+			return nil, errors.Join(errs...)
+		}
+		if exists {
+			result = append(result, first[k])
+		}
+	}
+	return result, nil
+}
+
+// locate finds the replica with the current version of the object when writes may have left replicas behind,
+// the object exists when the vote says so, and the most recently modified version is the current one
+func (r *replicatingStorage) locate(ctx context.Context, op, p string) (Storage, error) {
+	var best Storage
+	var bestInfo ObjectInfo
+	present := 0
+	var errs []error
+	for _, s := range r.replicas {
+		info, err := s.Stat(ctx, p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		present++
+		if best == nil || info.ModTime.After(bestInfo.ModTime) {
+			best, bestInfo = s, info
+		}
+	}
+	exists, ok := r.vote(present, len(errs))
+	if !ok {
+		return nil, errors.Join(errs...)
+	}
+	if !exists {
+		return nil, &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	return best, nil
+}
+
+// readCurrent runs the read on the first replica that succeeds, or on the one with the current version
+// when writes may have left replicas behind
+func readCurrent[T any](ctx context.Context, r *replicatingStorage, op, p string, fn func(s Storage) (T, error)) (T, error) {
+	if !r.partial() {
+		return readFirst(r, fn)
+	}
+	s, err := r.locate(ctx, op, p)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return fn(s)
+}
+
+func (r *replicatingStorage) PutObject(ctx context.Context, p string, rd io.Reader) error {
+	return r.PutObjectWithOpts(ctx, p, rd, nil)
+}
+
+func (r *replicatingStorage) PutObjectWithOpts(ctx context.Context, p string, rd io.Reader, opts *PutObjectOpts) error {
+	if len(r.replicas) == 1 {
+		return r.checkQuorum("put", p, []error{r.replicas[0].PutObjectWithOpts(ctx, p, rd, opts)})
+	}
+
+	readers := make([]*io.PipeReader, len(r.replicas))
+	writers := make([]*io.PipeWriter, len(r.replicas))
+	for i := range r.replicas {
+		readers[i], writers[i] = io.Pipe()
+	}
+
+	errs := make([]error, len(r.replicas))
+	var wg sync.WaitGroup
+	for i, s := range r.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.PutObjectWithOpts(ctx, p, readers[i], opts)
+			// unblocks the fan-out when the replica gave up without reading everything
+			_ = readers[i].CloseWithError(errReplicaDone)
+		}()
+	}
+
+	srcErr := fanOut(rd, writers)
+	wg.Wait()
+	if srcErr != nil {
+		return srcErr
+	}
+	return r.checkQuorum("put", p, errs)
+}
+
+var errReplicaDone = errors.New("replica is done")
+
+// fanOut copies the source to all the writers, a writer that fails is dropped, and the copy goes on
+// while there are writers left. The error is the one of the source.
+func fanOut(src io.Reader, writers []*io.PipeWriter) error {
+	active := make([]bool, len(writers))
+	for i := range active {
+		active[i] = true
+	}
+	left := len(writers)
+
+	buf := make([]byte, 256*1024)
+	for left > 0 {
+		n, err := src.Read(buf)
+		for i, w := range writers {
+			if n == 0 || !active[i] {
+				continue
+			}
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				active[i] = false
+				left--
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			for _, w := range writers {
+				_ = w.CloseWithError(err)
+			}
+			return err
+		}
+	}
+	for _, w := range writers {
+		_ = w.Close()
+	}
+	return nil
+}
+
+func (r *replicatingStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	return readCurrent(ctx, r, "open", p, func(s Storage) (io.ReadCloser, error) {
+		return s.ReadObject(ctx, p)
+	})
+}
+
+func (r *replicatingStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	return readCurrent(ctx, r, "open", p, func(s Storage) (io.ReadCloser, error) {
+		return s.ReadObjectRange(ctx, p, offset, length)
+	})
+}
+
+func (r *replicatingStorage) Exists(ctx context.Context, p string) (bool, error) {
+	if !r.partial() {
+		return readFirst(r, func(s Storage) (bool, error) {
+			return s.Exists(ctx, p)
+		})
+	}
+	var errs []error
+	present := 0
+	for _, s := range r.replicas {
+		exists, err := s.Exists(ctx, p)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if exists {
+			present++
+		}
+	}
+	exists, ok := r.vote(present, len(errs))
+	if !ok {
+		return false, errors.Join(errs...)
+	}
+	return exists, nil
+}
+
+func (r *replicatingStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	return readCurrent(ctx, r, "stat", p, func(s Storage) (ObjectInfo, error) {
+		return s.Stat(ctx, p)
+	})
+}
+
+func (r *replicatingStorage) SHA256(ctx context.Context, p string) (string, error) {
+	return readCurrent(ctx, r, "open", p, func(s Storage) (string, error) {
+		return s.SHA256(ctx, p)
+	})
+}
+
+func (r *replicatingStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	if !r.partial() {
+		return readFirst(r, func(s Storage) ([]string, error) {
+			return s.ListAll(ctx, prefix)
+		})
+	}
+	lists, errs := readReplicas(r, func(s Storage) ([]string, error) {
+		return s.ListAll(ctx, prefix)
+	})
+	return votedKeys(r, lists, errs, func(p string) string { return p })
+}
+
+func (r *replicatingStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	if !r.partial() {
+		return readFirst(r, func(s Storage) ([]ObjectInfo, error) {
+			return s.ListAllInfo(ctx, prefix)
+		})
+	}
+	return r.votedInfo(ctx, prefix)
+}
+
+// votedInfo lists the objects enough of the replicas have, an object found on several of them is reported
+// as the preferred replica has it
+func (r *replicatingStorage) votedInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	lists, errs := readReplicas(r, func(s Storage) ([]ObjectInfo, error) {
+		return s.ListAllInfo(ctx, prefix)
+	})
+	return votedKeys(r, lists, errs, func(info ObjectInfo) string { return info.Path })
+}
+
+// Walk streams the listing of the first replica when the quorum is all of the replicas, and falls back
+// to the next replica only when the failed one had not yielded anything. Voted listings are collected first.
+func (r *replicatingStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		if r.partial() {
+			infos, err := r.votedInfo(ctx, prefix)
+			if err != nil {
+				yield(ObjectInfo{}, err)
+				return
+			}
+			for _, info := range infos {
+				if !yield(info, nil) {
+					return
+				}
+			}
+			return
+		}
+
+		var firstErr error
+		for _, s := range r.replicas {
+			yielded := false
+			var walkErr error
+			for info, err := range s.Walk(ctx, prefix) {
+				if err != nil {
+					walkErr = err
+					break
+				}
+				yielded = true
+				if !yield(info, nil) {
+					return
+				}
+			}
+			if walkErr == nil {
+				return
+			}
+			if yielded {
+				yield(ObjectInfo{}, walkErr)
+				return
+			}
+			if firstErr == nil {
+				firstErr = walkErr
+			}
+		}
+		yield(ObjectInfo{}, firstErr)
+	}
+}
+
+func (r *replicatingStorage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	if !r.partial() {
+		return readFirst(r, func(s Storage) (map[string]bool, error) {
+			return s.ListTopLevelDirs(ctx, prefix)
+		})
+	}
+	dirs, errs := readReplicas(r, func(s Storage) ([]string, error) {
+		d, err := s.ListTopLevelDirs(ctx, prefix)
+		return slices.Collect(maps.Keys(d)), err
+	})
+	voted, err := votedKeys(r, dirs, errs, func(d string) string { return d })
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool, len(voted))
+	for _, d := range voted {
+		result[d] = true
+	}
+	return result, nil
+}
+
+func (r *replicatingStorage) Delete(ctx context.Context, p string) error {
+	return r.write("delete", p, func(s Storage) error {
+		return s.Delete(ctx, p)
+	})
+}
+
+func (r *replicatingStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	return r.write("delete prefix", prefix, func(s Storage) error {
+		return s.DeletePrefix(ctx, prefix)
+	})
+}
+
+func (r *replicatingStorage) Copy(ctx context.Context, src, dst string) error {
+	return r.write("copy", src, func(s Storage) error {
+		return s.Copy(ctx, src, dst)
+	})
+}
+
+func (r *replicatingStorage) Rename(ctx context.Context, src, dst string) error {
+	return r.write("rename", src, func(s Storage) error {
+		return s.Rename(ctx, src, dst)
+	})
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicatingStorage_WritesToAllReplicas(t *testing.T) {
+	local, err := NewLocal(&LocalStorageOpts{BaseDir: t.TempDir()})
+	require.NoError(t, err)
+	memory := NewMemoryStorage()
+	s, err := NewReplicatingStorage([]Storage{local, memory}, &ReplicateOpts{})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// a stream bigger than the fan-out buffer
+	content := bytes.Repeat([]byte("0123456789"), 100_000)
+	require.NoError(t, s.PutObject(ctx, "base/obj", io.MultiReader(bytes.NewReader(content))))
+
+	for _, replica := range []Storage{local, memory} {
+		rc, err := replica.ReadObject(ctx, "base/obj")
+		require.NoError(t, err)
+		assert.Equal(t, content, readAll(t, rc))
+	}
+
+	require.NoError(t, s.Rename(ctx, "base/obj", "base/renamed"))
+	for _, replica := range []Storage{local, memory} {
+		files, err := replica.ListAll(ctx, "")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"base/renamed"}, files)
+	}
+}
+
+func TestReplicatingStorage_Quorum(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("any", func(t *testing.T) {
+		failing, healthy := newFlakyStorage(), NewMemoryStorage()
+		s, err := NewReplicatingStorage([]Storage{failing, healthy}, &ReplicateOpts{Quorum: 1})
+		require.NoError(t, err)
+
+		failing.failNext("put", syscall.ECONNRESET)
+		require.NoError(t, s.PutObject(ctx, "obj", strings.NewReader("content")))
+
+		exists, err := healthy.Exists(ctx, "obj")
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("all", func(t *testing.T) {
+		failing, healthy := newFlakyStorage(), NewMemoryStorage()
+		s, err := NewReplicatingStorage([]Storage{healthy, failing}, &ReplicateOpts{})
+		require.NoError(t, err)
+
+		failing.failNext("put", syscall.ECONNRESET)
+		err = s.PutObject(ctx, "obj", strings.NewReader("content"))
+		assert.ErrorIs(t, err, syscall.ECONNRESET)
+		assert.ErrorContains(t, err, "written to 1 of 2 replicas")
+	})
+
+	t.Run("source error", func(t *testing.T) {
+		s, err := NewReplicatingStorage([]Storage{NewMemoryStorage(), NewMemoryStorage()}, &ReplicateOpts{Quorum: 1})
+		require.NoError(t, err)
+
+		err = s.PutObject(ctx, "obj", &failingReader{data: []byte("partial")})
+		assert.ErrorContains(t, err, "connection reset")
+
+		files, err := s.ListAll(ctx, "")
+		require.NoError(t, err)
+		assert.Empty(t, files)
+	})
+}
+
+func TestReplicatingStorage_ReadsFallBack(t *testing.T) {
+	first, second := newFlakyStorage(), NewMemoryStorage()
+	s, err := NewReplicatingStorage([]Storage{first, second}, &ReplicateOpts{Quorum: 1})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// the first replica missed the write
+	require.NoError(t, second.PutObject(ctx, "obj", strings.NewReader("content")))
+	rc, err := s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("content"), readAll(t, rc))
+
+	require.NoError(t, first.Storage.PutObject(ctx, "obj", strings.NewReader("content")))
+	first.failNext("stat", syscall.ECONNREFUSED)
+	info, err := s.Stat(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size)
+
+	_, err = s.ReadObject(ctx, "missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestReplicatingStorage_PartialWrites(t *testing.T) {
+	first, second := newFlakyStorage(), NewMemoryStorage()
+	s, err := NewReplicatingStorage([]Storage{first, second}, &ReplicateOpts{Quorum: 1})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, s.PutObject(ctx, "base/a", strings.NewReader("a")))
+	// the preferred replica misses the write, the quorum is met by the other one
+	first.failNext("put", syscall.ECONNRESET)
+	require.NoError(t, s.PutObject(ctx, "wal/b", strings.NewReader("b")))
+
+	exists, err := s.Exists(ctx, "wal/b")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = s.Exists(ctx, "missing")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	info, err := s.Stat(ctx, "wal/b")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), info.Size)
+
+	files, err := s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"base/a", "wal/b"}, files)
+
+	infos, err := s.ListAllInfo(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	assert.Equal(t, "wal/b", infos[1].Path)
+
+	var walked []string
+	for info, err := range s.Walk(ctx, "") {
+		require.NoError(t, err)
+		walked = append(walked, info.Path)
+	}
+	assert.Equal(t, []string{"base/a", "wal/b"}, walked)
+
+	dirs, err := s.ListTopLevelDirs(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"base": true, "wal": true}, dirs)
+
+	// a miss is not reported unless enough replicas answered to cover every write that met the quorum
+	a, b := newFlakyStorage(), newFlakyStorage()
+	s, err = NewReplicatingStorage([]Storage{a, b, NewMemoryStorage()}, &ReplicateOpts{Quorum: 2})
+	require.NoError(t, err)
+	a.failNext("exists", syscall.ECONNREFUSED)
+	b.failNext("exists", syscall.ECONNREFUSED)
+	_, err = s.Exists(ctx, "missing")
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
+
+func TestReplicatingStorage_MajorityQuorumHidesMissedWrites(t *testing.T) {
+	first, second, third := newFlakyStorage(), NewMemoryStorage(), NewMemoryStorage()
+	s, err := NewReplicatingStorage([]Storage{first, second, third}, &ReplicateOpts{Quorum: 2})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// the preferred replica misses an overwrite, the current version is read from the others
+	require.NoError(t, s.PutObject(ctx, "wal/a", strings.NewReader("old")))
+	first.failNext("put", syscall.ECONNRESET)
+	require.NoError(t, s.PutObject(ctx, "wal/a", strings.NewReader("new content")))
+
+	info, err := s.Stat(ctx, "wal/a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size)
+	rc, err := s.ReadObject(ctx, "wal/a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new content"), readAll(t, rc))
+
+	// a delete that met the quorum but missed the preferred replica
+	require.NoError(t, s.PutObject(ctx, "base/b", strings.NewReader("b")))
+	require.NoError(t, second.Delete(ctx, "base/b"))
+	require.NoError(t, third.Delete(ctx, "base/b"))
+
+	exists, err := s.Exists(ctx, "base/b")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	_, err = s.Stat(ctx, "base/b")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = s.ReadObject(ctx, "base/b")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	files, err := s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"wal/a"}, files)
+	infos, err := s.ListAllInfo(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "wal/a", infos[0].Path)
+	var walked []string
+	for info, err := range s.Walk(ctx, "") {
+		require.NoError(t, err)
+		walked = append(walked, info.Path)
+	}
+	assert.Equal(t, []string{"wal/a"}, walked)
+	dirs, err := s.ListTopLevelDirs(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"wal": true}, dirs)
+
+	// the vote is undecided while a replica that could change it fails to answer
+	first.failNext("exists", syscall.ECONNREFUSED)
+	require.NoError(t, second.PutObject(ctx, "wal/c", strings.NewReader("c")))
+	_, err = s.Exists(ctx, "wal/c")
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
+
+func TestParseQuorum(t *testing.T) {
+	for spec, expected := range map[string]int{"": 3, "all": 3, "ANY": 1, "2": 2} {
+		n, err := ParseQuorum(spec, 3)
+		require.NoError(t, err, spec)
+		assert.Equal(t, expected, n, spec)
+	}
+	for _, spec := range []string{"0", "4", "most"} {
+		_, err := ParseQuorum(spec, 3)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,494 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"iter"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 200 * time.Millisecond
+	defaultRetryMaxBackoff     = 10 * time.Second
+)
+
+// RetryOpts configures the retry decorator, zero values are replaced by defaults
+type RetryOpts struct {
+	// MaxAttempts counts the first call too, so 1 disables retries
+	MaxAttempts int
+
+	// InitialBackoff is doubled after every failed attempt, up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Jitter randomizes every backoff by up to the given fraction of it (0..1),
+	// so that parallel workers failing together do not retry in lockstep
+	Jitter float64
+
+	// Retryable overrides the classifier of the wrapped backend
+	Retryable func(err error) bool
+
+	// SpoolDir keeps uploads from non-seekable readers in temp files, so they can be sent again.
+	// Such uploads are attempted once when it's empty, seekable readers are rewound instead.
+	SpoolDir string
+}
+
+// retryClassifier is implemented by backends that know which of their errors are transient
+type retryClassifier interface {
+	isRetryable(err error) bool
+}
+
+type retryStorage struct {
+	s         Storage
+	o         RetryOpts
+	retryable func(err error) bool
+}
+
+var _ Storage = &retryStorage{}
+
+// NewRetryStorage retries failed operations with exponential backoff.
+//
+// Only idempotent operations are retried, reads resume from the offset they failed at (and fail with
+// ErrObjectChanged when the object was replaced meanwhile), and uploads
+// are retried when the reader can be rewound (or is spooled, see RetryOpts.SpoolDir).
+// Rename is retried only while the source is still in place.
+func NewRetryStorage(s Storage, o *RetryOpts) Storage {
+	r := &retryStorage{s: s, o: *o}
+	if r.o.MaxAttempts <= 0 {
+		r.o.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if r.o.InitialBackoff <= 0 {
+		r.o.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if r.o.MaxBackoff <= 0 {
+		r.o.MaxBackoff = defaultRetryMaxBackoff
+	}
+	r.o.Jitter = min(max(r.o.Jitter, 0), 1)
+
+	r.retryable = func(err error) bool {
+		return isRetryableBy(s, err)
+	}
+	if r.o.Retryable != nil {
+		r.retryable = r.o.Retryable
+	}
+	return r
+}
+
+// isRetryableBy asks the classifier of the storage, decorators pass the question to the storage they wrap
+func isRetryableBy(s Storage, err error) bool {
+	if c, ok := s.(retryClassifier); ok {
+		return c.isRetryable(err)
+	}
+	return isTransientError(err)
+}
+
+// isTransientError reports network failures that are worth another attempt, whatever the backend is
+func isTransientError(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ETIMEDOUT) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// isRetryableStatus reports HTTP statuses that mean "try again later"
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// shouldRetry decides whether the failed attempt is followed by another one
+func (r *retryStorage) shouldRetry(ctx context.Context, attempt int, err error) bool {
+	if attempt >= r.o.MaxAttempts || ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return false
+	}
+	return r.retryable(err)
+}
+
+// backoff returns the pause after the given failed attempt
+func (r *retryStorage) backoff(attempt int) time.Duration {
+	d := r.o.InitialBackoff
+	for i := 1; i < attempt && d < r.o.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, r.o.MaxBackoff)
+	if r.o.Jitter > 0 {
+		// spread evenly over [d-jitter, d+jitter]
+		spread := float64(d) * r.o.Jitter
+		d += time.Duration((rand.Float64()*2 - 1) * spread) //nolint:gosec
+	}
+	return d
+}
+
+// wait logs the failure and sleeps before the next attempt, it fails when ctx is done
+func (r *retryStorage) wait(ctx context.Context, op, p string, attempt int, err error) error {
+	d := r.backoff(attempt)
+	slog.Warn("storage operation failed, retrying",
+		slog.String("module", "storage"),
+		slog.String("op", op),
+		slog.String("path", p),
+		slog.Int("attempt", attempt),
+		slog.Duration("backoff", d),
+		slog.Any("err", err),
+	)
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retry calls fn until it succeeds, fails with a permanent error, or attempts are exhausted
+func retry[T any](ctx context.Context, r *retryStorage, op, p string, fn func() (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := fn()
+		if err == nil || !r.shouldRetry(ctx, attempt, err) {
+			return result, err
+		}
+		if werr := r.wait(ctx, op, p, attempt, err); werr != nil {
+			return result, err
+		}
+	}
+}
+
+// retryErr is retry for calls without a result
+func retryErr(ctx context.Context, r *retryStorage, op, p string, fn func() error) error {
+	_, err := retry(ctx, r, op, p, func() (struct{}, error) {
+		return struct{}{}, fn()
+	})
+	return err
+}
+
+func (r *retryStorage) PutObject(ctx context.Context, p string, rd io.Reader) error {
+	return r.PutObjectWithOpts(ctx, p, rd, nil)
+}
+
+// PutObjectWithOpts rewinds a seekable reader before every new attempt, other readers are spooled
+// to a temp file first when SpoolDir is set, and sent just once otherwise.
+func (r *retryStorage) PutObjectWithOpts(ctx context.Context, p string, rd io.Reader, opts *PutObjectOpts) error {
+	rs, ok := rd.(io.ReadSeeker)
+	if !ok {
+		if r.o.SpoolDir == "" {
+			return r.s.PutObjectWithOpts(ctx, p, rd, opts)
+		}
+		f, err := r.spool(rd)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}()
+		rs = f
+	}
+
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return r.s.PutObjectWithOpts(ctx, p, rd, opts)
+	}
+	attempt := 0
+	return retryErr(ctx, r, "put", p, func() error {
+		attempt++
+		if attempt > 1 {
+			if _, err := rs.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		return r.s.PutObjectWithOpts(ctx, p, rs, opts)
+	})
+}
+
+// spool copies the content into a temp file, positioned at its start
+func (r *retryStorage) spool(rd io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp(r.o.SpoolDir, "xrepo-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+	if _, err := io.Copy(f, rd); err != nil {
+		cleanup()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (r *retryStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	return r.openResumable(ctx, p, 0, -1)
+}
+
+func (r *retryStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	return r.openResumable(ctx, p, offset, length)
+}
+
+// openResumable pins the version of the object before it's opened, so that a resumed read never
+// continues with the content of another version
+func (r *retryStorage) openResumable(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	var info ObjectInfo
+	rc, err := retry(ctx, r, "read", p, func() (io.ReadCloser, error) {
+		var err error
+		info, err = r.s.Stat(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		if offset == 0 && length < 0 {
+			return r.s.ReadObject(ctx, p)
+		}
+		return r.s.ReadObjectRange(ctx, p, offset, length)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resumingReader{ctx: ctx, r: r, path: p, info: info, rc: rc, offset: offset, remaining: length}, nil
+}
+
+// ErrObjectChanged is the error of a resumed read of an object that was replaced since it was opened
+var ErrObjectChanged = errors.New("object changed while it was read")
+
+// sameVersion reports whether both describe the same version of an object: by the version ids
+// or ETags when both sides have them, by the modification time otherwise
+func sameVersion(a, b ObjectInfo) bool {
+	switch {
+	case a.Size != b.Size:
+		return false
+	case a.VersionID != "" && b.VersionID != "":
+		return a.VersionID == b.VersionID
+	case a.ETag != "" && b.ETag != "":
+		return a.ETag == b.ETag
+	default:
+		return a.ModTime.Equal(b.ModTime)
+	}
+}
+
+// resumingReader reopens the object at the current offset when the stream breaks,
+// a reopened stream is checked to be of the version the read started with.
+type resumingReader struct {
+	ctx  context.Context
+	r    *retryStorage
+	path string
+	info ObjectInfo // the version pinned when the object was opened
+	rc   io.ReadCloser
+
+	offset    int64
+	remaining int64 // negative reads up to the end
+
+	// failures counts broken streams since the last successful read
+	failures int
+}
+
+func (rr *resumingReader) Read(p []byte) (int, error) {
+	for {
+		if rr.remaining == 0 {
+			return 0, io.EOF
+		}
+		n, err := rr.rc.Read(p)
+		rr.offset += int64(n)
+		if rr.remaining > 0 {
+			rr.remaining -= int64(n)
+		}
+		if n > 0 {
+			rr.failures = 0
+		}
+		if err == nil || errors.Is(err, io.EOF) {
+			return n, err
+		}
+
+		rr.failures++
+		if !rr.r.shouldRetry(rr.ctx, rr.failures, err) {
+			return n, err
+		}
+		if werr := rr.r.wait(rr.ctx, "read", rr.path, rr.failures, err); werr != nil {
+			return n, err
+		}
+		if rerr := rr.reopen(); rerr != nil {
+			return n, rerr
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// reopen continues the read at the current offset. The version is checked after the stream is opened,
+// so that an object replaced before the new stream was opened is always noticed.
+func (rr *resumingReader) reopen() error {
+	_ = rr.rc.Close()
+	rc, err := rr.r.s.ReadObjectRange(rr.ctx, rr.path, rr.offset, rr.remaining)
+	if err == nil {
+		var info ObjectInfo
+		info, err = rr.r.s.Stat(rr.ctx, rr.path)
+		if err == nil && !sameVersion(rr.info, info) {
+			err = &fs.PathError{Op: "read", Path: rr.path, Err: ErrObjectChanged}
+		}
+		if err != nil {
+			_ = rc.Close()
+		}
+	}
+	if err != nil {
+		// reads fail from now on, with the reason to reopen
+		rr.rc = io.NopCloser(&errReader{err: err})
+		return err
+	}
+	rr.rc = rc
+	return nil
+}
+
+func (rr *resumingReader) Close() error {
+	return rr.rc.Close()
+}
+
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read(_ []byte) (int, error) {
+	return 0, e.err
+}
+
+func (r *retryStorage) Exists(ctx context.Context, p string) (bool, error) {
+	return retry(ctx, r, "exists", p, func() (bool, error) {
+		return r.s.Exists(ctx, p)
+	})
+}
+
+func (r *retryStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	return retry(ctx, r, "stat", p, func() (ObjectInfo, error) {
+		return r.s.Stat(ctx, p)
+	})
+}
+
+func (r *retryStorage) SHA256(ctx context.Context, p string) (string, error) {
+	return retry(ctx, r, "sha256", p, func() (string, error) {
+		return r.s.SHA256(ctx, p)
+	})
+}
+
+func (r *retryStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	return retry(ctx, r, "list", prefix, func() ([]string, error) {
+		return r.s.ListAll(ctx, prefix)
+	})
+}
+
+func (r *retryStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return retry(ctx, r, "list", prefix, func() ([]ObjectInfo, error) {
+		return r.s.ListAllInfo(ctx, prefix)
+	})
+}
+
+// Walk starts over when the listing fails before anything is yielded,
+// later failures are passed to the consumer, since the entries can't be taken back.
+func (r *retryStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		for attempt := 1; ; attempt++ {
+			yielded := false
+			var failed error
+			for info, err := range r.s.Walk(ctx, prefix) {
+				if err != nil {
+					failed = err
+					break
+				}
+				yielded = true
+				if !yield(info, nil) {
+					return
+				}
+			}
+			if failed == nil {
+				return
+			}
+			if yielded || !r.shouldRetry(ctx, attempt, failed) || r.wait(ctx, "walk", prefix, attempt, failed) != nil {
+				yield(ObjectInfo{}, failed)
+				return
+			}
+		}
+	}
+}
+
+func (r *retryStorage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	return retry(ctx, r, "list-dirs", prefix, func() (map[string]bool, error) {
+		return r.s.ListTopLevelDirs(ctx, prefix)
+	})
+}
+
+func (r *retryStorage) Delete(ctx context.Context, p string) error {
+	return retryErr(ctx, r, "delete", p, func() error {
+		return r.s.Delete(ctx, p)
+	})
+}
+
+func (r *retryStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	return retryErr(ctx, r, "delete-prefix", prefix, func() error {
+		return r.s.DeletePrefix(ctx, prefix)
+	})
+}
+
+func (r *retryStorage) Copy(ctx context.Context, src, dst string) error {
+	return retryErr(ctx, r, "copy", src, func() error {
+		return r.s.Copy(ctx, src, dst)
+	})
+}
+
+// Rename is not idempotent, a failed attempt may have moved the object anyway (e.g. the reply was lost),
+// so before trying again the source is checked, and a moved object counts as success.
+func (r *retryStorage) Rename(ctx context.Context, src, dst string) error {
+	attempt := 0
+	return retryErr(ctx, r, "rename", src, func() error {
+		attempt++
+		if attempt > 1 {
+			srcExists, err := r.s.Exists(ctx, src)
+			if err != nil {
+				return err
+			}
+			if !srcExists {
+				dstExists, err := r.s.Exists(ctx, dst)
+				if err != nil {
+					return err
+				}
+				if dstExists {
+					return nil
+				}
+			}
+		}
+		return r.s.Rename(ctx, src, dst)
+	})
+}
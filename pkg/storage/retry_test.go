@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyStorage fails the next calls of the given operations, on top of an in-memory storage
+type flakyStorage struct {
+	Storage
+
+	mu       sync.Mutex
+	failures map[string][]error
+	calls    map[string]int
+
+	// brokenAfter breaks the next opened stream after that many bytes
+	brokenAfter int64
+	ranges      []int64
+}
+
+func newFlakyStorage() *flakyStorage {
+	return &flakyStorage{
+		Storage:     NewMemoryStorage(),
+		failures:    make(map[string][]error),
+		calls:       make(map[string]int),
+		brokenAfter: -1,
+	}
+}
+
+func (f *flakyStorage) failNext(op string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = append(f.failures[op], errs...)
+}
+
+func (f *flakyStorage) call(op string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[op]++
+	if errs := f.failures[op]; len(errs) > 0 {
+		f.failures[op] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func (f *flakyStorage) callCount(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+func (f *flakyStorage) Exists(ctx context.Context, p string) (bool, error) {
+	if err := f.call("exists"); err != nil {
+		return false, err
+	}
+	return f.Storage.Exists(ctx, p)
+}
+
+func (f *flakyStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	if err := f.call("stat"); err != nil {
+		return ObjectInfo{}, err
+	}
+	return f.Storage.Stat(ctx, p)
+}
+
+// PutObjectWithOpts consumes part of the content before failing, as a broken upload does
+func (f *flakyStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	if err := f.call("put"); err != nil {
+		_, _ = io.CopyN(io.Discard, r, 3)
+		return err
+	}
+	return f.Storage.PutObjectWithOpts(ctx, p, r, opts)
+}
+
+func (f *flakyStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	return f.ReadObjectRange(ctx, p, 0, -1)
+}
+
+func (f *flakyStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	if err := f.call("read"); err != nil {
+		return nil, err
+	}
+	rc, err := f.Storage.ReadObjectRange(ctx, p, offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ranges = append(f.ranges, offset)
+	if f.brokenAfter >= 0 {
+		rc = &brokenReader{ReadCloser: rc, left: f.brokenAfter}
+		f.brokenAfter = -1
+	}
+	return rc, nil
+}
+
+// Rename moves the object, and fails anyway, as if the reply was lost
+func (f *flakyStorage) Rename(ctx context.Context, src, dst string) error {
+	err := f.call("rename")
+	if rerr := f.Storage.Rename(ctx, src, dst); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+type brokenReader struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	if b.left == 0 {
+		return 0, syscall.ECONNRESET
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
+
+func newTestRetryStorage(s Storage) Storage {
+	return NewRetryStorage(s, &RetryOpts{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		Jitter:         0.5,
+	})
+}
+
+func TestRetryStorage_RetriesTransientErrors(t *testing.T) {
+	f := newFlakyStorage()
+	s := newTestRetryStorage(f)
+	ctx := context.Background()
+	require.NoError(t, f.Storage.PutObject(ctx, "a/obj", strings.NewReader("content")))
+
+	f.failNext("exists", syscall.ECONNRESET, io.ErrUnexpectedEOF)
+	exists, err := s.Exists(ctx, "a/obj")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 3, f.callCount("exists"))
+
+	// attempts are exhausted
+	f.failNext("stat", syscall.ECONNRESET, syscall.ECONNRESET, syscall.ECONNRESET)
+	_, err = s.Stat(ctx, "a/obj")
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+	assert.Equal(t, 3, f.callCount("stat"))
+}
+
+func TestRetryStorage_PermanentErrorsAreNotRetried(t *testing.T) {
+	f := newFlakyStorage()
+	s := newTestRetryStorage(f)
+	ctx := context.Background()
+
+	_, err := s.Stat(ctx, "missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Equal(t, 1, f.callCount("stat"))
+
+	f.failNext("exists", errors.New("access denied"))
+	_, err = s.Exists(ctx, "missing")
+	assert.Error(t, err)
+	assert.Equal(t, 1, f.callCount("exists"))
+}
+
+func TestRetryStorage_CanceledContextStopsRetries(t *testing.T) {
+	f := newFlakyStorage()
+	s := NewRetryStorage(f, &RetryOpts{MaxAttempts: 5, InitialBackoff: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	f.failNext("exists", syscall.ECONNRESET, syscall.ECONNRESET)
+	_, err := s.Exists(ctx, "obj")
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+	assert.Equal(t, 1, f.callCount("exists"))
+}
+
+func TestRetryStorage_ReadResumesFromOffset(t *testing.T) {
+	f := newFlakyStorage()
+	s := newTestRetryStorage(f)
+	ctx := context.Background()
+
+	content := strings.Repeat("0123456789", 10)
+	require.NoError(t, f.Storage.PutObject(ctx, "obj", strings.NewReader(content)))
+
+	f.brokenAfter = 25
+	rc, err := s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, []byte(content), readAll(t, rc))
+	assert.Equal(t, []int64{0, 25}, f.ranges)
+
+	f.ranges = nil
+	f.brokenAfter = 5
+	rc, err = s.ReadObjectRange(ctx, "obj", 10, 20)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(content[10:30]), readAll(t, rc))
+	assert.Equal(t, []int64{10, 15}, f.ranges)
+
+	// the object went away between the attempts
+	f.ranges = nil
+	f.brokenAfter = 5
+	rc, err = s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	require.NoError(t, f.Storage.Delete(ctx, "obj"))
+	_, err = io.ReadAll(rc)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	require.NoError(t, rc.Close())
+}
+
+func TestRetryStorage_ReadFailsWhenObjectIsReplaced(t *testing.T) {
+	f := newFlakyStorage()
+	s := newTestRetryStorage(f)
+	ctx := context.Background()
+	require.NoError(t, f.Storage.PutObject(ctx, "obj", strings.NewReader(strings.Repeat("a", 100))))
+
+	f.brokenAfter = 25
+	rc, err := s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	require.NoError(t, f.Storage.PutObject(ctx, "obj", strings.NewReader(strings.Repeat("b", 100))))
+
+	// the read is not continued with the content of the new version, and not retried
+	data, err := io.ReadAll(rc)
+	require.ErrorIs(t, err, ErrObjectChanged)
+	assert.Equal(t, strings.Repeat("a", 25), string(data))
+	assert.Equal(t, []int64{0, 25}, f.ranges)
+	require.NoError(t, rc.Close())
+}
+
+func TestRetryStorage_PutObjectRewindsSeekableReaders(t *testing.T) {
+	f := newFlakyStorage()
+	s := newTestRetryStorage(f)
+	ctx := context.Background()
+
+	f.failNext("put", syscall.EPIPE)
+	r := strings.NewReader("header|content")
+	_, err := r.Seek(7, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, s.PutObject(ctx, "obj", r))
+	assert.Equal(t, 2, f.callCount("put"))
+
+	rc, err := s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("content"), readAll(t, rc))
+}
+
+func TestRetryStorage_PutObjectStreams(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("not retried without a spool dir", func(t *testing.T) {
+		f := newFlakyStorage()
+		s := newTestRetryStorage(f)
+
+		f.failNext("put", syscall.EPIPE)
+		err := s.PutObject(ctx, "obj", io.MultiReader(strings.NewReader("content")))
+		assert.ErrorIs(t, err, syscall.EPIPE)
+		assert.Equal(t, 1, f.callCount("put"))
+	})
+
+	t.Run("retried from the spool", func(t *testing.T) {
+		f := newFlakyStorage()
+		spoolDir := t.TempDir()
+		s := NewRetryStorage(f, &RetryOpts{InitialBackoff: time.Millisecond, SpoolDir: spoolDir})
+
+		f.failNext("put", syscall.EPIPE, syscall.EPIPE)
+		require.NoError(t, s.PutObject(ctx, "obj", io.MultiReader(strings.NewReader("content"))))
+		assert.Equal(t, 3, f.callCount("put"))
+
+		rc, err := s.ReadObject(ctx, "obj")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("content"), readAll(t, rc))
+
+		// the spooled copy is removed
+		entries, err := os.ReadDir(spoolDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestRetryStorage_RenameAppliedDespiteError(t *testing.T) {
+	f := newFlakyStorage()
+	s := newTestRetryStorage(f)
+	ctx := context.Background()
+	require.NoError(t, f.Storage.PutObject(ctx, "src", strings.NewReader("content")))
+
+	f.failNext("rename", syscall.ECONNRESET)
+	require.NoError(t, s.Rename(ctx, "src", "dst"))
+	assert.Equal(t, 1, f.callCount("rename"))
+
+	files, err := s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dst"}, files)
+}
+
+func TestRetryStorage_BackendClassifiers(t *testing.T) {
+	webdav := &webdavStorage{}
+	ftp := &ftpStorage{}
+	redial := func() (*sftp.Client, error) { return nil, errors.New("unreachable") }
+
+	tests := []struct {
+		name      string
+		retryable func(error) bool
+		err       error
+		expected  bool
+	}{
+		{"webdav 503", webdav.isRetryable, &webdavStatusError{statusCode: 503}, true},
+		{"webdav 429", webdav.isRetryable, fmt.Errorf("put: %w", &webdavStatusError{statusCode: 429}), true},
+		{"webdav 403", webdav.isRetryable, &webdavStatusError{statusCode: 403}, false},
+		{"webdav reset", webdav.isRetryable, fmt.Errorf("webdav put: %w", syscall.ECONNRESET), true},
+		{"ftp 421", ftp.isRetryable, &textproto.Error{Code: 421, Msg: "too many users"}, true},
+		{"ftp 452", ftp.isRetryable, &textproto.Error{Code: 452, Msg: "insufficient storage"}, true},
+		{"ftp 553", ftp.isRetryable, &textproto.Error{Code: 553, Msg: "file name not allowed"}, false},
+		{"sftp lost without redial", (&sftpStorage{}).isRetryable, fmt.Errorf("sftp open: %w", sftp.ErrSSHFxConnectionLost), false},
+		{"sftp lost with redial", (&sftpStorage{redial: redial}).isRetryable, fmt.Errorf("sftp open: %w", sftp.ErrSSHFxConnectionLost), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.retryable(tt.err))
+		})
+	}
+}
@@ -7,6 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"iter"
+	"net/http"
+	"net/url"
 	"path/filepath"
 	"strings"
 
@@ -14,6 +18,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
 type s3Storage struct {
@@ -42,16 +47,54 @@ func CreateUploader(client *s3.Client, partsize int64, concurrency int) *manager
 	})
 }
 
+// notFound maps the missing key error to fs.ErrNotExist
+func (s s3Storage) notFound(op, p string, err error) error {
+	var nsk *s3types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+// isRetryable treats throttling and server-side failures as transient, the SDK retries them too,
+// but gives up after a few quick attempts
+func (s s3Storage) isRetryable(err error) bool {
+	var re interface{ HTTPStatusCode() int }
+	if errors.As(err, &re) && isRetryableStatus(re.HTTPStatusCode()) {
+		return true
+	}
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+			return true
+		}
+	}
+	return isTransientError(err)
+}
+
 func (s s3Storage) PutObject(ctx context.Context, path string, r io.Reader) error {
-	path = s.fullPath(path)
+	return s.PutObjectWithOpts(ctx, path, r, nil)
+}
+
+// PutObjectWithOpts uploads the object, metadata is sent as user metadata (x-amz-meta-*), tags as object tagging.
+func (s s3Storage) PutObjectWithOpts(ctx context.Context, path string, r io.Reader, opts *PutObjectOpts) error {
+	key, err := s.fullPath(path)
+	if err != nil {
+		return err
+	}
 
 	objInput := &s3.PutObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(path),
+		Key:    aws.String(key),
 		Body:   r,
 	}
+	if meta := newObjectMeta(opts); meta != nil {
+		objInput.Metadata = meta.Metadata
+		objInput.Tagging = encodeTagging(meta.Tags)
+	}
 
-	_, err := s.uploader.Upload(ctx, objInput)
+	_, err = s.uploader.Upload(ctx, objInput)
 	if err != nil {
 		return err
 	}
@@ -59,26 +102,64 @@ func (s s3Storage) PutObject(ctx context.Context, path string, r io.Reader) erro
 }
 
 func (s s3Storage) ReadObject(ctx context.Context, path string) (io.ReadCloser, error) {
-	path = s.fullPath(path)
-
 	// TODO:design:fix: use *manager.Downloader
 
+	key, err := s.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
 	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(path),
+		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read object from S3: %w", err)
+		return nil, fmt.Errorf("failed to read object from S3: %w", s.notFound("read", path, err))
+	}
+	return out.Body, nil
+}
+
+func (s s3Storage) ReadObjectRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	key, err := s.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(byteRange),
+	})
+	if err != nil {
+		// the range starts past the end of the object
+		var ae smithy.APIError
+		if errors.As(err, &ae) && ae.ErrorCode() == "InvalidRange" {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		return nil, fmt.Errorf("failed to read object range from S3: %w", s.notFound("read", path, err))
 	}
 	return out.Body, nil
 }
 
 func (s s3Storage) Exists(ctx context.Context, path string) (bool, error) {
-	path = s.fullPath(path)
+	key, err := s.fullPath(path)
+	if err != nil {
+		return false, err
+	}
 
-	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+	_, err = s.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(path),
+		Key:    aws.String(key),
 	})
 	if err != nil {
 		var nf *s3types.NotFound
@@ -91,8 +172,6 @@ func (s s3Storage) Exists(ctx context.Context, path string) (bool, error) {
 }
 
 func (s s3Storage) SHA256(ctx context.Context, path string) (string, error) {
-	path = s.fullPath(path)
-
 	obj, err := s.ReadObject(ctx, path)
 	if err != nil {
 		return "", err
@@ -107,63 +186,400 @@ func (s s3Storage) SHA256(ctx context.Context, path string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func (s s3Storage) fullPath(path string) string {
-	return filepath.ToSlash(filepath.Join(s.prefix, path))
+// fullPath resolves the path to a bucket key under the prefix, paths that escape it are rejected
+func (s s3Storage) fullPath(path string) (string, error) {
+	name, err := cleanPath(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(filepath.Join(s.prefix, name)), nil
+}
+
+func (s s3Storage) Stat(ctx context.Context, path string) (ObjectInfo, error) {
+	key, err := s.fullPath(path)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: s3types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		var nf *s3types.NotFound
+		if errors.As(err, &nf) {
+			return ObjectInfo{}, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+		}
+		return ObjectInfo{}, err
+	}
+
+	tagging, err := s.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:    aws.String(s.bucket),
+		Key:       aws.String(key),
+		VersionId: out.VersionId,
+	})
+	if err != nil && !isS3TagReadUnsupported(err) {
+		return ObjectInfo{}, fmt.Errorf("failed to get object tagging: %w", err)
+	}
+	var tags map[string]string
+	if err == nil && len(tagging.TagSet) > 0 {
+		tags = make(map[string]string, len(tagging.TagSet))
+		for _, tag := range tagging.TagSet {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+
+	rel, err := filepath.Rel(s.prefix, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info := ObjectInfo{
+		Path:      filepath.ToSlash(rel),
+		Size:      aws.ToInt64(out.ContentLength),
+		ModTime:   aws.ToTime(out.LastModified),
+		ETag:      strings.Trim(aws.ToString(out.ETag), `"`),
+		VersionID: aws.ToString(out.VersionId),
+		Checksum:  headChecksum(out),
+		Tags:      tags,
+	}
+	if len(out.Metadata) > 0 {
+		info.Metadata = out.Metadata
+	}
+	return info, nil
+}
+
+// isS3TagReadUnsupported tells denied or unsupported tagging reads (i.e. S3-compatible stores without tagging,
+// or a policy without s3:GetObjectTagging) from failures of the request, objects are reported without tags then
+func isS3TagReadUnsupported(err error) bool {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "NotImplemented", "AccessDenied", "MethodNotAllowed":
+			return true
+		}
+	}
+	var re interface{ HTTPStatusCode() int }
+	if errors.As(err, &re) {
+		switch re.HTTPStatusCode() {
+		case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+			return true
+		}
+	}
+	return false
+}
+
+// encodeTagging builds the x-amz-tagging header value
+func encodeTagging(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return aws.String(values.Encode())
+}
+
+// headChecksum picks the strongest checksum S3 reports for the object
+func headChecksum(out *s3.HeadObjectOutput) string {
+	switch {
+	case out.ChecksumSHA256 != nil:
+		return "sha256:" + *out.ChecksumSHA256
+	case out.ChecksumSHA1 != nil:
+		return "sha1:" + *out.ChecksumSHA1
+	case out.ChecksumCRC64NVME != nil:
+		return "crc64nvme:" + *out.ChecksumCRC64NVME
+	case out.ChecksumCRC32C != nil:
+		return "crc32c:" + *out.ChecksumCRC32C
+	case out.ChecksumCRC32 != nil:
+		return "crc32:" + *out.ChecksumCRC32
+	default:
+		return ""
+	}
 }
 
 func (s s3Storage) ListAll(ctx context.Context, prefix string) ([]string, error) {
-	fullPath := s.fullPath(prefix)
-	var objects []string
+	return collectPaths(s.Walk(ctx, prefix))
+}
+
+func (s s3Storage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return collectInfos(s.Walk(ctx, prefix))
+}
+
+func (s s3Storage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		keyPrefix, err := s.keyPrefix(prefix)
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+		paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(keyPrefix),
+		})
+
+		// Iterate over pages of results, the next page is requested only when the current one is consumed
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(ObjectInfo{}, fmt.Errorf("failed to get page: %w", err))
+				return
+			}
+
+			for _, obj := range page.Contents {
+				if !matchesKeyPrefix(aws.ToString(obj.Key), keyPrefix) {
+					continue
+				}
+				rel, err := filepath.Rel(s.prefix, *obj.Key)
+				if err != nil {
+					yield(ObjectInfo{}, err)
+					return
+				}
+				if !yield(ObjectInfo{
+					Path:    filepath.ToSlash(rel),
+					Size:    aws.ToInt64(obj.Size),
+					ModTime: aws.ToTime(obj.LastModified),
+					ETag:    strings.Trim(aws.ToString(obj.ETag), `"`),
+				}, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ListTopLevelDirs returns the "directories" directly under the prefix (relative to the storage root),
+// using a delimiter listing, so the objects inside of them are not enumerated.
+func (s s3Storage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	dirPrefix, err := s.keyPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if dirPrefix != "" && !strings.HasSuffix(dirPrefix, "/") {
+		dirPrefix += "/"
+	}
 
 	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
-		Bucket: aws.String(s.bucket),
-		Prefix: aws.String(fullPath),
+		Bucket:    aws.String(s.bucket),
+		Delimiter: aws.String("/"), // Groups results by prefix (like top-level directories)
+		Prefix:    aws.String(dirPrefix),
 	})
 
-	// Iterate over pages of results
+	// Extract top-level prefixes (directories)
+	prefixes := make(map[string]bool)
 	for paginator.HasMorePages() {
 		page, err := paginator.NextPage(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get page: %w", err)
+			return nil, fmt.Errorf("failed to list objects in bucket: %w", err)
 		}
-
-		for _, obj := range page.Contents {
-			rel, err := filepath.Rel(s.prefix, *obj.Key)
+		for _, prefix := range page.CommonPrefixes {
+			if prefix.Prefix == nil {
+				continue
+			}
+			prefixClean := strings.TrimSuffix(*prefix.Prefix, "/")
+			rel, err := filepath.Rel(s.prefix, prefixClean)
 			if err != nil {
 				return nil, err
 			}
-			objects = append(objects, rel)
+			prefixes[filepath.ToSlash(rel)] = true
 		}
 	}
+	return prefixes, nil
+}
 
-	return objects, nil
+// keyPrefix resolves a listing prefix to a bucket key prefix, keeping the trailing slash
+// so that "a/" (or the storage root) does not match sibling keys like "ab/...".
+// A prefix without it still lists sibling keys, they are dropped with matchesKeyPrefix.
+func (s s3Storage) keyPrefix(prefix string) (string, error) {
+	fullPath, err := s.fullPath(prefix)
+	if err != nil {
+		return "", err
+	}
+	if fullPath == "" || fullPath == "." {
+		return "", nil
+	}
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		return fullPath + "/", nil
+	}
+	return fullPath, nil
 }
 
-func (s s3Storage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
-	input := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(s.bucket),
-		Delimiter: aws.String("/"), // Groups results by prefix (like top-level directories)
-		Prefix:    aws.String(prefix),
+func (s s3Storage) Delete(ctx context.Context, path string) error {
+	key, err := s.fullPath(path)
+	if err != nil {
+		return err
 	}
 
-	output, err := s.client.ListObjectsV2(ctx, input)
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list objects in bucket: %w", err)
+		return fmt.Errorf("failed to delete object from S3: %w", err)
 	}
+	return nil
+}
 
-	// Extract top-level prefixes (directories)
-	prefixes := make(map[string]bool)
-	for _, prefix := range output.CommonPrefixes {
-		if prefix.Prefix == nil {
+func (s s3Storage) DeletePrefix(ctx context.Context, prefix string) error {
+	keyPrefix, err := s.keyPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(keyPrefix),
+	})
+
+	// Each page holds at most 1000 keys, which is exactly the DeleteObjects batch limit
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get page: %w", err)
+		}
+
+		ids := make([]s3types.ObjectIdentifier, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			if matchesKeyPrefix(aws.ToString(obj.Key), keyPrefix) {
+				ids = append(ids, s3types.ObjectIdentifier{Key: obj.Key})
+			}
+		}
+		if len(ids) == 0 {
 			continue
 		}
-		prefixClean := strings.TrimSuffix(*prefix.Prefix, "/")
-		rel, err := filepath.Rel(s.prefix, prefixClean)
+
+		out, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3types.Delete{
+				Objects: ids,
+				Quiet:   aws.Bool(true),
+			},
+		})
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("failed to delete objects from S3: %w", err)
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("failed to delete %d objects from S3, first: %s: %s",
+				len(out.Errors), aws.ToString(e.Key), aws.ToString(e.Message))
 		}
-		prefixes[filepath.ToSlash(rel)] = true
 	}
+	return nil
+}
 
-	return prefixes, nil
+const (
+	// maxCopyObjectSize is the CopyObject limit, larger objects have to be copied part by part
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+	copyPartSize      = 512 * 1024 * 1024
+)
+
+// copySource builds the URL-encoded "bucket/key" value CopyObject expects
+func (s s3Storage) copySource(key string) string {
+	segments := strings.Split(s.bucket+"/"+key, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+func (s s3Storage) Copy(ctx context.Context, src, dst string) error {
+	srcKey, err := s.fullPath(src)
+	if err != nil {
+		return err
+	}
+	dstKey, err := s.fullPath(dst)
+	if err != nil {
+		return err
+	}
+	info, err := s.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	if srcKey == dstKey {
+		return nil
+	}
+	if info.Size > maxCopyObjectSize {
+		return s.copyMultipart(ctx, srcKey, dstKey, &info)
+	}
+
+	_, err = s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(s.copySource(srcKey)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy object in S3: %w", err)
+	}
+	return nil
+}
+
+// copyMultipart copies the object part by part, metadata and tags are not carried over by UploadPartCopy,
+// so they are set explicitly from the source info
+func (s s3Storage) copyMultipart(ctx context.Context, srcKey, dstKey string, info *ObjectInfo) error {
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(dstKey),
+		Metadata: info.Metadata,
+		Tagging:  encodeTagging(info.Tags),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+
+	parts, err := s.copyParts(ctx, srcKey, dstKey, created.UploadId, info.Size)
+	if err != nil {
+		_, _ = s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(dstKey),
+			UploadId: created.UploadId,
+		})
+		return err
+	}
+
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(dstKey),
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (s s3Storage) copyParts(ctx context.Context, srcKey, dstKey string, uploadID *string, size int64) ([]s3types.CompletedPart, error) {
+	parts := make([]s3types.CompletedPart, 0, size/copyPartSize+1)
+
+	for offset, partNumber := int64(0), int32(1); offset < size; offset, partNumber = offset+copyPartSize, partNumber+1 {
+		end := min(offset+copyPartSize, size) - 1
+
+		out, err := s.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(dstKey),
+			UploadId:        uploadID,
+			PartNumber:      aws.Int32(partNumber),
+			CopySource:      aws.String(s.copySource(srcKey)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy part %d: %w", partNumber, err)
+		}
+		parts = append(parts, s3types.CompletedPart{
+			ETag:       out.CopyPartResult.ETag,
+			PartNumber: aws.Int32(partNumber),
+		})
+	}
+	return parts, nil
+}
+
+// Rename is copy+delete, S3 has no move operation
+func (s s3Storage) Rename(ctx context.Context, src, dst string) error {
+	if err := s.Copy(ctx, src, dst); err != nil {
+		return err
+	}
+	if same, err := samePath(src, dst); err != nil || same {
+		return err
+	}
+	return s.Delete(ctx, src)
 }
@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsS3TagReadUnsupported(t *testing.T) {
+	for _, code := range []string{"NotImplemented", "AccessDenied", "MethodNotAllowed"} {
+		err := fmt.Errorf("operation error: %w", &smithy.GenericAPIError{Code: code})
+		assert.True(t, isS3TagReadUnsupported(err), code)
+	}
+	assert.False(t, isS3TagReadUnsupported(&smithy.GenericAPIError{Code: "SlowDown"}))
+	assert.False(t, isS3TagReadUnsupported(errors.New("connection reset")))
+}
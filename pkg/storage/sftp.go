@@ -4,22 +4,33 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"iter"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/pkg/sftp"
 )
 
 type sftpStorage struct {
+	root string
+
+	mu     sync.Mutex
 	client *sftp.Client
-	root   string
+	redial func() (*sftp.Client, error)
+	lost   bool
 }
 
-var _ Storage = &sftpStorage{}
+var (
+	_ Storage      = &sftpStorage{}
+	_ clientCopier = &sftpStorage{}
+)
 
 func NewSFTPStorage(client *sftp.Client, remoteDir string) Storage {
 	return &sftpStorage{
@@ -28,42 +39,210 @@ func NewSFTPStorage(client *sftp.Client, remoteDir string) Storage {
 	}
 }
 
-func (s *sftpStorage) resolvePath(p string) string {
-	return filepath.ToSlash(path.Join(s.root, p))
+// NewSFTPStorageWithRedial replaces the client with a redialed one, when its connection is lost.
+// Calls that were in flight fail with sftp.ErrSSHFxConnectionLost, and are worth a retry (see NewRetryStorage).
+func NewSFTPStorageWithRedial(client *sftp.Client, remoteDir string, redial func() (*sftp.Client, error)) Storage {
+	s := &sftpStorage{
+		root:   strings.TrimSuffix(remoteDir, "/"),
+		redial: redial,
+	}
+	s.setClient(client)
+	return s
+}
+
+// setClient watches the connection of the new client, so a lost one is replaced on the next call
+func (s *sftpStorage) setClient(c *sftp.Client) {
+	s.client = c
+	s.lost = false
+	go func() {
+		_ = c.Wait()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.client == c {
+			s.lost = true
+		}
+	}()
+}
+
+// conn returns the current client, redialing a lost connection when possible,
+// a failed redial is tried again on the next call, meanwhile calls fail on the lost one
+func (s *sftpStorage) conn() *sftp.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lost && s.redial != nil {
+		if c, err := s.redial(); err == nil {
+			s.setClient(c)
+		}
+	}
+	return s.client
+}
+
+// isRetryable treats a lost connection as transient when it can be redialed
+func (s *sftpStorage) isRetryable(err error) bool {
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) {
+		return s.redial != nil
+	}
+	return isTransientError(err)
 }
 
-func (s *sftpStorage) PutObject(_ context.Context, relPath string, r io.Reader) error {
-	fullPath := s.resolvePath(relPath)
+// resolvePath resolves the path under the root dir, paths that escape it are rejected
+func (s *sftpStorage) resolvePath(p string) (string, error) {
+	name, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.root, name), nil
+}
+
+func (s *sftpStorage) PutObject(ctx context.Context, relPath string, r io.Reader) error {
+	return s.PutObjectWithOpts(ctx, relPath, r, nil)
+}
 
+// PutObjectWithOpts uploads the object, metadata and tags are kept in a sidecar file next to it.
+func (s *sftpStorage) PutObjectWithOpts(_ context.Context, relPath string, r io.Reader, opts *PutObjectOpts) error {
+	fullPath, err := s.resolvePath(relPath)
+	if err != nil {
+		return err
+	}
+	if err := s.putAtomic(fullPath, r); err != nil {
+		return err
+	}
+	return s.writeMeta(fullPath, newObjectMeta(opts))
+}
+
+// putAtomic uploads into a hidden temp file next to the target, and moves it into place when the transfer
+// is complete, so readers never observe a partially uploaded object.
+func (s *sftpStorage) putAtomic(fullPath string, r io.Reader) error {
 	// Ensure directory exists
 	dir := path.Dir(fullPath)
-	if err := s.client.MkdirAll(dir); err != nil {
+	if err := s.conn().MkdirAll(dir); err != nil {
 		return fmt.Errorf("mkdir: %w", err)
 	}
 
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	tmpPath := path.Join(dir, tmpFilePrefix+path.Base(fullPath)+"-"+suffix)
+
+	if err := s.upload(tmpPath, r); err != nil {
+		_ = s.conn().Remove(tmpPath)
+		return err
+	}
+
+	if err := s.rename(tmpPath, fullPath); err != nil {
+		_ = s.conn().Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func (s *sftpStorage) upload(remotePath string, r io.Reader) error {
 	// Open file for writing
-	f, err := s.client.Create(fullPath)
+	f, err := s.conn().Create(remotePath)
 	if err != nil {
 		return fmt.Errorf("sftp create: %w", err)
 	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	// Close flushes outstanding writes, the upload is not complete until it succeeds
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("sftp close: %w", err)
+	}
+	return nil
+}
+
+// rename atomically replaces dst when the server supports posix-rename@openssh.com,
+// plain SFTP rename fails on existing targets, so the fallback is remove+rename.
+func (s *sftpStorage) rename(src, dst string) error {
+	if _, ok := s.conn().HasExtension("posix-rename@openssh.com"); ok {
+		if err := s.conn().PosixRename(src, dst); err != nil {
+			return fmt.Errorf("sftp posix-rename: %w", err)
+		}
+		return nil
+	}
+
+	if err := s.conn().Remove(dst); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("sftp remove: %w", err)
+	}
+	if err := s.conn().Rename(src, dst); err != nil {
+		return fmt.Errorf("sftp rename: %w", err)
+	}
+	return nil
+}
+
+// writeMeta replaces the metadata sidecar of the object, nil removes a stale one
+func (s *sftpStorage) writeMeta(fullPath string, meta *objectMeta) error {
+	sidecar := metaSidecarPath(fullPath)
+	if meta == nil {
+		if err := s.conn().Remove(sidecar); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("sftp remove: %w", err)
+		}
+		return nil
+	}
+	r, err := meta.marshal()
+	if err != nil {
+		return err
+	}
+	return s.putAtomic(sidecar, r)
+}
+
+// readMeta loads the metadata sidecar of the object, nil if there is none
+func (s *sftpStorage) readMeta(fullPath string) (*objectMeta, error) {
+	f, err := s.conn().Open(metaSidecarPath(fullPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("sftp open: %w", err)
+	}
 	defer f.Close()
+	return readObjectMeta(f)
+}
 
-	_, err = io.Copy(f, r)
-	return err
+// copyMeta makes the metadata of dst match src
+func (s *sftpStorage) copyMeta(srcPath, dstPath string) error {
+	meta, err := s.readMeta(srcPath)
+	if err != nil {
+		return err
+	}
+	return s.writeMeta(dstPath, meta)
 }
 
 func (s *sftpStorage) ReadObject(_ context.Context, relPath string) (io.ReadCloser, error) {
-	fullPath := s.resolvePath(relPath)
-	f, err := s.client.Open(fullPath)
+	fullPath, err := s.resolvePath(relPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.conn().Open(fullPath)
 	if err != nil {
 		return nil, fmt.Errorf("sftp open: %w", err)
 	}
 	return f, nil
 }
 
+func (s *sftpStorage) ReadObjectRange(_ context.Context, relPath string, offset, length int64) (io.ReadCloser, error) {
+	fullPath, err := s.resolvePath(relPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.conn().Open(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("sftp open: %w", err)
+	}
+	return seekRange(f, offset, length)
+}
+
 func (s *sftpStorage) Exists(_ context.Context, relPath string) (bool, error) {
-	fullPath := s.resolvePath(relPath)
-	info, err := s.client.Stat(fullPath)
+	fullPath, err := s.resolvePath(relPath)
+	if err != nil {
+		return false, err
+	}
+	info, err := s.conn().Stat(fullPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
@@ -87,45 +266,110 @@ func (s *sftpStorage) SHA256(ctx context.Context, relPath string) (string, error
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func (s *sftpStorage) ListAll(_ context.Context, prefix string) ([]string, error) {
-	fullPath := s.fullPath(prefix)
-	var result []string
+func (s *sftpStorage) Stat(_ context.Context, relPath string) (ObjectInfo, error) {
+	name, err := cleanPath(relPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fullPath, err := s.resolvePath(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := s.conn().Stat(fullPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return ObjectInfo{}, &fs.PathError{Op: "stat", Path: relPath, Err: fs.ErrNotExist}
+	}
+	result := ObjectInfo{
+		Path:    name,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
 
-	walker := s.client.Walk(fullPath)
-	for walker.Step() {
-		if err := walker.Err(); err != nil {
-			return nil, fmt.Errorf("error walking directory: %w", err)
-		}
-		stat := walker.Stat()
-		if stat == nil {
-			continue
-		}
-		if stat.IsDir() {
-			continue
+	meta, err := s.readMeta(fullPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if meta != nil {
+		meta.applyTo(&result)
+	}
+	return result, nil
+}
+
+func (s *sftpStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	return collectPaths(s.Walk(ctx, prefix))
+}
+
+func (s *sftpStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return collectInfos(s.Walk(ctx, prefix))
+}
+
+func (s *sftpStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		fullPath, err := s.resolvePath(prefix)
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
 		}
-		if walker.Path() != fullPath {
+
+		walker := s.conn().Walk(fullPath)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				// a missing prefix is an empty listing, as it is on object stores
+				if walker.Path() == fullPath && os.IsNotExist(err) {
+					return
+				}
+				yield(ObjectInfo{}, fmt.Errorf("error walking directory: %w", err))
+				return
+			}
+			if err := ctx.Err(); err != nil {
+				yield(ObjectInfo{}, err)
+				return
+			}
+			stat := walker.Stat()
+			if stat == nil {
+				continue
+			}
+			if stat.IsDir() || isInternalName(walker.Path()) {
+				continue
+			}
+			// the prefix itself is yielded too when it names a single object
 			rel, err := filepath.Rel(s.root, walker.Path())
 			if err != nil {
-				return nil, err
+				yield(ObjectInfo{}, err)
+				return
+			}
+			if !yield(ObjectInfo{
+				Path:    filepath.ToSlash(rel),
+				Size:    stat.Size(),
+				ModTime: stat.ModTime(),
+			}, nil) {
+				return
 			}
-			result = append(result, rel)
 		}
 	}
-
-	return result, nil
 }
 
 func (s *sftpStorage) ListTopLevelDirs(_ context.Context, prefix string) (map[string]bool, error) {
 	result := make(map[string]bool)
+	dir, err := s.resolvePath(prefix)
+	if err != nil {
+		return nil, err
+	}
 
-	entries, err := s.client.ReadDir(prefix)
+	entries, err := s.conn().ReadDir(dir)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
 		return nil, err
 	}
 
 	for _, entry := range entries {
 		if entry.IsDir() {
-			fullPath := filepath.ToSlash(filepath.Join(prefix, entry.Name()))
+			fullPath := path.Join(dir, entry.Name())
 			rel, err := filepath.Rel(s.root, fullPath)
 			if err != nil {
 				return nil, err
@@ -136,6 +380,142 @@ func (s *sftpStorage) ListTopLevelDirs(_ context.Context, prefix string) (map[st
 	return result, nil
 }
 
-func (s *sftpStorage) fullPath(p string) string {
-	return filepath.ToSlash(filepath.Join(s.root, filepath.Clean(p)))
+func (s *sftpStorage) Delete(_ context.Context, relPath string) error {
+	fullPath, err := s.resolvePath(relPath)
+	if err != nil {
+		return err
+	}
+	err = s.conn().Remove(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("sftp remove: %w", err)
+	}
+	return s.writeMeta(fullPath, nil)
+}
+
+func (s *sftpStorage) DeletePrefix(_ context.Context, prefix string) error {
+	fullPath, err := s.resolvePath(prefix)
+	if err != nil {
+		return err
+	}
+
+	// never remove the root dir itself, only its contents
+	if fullPath != path.Join(s.root, "") {
+		if err := s.conn().RemoveAll(fullPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("sftp remove all: %w", err)
+		}
+		return nil
+	}
+
+	entries, err := s.conn().ReadDir(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if err := s.conn().RemoveAll(path.Join(fullPath, entry.Name())); err != nil {
+			return fmt.Errorf("sftp remove all: %w", err)
+		}
+	}
+	return nil
+}
+
+// Copy hardlinks the object when the server supports hardlink@openssh.com, otherwise the content
+// is streamed through the client, since SFTP has no server-side copy.
+func (s *sftpStorage) Copy(ctx context.Context, src, dst string) error {
+	return s.copyThrough(ctx, src, dst, nil)
+}
+
+func (s *sftpStorage) copyThrough(ctx context.Context, src, dst string, wrap func(io.Reader) io.Reader) error {
+	srcPath, err := s.resolvePath(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := s.resolvePath(dst)
+	if err != nil {
+		return err
+	}
+
+	info, err := s.conn().Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return &fs.PathError{Op: "copy", Path: src, Err: fs.ErrNotExist}
+	}
+	if srcPath == dstPath {
+		return nil
+	}
+
+	if _, ok := s.conn().HasExtension("hardlink@openssh.com"); ok {
+		dir := path.Dir(dstPath)
+		if err := s.conn().MkdirAll(dir); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+		suffix, err := randomSuffix()
+		if err != nil {
+			return err
+		}
+		tmpPath := path.Join(dir, tmpFilePrefix+path.Base(dstPath)+"-"+suffix)
+		if err := s.conn().Link(srcPath, tmpPath); err == nil {
+			if err := s.rename(tmpPath, dstPath); err != nil {
+				_ = s.conn().Remove(tmpPath)
+				return err
+			}
+			return s.copyMeta(srcPath, dstPath)
+		}
+	}
+
+	if err := s.copyContent(ctx, src, dstPath, wrap); err != nil {
+		return err
+	}
+	return s.copyMeta(srcPath, dstPath)
+}
+
+func (s *sftpStorage) copyContent(ctx context.Context, src, dstPath string, wrap func(io.Reader) io.Reader) error {
+	rc, err := s.ReadObject(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if wrap != nil {
+		r = wrap(r)
+	}
+	return s.putAtomic(dstPath, r)
+}
+
+func (s *sftpStorage) Rename(_ context.Context, src, dst string) error {
+	srcPath, err := s.resolvePath(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := s.resolvePath(dst)
+	if err != nil {
+		return err
+	}
+
+	info, err := s.conn().Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return &fs.PathError{Op: "rename", Path: src, Err: fs.ErrNotExist}
+	}
+	if srcPath == dstPath {
+		return nil
+	}
+
+	if err := s.conn().MkdirAll(path.Dir(dstPath)); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+	if err := s.rename(srcPath, dstPath); err != nil {
+		return err
+	}
+
+	if err := s.copyMeta(srcPath, dstPath); err != nil {
+		return err
+	}
+	return s.writeMeta(srcPath, nil)
 }
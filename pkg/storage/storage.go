@@ -1,20 +1,274 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"iter"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+const (
+	// tmpFilePrefix marks in-flight uploads of file based backends, such files are never listed
+	tmpFilePrefix = ".xrepo-tmp-"
+
+	// metaFilePrefix marks metadata sidecars of file based backends, such files are never listed
+	metaFilePrefix = ".xrepo-meta-"
+)
+
+// ErrPathEscapesRoot is the error of paths and prefixes that resolve above the storage root, i.e. "../other"
+var ErrPathEscapesRoot = errors.New("path escapes the storage root")
+
+// ObjectInfo describes a stored object without reading its content
+type ObjectInfo struct {
+	// Path is relative to the storage root, in the same form ListAll returns it
+	Path    string
+	Size    int64
+	ModTime time.Time
+
+	// ETag and VersionID are set only by backends that have them (e.g. S3)
+	ETag      string
+	VersionID string
+
+	// Checksum is a storage-side checksum in the form "<algorithm>:<value>", if the backend keeps one
+	Checksum string
+
+	// Metadata and Tags are filled by Stat only, listings leave them empty
+	Metadata map[string]string
+	Tags     map[string]string
+}
+
+// PutObjectOpts holds optional attributes of the stored object.
+//
+// Keys are case-insensitive and are returned lowercased (the way S3 does it).
+// S3 maps them to user metadata and object tags, file based backends keep them in a sidecar file.
+type PutObjectOpts struct {
+	Metadata map[string]string
+	Tags     map[string]string
+}
+
+// Storage keeps objects under slash-separated paths relative to its root.
+// Paths and prefixes that resolve above the root are rejected with ErrPathEscapesRoot.
+//
+// Backends that have real directories (local, sftp, webdav, ftp) behave like object stores:
+// directories are not objects, empty ones are never listed, and a missing prefix lists nothing.
+// Package storagetest checks an implementation against this contract.
 type Storage interface {
 	PutObject(ctx context.Context, path string, r io.Reader) error
 
+	// PutObjectWithOpts works like PutObject, and attaches metadata and tags to the object
+	PutObjectWithOpts(ctx context.Context, path string, r io.Reader, opts *PutObjectOpts) error
+
+	// ReadObject streams the object, the error satisfies errors.Is(err, fs.ErrNotExist) for missing objects
 	ReadObject(ctx context.Context, path string) (io.ReadCloser, error)
 
+	// ReadObjectRange streams length bytes starting at offset, a negative length reads up to the end.
+	// A range past the end of the object yields fewer (or zero) bytes, it's not an error.
+	ReadObjectRange(ctx context.Context, path string, offset, length int64) (io.ReadCloser, error)
+
+	// Exists reports whether an object is stored under the path, it's false for directories
 	Exists(ctx context.Context, path string) (bool, error)
 
+	// Stat returns object metadata, the error satisfies errors.Is(err, fs.ErrNotExist) for missing objects
+	Stat(ctx context.Context, path string) (ObjectInfo, error)
+
 	SHA256(ctx context.Context, path string) (string, error)
 
+	// ListAll returns paths (in the form PutObject takes them) of all objects under the prefix, at any depth
 	ListAll(ctx context.Context, prefix string) ([]string, error)
 
+	// ListAllInfo works like ListAll, but returns object metadata instead of bare names
+	ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error)
+
+	// Walk streams the same entries as ListAllInfo while they are fetched, without materializing the listing.
+	// Iteration stops at the first error (yielded as the last element), or when the consumer breaks.
+	Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error]
+
+	// ListTopLevelDirs returns the directories directly under prefix (a dir relative to the storage root),
+	// keys are relative to the storage root too, e.g. "base/20250101" for the prefix "base".
 	ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error)
+
+	// Delete removes a single object, deleting a missing object is not an error
+	Delete(ctx context.Context, path string) error
+
+	// DeletePrefix removes all objects that ListAll would return for the same prefix
+	DeletePrefix(ctx context.Context, prefix string) error
+
+	// Copy duplicates an object server-side where the backend allows it, an existing dst is replaced
+	Copy(ctx context.Context, src, dst string) error
+
+	// Rename moves an object server-side where the backend allows it, an existing dst is replaced
+	Rename(ctx context.Context, src, dst string) error
+}
+
+// collectInfos materializes the walk, backends implement ListAllInfo through it
+func collectInfos(seq iter.Seq2[ObjectInfo, error]) ([]ObjectInfo, error) {
+	var result []ObjectInfo
+	for info, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// collectPaths materializes names of the walk, backends implement ListAll through it
+func collectPaths(seq iter.Seq2[ObjectInfo, error]) ([]string, error) {
+	var result []string
+	for info, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info.Path)
+	}
+	return result, nil
+}
+
+// cleanPath resolves the path (or prefix) to a clean slash-separated path relative to the storage root,
+// "" is the root itself. Paths that climb above the root are rejected, so that no backend ever
+// reads or removes anything outside of it.
+func cleanPath(p string) (string, error) {
+	name := path.Clean(strings.TrimLeft(filepath.ToSlash(p), "/"))
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", &fs.PathError{Op: "resolve", Path: p, Err: ErrPathEscapesRoot}
+	}
+	if name == "." {
+		return "", nil
+	}
+	return name, nil
+}
+
+// samePath reports whether both paths resolve to the same object, copying or renaming an object onto itself
+// is a no-op (it must not remove the object, as the delete of the source in copy+delete renames would)
+func samePath(src, dst string) (bool, error) {
+	srcName, err := cleanPath(src)
+	if err != nil {
+		return false, err
+	}
+	dstName, err := cleanPath(dst)
+	if err != nil {
+		return false, err
+	}
+	return srcName == dstName, nil
+}
+
+// matchesKeyPrefix reports whether the key is under the key prefix by whole path segments, the way
+// directory backends treat prefixes: "a/b" matches the object "a/b" and "a/b/c", but not "a/bc".
+// Object stores list by raw key prefix, so their listings are filtered through it.
+func matchesKeyPrefix(key, keyPrefix string) bool {
+	if keyPrefix == "" || strings.HasSuffix(keyPrefix, "/") {
+		return strings.HasPrefix(key, keyPrefix)
+	}
+	return key == keyPrefix || strings.HasPrefix(key, keyPrefix+"/")
+}
+
+// isTempName reports whether the path points to an in-flight upload
+func isTempName(p string) bool {
+	return strings.HasPrefix(path.Base(p), tmpFilePrefix)
+}
+
+// isInternalName reports whether the path points to a file that is not an object by itself
+func isInternalName(p string) bool {
+	base := path.Base(p)
+	return strings.HasPrefix(base, tmpFilePrefix) || strings.HasPrefix(base, metaFilePrefix)
+}
+
+// objectMeta is the content of the metadata sidecar
+type objectMeta struct {
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// metaSidecarPath resolves the sidecar name of the object (slash-separated path)
+func metaSidecarPath(p string) string {
+	return path.Join(path.Dir(p), metaFilePrefix+path.Base(p)+".json")
+}
+
+// newObjectMeta normalizes the options, nil means there is nothing to store
+func newObjectMeta(opts *PutObjectOpts) *objectMeta {
+	if opts == nil || (len(opts.Metadata) == 0 && len(opts.Tags) == 0) {
+		return nil
+	}
+	return &objectMeta{
+		Metadata: lowerKeys(opts.Metadata),
+		Tags:     lowerKeys(opts.Tags),
+	}
+}
+
+func lowerKeys(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		result[strings.ToLower(k)] = v
+	}
+	return result
+}
+
+func (m *objectMeta) marshal() (io.Reader, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (m *objectMeta) applyTo(info *ObjectInfo) {
+	info.Metadata = m.Metadata
+	info.Tags = m.Tags
+}
+
+func readObjectMeta(r io.Reader) (*objectMeta, error) {
+	var m objectMeta
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("cannot decode object metadata: %w", err)
+	}
+	return &m, nil
+}
+
+// randomSuffix makes temp names unique among concurrent writers of the same object
+func randomSuffix() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// rangeReadCloser limits the reader to the requested range, and closes the underlying object
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// newRangeReadCloser wraps an object already positioned at the range start
+func newRangeReadCloser(rc io.ReadCloser, length int64) io.ReadCloser {
+	if length < 0 {
+		return rc
+	}
+	return &rangeReadCloser{Reader: io.LimitReader(rc, length), Closer: rc}
+}
+
+// seekRange positions a seekable object at offset and limits it to length
+func seekRange(f io.ReadSeekCloser, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		_ = f.Close()
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return newRangeReadCloser(f, length), nil
 }
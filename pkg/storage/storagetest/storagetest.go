@@ -0,0 +1,472 @@
+// Package storagetest checks storage.Storage implementations against the behavior
+// the rest of the code relies on, so that backends stay interchangeable.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	"github.com/hashmap-kz/xrepo/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// largeObjectSize spans several parts of multipart/resumable uploads of the cloud backends
+const largeObjectSize = 17 << 20
+
+// emptySHA256 is the digest of zero bytes
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Run runs the whole contract as subtests of t.
+//
+// newStorage is called once per subtest, and must return a storage with no objects in it
+// (e.g. over a fresh temp dir, or a unique prefix of a bucket), cleanup is up to the caller.
+func Run(t *testing.T, newStorage func(t *testing.T) storage.Storage) {
+	t.Helper()
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Storage)
+	}{
+		{"RoundTrip", testRoundTrip},
+		{"NestedListing", testNestedListing},
+		{"SiblingPrefixes", testSiblingPrefixes},
+		{"MissingObjects", testMissingObjects},
+		{"Overwrite", testOverwrite},
+		{"MoveOntoItself", testMoveOntoItself},
+		{"EmptyObject", testEmptyObject},
+		{"UnicodeNames", testUnicodeNames},
+		{"LargeStream", testLargeStream},
+		{"PathEscape", testPathEscape},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStorage(t))
+		})
+	}
+}
+
+func testRoundTrip(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	content := []byte("hello, storage!")
+
+	require.NoError(t, s.PutObject(ctx, "roundtrip/obj.txt", bytes.NewReader(content)))
+
+	assert.Equal(t, content, readObject(t, s, "roundtrip/obj.txt"))
+	assert.Equal(t, content[7:14], readRange(t, s, "roundtrip/obj.txt", 7, 7))
+	assert.Equal(t, content[7:], readRange(t, s, "roundtrip/obj.txt", 7, -1))
+	assert.Empty(t, readRange(t, s, "roundtrip/obj.txt", 100, 10))
+
+	exists, err := s.Exists(ctx, "roundtrip/obj.txt")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	info, err := s.Stat(ctx, "roundtrip/obj.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "roundtrip/obj.txt", info.Path)
+	assert.Equal(t, int64(len(content)), info.Size)
+
+	sum, err := s.SHA256(ctx, "roundtrip/obj.txt")
+	require.NoError(t, err)
+	assert.Equal(t, sha256Hex(content), sum)
+
+	opts := &storage.PutObjectOpts{
+		Metadata: map[string]string{"Source-Host": "pg-01"},
+		Tags:     map[string]string{"kind": "wal"},
+	}
+	require.NoError(t, s.PutObjectWithOpts(ctx, "roundtrip/meta.txt", bytes.NewReader(content), opts))
+	info, err = s.Stat(ctx, "roundtrip/meta.txt")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"source-host": "pg-01"}, info.Metadata)
+	assert.Equal(t, map[string]string{"kind": "wal"}, info.Tags)
+
+	require.NoError(t, s.Copy(ctx, "roundtrip/meta.txt", "roundtrip/copy.txt"))
+	require.NoError(t, s.Rename(ctx, "roundtrip/copy.txt", "moved/obj.txt"))
+	assert.Equal(t, content, readObject(t, s, "moved/obj.txt"))
+	info, err = s.Stat(ctx, "moved/obj.txt")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"source-host": "pg-01"}, info.Metadata)
+
+	assertObjects(t, s, "", "moved/obj.txt", "roundtrip/meta.txt", "roundtrip/obj.txt")
+
+	require.NoError(t, s.Delete(ctx, "roundtrip/obj.txt"))
+	exists, err = s.Exists(ctx, "roundtrip/obj.txt")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func testNestedListing(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	for _, p := range []string{
+		"base/20250101/data/1",
+		"base/20250101/data/2",
+		"base/20250101/manifest.json",
+		"base/20250102/data/1",
+		"wal/000000010000000000000001",
+		"root.txt",
+	} {
+		require.NoError(t, s.PutObject(ctx, p, strings.NewReader(p)))
+	}
+
+	assertObjects(t, s, "",
+		"base/20250101/data/1",
+		"base/20250101/data/2",
+		"base/20250101/manifest.json",
+		"base/20250102/data/1",
+		"root.txt",
+		"wal/000000010000000000000001",
+	)
+	assertObjects(t, s, "base/",
+		"base/20250101/data/1",
+		"base/20250101/data/2",
+		"base/20250101/manifest.json",
+		"base/20250102/data/1",
+	)
+	assertObjects(t, s, "base/20250101/data", "base/20250101/data/1", "base/20250101/data/2")
+
+	// a prefix naming a single object lists just that object
+	assertObjects(t, s, "base/20250101/manifest.json", "base/20250101/manifest.json")
+
+	infos, err := s.ListAllInfo(ctx, "base/20250102/")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, "base/20250102/data/1", infos[0].Path)
+	assert.Equal(t, int64(len("base/20250102/data/1")), infos[0].Size)
+
+	// the consumer may stop the walk early
+	walked := 0
+	for _, err := range s.Walk(ctx, "") {
+		require.NoError(t, err)
+		walked++
+		break
+	}
+	assert.Equal(t, 1, walked)
+
+	dirs, err := s.ListTopLevelDirs(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"base": true, "wal": true}, dirs)
+
+	dirs, err = s.ListTopLevelDirs(ctx, "base")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"base/20250101": true, "base/20250102": true}, dirs)
+
+	dirs, err = s.ListTopLevelDirs(ctx, "base/20250101/data")
+	require.NoError(t, err)
+	assert.Empty(t, dirs)
+
+	// directories are not objects
+	exists, err := s.Exists(ctx, "base/20250101")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	_, err = s.Stat(ctx, "base/20250101")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, s.DeletePrefix(ctx, "base/20250101/"))
+	assertObjects(t, s, "", "base/20250102/data/1", "root.txt", "wal/000000010000000000000001")
+
+	require.NoError(t, s.DeletePrefix(ctx, ""))
+	assertObjects(t, s, "")
+}
+
+// testSiblingPrefixes checks that prefixes match whole path segments on every backend,
+// object stores list by raw key prefix, where "base" would also match "basement/..."
+func testSiblingPrefixes(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	for _, p := range []string{
+		"base/20250101/obj",
+		"base/obj",
+		"base.txt",
+		"basement/20250101/obj",
+	} {
+		require.NoError(t, s.PutObject(ctx, p, strings.NewReader(p)))
+	}
+
+	assertObjects(t, s, "base", "base/20250101/obj", "base/obj")
+	assertObjects(t, s, "base/", "base/20250101/obj", "base/obj")
+	assertObjects(t, s, "bas")
+	assertObjects(t, s, "base.txt", "base.txt")
+
+	var walked []string
+	for info, err := range s.Walk(ctx, "base") {
+		require.NoError(t, err)
+		walked = append(walked, info.Path)
+	}
+	assert.ElementsMatch(t, []string{"base/20250101/obj", "base/obj"}, walked)
+
+	dirs, err := s.ListTopLevelDirs(ctx, "base")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"base/20250101": true}, dirs)
+
+	dirs, err = s.ListTopLevelDirs(ctx, "bas")
+	require.NoError(t, err)
+	assert.Empty(t, dirs)
+
+	// a prefix climbing out of the root and back in is rejected, it removes nothing
+	assert.ErrorIs(t, s.DeletePrefix(ctx, "../base"), storage.ErrPathEscapesRoot)
+	assert.ErrorIs(t, s.DeletePrefix(ctx, "base/../.."), storage.ErrPathEscapesRoot)
+	assertObjects(t, s, "", "base/20250101/obj", "base/obj", "base.txt", "basement/20250101/obj")
+
+	require.NoError(t, s.DeletePrefix(ctx, "bas"))
+	require.NoError(t, s.DeletePrefix(ctx, "base"))
+	assertObjects(t, s, "", "base.txt", "basement/20250101/obj")
+}
+
+func testMissingObjects(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, s.PutObject(ctx, "present/obj", strings.NewReader("x")))
+
+	_, err := s.ReadObject(ctx, "present/missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = s.ReadObjectRange(ctx, "present/missing", 0, 1)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = s.Stat(ctx, "present/missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = s.SHA256(ctx, "present/missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	exists, err := s.Exists(ctx, "present/missing")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.ErrorIs(t, s.Copy(ctx, "present/missing", "present/copy"), fs.ErrNotExist)
+	assert.ErrorIs(t, s.Rename(ctx, "present/missing", "present/moved"), fs.ErrNotExist)
+
+	assert.NoError(t, s.Delete(ctx, "present/missing"))
+	assert.NoError(t, s.Delete(ctx, "missing/obj"))
+	assert.NoError(t, s.DeletePrefix(ctx, "missing/"))
+
+	assertObjects(t, s, "missing/")
+	assertObjects(t, s, "present/missing")
+
+	dirs, err := s.ListTopLevelDirs(ctx, "missing")
+	require.NoError(t, err)
+	assert.Empty(t, dirs)
+
+	// nothing above touched the existing object
+	assertObjects(t, s, "", "present/obj")
+}
+
+func testOverwrite(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	opts := &storage.PutObjectOpts{Metadata: map[string]string{"version": "1"}}
+
+	require.NoError(t, s.PutObjectWithOpts(ctx, "obj", strings.NewReader("the first, longer version"), opts))
+	require.NoError(t, s.PutObject(ctx, "obj", strings.NewReader("second")))
+
+	assert.Equal(t, []byte("second"), readObject(t, s, "obj"))
+	info, err := s.Stat(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("second")), info.Size)
+	// the metadata belongs to the replaced version
+	assert.Empty(t, info.Metadata)
+	assertObjects(t, s, "", "obj")
+
+	require.NoError(t, s.PutObject(ctx, "copy/dst", strings.NewReader("stale copy target")))
+	require.NoError(t, s.Copy(ctx, "obj", "copy/dst"))
+	assert.Equal(t, []byte("second"), readObject(t, s, "copy/dst"))
+
+	require.NoError(t, s.PutObject(ctx, "rename/dst", strings.NewReader("stale rename target")))
+	require.NoError(t, s.Rename(ctx, "copy/dst", "rename/dst"))
+	assert.Equal(t, []byte("second"), readObject(t, s, "rename/dst"))
+
+	assertObjects(t, s, "", "obj", "rename/dst")
+}
+
+func testMoveOntoItself(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	opts := &storage.PutObjectOpts{
+		Metadata: map[string]string{"origin": "primary"},
+		Tags:     map[string]string{"retention": "30d"},
+	}
+	require.NoError(t, s.PutObjectWithOpts(ctx, "dir/obj", strings.NewReader("content"), opts))
+
+	// the same object, however it's spelled
+	require.NoError(t, s.Copy(ctx, "dir/obj", "dir/obj"))
+	require.NoError(t, s.Rename(ctx, "dir/obj", "/dir/./obj"))
+
+	assert.Equal(t, []byte("content"), readObject(t, s, "dir/obj"))
+	info, err := s.Stat(ctx, "dir/obj")
+	require.NoError(t, err)
+	assert.Equal(t, "primary", info.Metadata["origin"])
+	assert.Equal(t, "30d", info.Tags["retention"])
+	assertObjects(t, s, "", "dir/obj")
+
+	err = s.Rename(ctx, "dir/missing", "dir/missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func testEmptyObject(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	require.NoError(t, s.PutObject(ctx, "empty/obj", bytes.NewReader(nil)))
+
+	exists, err := s.Exists(ctx, "empty/obj")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	assert.Empty(t, readObject(t, s, "empty/obj"))
+	assert.Empty(t, readRange(t, s, "empty/obj", 0, -1))
+
+	info, err := s.Stat(ctx, "empty/obj")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size)
+
+	sum, err := s.SHA256(ctx, "empty/obj")
+	require.NoError(t, err)
+	assert.Equal(t, emptySHA256, sum)
+
+	require.NoError(t, s.Copy(ctx, "empty/obj", "empty/copy"))
+	assert.Empty(t, readObject(t, s, "empty/copy"))
+
+	infos, err := s.ListAllInfo(ctx, "empty/")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	for _, info := range infos {
+		assert.Equal(t, int64(0), info.Size, info.Path)
+	}
+}
+
+func testUnicodeNames(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	names := []string{
+		"unicode/données/résumé.txt",
+		"unicode/日本語/ファイル.txt",
+		"unicode/with space/a+b=c.txt",
+	}
+	for _, name := range names {
+		require.NoError(t, s.PutObject(ctx, name, strings.NewReader(name)))
+	}
+
+	assertObjects(t, s, "unicode/", names...)
+	for _, name := range names {
+		assert.Equal(t, []byte(name), readObject(t, s, name))
+
+		info, err := s.Stat(ctx, name)
+		require.NoError(t, err)
+		assert.Equal(t, name, info.Path)
+	}
+
+	dirs, err := s.ListTopLevelDirs(ctx, "unicode")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		"unicode/données":    true,
+		"unicode/日本語":        true,
+		"unicode/with space": true,
+	}, dirs)
+
+	require.NoError(t, s.Rename(ctx, names[0], "unicode/日本語/résumé.txt"))
+	assertObjects(t, s, "unicode/日本語/", "unicode/日本語/ファイル.txt", "unicode/日本語/résumé.txt")
+
+	require.NoError(t, s.DeletePrefix(ctx, "unicode/with space/"))
+	assertObjects(t, s, "", "unicode/日本語/ファイル.txt", "unicode/日本語/résumé.txt")
+}
+
+func testLargeStream(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	// the source is neither seekable nor sized, so the backend has to stream it
+	src := rand.NewChaCha8([32]byte{1})
+	h := sha256.New()
+	body := struct{ io.Reader }{io.TeeReader(io.LimitReader(src, largeObjectSize), h)}
+	require.NoError(t, s.PutObject(ctx, "large/obj", body))
+	want := hex.EncodeToString(h.Sum(nil))
+
+	info, err := s.Stat(ctx, "large/obj")
+	require.NoError(t, err)
+	assert.Equal(t, int64(largeObjectSize), info.Size)
+
+	sum, err := s.SHA256(ctx, "large/obj")
+	require.NoError(t, err)
+	assert.Equal(t, want, sum)
+
+	rc, err := s.ReadObject(ctx, "large/obj")
+	require.NoError(t, err)
+	h.Reset()
+	n, err := io.Copy(h, rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, int64(largeObjectSize), n)
+	assert.Equal(t, want, hex.EncodeToString(h.Sum(nil)))
+
+	// a range crossing the middle of the object matches the generated content
+	const offset, length = largeObjectSize/2 - 1000, 5000
+	expected := make([]byte, offset+length)
+	_, err = io.ReadFull(rand.NewChaCha8([32]byte{1}), expected)
+	require.NoError(t, err)
+	assert.Equal(t, expected[offset:], readRange(t, s, "large/obj", offset, length))
+}
+
+func testPathEscape(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, s.PutObject(ctx, "inside/obj", strings.NewReader("x")))
+
+	for _, p := range []string{"..", "../", "../other", "inside/../../other", "/../other"} {
+		assert.ErrorIs(t, s.PutObject(ctx, p, strings.NewReader("y")), storage.ErrPathEscapesRoot, p)
+		_, err := s.ReadObject(ctx, p)
+		assert.ErrorIs(t, err, storage.ErrPathEscapesRoot, p)
+		_, err = s.ReadObjectRange(ctx, p, 0, 1)
+		assert.ErrorIs(t, err, storage.ErrPathEscapesRoot, p)
+		_, err = s.Exists(ctx, p)
+		assert.ErrorIs(t, err, storage.ErrPathEscapesRoot, p)
+		_, err = s.Stat(ctx, p)
+		assert.ErrorIs(t, err, storage.ErrPathEscapesRoot, p)
+		_, err = s.ListAll(ctx, p)
+		assert.ErrorIs(t, err, storage.ErrPathEscapesRoot, p)
+		_, err = s.ListTopLevelDirs(ctx, p)
+		assert.ErrorIs(t, err, storage.ErrPathEscapesRoot, p)
+		assert.ErrorIs(t, s.Delete(ctx, p), storage.ErrPathEscapesRoot, p)
+		assert.ErrorIs(t, s.DeletePrefix(ctx, p), storage.ErrPathEscapesRoot, p)
+		assert.ErrorIs(t, s.Copy(ctx, "inside/obj", p), storage.ErrPathEscapesRoot, p)
+		assert.ErrorIs(t, s.Rename(ctx, "inside/obj", p), storage.ErrPathEscapesRoot, p)
+	}
+
+	// dot segments that stay under the root are fine
+	assert.Equal(t, []byte("x"), readObject(t, s, "other/../inside/obj"))
+	assertObjects(t, s, "", "inside/obj")
+}
+
+// assertObjects checks that ListAll(prefix) returns exactly the expected paths, in any order
+func assertObjects(t *testing.T, s storage.Storage, prefix string, expected ...string) {
+	t.Helper()
+	files, err := s.ListAll(context.Background(), prefix)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, expected, files, "prefix %q", prefix)
+}
+
+func readObject(t *testing.T, s storage.Storage, p string) []byte {
+	t.Helper()
+	rc, err := s.ReadObject(context.Background(), p)
+	require.NoError(t, err)
+	return readAndClose(t, rc)
+}
+
+func readRange(t *testing.T, s storage.Storage, p string, offset, length int64) []byte {
+	t.Helper()
+	rc, err := s.ReadObjectRange(context.Background(), p, offset, length)
+	require.NoError(t, err)
+	return readAndClose(t, rc)
+}
+
+func readAndClose(t *testing.T, rc io.ReadCloser) []byte {
+	t.Helper()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	return data
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ThrottleOpts configures the bandwidth limits, a zero limit leaves that direction unlimited
+type ThrottleOpts struct {
+	UploadBytesPerSec   int64
+	DownloadBytesPerSec int64
+
+	// Schedule restricts the limits to the given time-of-day windows (local time),
+	// the limits apply all the time when it's empty
+	Schedule []TimeWindow
+}
+
+// TimeWindow is a daily period, as offsets from midnight. A window with End before Start spans midnight.
+type TimeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+func (w TimeWindow) contains(t time.Time) bool {
+	h, m, s := t.Clock()
+	at := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if w.Start <= w.End {
+		return at >= w.Start && at < w.End
+	}
+	return at >= w.Start || at < w.End
+}
+
+// ParseTimeWindows parses a comma-separated list of "HH:MM-HH:MM" windows, e.g. "08:00-12:00,13:00-18:00"
+func ParseTimeWindows(spec string) ([]TimeWindow, error) {
+	var result []TimeWindow
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid time window %q, expected HH:MM-HH:MM", part)
+		}
+		w := TimeWindow{}
+		var err error
+		if w.Start, err = parseClock(start); err != nil {
+			return nil, fmt.Errorf("invalid time window %q: %w", part, err)
+		}
+		if w.End, err = parseClock(end); err != nil {
+			return nil, fmt.Errorf("invalid time window %q: %w", part, err)
+		}
+		result = append(result, w)
+	}
+	return result, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+type throttleStorage struct {
+	s        Storage
+	upload   *rate.Limiter
+	download *rate.Limiter
+	schedule []TimeWindow
+	now      func() time.Time
+}
+
+var _ Storage = &throttleStorage{}
+
+// localHasher is implemented by backends that hash objects without transferring them (i.e. local files)
+type localHasher interface {
+	hashesLocally()
+}
+
+// clientCopier is implemented by backends that may copy objects by streaming them through the client
+// (ftp, sftp without hardlinks), the content passes through wrap, so that such copies can be limited
+type clientCopier interface {
+	copyThrough(ctx context.Context, src, dst string, wrap func(io.Reader) io.Reader) error
+}
+
+// NewThrottleStorage limits the bandwidth of uploads and downloads.
+//
+// Limits are shared by all the concurrent transfers of the storage, so a single instance has to be used
+// by all the workers. SHA256 of remote backends downloads the object, so it's limited like a download,
+// and copies streamed through the client are limited in both directions. Operations that move content
+// server-side (Copy of object stores, Rename) are not limited.
+func NewThrottleStorage(s Storage, o *ThrottleOpts) Storage {
+	return &throttleStorage{
+		s:        s,
+		upload:   newBandwidthLimiter(o.UploadBytesPerSec),
+		download: newBandwidthLimiter(o.DownloadBytesPerSec),
+		schedule: o.Schedule,
+		now:      time.Now,
+	}
+}
+
+// newBandwidthLimiter allows bursts of a second worth of bytes, nil is unlimited
+func newBandwidthLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec))
+}
+
+// active reports whether the limits apply now
+func (t *throttleStorage) active() bool {
+	if len(t.schedule) == 0 {
+		return true
+	}
+	now := t.now()
+	for _, w := range t.schedule {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *throttleStorage) isRetryable(err error) bool {
+	return isRetryableBy(t.s, err)
+}
+
+// throttledReader waits for the tokens of every chunk it reads, chunks never exceed the burst of the limiter
+type throttledReader struct {
+	ctx     context.Context
+	t       *throttleStorage
+	limiter *rate.Limiter
+	r       io.Reader
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if !tr.t.active() {
+		return tr.r.Read(p)
+	}
+	if burst := tr.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if werr := tr.limiter.WaitN(tr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type throttledReadCloser struct {
+	throttledReader
+	c io.Closer
+}
+
+func (trc *throttledReadCloser) Close() error {
+	return trc.c.Close()
+}
+
+func (t *throttleStorage) limitDownload(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if t.download == nil {
+		return rc
+	}
+	return &throttledReadCloser{
+		throttledReader: throttledReader{ctx: ctx, t: t, limiter: t.download, r: rc},
+		c:               rc,
+	}
+}
+
+func (t *throttleStorage) PutObject(ctx context.Context, p string, r io.Reader) error {
+	return t.PutObjectWithOpts(ctx, p, r, nil)
+}
+
+func (t *throttleStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	if t.upload != nil {
+		r = &throttledReader{ctx: ctx, t: t, limiter: t.upload, r: r}
+	}
+	return t.s.PutObjectWithOpts(ctx, p, r, opts)
+}
+
+func (t *throttleStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	rc, err := t.s.ReadObject(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return t.limitDownload(ctx, rc), nil
+}
+
+func (t *throttleStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	rc, err := t.s.ReadObjectRange(ctx, p, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return t.limitDownload(ctx, rc), nil
+}
+
+func (t *throttleStorage) Exists(ctx context.Context, p string) (bool, error) {
+	return t.s.Exists(ctx, p)
+}
+
+func (t *throttleStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	return t.s.Stat(ctx, p)
+}
+
+func (t *throttleStorage) SHA256(ctx context.Context, p string) (string, error) {
+	if _, ok := t.s.(localHasher); ok || t.download == nil {
+		return t.s.SHA256(ctx, p)
+	}
+	rc, err := t.ReadObject(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (t *throttleStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	return t.s.ListAll(ctx, prefix)
+}
+
+func (t *throttleStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return t.s.ListAllInfo(ctx, prefix)
+}
+
+func (t *throttleStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return t.s.Walk(ctx, prefix)
+}
+
+func (t *throttleStorage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	return t.s.ListTopLevelDirs(ctx, prefix)
+}
+
+func (t *throttleStorage) Delete(ctx context.Context, p string) error {
+	return t.s.Delete(ctx, p)
+}
+
+func (t *throttleStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	return t.s.DeletePrefix(ctx, prefix)
+}
+
+func (t *throttleStorage) Copy(ctx context.Context, src, dst string) error {
+	c, ok := t.s.(clientCopier)
+	if !ok || (t.upload == nil && t.download == nil) {
+		return t.s.Copy(ctx, src, dst)
+	}
+	return c.copyThrough(ctx, src, dst, func(r io.Reader) io.Reader {
+		for _, limiter := range []*rate.Limiter{t.download, t.upload} {
+			if limiter != nil {
+				r = &throttledReader{ctx: ctx, t: t, limiter: limiter, r: r}
+			}
+		}
+		return r
+	})
+}
+
+func (t *throttleStorage) Rename(ctx context.Context, src, dst string) error {
+	return t.s.Rename(ctx, src, dst)
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const throttleTestRate = 64 * 1024
+
+func TestThrottleStorage_LimitsUploadsAndDownloads(t *testing.T) {
+	s := NewThrottleStorage(NewMemoryStorage(), &ThrottleOpts{
+		UploadBytesPerSec:   throttleTestRate,
+		DownloadBytesPerSec: throttleTestRate,
+	})
+	ctx := context.Background()
+
+	// the first second worth of bytes is the burst, the rest takes half a second
+	content := bytes.Repeat([]byte("x"), throttleTestRate*3/2)
+
+	start := time.Now()
+	require.NoError(t, s.PutObject(ctx, "obj", bytes.NewReader(content)))
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	start = time.Now()
+	rc, err := s.ReadObject(ctx, "obj")
+	require.NoError(t, err)
+	assert.Equal(t, content, readAll(t, rc))
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestThrottleStorage_LimitIsSharedByWorkers(t *testing.T) {
+	s := NewThrottleStorage(NewMemoryStorage(), &ThrottleOpts{UploadBytesPerSec: throttleTestRate})
+	ctx := context.Background()
+
+	// each worker alone fits into the burst, together they don't
+	content := bytes.Repeat([]byte("x"), throttleTestRate*3/4)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, p := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.PutObject(ctx, p, bytes.NewReader(content)))
+		}()
+	}
+	wg.Wait()
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+// remoteStorage hides the local hashing of the wrapped storage, the way remote backends hash
+type remoteStorage struct {
+	Storage
+}
+
+func TestThrottleStorage_LimitsRemoteHashing(t *testing.T) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("x"), throttleTestRate*3/2)
+
+	remote := NewThrottleStorage(&remoteStorage{Storage: NewMemoryStorage()}, &ThrottleOpts{DownloadBytesPerSec: throttleTestRate})
+	require.NoError(t, remote.PutObject(ctx, "obj", bytes.NewReader(content)))
+	start := time.Now()
+	sum, err := remote.SHA256(ctx, "obj")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	local := NewThrottleStorage(NewMemoryStorage(), &ThrottleOpts{DownloadBytesPerSec: throttleTestRate})
+	require.NoError(t, local.PutObject(ctx, "obj", bytes.NewReader(content)))
+	start = time.Now()
+	localSum, err := local.SHA256(ctx, "obj")
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+	assert.Equal(t, localSum, sum)
+}
+
+func TestThrottleStorage_LimitsCopiesThroughClient(t *testing.T) {
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("x"), throttleTestRate*3/2)
+	backend := newFTPTestStorage(t, "")
+	require.NoError(t, backend.PutObject(ctx, "obj", bytes.NewReader(content)))
+
+	s := NewThrottleStorage(backend, &ThrottleOpts{DownloadBytesPerSec: throttleTestRate})
+	start := time.Now()
+	require.NoError(t, s.Copy(ctx, "obj", "copy"))
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	rc, err := backend.ReadObject(ctx, "copy")
+	require.NoError(t, err)
+	assert.Equal(t, content, readAll(t, rc))
+}
+
+func TestThrottleStorage_Schedule(t *testing.T) {
+	schedule, err := ParseTimeWindows("08:00-18:00")
+	require.NoError(t, err)
+
+	s := NewThrottleStorage(NewMemoryStorage(), &ThrottleOpts{
+		UploadBytesPerSec: throttleTestRate,
+		Schedule:          schedule,
+	})
+	clock := time.Date(2025, 1, 1, 20, 0, 0, 0, time.Local)
+	s.(*throttleStorage).now = func() time.Time { return clock }
+	ctx := context.Background()
+
+	// out of business hours nothing is limited
+	content := bytes.Repeat([]byte("x"), throttleTestRate*4)
+	start := time.Now()
+	require.NoError(t, s.PutObject(ctx, "obj", bytes.NewReader(content)))
+	assert.Less(t, time.Since(start), 400*time.Millisecond)
+
+	clock = time.Date(2025, 1, 1, 9, 30, 0, 0, time.Local)
+	start = time.Now()
+	require.NoError(t, s.PutObject(ctx, "obj", bytes.NewReader(content[:throttleTestRate*3/2])))
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestThrottleStorage_CanceledContext(t *testing.T) {
+	s := NewThrottleStorage(NewMemoryStorage(), &ThrottleOpts{UploadBytesPerSec: 1024})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.PutObject(ctx, "obj", bytes.NewReader(make([]byte, 4096)))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestParseTimeWindows(t *testing.T) {
+	windows, err := ParseTimeWindows("08:00-12:30, 22:00-06:00")
+	require.NoError(t, err)
+	assert.Equal(t, []TimeWindow{
+		{Start: 8 * time.Hour, End: 12*time.Hour + 30*time.Minute},
+		{Start: 22 * time.Hour, End: 6 * time.Hour},
+	}, windows)
+
+	at := func(h, m int) time.Time { return time.Date(2025, 1, 1, h, m, 0, 0, time.Local) }
+	assert.True(t, windows[0].contains(at(8, 0)))
+	assert.False(t, windows[0].contains(at(12, 30)))
+	assert.True(t, windows[1].contains(at(23, 0)))
+	assert.True(t, windows[1].contains(at(5, 59)))
+	assert.False(t, windows[1].contains(at(12, 0)))
+
+	windows, err = ParseTimeWindows("")
+	require.NoError(t, err)
+	assert.Empty(t, windows)
+
+	for _, spec := range []string{"08:00", "8-18", "08:00-25:00"} {
+		_, err = ParseTimeWindows(spec)
+		assert.Error(t, err, spec)
+	}
+}
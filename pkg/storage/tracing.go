@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"iter"
+
+	"github.com/hashmap-kz/xrepo/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type tracingStorage struct {
+	s       Storage
+	backend string
+	tracer  trace.Tracer
+}
+
+var _ Storage = &tracingStorage{}
+
+// NewTracingStorage wraps every operation of the storage into a span, the global provider is used when tp is nil.
+// Paths of the spans are the stored ones (tracing.EncodedPathKey), downloads are traced until the stream is closed.
+func NewTracingStorage(s Storage, backend string, tp trace.TracerProvider) Storage {
+	return &tracingStorage{s: s, backend: backend, tracer: tracing.Tracer(tp)}
+}
+
+func (ts *tracingStorage) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, tracing.BackendKey.String(ts.backend))
+	return tracing.Start(ctx, ts.tracer, "storage."+op, attrs...)
+}
+
+func (ts *tracingStorage) isRetryable(err error) bool {
+	return isRetryableBy(ts.s, err)
+}
+
+func (ts *tracingStorage) PutObject(ctx context.Context, p string, r io.Reader) error {
+	return ts.PutObjectWithOpts(ctx, p, r, nil)
+}
+
+func (ts *tracingStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	ctx, span := ts.start(ctx, "PutObject", tracing.EncodedPathKey.String(p))
+	cr := tracing.NewCountingReader(r)
+	err := ts.s.PutObjectWithOpts(ctx, p, cr, opts)
+	span.SetAttributes(tracing.BytesKey.Int64(cr.Count()))
+	tracing.End(span, err)
+	return err
+}
+
+func (ts *tracingStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	ctx, span := ts.start(ctx, "ReadObject", tracing.EncodedPathKey.String(p))
+	rc, err := ts.s.ReadObject(ctx, p)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	return tracing.NewSpanReadCloser(span, rc), nil
+}
+
+func (ts *tracingStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	ctx, span := ts.start(ctx, "ReadObjectRange",
+		tracing.EncodedPathKey.String(p),
+		tracing.OffsetKey.Int64(offset),
+		tracing.LengthKey.Int64(length),
+	)
+	rc, err := ts.s.ReadObjectRange(ctx, p, offset, length)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	return tracing.NewSpanReadCloser(span, rc), nil
+}
+
+func (ts *tracingStorage) Exists(ctx context.Context, p string) (bool, error) {
+	ctx, span := ts.start(ctx, "Exists", tracing.EncodedPathKey.String(p))
+	exists, err := ts.s.Exists(ctx, p)
+	tracing.End(span, err)
+	return exists, err
+}
+
+func (ts *tracingStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	ctx, span := ts.start(ctx, "Stat", tracing.EncodedPathKey.String(p))
+	info, err := ts.s.Stat(ctx, p)
+	tracing.End(span, err)
+	return info, err
+}
+
+func (ts *tracingStorage) SHA256(ctx context.Context, p string) (string, error) {
+	ctx, span := ts.start(ctx, "SHA256", tracing.EncodedPathKey.String(p))
+	sum, err := ts.s.SHA256(ctx, p)
+	tracing.End(span, err)
+	return sum, err
+}
+
+func (ts *tracingStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	ctx, span := ts.start(ctx, "ListAll", tracing.PrefixKey.String(prefix))
+	files, err := ts.s.ListAll(ctx, prefix)
+	tracing.End(span, err)
+	return files, err
+}
+
+func (ts *tracingStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	ctx, span := ts.start(ctx, "ListAllInfo", tracing.PrefixKey.String(prefix))
+	infos, err := ts.s.ListAllInfo(ctx, prefix)
+	tracing.End(span, err)
+	return infos, err
+}
+
+// Walk is traced until the listing is exhausted, or the consumer stops
+func (ts *tracingStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		ctx, span := ts.start(ctx, "Walk", tracing.PrefixKey.String(prefix))
+		var walkErr error
+		defer func() {
+			tracing.End(span, walkErr)
+		}()
+		for info, err := range ts.s.Walk(ctx, prefix) {
+			if err != nil {
+				walkErr = err
+			}
+			if !yield(info, err) {
+				return
+			}
+		}
+	}
+}
+
+func (ts *tracingStorage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	ctx, span := ts.start(ctx, "ListTopLevelDirs", tracing.PrefixKey.String(prefix))
+	dirs, err := ts.s.ListTopLevelDirs(ctx, prefix)
+	tracing.End(span, err)
+	return dirs, err
+}
+
+func (ts *tracingStorage) Delete(ctx context.Context, p string) error {
+	ctx, span := ts.start(ctx, "Delete", tracing.EncodedPathKey.String(p))
+	err := ts.s.Delete(ctx, p)
+	tracing.End(span, err)
+	return err
+}
+
+func (ts *tracingStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	ctx, span := ts.start(ctx, "DeletePrefix", tracing.PrefixKey.String(prefix))
+	err := ts.s.DeletePrefix(ctx, prefix)
+	tracing.End(span, err)
+	return err
+}
+
+func (ts *tracingStorage) Copy(ctx context.Context, src, dst string) error {
+	ctx, span := ts.start(ctx, "Copy",
+		tracing.EncodedPathKey.String(src),
+		tracing.EncodedDestinationKey.String(dst),
+	)
+	err := ts.s.Copy(ctx, src, dst)
+	tracing.End(span, err)
+	return err
+}
+
+func (ts *tracingStorage) Rename(ctx context.Context, src, dst string) error {
+	ctx, span := ts.start(ctx, "Rename",
+		tracing.EncodedPathKey.String(src),
+		tracing.EncodedDestinationKey.String(dst),
+	)
+	err := ts.s.Rename(ctx, src, dst)
+	tracing.End(span, err)
+	return err
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/hashmap-kz/xrepo/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingStorage(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	s := NewTracingStorage(NewMemoryStorage(), "memory", sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	ctx := context.Background()
+
+	require.NoError(t, s.PutObject(ctx, "a/obj.gz", strings.NewReader("content")))
+	_, err := s.Stat(ctx, "missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	spans := sr.Ended()
+	require.Len(t, spans, 2)
+
+	assert.Equal(t, "storage.PutObject", spans[0].Name())
+	attrs := make(map[string]string)
+	for _, kv := range spans[0].Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	assert.Equal(t, map[string]string{
+		string(tracing.BackendKey):     "memory",
+		string(tracing.EncodedPathKey): "a/obj.gz",
+		string(tracing.BytesKey):       "7",
+	}, attrs)
+
+	assert.Equal(t, "storage.Stat", spans[1].Name())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+}
@@ -0,0 +1,712 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webdavPropfindBody requests only the properties objectInfo needs
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+    <d:getetag/>
+  </d:prop>
+</d:propfind>`
+
+type webdavStorage struct {
+	client  *http.Client
+	baseURL *url.URL
+	root    string
+}
+
+var _ Storage = &webdavStorage{}
+
+// NewWebDAVStorage keeps objects as files of the share under the root dir (relative to the share URL)
+func NewWebDAVStorage(client *http.Client, baseURL *url.URL, root string) Storage {
+	return &webdavStorage{
+		client:  client,
+		baseURL: baseURL,
+		root:    strings.Trim(filepath.ToSlash(root), "/"),
+	}
+}
+
+// fullPath resolves the object path to a clean path relative to the share, "" is the share itself
+func (s *webdavStorage) fullPath(p string) (string, error) {
+	name, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	name = path.Join(s.root, name)
+	if name == "." {
+		return "", nil
+	}
+	return strings.TrimPrefix(name, "/"), nil
+}
+
+func (s *webdavStorage) relPath(fullPath string) string {
+	if s.root == "" {
+		return fullPath
+	}
+	return strings.TrimPrefix(fullPath, s.root+"/")
+}
+
+// resourceURL escapes the path relative to the share, collections get a trailing slash
+func (s *webdavStorage) resourceURL(fullPath string, collection bool) string {
+	segments := strings.Split(fullPath, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	u := s.baseURL.JoinPath(segments...)
+	if collection && !strings.HasSuffix(u.Path, "/") {
+		u = u.JoinPath("/")
+	}
+	return u.String()
+}
+
+// hrefPath maps the href of a PROPFIND response back to a path relative to the share
+func (s *webdavStorage) hrefPath(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("invalid href in webdav response: %w", err)
+	}
+	base := strings.TrimSuffix(s.baseURL.Path, "/") + "/"
+	p := strings.TrimSuffix(u.Path, "/")
+	if p+"/" == base {
+		return "", nil
+	}
+	rel, ok := strings.CutPrefix(p, base)
+	if !ok {
+		return "", fmt.Errorf("unexpected href in webdav response: %s", href)
+	}
+	return rel, nil
+}
+
+// webdavStatusError is an unexpected response status, the code is kept to tell transient failures
+type webdavStatusError struct {
+	method     string
+	path       string
+	status     string
+	statusCode int
+}
+
+func (e *webdavStatusError) Error() string {
+	return fmt.Sprintf("webdav %s %s: %s", e.method, e.path, e.status)
+}
+
+func newWebDAVStatusError(method, p string, resp *http.Response) error {
+	return &webdavStatusError{
+		method:     strings.ToLower(method),
+		path:       p,
+		status:     resp.Status,
+		statusCode: resp.StatusCode,
+	}
+}
+
+// isRetryable treats throttling and server-side failures as transient
+func (s *webdavStorage) isRetryable(err error) bool {
+	var se *webdavStatusError
+	if errors.As(err, &se) {
+		return isRetryableStatus(se.statusCode)
+	}
+	return isTransientError(err)
+}
+
+// do sends the request and checks the status, the caller owns the body of a successful response
+func (s *webdavStorage) do(req *http.Request, p string, ok ...int) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("webdav %s: %w", strings.ToLower(req.Method), err)
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	drainAndClose(resp)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &fs.PathError{Op: strings.ToLower(req.Method), Path: p, Err: fs.ErrNotExist}
+	}
+	return nil, newWebDAVStatusError(req.Method, p, resp)
+}
+
+// exec sends a request without a response body of interest
+func (s *webdavStorage) exec(ctx context.Context, method, target, p string, header http.Header, ok ...int) error {
+	req, err := http.NewRequestWithContext(ctx, method, target, http.NoBody)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := s.do(req, p, ok...)
+	if err != nil {
+		return err
+	}
+	drainAndClose(resp)
+	return nil
+}
+
+func drainAndClose(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+func (s *webdavStorage) PutObject(ctx context.Context, p string, r io.Reader) error {
+	return s.PutObjectWithOpts(ctx, p, r, nil)
+}
+
+// PutObjectWithOpts uploads the object, metadata and tags are kept in a sidecar file next to it.
+func (s *webdavStorage) PutObjectWithOpts(ctx context.Context, p string, r io.Reader, opts *PutObjectOpts) error {
+	fullPath, err := s.fullPath(p)
+	if err != nil {
+		return err
+	}
+	if err := s.putAtomic(ctx, fullPath, r); err != nil {
+		return err
+	}
+	return s.writeMeta(ctx, fullPath, newObjectMeta(opts))
+}
+
+// putAtomic uploads into a hidden temp file next to the target, and moves it into place when the transfer
+// is complete, so readers never observe a partially uploaded object.
+func (s *webdavStorage) putAtomic(ctx context.Context, fullPath string, r io.Reader) error {
+	dir := path.Dir(fullPath)
+	if err := s.mkdirAll(ctx, dir); err != nil {
+		return err
+	}
+
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	tmpPath := path.Join(dir, tmpFilePrefix+path.Base(fullPath)+"-"+suffix)
+
+	if err := s.upload(ctx, tmpPath, r); err != nil {
+		_ = s.remove(context.WithoutCancel(ctx), tmpPath)
+		return err
+	}
+	if err := s.move(ctx, tmpPath, fullPath); err != nil {
+		_ = s.remove(context.WithoutCancel(ctx), tmpPath)
+		return err
+	}
+	return nil
+}
+
+func (s *webdavStorage) upload(ctx context.Context, fullPath string, r io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.resourceURL(fullPath, false), r)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, fullPath, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	drainAndClose(resp)
+	return nil
+}
+
+// mkdirAll creates the collection with its parents, starting from the deepest one,
+// so only a single MKCOL is sent when the parents already exist.
+func (s *webdavStorage) mkdirAll(ctx context.Context, dir string) error {
+	if dir == "" || dir == "." {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "MKCOL", s.resourceURL(dir, true), http.NoBody)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webdav mkcol: %w", err)
+	}
+	drainAndClose(resp)
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusMethodNotAllowed:
+		// 405 means the collection already exists
+		return nil
+	case http.StatusConflict:
+		// the parent is missing
+		if err := s.mkdirAll(ctx, path.Dir(dir)); err != nil {
+			return err
+		}
+		return s.exec(ctx, "MKCOL", s.resourceURL(dir, true), dir, nil, http.StatusCreated, http.StatusMethodNotAllowed)
+	default:
+		return newWebDAVStatusError("MKCOL", dir, resp)
+	}
+}
+
+// move renames the resource server-side, replacing an existing target
+func (s *webdavStorage) move(ctx context.Context, src, dst string) error {
+	return s.exec(ctx, "MOVE", s.resourceURL(src, false), src, http.Header{
+		"Destination": {s.resourceURL(dst, false)},
+		"Overwrite":   {"T"},
+	}, http.StatusCreated, http.StatusNoContent)
+}
+
+// remove deletes the resource (collections recursively), a missing one is not an error
+func (s *webdavStorage) remove(ctx context.Context, fullPath string) error {
+	err := s.exec(ctx, http.MethodDelete, s.resourceURL(fullPath, false), fullPath, nil,
+		http.StatusNoContent, http.StatusOK, http.StatusAccepted)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// writeMeta replaces the metadata sidecar of the object, nil removes a stale one
+func (s *webdavStorage) writeMeta(ctx context.Context, fullPath string, meta *objectMeta) error {
+	sidecar := metaSidecarPath(fullPath)
+	if meta == nil {
+		return s.remove(ctx, sidecar)
+	}
+	r, err := meta.marshal()
+	if err != nil {
+		return err
+	}
+	return s.putAtomic(ctx, sidecar, r)
+}
+
+// readMeta loads the metadata sidecar of the object, nil if there is none
+func (s *webdavStorage) readMeta(ctx context.Context, fullPath string) (*objectMeta, error) {
+	resp, err := s.get(ctx, metaSidecarPath(fullPath), nil)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readObjectMeta(resp.Body)
+}
+
+// copyMeta makes the metadata of dst match src
+func (s *webdavStorage) copyMeta(ctx context.Context, srcPath, dstPath string) error {
+	meta, err := s.readMeta(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	return s.writeMeta(ctx, dstPath, meta)
+}
+
+func (s *webdavStorage) get(ctx context.Context, fullPath string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.resourceURL(fullPath, false), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return s.do(req, fullPath, http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable)
+}
+
+func (s *webdavStorage) ReadObject(ctx context.Context, p string) (io.ReadCloser, error) {
+	fullPath, err := s.fullPath(p)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.get(ctx, fullPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		drainAndClose(resp)
+		return nil, newWebDAVStatusError(http.MethodGet, p, resp)
+	}
+	return resp.Body, nil
+}
+
+// ReadObjectRange sends a Range request, servers that ignore it answer with the whole object,
+// which is then skipped up to the offset on the client.
+func (s *webdavStorage) ReadObjectRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset: %d", offset)
+	}
+	fullPath, err := s.fullPath(p)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	rangeValue := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		rangeValue += strconv.FormatInt(offset+length-1, 10)
+	}
+	resp, err := s.get(ctx, fullPath, http.Header{"Range": {rangeValue}})
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return newRangeReadCloser(resp.Body, length), nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the range starts past the end of the object
+		drainAndClose(resp)
+		return io.NopCloser(strings.NewReader("")), nil
+	default:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil && !errors.Is(err, io.EOF) {
+			_ = resp.Body.Close()
+			return nil, err
+		}
+		return newRangeReadCloser(resp.Body, length), nil
+	}
+}
+
+func (s *webdavStorage) Exists(ctx context.Context, p string) (bool, error) {
+	_, err := s.Stat(ctx, p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *webdavStorage) SHA256(ctx context.Context, p string) (string, error) {
+	rc, err := s.ReadObject(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, rc); err != nil {
+		return "", fmt.Errorf("failed to hash object: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *webdavStorage) Stat(ctx context.Context, p string) (ObjectInfo, error) {
+	fullPath, err := s.fullPath(p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	entries, err := s.propfind(ctx, fullPath, false, "0")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if len(entries) != 1 || entries[0].collection {
+		return ObjectInfo{}, &fs.PathError{Op: "stat", Path: p, Err: fs.ErrNotExist}
+	}
+	info := s.objectInfo(entries[0])
+
+	meta, err := s.readMeta(ctx, fullPath)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if meta != nil {
+		meta.applyTo(&info)
+	}
+	return info, nil
+}
+
+func (s *webdavStorage) objectInfo(e webdavEntry) ObjectInfo {
+	return ObjectInfo{
+		Path:    s.relPath(e.path),
+		Size:    e.size,
+		ModTime: e.modTime,
+		ETag:    e.etag,
+	}
+}
+
+func (s *webdavStorage) ListAll(ctx context.Context, prefix string) ([]string, error) {
+	return collectPaths(s.Walk(ctx, prefix))
+}
+
+func (s *webdavStorage) ListAllInfo(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return collectInfos(s.Walk(ctx, prefix))
+}
+
+// Walk lists the collections one level at a time (Depth: 1), since many servers (e.g. Nextcloud)
+// refuse Depth: infinity. A missing prefix yields nothing.
+func (s *webdavStorage) Walk(ctx context.Context, prefix string) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		root, err := s.fullPath(prefix)
+		if err != nil {
+			yield(ObjectInfo{}, err)
+			return
+		}
+		pending := []string{root}
+		first := true
+
+		for len(pending) > 0 {
+			dir := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+
+			entries, err := s.propfind(ctx, dir, true, "1")
+			if err != nil {
+				if first && errors.Is(err, fs.ErrNotExist) {
+					return
+				}
+				yield(ObjectInfo{}, err)
+				return
+			}
+			first = false
+
+			for _, e := range entries {
+				if e.path == dir && e.collection {
+					continue
+				}
+				if e.collection {
+					pending = append(pending, e.path)
+					continue
+				}
+				if isInternalName(e.path) {
+					continue
+				}
+				if !yield(s.objectInfo(e), nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ListTopLevelDirs returns the collections directly under the prefix (relative to the storage root)
+func (s *webdavStorage) ListTopLevelDirs(ctx context.Context, prefix string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	dir, err := s.fullPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.propfind(ctx, dir, true, "1")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return result, nil
+		}
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if e.collection && e.path != dir {
+			result[s.relPath(e.path)] = true
+		}
+	}
+	return result, nil
+}
+
+func (s *webdavStorage) Delete(ctx context.Context, p string) error {
+	fullPath, err := s.fullPath(p)
+	if err != nil {
+		return err
+	}
+	if err := s.remove(ctx, fullPath); err != nil {
+		return err
+	}
+	return s.writeMeta(ctx, fullPath, nil)
+}
+
+// DeletePrefix removes the collection, DELETE is recursive in WebDAV
+func (s *webdavStorage) DeletePrefix(ctx context.Context, prefix string) error {
+	fullPath, err := s.fullPath(prefix)
+	if err != nil {
+		return err
+	}
+
+	// never remove the root collection itself, only its contents
+	if fullPath != s.root {
+		return s.remove(ctx, fullPath)
+	}
+
+	entries, err := s.propfind(ctx, fullPath, true, "1")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if e.path == fullPath {
+			continue
+		}
+		if err := s.remove(ctx, e.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy duplicates the object server-side under a temp name, and moves it into place
+func (s *webdavStorage) Copy(ctx context.Context, src, dst string) error {
+	srcPath, err := s.fullPath(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := s.fullPath(dst)
+	if err != nil {
+		return err
+	}
+
+	if err := s.requireObject(ctx, "copy", src, srcPath); err != nil {
+		return err
+	}
+	if srcPath == dstPath {
+		return nil
+	}
+
+	dir := path.Dir(dstPath)
+	if err := s.mkdirAll(ctx, dir); err != nil {
+		return err
+	}
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+	tmpPath := path.Join(dir, tmpFilePrefix+path.Base(dstPath)+"-"+suffix)
+
+	err = s.exec(ctx, "COPY", s.resourceURL(srcPath, false), src, http.Header{
+		"Destination": {s.resourceURL(tmpPath, false)},
+		"Overwrite":   {"T"},
+		"Depth":       {"0"},
+	}, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	if err := s.move(ctx, tmpPath, dstPath); err != nil {
+		_ = s.remove(context.WithoutCancel(ctx), tmpPath)
+		return err
+	}
+	return s.copyMeta(ctx, srcPath, dstPath)
+}
+
+func (s *webdavStorage) Rename(ctx context.Context, src, dst string) error {
+	srcPath, err := s.fullPath(src)
+	if err != nil {
+		return err
+	}
+	dstPath, err := s.fullPath(dst)
+	if err != nil {
+		return err
+	}
+
+	if err := s.requireObject(ctx, "rename", src, srcPath); err != nil {
+		return err
+	}
+	if srcPath == dstPath {
+		return nil
+	}
+	if err := s.mkdirAll(ctx, path.Dir(dstPath)); err != nil {
+		return err
+	}
+	if err := s.move(ctx, srcPath, dstPath); err != nil {
+		return err
+	}
+
+	if err := s.copyMeta(ctx, srcPath, dstPath); err != nil {
+		return err
+	}
+	return s.writeMeta(ctx, srcPath, nil)
+}
+
+// requireObject fails with fs.ErrNotExist unless the path is a regular object
+func (s *webdavStorage) requireObject(ctx context.Context, op, p, fullPath string) error {
+	entries, err := s.propfind(ctx, fullPath, false, "0")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+		}
+		return err
+	}
+	if len(entries) != 1 || entries[0].collection {
+		return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+// webdavEntry is a resource of the PROPFIND response, path is relative to the share
+type webdavEntry struct {
+	path       string
+	collection bool
+	size       int64
+	modTime    time.Time
+	etag       string
+}
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+				ETag          string `xml:"getetag"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func (s *webdavStorage) propfind(ctx context.Context, fullPath string, collection bool, depth string) ([]webdavEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", s.resourceURL(fullPath, collection), strings.NewReader(webdavPropfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := s.do(req, s.relPath(fullPath), http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("cannot decode webdav response: %w", err)
+	}
+
+	result := make([]webdavEntry, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		p, err := s.hrefPath(r.Href)
+		if err != nil {
+			return nil, err
+		}
+		e := webdavEntry{path: p}
+		for _, ps := range r.Propstat {
+			// properties the server does not have are reported in a separate 404 propstat
+			if !strings.Contains(ps.Status, " 200") {
+				continue
+			}
+			e.collection = ps.Prop.ResourceType.Collection != nil
+			if ps.Prop.ContentLength != "" {
+				e.size, err = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid content length of %s: %w", p, err)
+				}
+			}
+			if ps.Prop.LastModified != "" {
+				if t, err := http.ParseTime(ps.Prop.LastModified); err == nil {
+					e.modTime = t
+				}
+			}
+			e.etag = strings.Trim(ps.Prop.ETag, `"`)
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" //nolint:gosec
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashmap-kz/xrepo/pkg/clients/webdavx"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+// newWebDAVTestStorage serves an in-memory share under /dav/, wrapped by the auth middleware if given
+func newWebDAVTestStorage(t *testing.T, cfg *webdavx.WebDAVConfig, auth func(http.Handler) http.Handler) Storage {
+	t.Helper()
+
+	var h http.Handler = &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+	if auth != nil {
+		h = auth(h)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	cfg.URL = srv.URL + "/dav/"
+	c, err := webdavx.NewWebDAVClient(cfg)
+	require.NoError(t, err)
+	return NewWebDAVStorage(c.Client(), c.URL(), "backups/main")
+}
+
+func readAll(t *testing.T, rc io.ReadCloser) []byte {
+	t.Helper()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	return data
+}
+
+func TestWebDAVStorage_PutListAndRead(t *testing.T) {
+	s := newWebDAVTestStorage(t, &webdavx.WebDAVConfig{}, nil)
+	ctx := context.Background()
+
+	require.NoError(t, s.PutObject(ctx, "listall/a b.txt", strings.NewReader("A")))
+	require.NoError(t, s.PutObject(ctx, "listall/sub/b.txt", strings.NewReader("BB")))
+	require.NoError(t, s.PutObject(ctx, "listall-sibling/c.txt", strings.NewReader("C")))
+
+	files, err := s.ListAll(ctx, "listall/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"listall/a b.txt", "listall/sub/b.txt"}, files)
+
+	files, err = s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	files, err = s.ListAll(ctx, "missing/")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	rc, err := s.ReadObject(ctx, "listall/sub/b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("BB"), readAll(t, rc))
+
+	_, err = s.ReadObject(ctx, "listall/missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	exists, err := s.Exists(ctx, "listall/a b.txt")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = s.Exists(ctx, "listall/sub")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestWebDAVStorage_ReadObjectRange(t *testing.T) {
+	s := newWebDAVTestStorage(t, &webdavx.WebDAVConfig{}, nil)
+	ctx := context.Background()
+
+	require.NoError(t, s.PutObject(ctx, "range/obj", strings.NewReader("0123456789")))
+
+	rc, err := s.ReadObjectRange(ctx, "range/obj", 2, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("234"), readAll(t, rc))
+
+	rc, err = s.ReadObjectRange(ctx, "range/obj", 7, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("789"), readAll(t, rc))
+
+	rc, err = s.ReadObjectRange(ctx, "range/obj", 20, 5)
+	require.NoError(t, err)
+	assert.Empty(t, readAll(t, rc))
+}
+
+func TestWebDAVStorage_ListTopLevelDirs(t *testing.T) {
+	s := newWebDAVTestStorage(t, &webdavx.WebDAVConfig{}, nil)
+	ctx := context.Background()
+
+	for _, p := range []string{"dir1/file1.txt", "dir2/file2.txt", "dir3/subdir/file.txt", "root.txt"} {
+		require.NoError(t, s.PutObject(ctx, p, strings.NewReader("hello")))
+	}
+
+	dirs, err := s.ListTopLevelDirs(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"dir1": true, "dir2": true, "dir3": true}, dirs)
+
+	dirs, err = s.ListTopLevelDirs(ctx, "dir3")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"dir3/subdir": true}, dirs)
+}
+
+func TestWebDAVStorage_StatDeleteAndDeletePrefix(t *testing.T) {
+	s := newWebDAVTestStorage(t, &webdavx.WebDAVConfig{}, nil)
+	ctx := context.Background()
+
+	require.NoError(t, s.PutObject(ctx, "delete/a.txt", strings.NewReader("AAA")))
+	require.NoError(t, s.PutObject(ctx, "delete/b.txt", strings.NewReader("B")))
+	require.NoError(t, s.PutObject(ctx, "delete-sibling/c.txt", strings.NewReader("C")))
+
+	info, err := s.Stat(ctx, "delete/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "delete/a.txt", info.Path)
+	assert.Equal(t, int64(3), info.Size)
+	assert.False(t, info.ModTime.IsZero())
+
+	_, err = s.Stat(ctx, "delete/missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, s.Delete(ctx, "delete/a.txt"))
+	require.NoError(t, s.Delete(ctx, "delete/a.txt"))
+
+	require.NoError(t, s.DeletePrefix(ctx, "delete/"))
+	files, err := s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"delete-sibling/c.txt"}, files)
+
+	require.NoError(t, s.DeletePrefix(ctx, ""))
+	files, err = s.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestWebDAVStorage_CopyAndRenameWithOpts(t *testing.T) {
+	s := newWebDAVTestStorage(t, &webdavx.WebDAVConfig{}, nil)
+	ctx := context.Background()
+
+	opts := &PutObjectOpts{
+		Metadata: map[string]string{"Source-Host": "pg-01"},
+		Tags:     map[string]string{"kind": "wal"},
+	}
+	require.NoError(t, s.PutObjectWithOpts(ctx, "mv/incoming/a.txt", strings.NewReader("A"), opts))
+
+	require.NoError(t, s.Rename(ctx, "mv/incoming/a.txt", "mv/base/a.txt"))
+	require.NoError(t, s.Copy(ctx, "mv/base/a.txt", "mv/copy/a.txt"))
+
+	files, err := s.ListAll(ctx, "mv/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"mv/base/a.txt", "mv/copy/a.txt"}, files)
+
+	info, err := s.Stat(ctx, "mv/copy/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"source-host": "pg-01"}, info.Metadata)
+	assert.Equal(t, map[string]string{"kind": "wal"}, info.Tags)
+
+	assert.ErrorIs(t, s.Copy(ctx, "mv/missing", "mv/x"), fs.ErrNotExist)
+	assert.ErrorIs(t, s.Rename(ctx, "mv/missing", "mv/x"), fs.ErrNotExist)
+}
+
+func TestWebDAVStorage_BasicAuth(t *testing.T) {
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "backup" || pass != "secret" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="dav"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	ctx := context.Background()
+
+	s := newWebDAVTestStorage(t, &webdavx.WebDAVConfig{User: "backup", Pass: "secret"}, auth)
+	require.NoError(t, s.PutObject(ctx, "auth/a.txt", strings.NewReader("A")))
+
+	s = newWebDAVTestStorage(t, &webdavx.WebDAVConfig{User: "backup", Pass: "wrong"}, auth)
+	assert.Error(t, s.PutObject(ctx, "auth/a.txt", strings.NewReader("A")))
+}
+
+func TestWebDAVStorage_DigestAuth(t *testing.T) {
+	const realm, nonce = "dav", "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	h := func(s string) string {
+		sum := md5.Sum([]byte(s)) //nolint:gosec
+		return hex.EncodeToString(sum[:])
+	}
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			params, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Digest ")
+			if ok {
+				p := parseTestAuthParams(params)
+				ha1 := h(fmt.Sprintf("%s:%s:%s", p["username"], realm, "secret"))
+				ha2 := h(r.Method + ":" + p["uri"])
+				want := h(strings.Join([]string{ha1, nonce, p["nc"], p["cnonce"], p["qop"], ha2}, ":"))
+				if p["username"] == "backup" && p["nonce"] == nonce && p["uri"] == r.URL.RequestURI() && p["response"] == want {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			_, _ = io.Copy(io.Discard, r.Body)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm=%q, nonce=%q, qop="auth", algorithm=MD5`, realm, nonce))
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+	}
+	ctx := context.Background()
+
+	s := newWebDAVTestStorage(t, &webdavx.WebDAVConfig{User: "backup", Pass: "secret", Auth: webdavx.AuthDigest}, auth)
+
+	// the streamed body of the first request can't be replayed, so the challenge must be known upfront
+	content := bytes.Repeat([]byte("x"), 64*1024)
+	require.NoError(t, s.PutObject(ctx, "digest/a.txt", io.MultiReader(bytes.NewReader(content))))
+
+	rc, err := s.ReadObject(ctx, "digest/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, content, readAll(t, rc))
+
+	s = newWebDAVTestStorage(t, &webdavx.WebDAVConfig{User: "backup", Pass: "wrong", Auth: webdavx.AuthDigest}, auth)
+	assert.Error(t, s.PutObject(ctx, "digest/a.txt", strings.NewReader("A")))
+}
+
+func parseTestAuthParams(s string) map[string]string {
+	result := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		result[k] = strings.Trim(v, `"`)
+	}
+	return result
+}
@@ -0,0 +1,181 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/hashmap-kz/xrepo"
+
+// Span attributes
+const (
+	BackendKey     = attribute.Key("xrepo.backend")      // storage type, i.e. "s3"
+	PathKey        = attribute.Key("xrepo.path")         // logical (plain) name in the repo
+	EncodedPathKey = attribute.Key("xrepo.encoded_path") // stored name, with the compression/encryption extensions
+	PrefixKey      = attribute.Key("xrepo.prefix")
+	OffsetKey      = attribute.Key("xrepo.offset")
+	LengthKey      = attribute.Key("xrepo.length")
+
+	// destinations of Copy/Rename, logical and stored
+	DestinationKey        = attribute.Key("xrepo.destination")
+	EncodedDestinationKey = attribute.Key("xrepo.encoded_destination")
+
+	CompressorKey = attribute.Key("xrepo.compressor")
+	EncryptorKey  = attribute.Key("xrepo.encryptor")
+	BytesKey      = attribute.Key("xrepo.bytes")
+
+	// ReadTimeKey is the time spent inside Read of a stream, for the decrypt and decompress stages of a repo read
+	// it's the time of the stage alone, without reading its input
+	ReadTimeKey = attribute.Key("xrepo.read_time_ms")
+
+	// InputBytesKey is the size of the input of a stage, i.e. the compressed size for decompression
+	InputBytesKey = attribute.Key("xrepo.input_bytes")
+
+	// ObjectsKey is the number of objects an operation affected, i.e. chunks removed by a prune
+	ObjectsKey = attribute.Key("xrepo.objects")
+)
+
+// Tracer returns the tracer of xrepo, the global provider is used when tp is nil
+func Tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(instrumentationName)
+}
+
+// Start starts a span of an operation, i.e. "storage.PutObject"
+func Start(ctx context.Context, t trace.Tracer, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return t.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records the error of the operation, if any, and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// CountingReader counts the bytes of an upload, to be reported with BytesKey
+type CountingReader struct {
+	r io.Reader
+	n int64
+}
+
+func NewCountingReader(r io.Reader) *CountingReader {
+	return &CountingReader{r: r}
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Count returns the number of bytes read so far
+func (c *CountingReader) Count() int64 {
+	return c.n
+}
+
+// SpanReadCloser keeps the span of a download open until the stream is closed,
+// so that the span covers the transfer and not only the request
+type SpanReadCloser struct {
+	span     trace.Span
+	rc       io.ReadCloser
+	n        int64
+	readTime time.Duration
+	err      error
+}
+
+func NewSpanReadCloser(span trace.Span, rc io.ReadCloser) *SpanReadCloser {
+	return &SpanReadCloser{span: span, rc: rc}
+}
+
+func (s *SpanReadCloser) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := s.rc.Read(p)
+	s.readTime += time.Since(start)
+	s.n += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) && s.err == nil {
+		s.err = err
+	}
+	return n, err
+}
+
+func (s *SpanReadCloser) Close() error {
+	err := s.rc.Close()
+	s.span.SetAttributes(
+		BytesKey.Int64(s.n),
+		ReadTimeKey.Int64(s.readTime.Milliseconds()),
+	)
+	End(s.span, errors.Join(s.err, err))
+	return err
+}
+
+// Stage traces a stage of a download pipeline, i.e. decryption, as a span of its own.
+// The span covers the stage from its setup until End, ReadTimeKey reports the time spent in the stage itself.
+type Stage struct {
+	span    trace.Span
+	in, out timedReader
+	setup   time.Duration
+	err     error
+}
+
+func StartStage(ctx context.Context, t trace.Tracer, name string, attrs ...attribute.KeyValue) *Stage {
+	_, span := Start(ctx, t, name, attrs...)
+	return &Stage{span: span}
+}
+
+// Open sets the stage up on top of the src stream, and returns the output of the stage
+func (s *Stage) Open(src io.Reader, open func(io.Reader) (io.Reader, error)) (io.Reader, error) {
+	s.in.r = src
+	start := time.Now()
+	out, err := open(&s.in)
+	s.setup = time.Since(start)
+	if err != nil {
+		s.err = err
+		return nil, err
+	}
+	s.out.r = out
+	return &s.out, nil
+}
+
+// End reports the sizes and the time of the stage, and ends the span
+func (s *Stage) End() {
+	if s.err == nil {
+		s.err = s.out.err
+	}
+	s.span.SetAttributes(
+		BytesKey.Int64(s.out.n),
+		InputBytesKey.Int64(s.in.n),
+		ReadTimeKey.Int64((s.setup + s.out.elapsed - s.in.elapsed).Milliseconds()),
+	)
+	End(s.span, s.err)
+}
+
+// timedReader counts the bytes and the time spent inside Read
+type timedReader struct {
+	r       io.Reader
+	n       int64
+	elapsed time.Duration
+	err     error
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.r.Read(p)
+	t.elapsed += time.Since(start)
+	t.n += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
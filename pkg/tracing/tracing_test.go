@@ -0,0 +1,111 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func attrsOf(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	result := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		result[kv.Key] = kv.Value
+	}
+	return result
+}
+
+func TestSpanReadCloser_EndsOnClose(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tracer := Tracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+
+	_, span := Start(context.Background(), tracer, "storage.ReadObject", PathKey.String("a/obj"))
+	rc := NewSpanReadCloser(span, io.NopCloser(strings.NewReader("content")))
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("content"), data)
+	assert.Empty(t, sr.Ended())
+
+	require.NoError(t, rc.Close())
+	require.Len(t, sr.Ended(), 1)
+	ended := sr.Ended()[0]
+	assert.Equal(t, "storage.ReadObject", ended.Name())
+	assert.Equal(t, codes.Unset, ended.Status().Code)
+	assert.Equal(t, int64(7), attrsOf(ended)[BytesKey].AsInt64())
+	assert.Equal(t, "a/obj", attrsOf(ended)[PathKey].AsString())
+}
+
+func TestSpanReadCloser_RecordsStreamErrors(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tracer := Tracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+
+	_, span := Start(context.Background(), tracer, "storage.ReadObject")
+	rc := NewSpanReadCloser(span, io.NopCloser(errReader{err: syscall.ECONNRESET}))
+	_, err := io.ReadAll(rc)
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+	require.NoError(t, rc.Close())
+
+	require.Len(t, sr.Ended(), 1)
+	assert.Equal(t, codes.Error, sr.Ended()[0].Status().Code)
+}
+
+func TestStage_ReportsInputAndOutput(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tracer := Tracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	stage := StartStage(context.Background(), tracer, "repo.Decompress")
+
+	// a stage that drops every other byte
+	out, err := stage.Open(strings.NewReader("aabbccdd"), func(src io.Reader) (io.Reader, error) {
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return nil, err
+		}
+		half := make([]byte, 0, len(data)/2)
+		for i := 0; i < len(data); i += 2 {
+			half = append(half, data[i])
+		}
+		return strings.NewReader(string(half)), nil
+	})
+	require.NoError(t, err)
+	data, err := io.ReadAll(out)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("abcd"), data)
+	assert.Empty(t, sr.Ended())
+
+	stage.End()
+	require.Len(t, sr.Ended(), 1)
+	attrs := attrsOf(sr.Ended()[0])
+	assert.Equal(t, int64(4), attrs[BytesKey].AsInt64())
+	assert.Equal(t, int64(8), attrs[InputBytesKey].AsInt64())
+	assert.Contains(t, attrs, ReadTimeKey)
+}
+
+func TestStage_RecordsSetupErrors(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tracer := Tracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	stage := StartStage(context.Background(), tracer, "repo.Decrypt")
+
+	_, err := stage.Open(strings.NewReader(""), func(io.Reader) (io.Reader, error) {
+		return nil, syscall.EINVAL
+	})
+	assert.ErrorIs(t, err, syscall.EINVAL)
+	stage.End()
+	require.Len(t, sr.Ended(), 1)
+	assert.Equal(t, codes.Error, sr.Ended()[0].Status().Code)
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(_ []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,132 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"testing"
+
+	storage2 "github.com/hashmap-kz/xrepo/pkg/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func storageTestsCreateAzureClient(t *testing.T) storage2.Storage {
+	t.Helper()
+	_, store := createAzureClient("storage-unittest")
+	require.NoError(t, store.DeletePrefix(context.Background(), ""))
+	return store
+}
+
+func TestAzureStorage_PutListAndRead(t *testing.T) {
+	store := storageTestsCreateAzureClient(t)
+
+	ctx := context.Background()
+	require.NoError(t, store.PutObject(ctx, "listall/a.txt", bytes.NewReader([]byte("A"))))
+	require.NoError(t, store.PutObject(ctx, "listall/b.txt", bytes.NewReader([]byte("B"))))
+	require.NoError(t, store.PutObject(ctx, "listall-sibling/c.txt", bytes.NewReader([]byte("C"))))
+
+	files, err := store.ListAll(ctx, "listall/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"listall/a.txt", "listall/b.txt"}, files)
+
+	rc, err := store.ReadObject(ctx, "listall/b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("B"), readAllAndClose(t, rc))
+
+	_, err = store.ReadObject(ctx, "listall/missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestAzureStorage_PutObject_LargerThanBlock(t *testing.T) {
+	store := storageTestsCreateAzureClient(t)
+
+	// spans several staged blocks
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)
+
+	ctx := context.Background()
+	require.NoError(t, store.PutObject(ctx, "large/obj", bytes.NewReader(content)))
+
+	rc, err := store.ReadObject(ctx, "large/obj")
+	require.NoError(t, err)
+	assert.Equal(t, content, readAllAndClose(t, rc))
+
+	rc, err = store.ReadObjectRange(ctx, "large/obj", 10, 20)
+	require.NoError(t, err)
+	assert.Equal(t, content[10:30], readAllAndClose(t, rc))
+
+	rc, err = store.ReadObjectRange(ctx, "large/obj", int64(len(content))+1, 20)
+	require.NoError(t, err)
+	assert.Empty(t, readAllAndClose(t, rc))
+}
+
+func TestAzureStorage_ListTopLevelDirs(t *testing.T) {
+	store := storageTestsCreateAzureClient(t)
+
+	ctx := context.Background()
+	for _, p := range []string{"dir1/file1.txt", "dir2/file2.txt", "dir2/file3.txt", "dir3/subdir/file.txt", "root.txt"} {
+		require.NoError(t, store.PutObject(ctx, p, bytes.NewReader([]byte("hello"))))
+	}
+
+	dirs, err := store.ListTopLevelDirs(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"dir1": true, "dir2": true, "dir3": true}, dirs)
+
+	dirs, err = store.ListTopLevelDirs(ctx, "dir3")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"dir3/subdir": true}, dirs)
+}
+
+func TestAzureStorage_StatDeleteAndDeletePrefix(t *testing.T) {
+	store := storageTestsCreateAzureClient(t)
+
+	ctx := context.Background()
+	require.NoError(t, store.PutObject(ctx, "delete/a.txt", bytes.NewReader([]byte("AAA"))))
+	require.NoError(t, store.PutObject(ctx, "delete/b.txt", bytes.NewReader([]byte("B"))))
+	require.NoError(t, store.PutObject(ctx, "delete-sibling/c.txt", bytes.NewReader([]byte("C"))))
+
+	info, err := store.Stat(ctx, "delete/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "delete/a.txt", info.Path)
+	assert.Equal(t, int64(3), info.Size)
+	assert.NotEmpty(t, info.ETag)
+
+	_, err = store.Stat(ctx, "delete/missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, store.Delete(ctx, "delete/a.txt"))
+	require.NoError(t, store.Delete(ctx, "delete/a.txt"))
+
+	require.NoError(t, store.DeletePrefix(ctx, "delete/"))
+	files, err := store.ListAll(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"delete-sibling/c.txt"}, files)
+}
+
+func TestAzureStorage_CopyAndRenameWithOpts(t *testing.T) {
+	store := storageTestsCreateAzureClient(t)
+
+	ctx := context.Background()
+	opts := &storage2.PutObjectOpts{
+		Metadata: map[string]string{"source-host": "pg-01"},
+		Tags:     map[string]string{"kind": "wal"},
+	}
+	require.NoError(t, store.PutObjectWithOpts(ctx, "mv/incoming/a b.txt", bytes.NewReader([]byte("A")), opts))
+
+	require.NoError(t, store.Rename(ctx, "mv/incoming/a b.txt", "mv/base/a b.txt"))
+	require.NoError(t, store.Copy(ctx, "mv/base/a b.txt", "mv/copy/a b.txt"))
+
+	files, err := store.ListAll(ctx, "mv/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"mv/base/a b.txt", "mv/copy/a b.txt"}, files)
+
+	info, err := store.Stat(ctx, "mv/copy/a b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, opts.Metadata, info.Metadata)
+	assert.Equal(t, opts.Tags, info.Tags)
+
+	assert.ErrorIs(t, store.Copy(ctx, "mv/missing", "mv/x"), fs.ErrNotExist)
+}
@@ -0,0 +1,54 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	storage2 "github.com/hashmap-kz/xrepo/pkg/storage"
+	"github.com/hashmap-kz/xrepo/pkg/storage/storagetest"
+
+	"github.com/stretchr/testify/require"
+)
+
+// conformancePrefix gives every subtest its own dir, leftovers of a previous run are removed
+func conformancePrefix(t *testing.T) string {
+	t.Helper()
+	return "conformance/" + strings.ReplaceAll(t.Name(), "/", "-")
+}
+
+func emptyStorage(t *testing.T, s storage2.Storage) storage2.Storage {
+	t.Helper()
+	require.NoError(t, s.DeletePrefix(context.Background(), ""))
+	return s
+}
+
+func TestConformance_S3(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage2.Storage {
+		_, s := createS3Client(conformancePrefix(t))
+		return emptyStorage(t, s)
+	})
+}
+
+func TestConformance_SFTP(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage2.Storage {
+		_, s := createSftpClient(root + "/" + conformancePrefix(t))
+		return emptyStorage(t, s)
+	})
+}
+
+func TestConformance_Azure(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage2.Storage {
+		_, s := createAzureClient(conformancePrefix(t))
+		return emptyStorage(t, s)
+	})
+}
+
+func TestConformance_GCS(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage2.Storage {
+		_, s := createGCSClient(conformancePrefix(t))
+		return emptyStorage(t, s)
+	})
+}
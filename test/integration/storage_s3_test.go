@@ -5,6 +5,7 @@ package integration
 import (
 	"bytes"
 	"context"
+	"io/fs"
 	"strings"
 	"testing"
 	"time"
@@ -76,7 +77,7 @@ func TestS3Storage_ListTopLevelDirs(t *testing.T) {
 	}
 
 	s := storage2.NewS3Storage(client, bucket, prefix)
-	dirs, err := s.ListTopLevelDirs(ctx, prefix)
+	dirs, err := s.ListTopLevelDirs(ctx, "")
 	assert.NoError(t, err)
 
 	// Verify detected top-level dirs
@@ -85,3 +86,128 @@ func TestS3Storage_ListTopLevelDirs(t *testing.T) {
 	assert.True(t, dirs["dir3"])
 	assert.Len(t, dirs, 3)
 }
+
+func TestS3Storage_DeleteAndDeletePrefix(t *testing.T) {
+	_, store := storageTestsCreateS3Client(t)
+
+	ctx := context.Background()
+	require.NoError(t, store.PutObject(ctx, "delete/a.txt", bytes.NewReader([]byte("A"))))
+	require.NoError(t, store.PutObject(ctx, "delete/b.txt", bytes.NewReader([]byte("B"))))
+	require.NoError(t, store.PutObject(ctx, "delete-sibling/c.txt", bytes.NewReader([]byte("C"))))
+
+	require.NoError(t, store.Delete(ctx, "delete/a.txt"))
+	exists, err := store.Exists(ctx, "delete/a.txt")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, store.DeletePrefix(ctx, "delete/"))
+	files, err := store.ListAll(ctx, "delete/")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	// the sibling with the same name prefix must survive
+	exists, err = store.Exists(ctx, "delete-sibling/c.txt")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	require.NoError(t, store.Delete(ctx, "delete-sibling/c.txt"))
+}
+
+func TestS3Storage_StatAndListAllInfo(t *testing.T) {
+	_, store := storageTestsCreateS3Client(t)
+
+	ctx := context.Background()
+	require.NoError(t, store.PutObject(ctx, "stat/a.txt", bytes.NewReader([]byte("AAA"))))
+
+	info, err := store.Stat(ctx, "stat/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "stat/a.txt", info.Path)
+	assert.Equal(t, int64(3), info.Size)
+	assert.NotEmpty(t, info.ETag)
+	assert.False(t, info.ModTime.IsZero())
+
+	infos, err := store.ListAllInfo(ctx, "stat/")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, info.Size, infos[0].Size)
+	assert.Equal(t, info.ETag, infos[0].ETag)
+
+	_, err = store.Stat(ctx, "stat/missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestS3Storage_Walk_StopsEarly(t *testing.T) {
+	_, store := storageTestsCreateS3Client(t)
+
+	ctx := context.Background()
+	for _, p := range []string{"walk/1", "walk/2", "walk/3"} {
+		require.NoError(t, store.PutObject(ctx, p, bytes.NewReader([]byte(p))))
+	}
+
+	var seen []string
+	for info, err := range store.Walk(ctx, "walk/") {
+		require.NoError(t, err)
+		seen = append(seen, info.Path)
+		if len(seen) == 2 {
+			break
+		}
+	}
+	assert.Len(t, seen, 2)
+}
+
+func TestS3Storage_CopyAndRename(t *testing.T) {
+	_, store := storageTestsCreateS3Client(t)
+
+	ctx := context.Background()
+	require.NoError(t, store.DeletePrefix(ctx, "mv/"))
+	require.NoError(t, store.PutObject(ctx, "mv/incoming/a b.txt", bytes.NewReader([]byte("A"))))
+
+	require.NoError(t, store.Rename(ctx, "mv/incoming/a b.txt", "mv/base/a b.txt"))
+	require.NoError(t, store.Copy(ctx, "mv/base/a b.txt", "mv/copy/a b.txt"))
+
+	files, err := store.ListAll(ctx, "mv/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"mv/base/a b.txt", "mv/copy/a b.txt"}, files)
+
+	err = store.Copy(ctx, "mv/missing", "mv/x")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestS3Storage_PutObjectWithOpts(t *testing.T) {
+	_, store := storageTestsCreateS3Client(t)
+
+	ctx := context.Background()
+	require.NoError(t, store.DeletePrefix(ctx, "meta/"))
+
+	opts := &storage2.PutObjectOpts{
+		Metadata: map[string]string{"source-host": "pg-01", "lsn": "0/3000028"},
+		Tags:     map[string]string{"kind": "wal"},
+	}
+	require.NoError(t, store.PutObjectWithOpts(ctx, "meta/obj", bytes.NewReader([]byte("A")), opts))
+	require.NoError(t, store.Copy(ctx, "meta/obj", "meta/copy"))
+
+	for _, p := range []string{"meta/obj", "meta/copy"} {
+		info, err := store.Stat(ctx, p)
+		require.NoError(t, err)
+		assert.Equal(t, opts.Metadata, info.Metadata)
+		assert.Equal(t, opts.Tags, info.Tags)
+	}
+}
+
+func TestS3Storage_ReadObjectRange(t *testing.T) {
+	_, store := storageTestsCreateS3Client(t)
+
+	ctx := context.Background()
+	require.NoError(t, store.PutObject(ctx, "range/seg", bytes.NewReader([]byte("0123456789"))))
+
+	rc, err := store.ReadObjectRange(ctx, "range/seg", 4, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("45"), readAllAndClose(t, rc))
+
+	rc, err = store.ReadObjectRange(ctx, "range/seg", 7, -1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("789"), readAllAndClose(t, rc))
+
+	rc, err = store.ReadObjectRange(ctx, "range/seg", 20, 5)
+	require.NoError(t, err)
+	assert.Empty(t, readAllAndClose(t, rc))
+}
@@ -3,8 +3,11 @@
 package integration
 
 import (
+	"bytes"
 	"context"
+	"io/fs"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/hashmap-kz/xrepo/pkg/storage"
@@ -81,7 +84,7 @@ func TestSFTP_ListTopLevelDirs(t *testing.T) {
 	prepareSFTPData(t, client, root)
 
 	s := storage.NewSFTPStorage(client, root)
-	dirs, err := s.ListTopLevelDirs(context.Background(), root)
+	dirs, err := s.ListTopLevelDirs(context.Background(), "")
 	assert.NoError(t, err)
 
 	assert.True(t, dirs["dir1"])
@@ -89,3 +92,125 @@ func TestSFTP_ListTopLevelDirs(t *testing.T) {
 	assert.True(t, dirs["dir3"])
 	assert.Len(t, dirs, 3)
 }
+
+func TestSFTP_DeleteAndDeletePrefix(t *testing.T) {
+	client := connectSFTP(t)
+	defer client.Close()
+
+	prepareSFTPData(t, client, root)
+
+	ctx := context.Background()
+	s := storage.NewSFTPStorage(client, root)
+
+	assert.NoError(t, s.Delete(ctx, "dir1/file1.txt"))
+	exists, err := s.Exists(ctx, "dir1/file1.txt")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// deleting a missing object is a no-op
+	assert.NoError(t, s.Delete(ctx, "dir1/file1.txt"))
+
+	assert.NoError(t, s.DeletePrefix(ctx, "dir3"))
+	files, err := s.ListAll(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dir2/file2.txt"}, files)
+}
+
+func TestSFTP_StatAndListAllInfo(t *testing.T) {
+	client := connectSFTP(t)
+	defer client.Close()
+
+	prepareSFTPData(t, client, root)
+
+	ctx := context.Background()
+	s := storage.NewSFTPStorage(client, root)
+
+	info, err := s.Stat(ctx, "dir1/file1.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "dir1/file1.txt", info.Path)
+	assert.Equal(t, int64(4), info.Size)
+
+	infos, err := s.ListAllInfo(ctx, "dir2")
+	assert.NoError(t, err)
+	assert.Len(t, infos, 1)
+
+	_, err = s.Stat(ctx, "dir1/missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestSFTP_PutObject_OverwriteAndSkipTempFiles(t *testing.T) {
+	client := connectSFTP(t)
+	defer client.Close()
+
+	prepareSFTPData(t, client, root)
+
+	ctx := context.Background()
+	s := storage.NewSFTPStorage(client, root)
+
+	assert.NoError(t, s.PutObject(ctx, "dir1/file1.txt", strings.NewReader("replaced")))
+
+	rc, err := s.ReadObject(ctx, "dir1/file1.txt")
+	assert.NoError(t, err)
+	content := readAllAndClose(t, rc)
+	assert.Equal(t, []byte("replaced"), content)
+
+	// leftovers of an interrupted upload are not objects
+	f, err := client.Create(filepath.ToSlash(filepath.Join(root, "dir1", ".xrepo-tmp-file1.txt-dead")))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	files, err := s.ListAll(ctx, "dir1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dir1/file1.txt"}, files)
+}
+
+func TestSFTP_CopyAndRename(t *testing.T) {
+	client := connectSFTP(t)
+	defer client.Close()
+
+	prepareSFTPData(t, client, root)
+
+	ctx := context.Background()
+	s := storage.NewSFTPStorage(client, root)
+
+	assert.NoError(t, s.Rename(ctx, "dir1/file1.txt", "moved/file1.txt"))
+	assert.NoError(t, s.Copy(ctx, "moved/file1.txt", "copied/file1.txt"))
+
+	exists, err := s.Exists(ctx, "dir1/file1.txt")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	rc, err := s.ReadObject(ctx, "copied/file1.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data"), readAllAndClose(t, rc))
+
+	assert.NoError(t, s.DeletePrefix(ctx, "moved"))
+	assert.NoError(t, s.DeletePrefix(ctx, "copied"))
+}
+
+func TestSFTP_PutObjectWithOpts(t *testing.T) {
+	client := connectSFTP(t)
+	defer client.Close()
+
+	prepareSFTPData(t, client, root)
+
+	ctx := context.Background()
+	s := storage.NewSFTPStorage(client, root)
+
+	opts := &storage.PutObjectOpts{
+		Metadata: map[string]string{"source-host": "pg-01"},
+		Tags:     map[string]string{"kind": "wal"},
+	}
+	assert.NoError(t, s.PutObjectWithOpts(ctx, "meta/obj", bytes.NewReader([]byte("A")), opts))
+
+	info, err := s.Stat(ctx, "meta/obj")
+	assert.NoError(t, err)
+	assert.Equal(t, opts.Metadata, info.Metadata)
+	assert.Equal(t, opts.Tags, info.Tags)
+
+	files, err := s.ListAll(ctx, "meta")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"meta/obj"}, files)
+
+	assert.NoError(t, s.DeletePrefix(ctx, "meta"))
+}
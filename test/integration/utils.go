@@ -1,17 +1,24 @@
 package integration
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/hashmap-kz/xrepo/pkg/clients/azblobx"
+	"github.com/hashmap-kz/xrepo/pkg/clients/gcsx"
 	"github.com/hashmap-kz/xrepo/pkg/clients/s3x"
 	"github.com/hashmap-kz/xrepo/pkg/clients/sftpx"
 
 	storage2 "github.com/hashmap-kz/xrepo/pkg/storage"
 
+	gcs "cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/require"
@@ -64,6 +71,61 @@ func createSftpClient(prefix string) (*sftp.Client, storage2.Storage) {
 	return client.SFTPClient(), store
 }
 
+// Azurite well-known development account
+const (
+	azuriteURL         = "http://127.0.0.1:10000/devstoreaccount1"
+	azuriteAccountName = "devstoreaccount1"
+	azuriteAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	azuriteContainer   = "backups"
+)
+
+func createAzureClient(prefix string) (*container.Client, storage2.Storage) {
+	client, err := azblobx.NewAzureBlobClient(&azblobx.AzureBlobConfig{
+		EndpointURL: azuriteURL,
+		AccountName: azuriteAccountName,
+		AccountKey:  azuriteAccountKey,
+		Container:   azuriteContainer,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = client.Client().Create(context.Background(), nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		log.Fatal(err)
+	}
+
+	store := storage2.NewAzureBlobStorage(client.Client(), prefix)
+	return client.Client(), store
+}
+
+const (
+	fakeGCSURL    = "http://localhost:4443/storage/v1/"
+	fakeGCSBucket = "backups"
+)
+
+func createGCSClient(prefix string) (*gcs.Client, storage2.Storage) {
+	ctx := context.Background()
+	client, err := gcsx.NewGCSClient(ctx, &gcsx.GCSConfig{
+		EndpointURL: fakeGCSURL,
+		Bucket:      fakeGCSBucket,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the fake server starts empty
+	bucket := client.Client().Bucket(fakeGCSBucket)
+	if _, err := bucket.Attrs(ctx); errors.Is(err, gcs.ErrBucketNotExist) {
+		if err := bucket.Create(ctx, "", nil); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	store := storage2.NewGCSStorage(client.Client(), fakeGCSBucket, prefix)
+	return client.Client(), store
+}
+
 func readAllAndClose(t *testing.T, r io.ReadCloser) []byte {
 	t.Helper()
 	data, err := io.ReadAll(r)